@@ -6,6 +6,9 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/bpowers/dynamo/dynamo"
@@ -22,12 +25,17 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"text/template"
+	"time"
 )
 
 var (
 	httpListen = flag.String("http", "127.0.0.1:3999", "host:port to listen on")
 	htmlOutput = flag.Bool("html", false, "render program output as HTML")
+	noBuild    = flag.Bool("no-build", false, "only show the generated Go, don't build or run it")
+	timeout    = flag.Duration("timeout", 10*time.Second, "kill simulations running longer than this; 0 for no limit")
+	codegen    = flag.Bool("codegen", false, "run models by building the generated Go, rather than simulating them in the server")
 )
 
 var (
@@ -38,35 +46,91 @@ var (
 func main() {
 	flag.Parse()
 
-	// source of unique numbers
-	go func() {
-		for i := 0; ; i++ {
-			uniq <- i
-		}
-	}()
-
 	http.HandleFunc("/", FrontPage)
 	http.HandleFunc("/compile", Compile)
+	http.HandleFunc("/format", Format)
+	http.HandleFunc("/share", Share)
+	http.HandleFunc("/tokenize", Tokenize)
+	http.HandleFunc("/validate", Validate)
+	http.HandleFunc("/graph", Graph)
+	http.HandleFunc("/model.json", ModelJSON)
+	http.HandleFunc("/export/", Export)
+	http.HandleFunc("/s/", Shared)
+	http.Handle("/static/", http.FileServer(http.FS(content)))
+	go shared.expireLoop()
 	log.Fatal(http.ListenAndServe(*httpListen, nil))
 }
 
 // FrontPage is an HTTP handler that renders the goplay interface.
 // If a filename is supplied in the path component of the URI,
 // its contents will be put in the interface's text area.
-// Otherwise, the default "hello, world" program is displayed.
+// Otherwise, the default "hello, world" program is displayed.  A
+// model in the URL fragment, #m=BASE64, is loaded by the page
+// itself, as browsers don't send the fragment to the server.
 func FrontPage(w http.ResponseWriter, req *http.Request) {
 	data, err := ioutil.ReadFile(req.URL.Path[1:])
 	if err != nil {
 		data = helloWorld
 	}
-	frontPage.Execute(w, data)
+	frontPage.Execute(w, frontPageData{Src: data, NoBuild: *noBuild})
 }
 
-// Compile is an HTTP handler that reads Go source code from the request,
-// runs the program (returning any errors),
-// and sends the program's output as the HTTP response.
+// frontPageData is the data the front page template is rendered
+// with.
+type frontPageData struct {
+	Src     []byte
+	NoBuild bool // if true, the model is only transliterated
+}
+
+// Compile is an HTTP handler that reads a model from the request,
+// simulates it (returning any errors), and sends the simulation's
+// output as the HTTP response.  With -no-build, the generated Go
+// source is sent instead.  With -codegen, the model is run by
+// building and running the generated program; then if the request
+// has a 'stream' parameter and the connection supports it, the
+// output is sent as it is produced rather than once the run has
+// finished.
 func Compile(w http.ResponseWriter, req *http.Request) {
-	out, err := compile(req)
+	if *noBuild {
+		goSrc, err := transliterate("<web>", req.Body)
+		if err != nil {
+			error_(w, nil, err)
+			return
+		}
+		output.Execute(w, goSrc)
+		return
+	}
+
+	if !*codegen {
+		out, err := simulate(req)
+		if err != nil {
+			error_(w, nil, err)
+			return
+		}
+		if *htmlOutput {
+			w.Write(out)
+		} else {
+			output.Execute(w, out)
+		}
+		return
+	}
+
+	bin, out, err := compile(req)
+	if err != nil {
+		error_(w, out, err)
+		return
+	}
+	defer os.Remove(bin)
+
+	if f, ok := w.(http.Flusher); ok && !*htmlOutput && req.FormValue("stream") != "" {
+		stream(w, f, bin)
+		return
+	}
+
+	// run x
+	ctx, cancel := simContext()
+	defer cancel()
+	out, err = run(ctx, "", bin)
 	if err != nil {
 		error_(w, out, err)
 		return
@@ -80,6 +144,216 @@ func Compile(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Format is an HTTP handler that reads a model from the request and
+// sends it back in canonical form, as plain text.
+func Format(w http.ResponseWriter, req *http.Request) {
+	src, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	out, err := dynamo.Format(src)
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(out)
+}
+
+// A jsonToken is a token in the form sent to the browser, with the
+// line and column of its first character.
+type jsonToken struct {
+	Kind string `json:"kind"`
+	Val  string `json:"val"`
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+}
+
+// Tokenize is an HTTP handler that reads a model from the request
+// and sends back its tokens as a JSON array, for syntax highlighting.
+func Tokenize(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	src, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	fset := token.NewFileSet()
+	toks, err := dynamo.Tokenize(string(src), fset)
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	out := make([]jsonToken, 0, len(toks))
+	for _, t := range toks {
+		pos := fset.Position(t.Pos)
+		out = append(out, jsonToken{t.Kind.String(), t.Val, pos.Line, pos.Column})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// A jsonProblem is a problem found by dynamo.Validate in the form
+// sent to the browser.
+type jsonProblem struct {
+	Severity string `json:"severity"`
+	Var      string `json:"var"`
+	Message  string `json:"message"`
+}
+
+// Validate is an HTTP handler that reads a model from the request
+// and sends back the problems dynamo.Validate finds with it as a
+// JSON array.  Models that don't parse get their parse errors, as
+// from Compile.
+func Validate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := dynamo.ParseReader(req.Body, "<web>", token.NewFileSet())
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	out := []jsonProblem{}
+	for _, e := range dynamo.Validate(f) {
+		out = append(out, jsonProblem{e.Severity.String(), e.VarName, e.Msg})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// Graph is an HTTP handler that reads a model from the request and
+// sends back the dependencies between its variables as a Graphviz
+// digraph.
+func Graph(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := dynamo.ParseReader(req.Body, "<web>", token.NewFileSet())
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	var buf bytes.Buffer
+	for _, d := range f.Decls {
+		if m, ok := d.(*dynamo.ModelDecl); ok {
+			if err := dynamo.BuildDepGraph(m).WriteDOT(&buf); err != nil {
+				error_(w, nil, err)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// ModelJSON is an HTTP handler that sends a model as JSON, as
+// written by dynamo.GenJSON.  A GET sends the shared model whose ID
+// is given by the id parameter, or the default model without one; a
+// POST sends the model in the request.
+func ModelJSON(w http.ResponseWriter, req *http.Request) {
+	var src []byte
+	switch req.Method {
+	case "GET":
+		src = helloWorld
+		if id := req.FormValue("id"); id != "" {
+			var ok bool
+			if src, ok = shared.get(id, time.Now()); !ok {
+				http.NotFound(w, req)
+				return
+			}
+		}
+	case "POST":
+		var err error
+		if src, err = ioutil.ReadAll(req.Body); err != nil {
+			error_(w, nil, err)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, err := dynamo.ParseReader(bytes.NewReader(src), "<web>", token.NewFileSet())
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	out, err := dynamo.GenJSON(f)
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// exportTypes maps each format Export converts to, the last element
+// of its path, to the content type it's sent with.
+var exportTypes = map[string]string{
+	"xmile": "application/xml",
+	"csv":   "text/csv; charset=utf-8",
+	"dot":   "text/vnd.graphviz; charset=utf-8",
+}
+
+// Export is an HTTP handler that reads a model from the request and
+// sends it back converted to the format at the end of the path, as
+// a file to download: /export/xmile sends the model as XMILE,
+// /export/csv the results of simulating it as CSV, and /export/dot
+// its dependency graph as a Graphviz digraph.
+func Export(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := strings.TrimPrefix(req.URL.Path, "/export/")
+	contentType, ok := exportTypes[format]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	var out []byte
+	var err error
+	if format == "csv" {
+		out, err = simulate(req)
+	} else {
+		out, err = export(req.Body, format)
+	}
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="model.%s"`, format))
+	w.Write(out)
+}
+
+// export converts the model read from in to XMILE or to the DOT of
+// its dependency graph.
+func export(in io.Reader, format string) ([]byte, error) {
+	f, err := parseModel("<web>", in)
+	if err != nil {
+		return nil, err
+	}
+	if format == "xmile" {
+		return dynamo.GenXMILE(f)
+	}
+	var buf bytes.Buffer
+	for _, d := range f.Decls {
+		if m, ok := d.(*dynamo.ModelDecl); ok {
+			if err := dynamo.BuildDepGraph(m).WriteDOT(&buf); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
 var (
 	commentRe = regexp.MustCompile(`(?m)^#.*\n`)
 	tmpdir    string
@@ -92,12 +366,19 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// source of unique numbers
+	go func() {
+		for i := 0; ; i++ {
+			uniq <- i
+		}
+	}()
 }
 
-// gofmt takes the given, valid, Go AST and returns a
-// canonically-formatted go program in a byte-array, or an error.
-func gofmt(f *ast.File) ([]byte, error) {
-	fset := token.NewFileSet()
+// gofmt takes the given, valid, Go AST, positioned in fset, and
+// returns a canonically-formatted go program in a byte-array, or an
+// error.
+func gofmt(fset *token.FileSet, f *ast.File) ([]byte, error) {
 	var buf bytes.Buffer
 	if err := format.Node(&buf, fset, f); err != nil {
 		return nil, err
@@ -105,46 +386,62 @@ func gofmt(f *ast.File) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// transliterate takes an input stream and a name and returns a byte
-// buffer containing valid & gofmt'ed source code, or an error.  The
-// name is used purely for diagnostic purposes
-func transliterate(name string, in io.Reader) ([]byte, error) {
+// parseModel parses the model read from in, returning an error if it
+// doesn't parse or its auxiliaries form a cycle.  The name is used
+// purely for diagnostic purposes.
+func parseModel(name string, in io.Reader) (*dynamo.File, error) {
 	fset := token.NewFileSet()
-
-	// dump in the file
-	mdlSrc, err := ioutil.ReadAll(in)
+	pkg, err := dynamo.ParseReader(in, name, fset)
 	if err != nil {
-		return nil, fmt.Errorf("ReadAll(%v): %s", in, err)
-	}
-
-	fsetFile := fset.AddFile(name, fset.Base(), len(mdlSrc))
-
-	// and parse
-	pkg, err := dynamo.Parse(fsetFile, fset, string(mdlSrc))
-	if err != nil {
-		return nil, fmt.Errorf("Parse(%v): %s", name, err)
+		// returned as is, so error_ can send the list to
+		// the browser
+		return nil, err
 	}
 	if pkg.NErrors > 0 {
 		return nil, fmt.Errorf("There were errors parsing the file")
 	}
+	if cycles := dynamo.CheckCycles(pkg); len(cycles) > 0 {
+		var errs dynamo.ErrorVector
+		for _, c := range cycles {
+			errs.Error(fset.Position(c.Pos), c.Error())
+		}
+		return nil, errs.GetError(dynamo.Sorted)
+	}
+	return pkg, nil
+}
+
+// transliterate takes an input stream and a name and returns a byte
+// buffer containing valid & gofmt'ed source code, or an error.  The
+// name is used purely for diagnostic purposes
+func transliterate(name string, in io.Reader) ([]byte, error) {
+	pkg, err := parseModel(name, in)
+	if err != nil {
+		// returned as is, so error_ can send the list to
+		// the browser
+		return nil, err
+	}
 
-	goSource, err := dynamo.GenGo(pkg)
+	goFset := token.NewFileSet()
+	goSource, err := dynamo.GenGo(goFset, pkg)
 	if err != nil {
-		log.Fatalf("GenGo(%v): %s", pkg, err)
+		return nil, fmt.Errorf("GenGo: %s", err)
 	}
 
-	src, err := gofmt(goSource)
+	src, err := gofmt(goFset, goSource)
 	if err != nil {
-		log.Fatalf("gofmtFile(%v): %s", goSource, err)
+		return nil, fmt.Errorf("gofmt: %s", err)
 	}
 	return src, nil
 }
 
-func compile(req *http.Request) (out []byte, err error) {
+// compile transliterates the model in the request body to Go and
+// builds it, returning the path to the resulting binary.  On error,
+// out holds the output of the go tool.
+func compile(req *http.Request) (bin string, out []byte, err error) {
 	// x is the base name for .go, .6, executable files
 	x := filepath.Join(tmpdir, "compile"+strconv.Itoa(<-uniq))
 	src := x + ".go"
-	bin := x
+	bin = x
 	if runtime.GOOS == "windows" {
 		bin += ".exe"
 	}
@@ -167,7 +464,7 @@ func compile(req *http.Request) (out []byte, err error) {
 
 	goBody, err := transliterate("<web>", body)
 	if err != nil {
-		return nil, err
+		return
 	}
 
 	if err = ioutil.WriteFile(src, goBody, 0666); err != nil {
@@ -176,173 +473,138 @@ func compile(req *http.Request) (out []byte, err error) {
 
 	// build x.go, creating x
 	dir, file := filepath.Split(src)
-	out, err = run(dir, "go", "build", "-o", bin, file)
-	defer os.Remove(bin)
+	out, err = run(context.Background(), dir, "go", "build", "-o", bin, file)
 	if err != nil {
-		return
+		os.Remove(bin)
 	}
-
-	// run x
-	return run("", bin)
+	return
 }
 
-// error writes compile, link, or runtime errors to the HTTP connection.
-// The JavaScript interface uses the 404 status code to identify the error.
-func error_(w http.ResponseWriter, out []byte, err error) {
-	w.WriteHeader(404)
-	if out != nil {
-		output.Execute(w, out)
-	} else {
-		output.Execute(w, err.Error())
+// simulate runs the model in the request body with dynamo.Simulate,
+// returning its output as CSV.
+func simulate(req *http.Request) ([]byte, error) {
+	f, err := parseModel("<web>", req.Body)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := simContext()
+	defer cancel()
+	ts, err := dynamo.Simulate(f, dynamo.SimulateOptions{TimeoutCtx: ctx})
+	if err != nil {
+		return nil, timedOut(ctx, err)
 	}
-}
-
-// run executes the specified command and returns its output and an error.
-func run(dir string, args ...string) ([]byte, error) {
 	var buf bytes.Buffer
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Dir = dir
-	cmd.Stdout = &buf
-	cmd.Stderr = cmd.Stdout
-	err := cmd.Run()
-	return buf.Bytes(), err
+	if err := ts.WriteCSV(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-var frontPage = template.Must(template.New("frontPage").Parse(frontPageText)) // HTML template
-var output = template.Must(template.New("output").Parse(outputText))          // HTML template
-
-var outputText = `<pre>{{printf "%s" . |html}}</pre>`
-
-var frontPageText = `<!doctype html>
-<html>
-<head>
-<style>
-pre, textarea {
-	font-family: Monaco, 'Courier New', 'DejaVu Sans Mono', 'Bitstream Vera Sans Mono', monospace;
-	font-size: 100%;
-}
-.hints {
-	font-size: 0.8em;
-	text-align: right;
+// flushWriter HTML-escapes everything written to it and immediately
+// flushes it to the client.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
 }
-#edit, #output, #errors { width: 100%; text-align: left; }
-#edit { height: 500px; }
-#output { color: #00c; }
-#errors { color: #c00; }
-</style>
-<script>
-
-function insertTabs(n) {
-	// find the selection start and end
-	var cont  = document.getElementById("edit");
-	var start = cont.selectionStart;
-	var end   = cont.selectionEnd;
-	// split the textarea content into two, and insert n tabs
-	var v = cont.value;
-	var u = v.substr(0, start);
-	for (var i=0; i<n; i++) {
-		u += "\t";
-	}
-	u += v.substr(end);
-	// set revised content
-	cont.value = u;
-	// reset caret position after inserted tabs
-	cont.selectionStart = start+n;
-	cont.selectionEnd = start+n;
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	template.HTMLEscape(fw.w, p)
+	fw.f.Flush()
+	return len(p), nil
 }
 
-function autoindent(el) {
-	var curpos = el.selectionStart;
-	var tabs = 0;
-	while (curpos > 0) {
-		curpos--;
-		if (el.value[curpos] == "\t") {
-			tabs++;
-		} else if (tabs > 0 || el.value[curpos] == "\n") {
-			break;
-		}
+// stream runs bin, sending its output to the client as it is
+// produced.  As the response has already started by the time the
+// program can fail, errors are appended to the output rather than
+// reported with a 404.
+func stream(w http.ResponseWriter, f http.Flusher, bin string) {
+	io.WriteString(w, "<pre>")
+	fw := flushWriter{w, f}
+	ctx, cancel := simContext()
+	defer cancel()
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Stdout = fw
+	cmd.Stderr = fw
+	if err := timedOut(ctx, cmd.Run()); err != nil {
+		fmt.Fprintf(fw, "\n%s\n", err)
 	}
-	setTimeout(function() {
-		insertTabs(tabs);
-	}, 1);
+	io.WriteString(w, "</pre>")
 }
 
-function preventDefault(e) {
-	if (e.preventDefault) {
-		e.preventDefault();
-	} else {
-		e.cancelBubble = true;
-	}
+// A diagnostic is a parse error in the form sent to the browser,
+// which uses its position to point at the offending line.
+type diagnostic struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
 }
 
-function keyHandler(event) {
-	var e = window.event || event;
-	if (e.keyCode == 9) { // tab
-		insertTabs(1);
-		preventDefault(e);
-		return false;
-	}
-	if (e.keyCode == 13) { // enter
-		if (e.shiftKey) { // +shift
-			compile(e.target);
-			preventDefault(e);
-			return false;
-		} else {
-			autoindent(e.target);
+// error writes compile, link, or runtime errors to the HTTP connection.
+// The JavaScript interface uses the 404 status code to identify the error.
+// Errors parsing the model are sent as a JSON array of diagnostics.
+func error_(w http.ResponseWriter, out []byte, err error) {
+	if list, ok := err.(dynamo.ErrorList); ok {
+		diags := make([]diagnostic, 0, len(list))
+		for _, e := range list {
+			diags = append(diags, diagnostic{e.Pos.Line, e.Pos.Column, e.Msg})
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(404)
+		json.NewEncoder(w).Encode(diags)
+		return
+	}
+	w.WriteHeader(404)
+	if out != nil {
+		output.Execute(w, out)
+	} else {
+		output.Execute(w, err.Error())
 	}
-	return true;
 }
 
-var xmlreq;
-
-function autocompile() {
-	if(!document.getElementById("autocompile").checked) {
-		return;
+// simContext returns the context a simulation runs in, which is done
+// once it has run for longer than -timeout.
+func simContext() (context.Context, context.CancelFunc) {
+	if *timeout <= 0 {
+		return context.WithCancel(context.Background())
 	}
-	compile();
+	return context.WithTimeout(context.Background(), *timeout)
 }
 
-function compile() {
-	var prog = document.getElementById("edit").value;
-	var req = new XMLHttpRequest();
-	xmlreq = req;
-	req.onreadystatechange = compileUpdate;
-	req.open("POST", "/compile", true);
-	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
-	req.send(prog);	
+// timedOut returns a clearer error than err, the result of running a
+// command in ctx, if the command was killed for running too long.
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("simulation timed out after %s", *timeout)
+	}
+	return err
 }
 
-function compileUpdate() {
-	var req = xmlreq;
-	if(!req || req.readyState != 4) {
-		return;
-	}
-	if(req.status == 200) {
-		document.getElementById("output").innerHTML = req.responseText;
-		document.getElementById("errors").innerHTML = "";
-	} else {
-		document.getElementById("errors").innerHTML = req.responseText;
-		document.getElementById("output").innerHTML = "";
+// run executes the specified command and returns its output and an
+// error.  The command is killed if ctx is done before it exits, and
+// the error is added to the end of its output, which error_ shows
+// in place of the error.
+func run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var buf bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = &buf
+	cmd.Stderr = cmd.Stdout
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		err = timedOut(ctx, err)
+		fmt.Fprintf(&buf, "\n%s\n", err)
 	}
+	return buf.Bytes(), err
 }
-</script>
-</head>
-<body>
-<table width="100%"><tr><td width="60%" valign="top">
-<textarea autofocus="true" id="edit" spellcheck="false" onkeydown="keyHandler(event);" onkeyup="autocompile();">{{printf "%s" . |html}}</textarea>
-<div class="hints">
-(Shift-Enter to compile and run.)&nbsp;&nbsp;&nbsp;&nbsp;
-<input type="checkbox" id="autocompile" value="checked" /> Compile and run after each keystroke
-</div>
-<td width="3%">
-<td width="27%" align="right" valign="top">
-<div id="output"></div>
-</table>
-<div id="errors"></div>
-</body>
-</html>
-`
+
+// content holds the playground's templates and the static files
+// served under /static/.
+//
+//go:embed templates static
+var content embed.FS
+
+var frontPage = template.Must(template.ParseFS(content, "templates/frontpage.html")) // HTML template
+var output = template.Must(template.ParseFS(content, "templates/output.html"))       // HTML template
 
 var helloWorld = []byte(`*
 NOTE	House5 -- Three sector urban model with housing filter down
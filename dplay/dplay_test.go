@@ -0,0 +1,327 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// popModel is a model with a level, to run through the handlers.
+const popModel = `*
+NOTE	population
+L	POP.K=POP.J+(DT)(B.JK-D.JK)
+N	POP=100
+R	B.KL=(NB)(POP.K)
+C	NB=.04
+R	D.KL=(ND)(POP.K)
+C	ND=.01
+C	LENGTH=10
+C	DT=1
+C	SAVPER=1
+`
+
+// post sends src to handler in a POST to path, returning the
+// recorded response.
+func post(handler http.HandlerFunc, path, src string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(src))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// A flushRecorder is a ResponseRecorder that notes what had been
+// written, and when, each time it was flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []string
+	times   []time.Time
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes = append(r.flushes, r.Body.String())
+	r.times = append(r.times, time.Now())
+}
+
+// slowModel takes long enough to run, twenty million steps between
+// its three save steps, that output sent only once it ends can be
+// told from output sent as it is produced.
+const slowModel = `*
+NOTE	slow filling
+L	S.K=S.J+(DT)(IN.JK)
+N	S=0
+R	IN.KL=1
+C	LENGTH=4000
+C	DT=.0001
+C	SAVPER=2000
+`
+
+// TestStream builds the program generated for slowModel and checks
+// that stream sends each row it writes on as it's written, rather
+// than all at once when the program exits.
+func TestStream(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command to build the program")
+	}
+	bin, out, err := compile(httptest.NewRequest("POST", "/compile", strings.NewReader(slowModel)))
+	if err != nil {
+		t.Fatalf("compile: %s\n%s", err, out)
+	}
+	defer os.Remove(bin)
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	stream(w, w, bin)
+	end := time.Now()
+
+	// arrived returns how far into the run the header and the
+	// first n rows had all been sent
+	arrived := func(n int) time.Duration {
+		for i, f := range w.flushes {
+			if strings.Count(f, "\n") > n {
+				return w.times[i].Sub(start)
+			}
+		}
+		t.Fatalf("%d rows never arrived: %q", n, w.Body)
+		return 0
+	}
+	// the first row is written before the first step, and the
+	// second halfway through the run
+	run := end.Sub(start)
+	if d := arrived(1); d > run/4 {
+		t.Errorf("first row arrived after %s of a %s run", d, run)
+	}
+	if d := arrived(2); d > run*3/4 {
+		t.Errorf("second row arrived after %s of a %s run", d, run)
+	}
+	body := w.Body.String()
+	if !strings.HasPrefix(body, "<pre>TIME,IN,S\n0,1,0\n") || strings.Count(body, "\n") != 4 || !strings.HasSuffix(body, "</pre>") {
+		t.Errorf("got body %q, want the header and three rows in <pre>", body)
+	}
+}
+
+func TestCompileNoBuild(t *testing.T) {
+	defer func(old bool) { *noBuild = old }(*noBuild)
+	*noBuild = true
+
+	w := post(Compile, "/compile", popModel)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{"<pre>", "package main", "func main()"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body doesn't contain %q:\n%s", want, body)
+		}
+	}
+
+	w = post(Compile, "/compile", "* bad\nA X.K=\n")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("bad model: got status %d, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	FrontPage(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "Building is disabled") {
+		t.Errorf("front page doesn't say building is disabled")
+	}
+}
+
+func TestExport(t *testing.T) {
+	tests := []struct {
+		format, contentType, want string
+	}{
+		{"xmile", "application/xml", "<xmile"},
+		{"csv", "text/csv; charset=utf-8", "time,B,D,POP\n0,4,1,100\n"},
+		{"dot", "text/vnd.graphviz; charset=utf-8", "digraph"},
+	}
+	for _, test := range tests {
+		w := post(Export, "/export/"+test.format, popModel)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d, want 200: %s", test.format, w.Code, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s: got Content-Type %s, want %s", test.format, ct, test.contentType)
+		}
+		want := `attachment; filename="model.` + test.format + `"`
+		if cd := w.Header().Get("Content-Disposition"); cd != want {
+			t.Errorf("%s: got Content-Disposition %s, want %s", test.format, cd, want)
+		}
+		if !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s: body doesn't contain %q:\n%s", test.format, test.want, w.Body)
+		}
+
+		w = post(Export, "/export/"+test.format, "* bad\nA X.K=\n")
+		if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: bad model: got status %d, want 404 with diagnostics", test.format, w.Code)
+		}
+	}
+
+	if w := post(Export, "/export/pdf", popModel); w.Code != http.StatusNotFound {
+		t.Errorf("pdf: got status %d, want 404", w.Code)
+	}
+}
+
+func TestCompileGenGoError(t *testing.T) {
+	defer func(old bool) { *noBuild = old }(*noBuild)
+	*noBuild = true
+
+	// parses, but TABHL's upper bound must be constant to generate
+	const src = `* bad
+A	Y.K=TABHL(YT,TIME.K,0,H.K,1)
+T	YT=1/2
+A	H.K=TIME.K
+C	LENGTH=1
+C	DT=1
+C	SAVPER=1
+`
+	w := post(Compile, "/compile", src)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got status %d, want 404", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "GenGo") || !strings.Contains(body, "non-constant") {
+		t.Errorf("body doesn't give the GenGo error:\n%s", body)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	defer func(old time.Duration) { *timeout = old }(*timeout)
+	*timeout = 200 * time.Millisecond
+
+	// a simulation that would run for days
+	const src = `* forever
+L	X.K=X.J+(DT)(R.JK)
+N	X=0
+R	R.KL=1
+C	LENGTH=1e12
+C	DT=1
+C	SAVPER=1e12
+`
+	start := time.Now()
+	w := post(Compile, "/compile", src)
+	if d := time.Since(start); d > 2**timeout {
+		t.Errorf("simulation stopped after %s, want at most %s", d, 2**timeout)
+	}
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "simulation timed out after 200ms") {
+		t.Errorf("got status %d and body %q, want 404 and a timeout", w.Code, w.Body)
+	}
+
+	// and a program that would, as with -codegen
+	start = time.Now()
+	ctx, cancel := simContext()
+	defer cancel()
+	out, err := run(ctx, "", "sleep", "10")
+	if d := time.Since(start); d > 2**timeout {
+		t.Errorf("program killed after %s, want at most %s", d, 2**timeout)
+	}
+	if err == nil || !strings.Contains(string(out), "simulation timed out after 200ms") {
+		t.Errorf("got error %v and output %q, want a timeout", err, out)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	w := post(Tokenize, "/tokenize", string(helloWorld))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d, want 200 with JSON: %s", w.Code, w.Body)
+	}
+	var toks []jsonToken
+	if err := json.NewDecoder(w.Body).Decode(&toks); err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+	// five NOTE cards, three cards of four tokens after them,
+	// and a semicolon ending each line with tokens
+	if len(toks) != 30 {
+		t.Errorf("got %d tokens, want 30: %+v", len(toks), toks)
+	}
+	want := map[int]jsonToken{
+		0:  {"comment", "*", 1, 1},
+		7:  {"ident", "POPN", 6, 3},
+		8:  {"op", "=", 6, 7},
+		9:  {"num", "133000", 6, 8},
+		10: {"semi", "\n", 6, 14},
+		20: {"ident", "C", 11, 1},
+	}
+	for i, tok := range want {
+		if i < len(toks) && toks[i] != tok {
+			t.Errorf("token %d: got %+v, want %+v", i, toks[i], tok)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	Tokenize(w, httptest.NewRequest("GET", "/tokenize", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want 405", w.Code)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	// the templates are parsed from content when the package is
+	// initialized; each must also render.
+	for _, name := range []string{"templates/frontpage.html", "templates/output.html"} {
+		if _, err := template.ParseFS(content, name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := frontPage.Execute(&buf, frontPageData{Src: helloWorld}); err != nil {
+		t.Errorf("front page: %s", err)
+	}
+	if !strings.Contains(buf.String(), "/static/play.js") || !strings.Contains(buf.String(), "POPN=133000") {
+		t.Errorf("front page lacks the script or the model:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := output.Execute(&buf, "time,POP\n"); err != nil {
+		t.Errorf("output: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	http.FileServer(http.FS(content)).ServeHTTP(w, httptest.NewRequest("GET", "/static/play.js", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "function") {
+		t.Errorf("/static/play.js: got status %d, want 200 and the script", w.Code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	w := post(Validate, "/validate", "* unused\nT UNUSED=1/2\nC LENGTH=1\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var problems []jsonProblem
+	if err := json.NewDecoder(w.Body).Decode(&problems); err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+	want := jsonProblem{"warning", "UNUSED", "table UNUSED is never looked up with TABHL"}
+	if len(problems) != 1 || problems[0] != want {
+		t.Errorf("got problems %+v, want %+v", problems, want)
+	}
+
+	if w := post(Validate, "/validate", popModel); w.Body.String() != "[]\n" {
+		t.Errorf("popModel: got %q, want no problems", w.Body)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	w := post(Graph, "/graph", popModel)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/vnd.graphviz; charset=utf-8" {
+		t.Fatalf("got status %d, want 200 with a graph: %s", w.Code, w.Body)
+	}
+	for _, want := range []string{"digraph", `"POP" [color=blue];`, `"B" -> "POP";`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("body doesn't contain %s:\n%s", want, w.Body)
+		}
+	}
+	if w := post(Graph, "/graph", "* bad\nA X.K=\n"); w.Code != http.StatusNotFound {
+		t.Errorf("bad model: got status %d, want 404", w.Code)
+	}
+}
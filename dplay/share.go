@@ -0,0 +1,153 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	shareTTL       = 24 * time.Hour // how long a shared model is kept
+	shareMaxLen    = 1 << 16        // the largest model that can be shared
+	shareMaxModels = 1024           // the most models kept at once
+	shareIDLen     = 8
+
+	// 32 letters and digits, leaving out the easily confused
+	// l, o, 0 and 1, so that a random byte masked to 5 bits
+	// picks one without bias
+	shareIDChars = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+// sharedModel is a model stored by Share.
+type sharedModel struct {
+	src     []byte
+	created time.Time
+}
+
+// shareStore holds shared models in memory, by ID, until they
+// expire.
+type shareStore struct {
+	sync.Mutex
+	models map[string]sharedModel
+}
+
+var shared = &shareStore{models: map[string]sharedModel{}}
+
+// newShareID returns a random ID for a shared model.
+func newShareID() (string, error) {
+	b := make([]byte, shareIDLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = shareIDChars[b[i]&31]
+	}
+	return string(b), nil
+}
+
+// put stores src, created at now, and returns its ID.  Once
+// shareMaxModels are stored, no more can be until some expire.
+func (s *shareStore) put(src []byte, now time.Time) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.models) >= shareMaxModels {
+		s.removeExpired(now)
+		if len(s.models) >= shareMaxModels {
+			return "", fmt.Errorf("too many shared models; try again later")
+		}
+	}
+	for {
+		id, err := newShareID()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := s.models[id]; !ok {
+			s.models[id] = sharedModel{src, now}
+			return id, nil
+		}
+	}
+}
+
+// get returns the model stored under id, if it hasn't expired by
+// now.  A model can expire before expireLoop gets to removing it.
+func (s *shareStore) get(id string, now time.Time) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.models[id]
+	if !ok || now.Sub(m.created) > shareTTL {
+		return nil, false
+	}
+	return m.src, true
+}
+
+// expire removes the models stored more than shareTTL before now.
+func (s *shareStore) expire(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.removeExpired(now)
+}
+
+// removeExpired is expire for a caller holding s's lock.
+func (s *shareStore) removeExpired(now time.Time) {
+	for id, m := range s.models {
+		if now.Sub(m.created) > shareTTL {
+			delete(s.models, id)
+		}
+	}
+}
+
+// expireLoop removes expired models every hour, forever.
+func (s *shareStore) expireLoop() {
+	for now := range time.Tick(time.Hour) {
+		s.expire(now)
+	}
+}
+
+// Share is an HTTP handler that stores the model POSTed to it and
+// replies with the JSON object {"id": ID}.  The model can then be
+// loaded from /s/ID for shareTTL.
+func Share(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	src, err := ioutil.ReadAll(io.LimitReader(req.Body, shareMaxLen+1))
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	if len(src) > shareMaxLen {
+		error_(w, nil, fmt.Errorf("models larger than %d bytes can't be shared", shareMaxLen))
+		return
+	}
+	id, err := shared.put(src, time.Now())
+	if err != nil {
+		error_(w, nil, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ID string `json:"id"`
+	}{id})
+}
+
+// Shared is an HTTP handler that renders the playground with the
+// model stored under the ID in the path, /s/ID.
+func Shared(w http.ResponseWriter, req *http.Request) {
+	src, ok := shared.get(strings.TrimPrefix(req.URL.Path, "/s/"), time.Now())
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	frontPage.Execute(w, frontPageData{Src: src, NoBuild: *noBuild})
+}
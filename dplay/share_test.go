@@ -0,0 +1,88 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareStore(t *testing.T) {
+	s := &shareStore{models: map[string]sharedModel{}}
+	now := time.Now()
+	id, err := s.put([]byte(popModel), now)
+	if err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if len(id) != shareIDLen || strings.Trim(id, shareIDChars) != "" {
+		t.Errorf("got ID %q, want %d of %s", id, shareIDLen, shareIDChars)
+	}
+	if src, ok := s.get(id, now.Add(shareTTL)); !ok || string(src) != popModel {
+		t.Errorf("get at the TTL: got %q, %t, want the model", src, ok)
+	}
+
+	// an expired model is gone, even before expire removes it
+	later := now.Add(shareTTL + time.Second)
+	if _, ok := s.get(id, later); ok {
+		t.Errorf("get after the TTL: got the model")
+	}
+	s.expire(now.Add(shareTTL))
+	if len(s.models) != 1 {
+		t.Errorf("expire at the TTL: got %d models, want 1", len(s.models))
+	}
+	s.expire(later)
+	if len(s.models) != 0 {
+		t.Errorf("expire after the TTL: got %d models, want 0", len(s.models))
+	}
+
+	// once full, models can only be stored as others expire
+	for i := 0; i < shareMaxModels; i++ {
+		if _, err := s.put([]byte(popModel), now); err != nil {
+			t.Fatalf("put %d: %s", i, err)
+		}
+	}
+	if _, err := s.put([]byte(popModel), now); err == nil {
+		t.Errorf("put into a full store: expected an error")
+	}
+	if _, err := s.put([]byte(popModel), later); err != nil {
+		t.Errorf("put into a full store of expired models: %s", err)
+	}
+	if len(s.models) != 1 {
+		t.Errorf("got %d models, want only the last", len(s.models))
+	}
+}
+
+func TestShare(t *testing.T) {
+	w := post(Share, "/share", popModel)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding %q: %s", w.Body, err)
+	}
+
+	w = httptest.NewRecorder()
+	Shared(w, httptest.NewRequest("GET", "/s/"+resp.ID, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "POP.K=POP.J+(DT)(B.JK-D.JK)") {
+		t.Errorf("GET /s/%s: got status %d, want 200 and the model:\n%s", resp.ID, w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	Shared(w, httptest.NewRequest("GET", "/s/nosuchid", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown ID: got status %d, want 404", w.Code)
+	}
+
+	if w := post(Share, "/share", strings.Repeat("*", shareMaxLen+1)); w.Code != http.StatusNotFound {
+		t.Errorf("huge model: got status %d, want 404", w.Code)
+	}
+}
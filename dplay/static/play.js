@@ -0,0 +1,236 @@
+function insertTabs(n) {
+	// find the selection start and end
+	var cont  = document.getElementById("edit");
+	var start = cont.selectionStart;
+	var end   = cont.selectionEnd;
+	// split the textarea content into two, and insert n tabs
+	var v = cont.value;
+	var u = v.substr(0, start);
+	for (var i=0; i<n; i++) {
+		u += "\t";
+	}
+	u += v.substr(end);
+	// set revised content
+	cont.value = u;
+	// reset caret position after inserted tabs
+	cont.selectionStart = start+n;
+	cont.selectionEnd = start+n;
+}
+
+function autoindent(el) {
+	var curpos = el.selectionStart;
+	var tabs = 0;
+	while (curpos > 0) {
+		curpos--;
+		if (el.value[curpos] == "\t") {
+			tabs++;
+		} else if (tabs > 0 || el.value[curpos] == "\n") {
+			break;
+		}
+	}
+	setTimeout(function() {
+		insertTabs(tabs);
+	}, 1);
+}
+
+function preventDefault(e) {
+	if (e.preventDefault) {
+		e.preventDefault();
+	} else {
+		e.cancelBubble = true;
+	}
+}
+
+function keyHandler(event) {
+	var e = window.event || event;
+	if (e.keyCode == 9) { // tab
+		insertTabs(1);
+		preventDefault(e);
+		return false;
+	}
+	if (e.keyCode == 13) { // enter
+		if (e.shiftKey) { // +shift
+			compile(e.target);
+			preventDefault(e);
+			return false;
+		} else {
+			autoindent(e.target);
+		}
+	}
+	return true;
+}
+
+var xmlreq;
+
+function autocompile() {
+	if(!document.getElementById("autocompile").checked) {
+		return;
+	}
+	compile();
+}
+
+function compile() {
+	var prog = document.getElementById("edit").value;
+	var req = new XMLHttpRequest();
+	xmlreq = req;
+	req.onreadystatechange = compileUpdate;
+	req.open("POST", "/compile?stream=1", true);
+	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
+	req.send(prog);	
+	validate(prog);
+}
+
+// validate asks the server to check prog, listing the problems it
+// finds under the errors.
+function validate(prog) {
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if(req.readyState != 4) {
+			return;
+		}
+		var warnings = document.getElementById("warnings");
+		warnings.innerHTML = "";
+		if(req.status != 200) {
+			// parse errors are shown by compile
+			return;
+		}
+		var problems = JSON.parse(req.responseText);
+		for (var i = 0; i < problems.length; i++) {
+			var p = problems[i];
+			var div = document.createElement("div");
+			div.className = "diagnostic " + p.severity;
+			div.appendChild(document.createTextNode(
+				p.severity + ": " + p["var"] + ": " + p.message));
+			warnings.appendChild(div);
+		}
+	};
+	req.open("POST", "/validate", true);
+	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
+	req.send(prog);
+}
+
+function format() {
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if(req.readyState != 4) {
+			return;
+		}
+		if(req.status == 200) {
+			document.getElementById("edit").value = req.responseText;
+			document.getElementById("errors").innerHTML = "";
+			saveHash();
+		} else if(/json/.test(req.getResponseHeader("Content-Type"))) {
+			showDiagnostics(JSON.parse(req.responseText));
+		} else {
+			document.getElementById("errors").innerHTML = req.responseText;
+		}
+	};
+	req.open("POST", "/format", true);
+	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
+	req.send(document.getElementById("edit").value);
+}
+
+function compileUpdate() {
+	var req = xmlreq;
+	if(!req || req.readyState < 3) {
+		return;
+	}
+	if(req.readyState == 3) {
+		// partial output from a streaming run
+		if(req.status == 200) {
+			document.getElementById("output").innerHTML = req.responseText;
+		}
+		return;
+	}
+	if(req.status == 200) {
+		document.getElementById("output").innerHTML = req.responseText;
+		document.getElementById("errors").innerHTML = "";
+	} else if(/json/.test(req.getResponseHeader("Content-Type"))) {
+		showDiagnostics(JSON.parse(req.responseText));
+		document.getElementById("output").innerHTML = "";
+	} else {
+		document.getElementById("errors").innerHTML = req.responseText;
+		document.getElementById("output").innerHTML = "";
+	}
+}
+
+// showDiagnostics lists the parse errors in diags.  Clicking one
+// selects the line it is on in the editor.
+function showDiagnostics(diags) {
+	var errors = document.getElementById("errors");
+	errors.innerHTML = "";
+	for (var i = 0; i < diags.length; i++) {
+		var d = diags[i];
+		var div = document.createElement("div");
+		div.className = "diagnostic";
+		div.appendChild(document.createTextNode(
+			"line " + d.line + ":" + d.column + ": " + d.message));
+		div.onclick = selectLine.bind(null, d.line);
+		errors.appendChild(div);
+	}
+}
+
+// encodeModel and decodeModel convert between a model and the
+// base64 of its UTF-8 encoding, for the URL fragment.
+function encodeModel(src) {
+	return btoa(unescape(encodeURIComponent(src)));
+}
+
+function decodeModel(s) {
+	return decodeURIComponent(escape(atob(s)));
+}
+
+// saveHash keeps the model in the URL fragment, so that reloading
+// the page or copying its URL keeps it.
+function saveHash() {
+	var hash = "#m=" + encodeModel(document.getElementById("edit").value);
+	if (history.replaceState) {
+		history.replaceState(null, "", hash);
+	} else {
+		location.hash = hash;
+	}
+}
+
+function loadHash() {
+	var m = /^#m=(.*)$/.exec(location.hash);
+	if (!m) {
+		return;
+	}
+	try {
+		document.getElementById("edit").value = decodeModel(m[1]);
+	} catch (e) {
+		// a mangled fragment leaves the model the server sent
+	}
+}
+
+function share() {
+	var req = new XMLHttpRequest();
+	req.onreadystatechange = function() {
+		if(req.readyState != 4) {
+			return;
+		}
+		if(req.status == 200) {
+			var url = location.protocol + "//" + location.host + "/s/" + JSON.parse(req.responseText).id;
+			var link = document.getElementById("sharelink");
+			link.href = url;
+			link.innerHTML = "";
+			link.appendChild(document.createTextNode(url));
+		} else {
+			document.getElementById("errors").innerHTML = req.responseText;
+		}
+	};
+	req.open("POST", "/share", true);
+	req.setRequestHeader("Content-Type", "text/plain; charset=utf-8");
+	req.send(document.getElementById("edit").value);
+}
+
+function selectLine(line) {
+	var edit = document.getElementById("edit");
+	var lines = edit.value.split("\n");
+	var start = 0;
+	for (var i = 0; i < line-1 && i < lines.length; i++) {
+		start += lines[i].length + 1;
+	}
+	edit.focus();
+	edit.setSelectionRange(start, start + (lines[line-1] || "").length);
+}
@@ -0,0 +1,310 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+)
+
+// An applier holds the functions Apply calls on each node.
+type applier struct {
+	pre, post func(Node) Node
+}
+
+// Apply traverses an AST in depth-first order, replacing nodes as it
+// goes, and returns the replacement for node.  For each node n, it
+// calls pre(n), then replaces each child of the node pre returned by
+// the result of applying to that child, and finally calls post on
+// the node with its new children.  pre and post return the node to
+// use in n's place, which may be n itself; either may be nil, which
+// leaves nodes as they are.  If pre returns nil, n's children aren't
+// visited and n is removed: dropped from a list, or leaving an
+// optional field empty.
+//
+// Apply changes the nodes it visits in place; Clone a File first to
+// keep the original.  A replacement must be usable where the node it
+// replaces was, like an *Ident for a VarDecl's Name, or Apply
+// panics.
+func Apply(node Node, pre, post func(Node) Node) Node {
+	a := &applier{pre, post}
+	return a.apply(node)
+}
+
+func (a *applier) expr(e Expr) Expr {
+	if e == nil {
+		return nil
+	}
+	if r := a.apply(e); r != nil {
+		return r.(Expr)
+	}
+	return nil
+}
+
+func (a *applier) exprList(list []Expr) []Expr {
+	out := list[:0]
+	for _, x := range list {
+		if r := a.expr(x); r != nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (a *applier) ident(id *Ident) *Ident {
+	if id == nil {
+		return nil
+	}
+	if r := a.apply(id); r != nil {
+		return r.(*Ident)
+	}
+	return nil
+}
+
+func (a *applier) identList(list []*Ident) []*Ident {
+	out := list[:0]
+	for _, x := range list {
+		if r := a.ident(x); r != nil {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (a *applier) basicLit(lit *BasicLit) *BasicLit {
+	if lit == nil {
+		return nil
+	}
+	if r := a.apply(lit); r != nil {
+		return r.(*BasicLit)
+	}
+	return nil
+}
+
+func (a *applier) fieldList(l *FieldList) *FieldList {
+	if l == nil {
+		return nil
+	}
+	if r := a.apply(l); r != nil {
+		return r.(*FieldList)
+	}
+	return nil
+}
+
+func (a *applier) varDecl(d *VarDecl) *VarDecl {
+	if d == nil {
+		return nil
+	}
+	if r := a.apply(d); r != nil {
+		return r.(*VarDecl)
+	}
+	return nil
+}
+
+func (a *applier) block(b *BlockStmt) *BlockStmt {
+	if b == nil {
+		return nil
+	}
+	if r := a.apply(b); r != nil {
+		return r.(*BlockStmt)
+	}
+	return nil
+}
+
+func (a *applier) apply(node Node) Node {
+	if a.pre != nil {
+		if node = a.pre(node); node == nil {
+			return nil
+		}
+	}
+
+	// replace children, in the order Walk visits them
+	switch n := node.(type) {
+	case *Field:
+		n.Names = a.identList(n.Names)
+		n.Type = a.expr(n.Type)
+		n.Tag = a.basicLit(n.Tag)
+
+	case *FieldList:
+		list := n.List[:0]
+		for _, f := range n.List {
+			if r := a.apply(f); r != nil {
+				list = append(list, r.(*Field))
+			}
+		}
+		n.List = list
+
+	// Expressions
+	case *BadExpr, *Ident, *BasicLit, *RefExpr:
+		// nothing to do
+
+	case *CompositeLit:
+		n.Type = a.expr(n.Type)
+		n.Elts = a.exprList(n.Elts)
+
+	case *SubscriptExpr:
+		n.Base = a.ident(n.Base)
+
+	case *UnitExpr:
+		n.X = a.expr(n.X)
+		n.Unit = a.expr(n.Unit)
+
+	case *TableExpr:
+		pairs := n.Pairs[:0]
+		for _, p := range n.Pairs {
+			if r := a.apply(p); r != nil {
+				pairs = append(pairs, r.(*PairExpr))
+			}
+		}
+		n.Pairs = pairs
+
+	case *TableFwdExpr:
+		ys := n.Ys[:0]
+		for _, y := range n.Ys {
+			if r := a.basicLit(y); r != nil {
+				ys = append(ys, r)
+			}
+		}
+		n.Ys = ys
+
+	case *PairExpr:
+		n.X = a.expr(n.X)
+		n.Y = a.expr(n.Y)
+
+	case *ParenExpr:
+		n.X = a.expr(n.X)
+
+	case *SelectorExpr:
+		n.X = a.expr(n.X)
+		n.Sel = a.ident(n.Sel)
+
+	case *IndexExpr:
+		n.X = a.expr(n.X)
+		n.Index = a.expr(n.Index)
+
+	case *CallExpr:
+		n.Fun = a.expr(n.Fun)
+		n.Args = a.exprList(n.Args)
+
+	case *UnaryExpr:
+		n.X = a.expr(n.X)
+
+	case *BinaryExpr:
+		n.X = a.expr(n.X)
+		n.Y = a.expr(n.Y)
+
+	case *IfExpr:
+		n.Cond = a.expr(n.Cond)
+		n.Then = a.expr(n.Then)
+		n.Else = a.expr(n.Else)
+
+	case *KeyValueExpr:
+		n.Key = a.expr(n.Key)
+		n.Value = a.expr(n.Value)
+
+	case *InterfaceType:
+		n.Methods = a.fieldList(n.Methods)
+
+	// Statements
+	case *BadStmt, *EmptyStmt:
+		// nothing to do
+
+	case *DeclStmt:
+		n.Decl = a.varDecl(n.Decl)
+
+	case *ExprStmt:
+		n.X = a.expr(n.X)
+
+	case *AssignStmt:
+		n.Lhs = a.varDecl(n.Lhs)
+		n.Rhs = a.expr(n.Rhs)
+
+	case *SpecStmt:
+		n.Elts = a.exprList(n.Elts)
+
+	case *OutputStmt:
+		n.Names = a.identList(n.Names)
+
+	case *BlockStmt:
+		list := n.List[:0]
+		for _, s := range n.List {
+			if r := a.apply(s); r != nil {
+				list = append(list, r.(Stmt))
+			}
+		}
+		n.List = list
+
+	// Declarations
+	case *ImportSpec:
+		n.Name = a.ident(n.Name)
+		n.Path = a.basicLit(n.Path)
+
+	case *BadDecl:
+		// nothing to do
+
+	case *GenDecl:
+		specs := n.Specs[:0]
+		for _, s := range n.Specs {
+			if r := a.apply(s); r != nil {
+				specs = append(specs, r.(Spec))
+			}
+		}
+		n.Specs = specs
+
+	case *VarDecl:
+		n.Name = a.ident(n.Name)
+		n.Type = a.ident(n.Type)
+		n.Units = a.expr(n.Units)
+
+	case *InterfaceDecl:
+		n.Units = a.basicLit(n.Units)
+		n.Body = a.block(n.Body)
+
+	case *ModelDecl:
+		n.Recv = a.fieldList(n.Recv)
+		n.Body = a.block(n.Body)
+
+	case *MacroDecl:
+		n.Name = a.ident(n.Name)
+		n.Params = a.identList(n.Params)
+		n.Body = a.block(n.Body)
+
+	// Files and packages
+	case *File:
+		if n == nil {
+			break
+		}
+		decls := n.Decls[:0]
+		for _, d := range n.Decls {
+			if r := a.apply(d); r != nil {
+				decls = append(decls, r.(Decl))
+			}
+		}
+		n.Decls = decls
+		macros := n.Macros[:0]
+		for _, m := range n.Macros {
+			if r := a.apply(m); r != nil {
+				macros = append(macros, r.(*MacroDecl))
+			}
+		}
+		n.Macros = macros
+
+	case *Package:
+		for name, f := range n.Files {
+			if r := a.apply(f); r != nil {
+				n.Files[name] = r.(*File)
+			} else {
+				delete(n.Files, name)
+			}
+		}
+
+	default:
+		panic(fmt.Sprintf("Apply: unexpected node type %T", n))
+	}
+
+	if a.post != nil {
+		node = a.post(node)
+	}
+	return node
+}
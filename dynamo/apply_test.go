@@ -0,0 +1,55 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestApplyDouble(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	before := CollectIdents(f)
+
+	double := func(n Node) Node {
+		lit, ok := n.(*BasicLit)
+		if !ok {
+			return n
+		}
+		v, err := lit.Float64()
+		if err != nil {
+			t.Fatalf("%s: %s", lit.Value, err)
+		}
+		return &BasicLit{ValuePos: lit.ValuePos, Kind: lit.Kind, Value: strconv.FormatFloat(2*v, 'g', -1, 64)}
+	}
+	if got := Apply(f, nil, double); got != f {
+		t.Fatalf("Apply returned %v, want the File it was given", got)
+	}
+
+	eqns := equations(f)
+	want := map[string]string{
+		"POPN":   "C POPN=266000",
+		"NB":     "C NB=0.08",
+		"ND":     "C ND=0.02",
+		"LENGTH": "C LENGTH=500",
+		"B":      "R B.KL=(NB)*(POP.K)",
+	}
+	for n, w := range want {
+		if eqns[n] != w {
+			t.Errorf("%s: got %q, want %q", n, eqns[n], w)
+		}
+	}
+
+	// the identifiers are the same nodes, with the same names
+	after := CollectIdents(f)
+	if len(after) != len(before) {
+		t.Fatalf("got %d identifiers, want %d", len(after), len(before))
+	}
+	for i := range after {
+		if after[i] != before[i] || after[i].Name != before[i].Name {
+			t.Errorf("identifier %d: got %s, want %s unchanged", i, after[i].Name, before[i].Name)
+		}
+	}
+}
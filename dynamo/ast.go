@@ -7,6 +7,9 @@ package dynamo
 import (
 	"fmt"
 	"go/token"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type ObjectKind int
@@ -86,6 +89,39 @@ type CommentGroup struct {
 func (g *CommentGroup) Pos() token.Pos { return g.List[0].Pos() }
 func (g *CommentGroup) End() token.Pos { return g.List[len(g.List)-1].End() }
 
+// Text returns the text of the comment group, one line per comment.
+// Comment markers (NOTE, *, //, /* and */) and surrounding space are
+// removed, as are empty lines.  Unless the result is empty, it is
+// newline-terminated.
+func (g *CommentGroup) Text() string {
+	if g == nil {
+		return ""
+	}
+	var lines []string
+	for _, c := range g.List {
+		text := c.Text
+		switch {
+		case len(text) >= 4 && strings.ToUpper(text[:4]) == "NOTE":
+			text = text[4:]
+		case strings.HasPrefix(text, "//"):
+			text = text[2:]
+		case strings.HasPrefix(text, "/*"):
+			text = strings.TrimSuffix(text[2:], "*/")
+		case strings.HasPrefix(text, "*"):
+			text = text[1:]
+		}
+		for _, l := range strings.Split(text, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
 // ----------------------------------------------------------------------------
 // Expressions and types
 
@@ -185,6 +221,10 @@ type (
 		ValuePos token.Pos   // literal position
 		Kind     token.Token // token.INT, token.FLOAT, token.IMAG, token.CHAR, or token.STRING
 		Value    string      // literal string; e.g. 42, 0x7f, 3.14, 1e-9, 2.4i, 'a', '\x7f', "foo" or `\m\n\o`
+
+		mu        sync.Mutex // guards parsed and parsedVal
+		parsed    *float64   // value of Value, set by Float64; or nil
+		parsedVal string     // the Value parsed was read from
 	}
 
 	// A CompositeLit node represents a composite literal.
@@ -257,6 +297,22 @@ type (
 		Ident // the variable name
 	}
 
+	// An IfExpr node represents a conditional expression,
+	// IF Cond THEN Then ELSE Else.
+	IfExpr struct {
+		If   token.Pos // position of "IF"
+		Cond Expr      // condition
+		Then Expr      // value if Cond holds
+		Else Expr      // value otherwise
+	}
+
+	// A SubscriptExpr node represents a reference to a variable
+	// at a point in time, like POP.K or BIRTHS.JK.
+	SubscriptExpr struct {
+		Base *Ident // the variable name
+		Sub  string // upper-cased time subscript
+	}
+
 	// A KeyValueExpr node represents (key : value) pairs
 	// in composite literals.
 	//
@@ -317,24 +373,30 @@ func (x *PairExpr) Pos() token.Pos      { return x.X.Pos() }
 func (x *TableExpr) Pos() token.Pos     { return x.Lbrack }
 func (x *TableFwdExpr) Pos() token.Pos  { return x.Ys[0].Pos() }
 func (x *UnitExpr) Pos() token.Pos      { return x.X.Pos() }
+func (x *IfExpr) Pos() token.Pos        { return x.If }
+func (x *SubscriptExpr) Pos() token.Pos { return x.Base.Pos() }
 func (x *KeyValueExpr) Pos() token.Pos  { return x.Key.Pos() }
 func (x *ModelType) Pos() token.Pos     { return x.Model }
 func (x *InterfaceType) Pos() token.Pos { return x.Interface }
 
-func (x *BadExpr) End() token.Pos       { return x.To }
-func (x *Ident) End() token.Pos         { return token.Pos(int(x.NamePos) + len(x.Name)) }
-func (x *BasicLit) End() token.Pos      { return token.Pos(int(x.ValuePos) + len(x.Value)) }
-func (x *CompositeLit) End() token.Pos  { return x.Rbrace + 1 }
-func (x *ParenExpr) End() token.Pos     { return x.Rparen + 1 }
-func (x *SelectorExpr) End() token.Pos  { return x.Sel.End() }
-func (x *IndexExpr) End() token.Pos     { return x.Rbrack + 1 }
-func (x *CallExpr) End() token.Pos      { return x.Rparen + 1 }
-func (x *UnaryExpr) End() token.Pos     { return x.X.End() }
-func (x *BinaryExpr) End() token.Pos    { return x.Y.End() }
-func (x *TableExpr) End() token.Pos     { return x.Rbrack + 1 }
-func (x *TableFwdExpr) End() token.Pos  { return x.Ys[len(x.Ys)-1].End() }
-func (x *PairExpr) End() token.Pos      { return x.Y.End() }
-func (x *UnitExpr) End() token.Pos      { return x.Unit.End() }
+func (x *BadExpr) End() token.Pos      { return x.To }
+func (x *Ident) End() token.Pos        { return token.Pos(int(x.NamePos) + len(x.Name)) }
+func (x *BasicLit) End() token.Pos     { return token.Pos(int(x.ValuePos) + len(x.Value)) }
+func (x *CompositeLit) End() token.Pos { return x.Rbrace + 1 }
+func (x *ParenExpr) End() token.Pos    { return x.Rparen + 1 }
+func (x *SelectorExpr) End() token.Pos { return x.Sel.End() }
+func (x *IndexExpr) End() token.Pos    { return x.Rbrack + 1 }
+func (x *CallExpr) End() token.Pos     { return x.Rparen + 1 }
+func (x *UnaryExpr) End() token.Pos    { return x.X.End() }
+func (x *BinaryExpr) End() token.Pos   { return x.Y.End() }
+func (x *TableExpr) End() token.Pos    { return x.Rbrack + 1 }
+func (x *TableFwdExpr) End() token.Pos { return x.Ys[len(x.Ys)-1].End() }
+func (x *PairExpr) End() token.Pos     { return x.Y.End() }
+func (x *UnitExpr) End() token.Pos     { return x.Unit.End() }
+func (x *IfExpr) End() token.Pos       { return x.Else.End() }
+func (x *SubscriptExpr) End() token.Pos {
+	return token.Pos(int(x.Base.End()) + 1 + len(x.Sub))
+}
 func (x *KeyValueExpr) End() token.Pos  { return x.Value.End() }
 func (x *ModelType) End() token.Pos     { return x.Fields.End() }
 func (x *InterfaceType) End() token.Pos { return x.Methods.End() }
@@ -342,21 +404,23 @@ func (x *InterfaceType) End() token.Pos { return x.Methods.End() }
 // exprNode() ensures that only expression/type nodes can be
 // assigned to an ExprNode.
 //
-func (*BadExpr) exprNode()      {}
-func (*Ident) exprNode()        {}
-func (*BasicLit) exprNode()     {}
-func (*CompositeLit) exprNode() {}
-func (*ParenExpr) exprNode()    {}
-func (*SelectorExpr) exprNode() {}
-func (*IndexExpr) exprNode()    {}
-func (*CallExpr) exprNode()     {}
-func (*UnaryExpr) exprNode()    {}
-func (*BinaryExpr) exprNode()   {}
-func (*TableExpr) exprNode()    {}
-func (*TableFwdExpr) exprNode() {}
-func (*PairExpr) exprNode()     {}
-func (*UnitExpr) exprNode()     {}
-func (*KeyValueExpr) exprNode() {}
+func (*BadExpr) exprNode()       {}
+func (*Ident) exprNode()         {}
+func (*BasicLit) exprNode()      {}
+func (*CompositeLit) exprNode()  {}
+func (*ParenExpr) exprNode()     {}
+func (*SelectorExpr) exprNode()  {}
+func (*IndexExpr) exprNode()     {}
+func (*CallExpr) exprNode()      {}
+func (*UnaryExpr) exprNode()     {}
+func (*BinaryExpr) exprNode()    {}
+func (*TableExpr) exprNode()     {}
+func (*TableFwdExpr) exprNode()  {}
+func (*PairExpr) exprNode()      {}
+func (*UnitExpr) exprNode()      {}
+func (*IfExpr) exprNode()        {}
+func (*SubscriptExpr) exprNode() {}
+func (*KeyValueExpr) exprNode()  {}
 
 func (*ModelType) exprNode()     {}
 func (*InterfaceType) exprNode() {}
@@ -365,6 +429,25 @@ func (bl *BasicLit) String() string {
 	return bl.Value
 }
 
+// Float64 returns the value of the number literal bl.  The value is
+// parsed once and cached; it is parsed again only if Value has been
+// changed since.  Float64 may be called from several goroutines at
+// once, as simulations running in parallel share a model's literals.
+//
+func (bl *BasicLit) Float64() (float64, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.parsed != nil && bl.parsedVal == bl.Value {
+		return *bl.parsed, nil
+	}
+	v, err := strconv.ParseFloat(bl.Value, 64)
+	if err != nil {
+		return 0, err
+	}
+	bl.parsed, bl.parsedVal = &v, bl.Value
+	return v, nil
+}
+
 func (i Ident) String() string {
 	return fmt.Sprintf(`s.Curr["%s"]`, i.Name)
 }
@@ -450,6 +533,23 @@ type (
 		Rhs    Expr
 	}
 
+	// A SpecStmt node represents a SPEC card, giving simulation
+	// parameters like DT=.25/LENGTH=100/SAVPER=1.  Each of Elts
+	// is a KeyValueExpr with an upper-cased *Ident Key and a
+	// *BasicLit Value.
+	SpecStmt struct {
+		Spec token.Pos // position of "SPEC"
+		Elts []Expr    // the parameters, in order
+	}
+
+	// An OutputStmt node represents a PRINT or PLOT card, naming
+	// the variables written out each save step.
+	OutputStmt struct {
+		Card  token.Pos // position of "PRINT" or "PLOT"
+		Kind  string    // PRINT or PLOT
+		Names []*Ident  // the variables, in order
+	}
+
 	// A BlockStmt node represents a braced statement list.
 	BlockStmt struct {
 		Lbrace token.Pos // position of "{"
@@ -465,6 +565,8 @@ func (s *DeclStmt) Pos() token.Pos   { return s.Decl.Pos() }
 func (s *EmptyStmt) Pos() token.Pos  { return s.Semicolon }
 func (s *ExprStmt) Pos() token.Pos   { return s.X.Pos() }
 func (s *AssignStmt) Pos() token.Pos { return s.Lhs.Pos() }
+func (s *SpecStmt) Pos() token.Pos   { return s.Spec }
+func (s *OutputStmt) Pos() token.Pos { return s.Card }
 func (s *BlockStmt) Pos() token.Pos  { return s.Lbrace }
 
 func (s *BadStmt) End() token.Pos  { return s.To }
@@ -474,7 +576,19 @@ func (s *EmptyStmt) End() token.Pos {
 }
 func (s *ExprStmt) End() token.Pos   { return s.X.End() }
 func (s *AssignStmt) End() token.Pos { return s.Rhs.End() }
-func (s *BlockStmt) End() token.Pos  { return s.Rbrace + 1 }
+func (s *SpecStmt) End() token.Pos {
+	if n := len(s.Elts); n > 0 {
+		return s.Elts[n-1].End()
+	}
+	return s.Spec
+}
+func (s *OutputStmt) End() token.Pos {
+	if n := len(s.Names); n > 0 {
+		return s.Names[n-1].End()
+	}
+	return s.Card + token.Pos(len(s.Kind))
+}
+func (s *BlockStmt) End() token.Pos { return s.Rbrace + 1 }
 
 // stmtNode() ensures that only statement nodes can be
 // assigned to a StmtNode.
@@ -484,6 +598,8 @@ func (*DeclStmt) stmtNode()   {}
 func (*EmptyStmt) stmtNode()  {}
 func (*ExprStmt) stmtNode()   {}
 func (*AssignStmt) stmtNode() {}
+func (*SpecStmt) stmtNode()   {}
+func (*OutputStmt) stmtNode() {}
 func (*BlockStmt) stmtNode()  {}
 
 func (s *AssignStmt) Name() string {
@@ -494,6 +610,14 @@ func (s *DeclStmt) Name() string {
 	return s.Decl.Name.Name
 }
 
+func (s *SpecStmt) Name() string {
+	return "SPEC"
+}
+
+func (s *OutputStmt) Name() string {
+	return s.Kind
+}
+
 // ----------------------------------------------------------------------------
 // Declarations
 
@@ -596,7 +720,8 @@ type (
 		Doc   *CommentGroup // associated documentation; or nil
 		Name  *Ident        // name of the variable
 		Type  *Ident        // type (stock, flow) of the variable
-		Units Expr          // name of the variable
+		Sub   string        // upper-cased time subscript of the name; or ""
+		Units Expr          // units of the variable; or nil
 	}
 
 	// A InterfaceDecl node represents an interface declaration.
@@ -620,6 +745,17 @@ type (
 		Virtual bool          // if the model has decls which require initialization
 		Errors  int           // number of errors, such as unresolvable refs
 	}
+
+	// A MacroDecl node represents a DYNAMO III macro definition,
+	// MACRO Name(Params) followed by its equations and MEND.
+	MacroDecl struct {
+		Doc    *CommentGroup // associated documentation; or nil
+		Macro  token.Pos     // position of "MACRO"
+		Name   *Ident        // macro name, and the variable holding its result
+		Params []*Ident      // parameter names
+		Body   *BlockStmt    // equations of the macro
+		Mend   token.Pos     // position of "MEND"
+	}
 )
 
 // Pos and End implementations for declaration nodes.
@@ -629,9 +765,15 @@ func (d *GenDecl) Pos() token.Pos       { return d.TokPos }
 func (d *VarDecl) Pos() token.Pos       { return d.Name.Pos() }
 func (d *InterfaceDecl) Pos() token.Pos { return d.Name.Pos() }
 func (d *ModelDecl) Pos() token.Pos     { return d.Name.Pos() }
+func (d *MacroDecl) Pos() token.Pos     { return d.Macro }
 
 func (d *BadDecl) End() token.Pos { return d.To }
-func (d *VarDecl) End() token.Pos { return d.Units.End() }
+func (d *VarDecl) End() token.Pos {
+	if d.Units != nil {
+		return d.Units.End()
+	}
+	return d.Name.End()
+}
 func (d *GenDecl) End() token.Pos {
 	if d.Rparen.IsValid() {
 		return d.Rparen + 1
@@ -640,6 +782,7 @@ func (d *GenDecl) End() token.Pos {
 }
 func (d *InterfaceDecl) End() token.Pos { return d.Body.End() }
 func (d *ModelDecl) End() token.Pos     { return d.Body.End() }
+func (d *MacroDecl) End() token.Pos     { return d.Mend }
 
 // declNode() ensures that only declaration nodes can be
 // assigned to a DeclNode.
@@ -649,6 +792,7 @@ func (d *GenDecl) declNode()       {}
 func (d *VarDecl) declNode()       {}
 func (d *InterfaceDecl) declNode() {}
 func (d *ModelDecl) declNode()     {}
+func (d *MacroDecl) declNode()     {}
 
 // ----------------------------------------------------------------------------
 // Files and packages
@@ -664,6 +808,7 @@ type File struct {
 	Package    token.Pos       // position of "package" keyword
 	Name       *Ident          // package name
 	Decls      []Decl          // top-level declarations; or nil
+	Macros     []*MacroDecl    // macro definitions; or nil
 	Scope      *Scope          // package scope (this file only)
 	Imports    []*ImportSpec   // imports in this file
 	Unresolved []*Ident        // unresolved identifiers in this file
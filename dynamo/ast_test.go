@@ -0,0 +1,74 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"sync"
+	"testing"
+)
+
+func TestBasicLitFloat64(t *testing.T) {
+	lit := &BasicLit{Kind: token.FLOAT, Value: "2.5e-1"}
+	if lit.parsed != nil {
+		t.Fatalf("cache populated before the first call")
+	}
+	v, err := lit.Float64()
+	if err != nil || v != .25 {
+		t.Fatalf("got %g (%v), want .25", v, err)
+	}
+	if lit.parsed == nil || *lit.parsed != .25 {
+		t.Errorf("cache not populated after the first call")
+	}
+	cached := lit.parsed
+	for i := 0; i < 3; i++ {
+		if v, err := lit.Float64(); err != nil || v != .25 {
+			t.Errorf("call %d: got %g (%v), want .25", i+2, v, err)
+		}
+	}
+	if lit.parsed != cached {
+		t.Errorf("value parsed again, rather than taken from the cache")
+	}
+
+	// a changed Value is parsed afresh
+	lit.Value = "4"
+	if v, err := lit.Float64(); err != nil || v != 4 {
+		t.Errorf("changed value: got %g (%v), want 4", v, err)
+	}
+
+	bad := &BasicLit{Kind: token.FLOAT, Value: "abc"}
+	if _, err := bad.Float64(); err == nil {
+		t.Errorf("abc: expected an error")
+	}
+	if bad.parsed != nil {
+		t.Errorf("abc: error cached as a value")
+	}
+}
+
+// TestBasicLitFloat64Concurrent checks that goroutines can share a
+// literal's cache; run with -race, it checks that they do so safely.
+func TestBasicLitFloat64Concurrent(t *testing.T) {
+	lit := &BasicLit{Kind: token.FLOAT, Value: ".5"}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if v, err := lit.Float64(); err != nil || v != .5 {
+					errs <- fmt.Errorf("got %g (%v), want .5", v, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
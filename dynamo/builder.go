@@ -0,0 +1,329 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ModelBuilder constructs the AST of a model directly, for tools
+// that generate models without going through DYNAMO source text.
+// Variables may be added in any order; references between them are
+// checked when File is called.
+type ModelBuilder struct {
+	name  string
+	stmts []Stmt
+	types map[string]string // upper-cased name -> type name
+}
+
+// NewModel returns a builder for an empty model with the given name.
+// Only a model named "main" has its timespec extracted from the TIME,
+// LENGTH, SAVPER and DT constants, as when parsing.
+func NewModel(name string) *ModelBuilder {
+	return &ModelBuilder{name: name, types: map[string]string{}}
+}
+
+func (b *ModelBuilder) declare(name, ty string, rhs Expr) error {
+	if name == "" {
+		return fmt.Errorf("empty variable name")
+	}
+	if rhs == nil {
+		return fmt.Errorf("%s: missing equation", name)
+	}
+	n := strings.ToUpper(name)
+	if _, ok := b.types[n]; ok {
+		return fmt.Errorf("%s redeclared", name)
+	}
+	b.types[n] = ty
+
+	decl := &VarDecl{Name: id(name), Type: id(ty)}
+	b.stmts = append(b.stmts, &AssignStmt{Lhs: decl, Rhs: rhs})
+	return nil
+}
+
+// AddConst adds a constant.
+func (b *ModelBuilder) AddConst(name string, value float64) error {
+	return b.declare(name, "const", floatLit(value))
+}
+
+// AddAux adds an auxiliary computed from eqn.
+func (b *ModelBuilder) AddAux(name string, eqn Expr) error {
+	return b.declare(name, "aux", eqn)
+}
+
+// AddFlow adds a rate computed from eqn.
+func (b *ModelBuilder) AddFlow(name string, eqn Expr) error {
+	return b.declare(name, "flow", eqn)
+}
+
+// AddStock adds a level starting at initial and integrating netflow,
+// which may only reference flows.
+func (b *ModelBuilder) AddStock(name string, initial, netflow Expr) error {
+	if initial == nil || netflow == nil {
+		return fmt.Errorf("%s: stock needs an initial value and a net flow", name)
+	}
+	rhs := &CompositeLit{Elts: []Expr{
+		&KeyValueExpr{Key: id("initial"), Value: initial},
+		&KeyValueExpr{Key: id("inflow"), Value: netflow},
+	}}
+	return b.declare(name, "stock", rhs)
+}
+
+// AddTable adds a table of (x, y) points, with xs strictly
+// increasing.
+func (b *ModelBuilder) AddTable(name string, xs, ys []float64) error {
+	if len(xs) == 0 || len(xs) != len(ys) {
+		return fmt.Errorf("%s: table needs the same, non-zero number of xs (%d) and ys (%d)",
+			name, len(xs), len(ys))
+	}
+	t := new(TableExpr)
+	for i := range xs {
+		if i > 0 && xs[i] <= xs[i-1] {
+			return fmt.Errorf("%s: table xs must be increasing (%f after %f)",
+				name, xs[i], xs[i-1])
+		}
+		t.Pairs = append(t.Pairs, &PairExpr{X: floatLit(xs[i]), Y: floatLit(ys[i])})
+	}
+	return b.declare(name, "table", t)
+}
+
+// checkRefs returns an error if e references a variable that hasn't
+// been declared, or, if flowsOnly is set, one that isn't a flow.
+// Function names are not variable references.
+func (b *ModelBuilder) checkRefs(name string, e Expr, flowsOnly bool) (err error) {
+	Inspect(e, func(n Node) bool {
+		if err != nil {
+			return false
+		}
+		switch x := n.(type) {
+		case *CallExpr:
+			for _, arg := range x.Args {
+				if err = b.checkRefs(name, arg, flowsOnly); err != nil {
+					break
+				}
+			}
+			return false
+		case *RefExpr:
+			err = b.checkRef(name, &x.Ident, flowsOnly)
+		case *Ident:
+			err = b.checkRef(name, x, flowsOnly)
+		}
+		return true
+	})
+	return
+}
+
+func (b *ModelBuilder) checkRef(name string, x *Ident, flowsOnly bool) (err error) {
+	ty, ok := b.types[strings.ToUpper(x.Name)]
+	switch {
+	case !ok:
+		err = fmt.Errorf("%s: reference to undeclared %s", name, x.Name)
+	case flowsOnly && ty != "flow":
+		err = fmt.Errorf("%s: net flow references %s, which is a %s, not a flow",
+			name, x.Name, ty)
+	}
+	return
+}
+
+// subscripted returns a copy of assign with the time subscripts the
+// parser would have given it: on the variable it declares, and on
+// each reference to a variable, as refSubscript gives.
+func (b *ModelBuilder) subscripted(assign *AssignStmt) *AssignStmt {
+	lhs := *assign.Lhs
+	lhs.Sub = declSubscripts[lhs.Type.Name]
+	sub := func(eqn string, e Expr) Expr {
+		e, _ = mapExpr(e, func(e Expr) (Expr, error) {
+			var x *Ident
+			switch n := e.(type) {
+			case *Ident:
+				x = n
+			case *RefExpr:
+				x = &n.Ident
+			default:
+				return nil, nil
+			}
+			if s := refSubscript(eqn, b.types[strings.ToUpper(x.Name)]); s != "" {
+				return &SubscriptExpr{&Ident{NamePos: x.NamePos, Name: x.Name}, s}, nil
+			}
+			return nil, nil
+		})
+		return e
+	}
+
+	rhs := assign.Rhs
+	if cl, ok := rhs.(*CompositeLit); ok && lhs.Type.Name == "stock" {
+		// the initial value is an N card's equation, and the
+		// flows an L card's
+		c := *cl
+		c.Elts = make([]Expr, len(cl.Elts))
+		for i, e := range cl.Elts {
+			kv := *e.(*KeyValueExpr)
+			eqn := "stock"
+			if k, _, _ := kvConvert(&kv); k == "initial" {
+				eqn = "initial"
+			}
+			kv.Value = sub(eqn, kv.Value)
+			c.Elts[i] = &kv
+		}
+		rhs = &c
+	} else {
+		rhs = sub(lhs.Type.Name, rhs)
+	}
+	a := *assign
+	a.Lhs, a.Rhs = &lhs, rhs
+	return &a
+}
+
+// File validates the references between the model's variables and
+// returns the model as a File ready for GenGo.
+func (b *ModelBuilder) File() (*File, error) {
+	for _, s := range b.stmts {
+		assign := s.(*AssignStmt)
+		name := assign.Lhs.Name.Name
+		switch assign.Lhs.Type.Name {
+		case "const", "table":
+		case "stock":
+			for _, e := range assign.Rhs.(*CompositeLit).Elts {
+				k, v, _ := kvConvert(e)
+				if err := b.checkRefs(name, v, k == "inflow"); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			if err := b.checkRefs(name, assign.Rhs, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	m := new(ModelDecl)
+	m.Name = id(b.name)
+	m.Body = new(BlockStmt)
+	for _, s := range b.stmts {
+		m.Body.List = append(m.Body.List, b.subscripted(s.(*AssignStmt)))
+	}
+
+	if b.name == "main" {
+		if err := extractTimespec(m); err != nil {
+			return nil, fmt.Errorf("extractTimespec: %s", err)
+		}
+	}
+
+	return &File{Name: m.Name, Decls: []Decl{m}}, nil
+}
+
+// A Builder builds the model named main, as a ModelBuilder does, but
+// takes equations as DYNAMO expressions, parsed as by ParseExpr, and
+// returns itself from each method so that calls can be chained:
+//
+//	f, err := NewBuilder().
+//		AddStock("POP", "POPN", "B").
+//		AddConst("POPN", 100).
+//		AddRate("B", "(NB)(POP)").
+//		AddConst("NB", .04).
+//		SetTimespec(0, 10, 1, 1).
+//		Build()
+//
+// The first error is kept, and returned by Build; the calls after it
+// do nothing.
+type Builder struct {
+	m   *ModelBuilder
+	err error
+}
+
+// NewBuilder returns a Builder for an empty model.
+func NewBuilder() *Builder {
+	return &Builder{m: NewModel("main")}
+}
+
+// add calls fn, the ModelBuilder method adding name with the
+// expressions parsed from srcs, unless b already has an error.
+func (b *Builder) add(name string, fn func(es []Expr) error, srcs ...string) *Builder {
+	if b.err != nil {
+		return b
+	}
+	es := make([]Expr, len(srcs))
+	for i, src := range srcs {
+		e, err := ParseExpr(src)
+		if err != nil {
+			b.err = fmt.Errorf("%s: %s", name, err)
+			return b
+		}
+		es[i] = e
+	}
+	b.err = fn(es)
+	return b
+}
+
+// AddStock adds a level starting at initial and integrating netflow,
+// which may only reference rates.  Unlike an L card, netflow is the
+// level's rate of change, without the level or DT.
+func (b *Builder) AddStock(name, initial, netflow string) *Builder {
+	return b.add(name, func(es []Expr) error {
+		return b.m.AddStock(name, es[0], es[1])
+	}, initial, netflow)
+}
+
+// AddRate adds a rate computed from eqn.
+func (b *Builder) AddRate(name, eqn string) *Builder {
+	return b.add(name, func(es []Expr) error {
+		return b.m.AddFlow(name, es[0])
+	}, eqn)
+}
+
+// AddAux adds an auxiliary computed from eqn.
+func (b *Builder) AddAux(name, eqn string) *Builder {
+	return b.add(name, func(es []Expr) error {
+		return b.m.AddAux(name, es[0])
+	}, eqn)
+}
+
+// AddConst adds a constant.
+func (b *Builder) AddConst(name string, value float64) *Builder {
+	return b.add(name, func([]Expr) error {
+		return b.m.AddConst(name, value)
+	})
+}
+
+// AddTable adds a table of ys at xs evenly spaced from xMin to xMax,
+// as a T card looked up by TABHL with those bounds.
+func (b *Builder) AddTable(name string, ys []float64, xMin, xMax float64) *Builder {
+	return b.add(name, func([]Expr) error {
+		xs := make([]float64, len(ys))
+		for i := range xs {
+			xs[i] = xMin
+			if len(ys) > 1 {
+				xs[i] += float64(i) * (xMax - xMin) / float64(len(ys)-1)
+			}
+		}
+		return b.m.AddTable(name, xs, ys)
+	})
+}
+
+// SetTimespec adds the TIME, LENGTH, DT and SAVPER constants: the
+// simulation runs from start to end in steps of dt, saving its
+// state every savePer.
+func (b *Builder) SetTimespec(start, end, dt, savePer float64) *Builder {
+	return b.add("timespec", func([]Expr) error {
+		for _, c := range []struct {
+			name  string
+			value float64
+		}{{"TIME", start}, {"LENGTH", end}, {"DT", dt}, {"SAVPER", savePer}} {
+			if err := b.m.AddConst(c.name, c.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Build returns the model, or the first error from building it.
+func (b *Builder) Build() (*File, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.m.File()
+}
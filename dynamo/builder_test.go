@@ -0,0 +1,172 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// expr parses the expression src, failing the test if it can't.
+func expr(t testing.TB, src string) Expr {
+	e, err := ParseExpr(src)
+	if err != nil {
+		t.Fatalf("ParseExpr(%q): %s", src, err)
+	}
+	return e
+}
+
+func TestModelBuilder(t *testing.T) {
+	// the population sector of House5, as in helloWorld
+	b := NewModel("main")
+	for _, err := range []error{
+		b.AddStock("POP", expr(t, "POPN"), expr(t, "B-D")),
+		b.AddConst("POPN", 133000),
+		b.AddFlow("B", expr(t, "NB*POP")),
+		b.AddConst("NB", .04),
+		b.AddFlow("D", expr(t, "ND*POP")),
+		b.AddConst("ND", .01),
+		b.AddConst("LENGTH", 250),
+		b.AddConst("DT", 5),
+		b.AddConst("SAVPER", 5),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	built, err := b.File()
+	if err != nil {
+		t.Fatalf("File: %s", err)
+	}
+	parsed, _ := parseSrc(t, helloWorld)
+
+	want, err := Simulate(parsed, SimulateOptions{OutputVars: []string{"POP"}})
+	if err != nil {
+		t.Fatalf("Simulate(parsed): %s", err)
+	}
+	got, err := Simulate(built, SimulateOptions{OutputVars: []string{"POP"}})
+	if err != nil {
+		t.Fatalf("Simulate(built): %s", err)
+	}
+	if len(got.Time) != len(want.Time) {
+		t.Fatalf("got %d times, want %d", len(got.Time), len(want.Time))
+	}
+	for i := range want.Time {
+		g, w := got.Vars["POP"][i], want.Vars["POP"][i]
+		if math.Abs(g-w) > 1e-9*math.Abs(w) {
+			t.Errorf("POP at %g: got %g, want %g", want.Time[i], g, w)
+		}
+	}
+}
+
+func TestModelBuilderErrors(t *testing.T) {
+	b := NewModel("main")
+	if err := b.AddConst("C", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddConst("c", 2); err == nil {
+		t.Errorf("redeclared constant: got no error")
+	}
+	if err := b.AddTable("T", []float64{0, 1}, []float64{1}); err == nil {
+		t.Errorf("table of 2 xs and 1 y: got no error")
+	}
+	if err := b.AddTable("T", []float64{1, 0}, []float64{1, 2}); err == nil {
+		t.Errorf("table of decreasing xs: got no error")
+	}
+
+	tests := []struct {
+		name string
+		add  func(b *ModelBuilder) error
+	}{
+		{"undeclared", func(b *ModelBuilder) error {
+			return b.AddAux("A", expr(t, "C*NOPE"))
+		}},
+		{"net flow of a constant", func(b *ModelBuilder) error {
+			return b.AddStock("S", expr(t, "1"), expr(t, "C"))
+		}},
+	}
+	for _, test := range tests {
+		b := NewModel("main")
+		if err := b.AddConst("C", 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.add(b); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if _, err := b.File(); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	built, err := NewBuilder().
+		AddStock("POP", "POPN", "B-D").
+		AddConst("POPN", 133000).
+		AddRate("B", "(NB)(POP)").
+		AddConst("NB", .04).
+		AddRate("D", "(ND)(POP)").
+		AddConst("ND", .01).
+		SetTimespec(0, 250, 5, 5).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+	var got bytes.Buffer
+	if err := Fprint(&got, nil, built); err != nil {
+		t.Fatalf("Fprint: %s", err)
+	}
+
+	// helloWorld, without its NOTE cards
+	var src []string
+	for _, line := range strings.Split(helloWorld, "\n") {
+		if !strings.HasPrefix(line, "NOTE") {
+			src = append(src, line)
+		}
+	}
+	parsed, _ := parseSrc(t, strings.Join(src, "\n"))
+	var want bytes.Buffer
+	if err := Fprint(&want, nil, parsed); err != nil {
+		t.Fatalf("Fprint: %s", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("built model prints as\n%s\nwant\n%s", &got, &want)
+	}
+}
+
+func TestBuilderErrors(t *testing.T) {
+	tests := []struct {
+		b   *Builder
+		err string
+	}{
+		{NewBuilder().AddAux("A", "1+").AddConst("A", 1), "A: 1:"},
+		{NewBuilder().AddConst("C", 1).AddConst("c", 2).AddAux("X", "BOGUS"), "c redeclared"},
+		{NewBuilder().AddAux("X", "Y*2"), "X: reference to undeclared Y"},
+		{NewBuilder().AddTable("T", nil, 0, 1), "T: table needs"},
+		{NewBuilder().AddConst("DT", 1).SetTimespec(0, 10, 1, 1), "DT redeclared"},
+	}
+	for _, test := range tests {
+		if _, err := test.b.Build(); err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("got error %v, want %s", err, test.err)
+		}
+	}
+
+	// a table of ys evenly spaced from xMin to xMax
+	f, err := NewBuilder().AddTable("T", []float64{0, 10, 40}, 0, 2).Build()
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+	table, ok := rhs(f, "T").(*TableExpr)
+	if !ok || len(table.Pairs) != 3 {
+		t.Fatalf("got table %#v, want 3 points", rhs(f, "T"))
+	}
+	for i, want := range []float64{0, 1, 2} {
+		if x, err := table.Pairs[i].X.(*BasicLit).Float64(); err != nil || x != want {
+			t.Errorf("point %d: got x %s, want %g", i, table.Pairs[i].X.(*BasicLit).Value, want)
+		}
+	}
+}
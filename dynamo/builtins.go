@@ -0,0 +1,90 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// builtins maps the names of DYNAMO's built-in functions to the
+// number of arguments each takes.
+var builtins = map[string]int{
+	"TABHL":  5,
+	"CLIP":   4,
+	"MAX":    2,
+	"MIN":    2,
+	"ABS":    1,
+	"SQRT":   1,
+	"EXP":    1,
+	"LOG":    1,
+	"SIN":    1,
+	"COS":    1,
+	"STEP":   2,
+	"RAMP":   2,
+	"PULSE":  3,
+	"SMOOTH": 2,
+	"DELAY3": 2,
+	"NOISE":  0,
+	"NORMRN": 2,
+}
+
+// funcName returns the upper-cased name of the function called by c.
+func funcName(c *CallExpr) string {
+	if id, ok := c.Fun.(*Ident); ok {
+		return strings.ToUpper(id.Name)
+	}
+	return ""
+}
+
+// CheckCalls returns an error for each call in f to a function that
+// isn't one of DYNAMO's built-ins or f's macros, or with the wrong
+// number of arguments.  GenGo stops at the first call it can't generate, so
+// this is the strict mode for reporting every misspelt function name
+// at once, with its position.
+func CheckCalls(fset *token.FileSet, f *File) error {
+	var errs ErrorVector
+	funcs := map[string]int{}
+	for name, nargs := range builtins {
+		funcs[name] = nargs
+	}
+	var bodies []*BlockStmt
+	for _, m := range f.Macros {
+		funcs[strings.ToUpper(m.Name.Name)] = len(m.Params)
+		bodies = append(bodies, m.Body)
+	}
+	for _, d := range f.Decls {
+		if md, ok := d.(*ModelDecl); ok && md.Body != nil {
+			bodies = append(bodies, md.Body)
+		}
+	}
+	for _, body := range bodies {
+		for _, s := range body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok {
+				continue
+			}
+			Inspect(assign.Rhs, func(n Node) bool {
+				c, ok := n.(*CallExpr)
+				if !ok {
+					return true
+				}
+				name := funcName(c)
+				nargs, ok := funcs[name]
+				switch {
+				case !ok:
+					errs.RuleError(fset.Position(c.Pos()), "call",
+						fmt.Sprintf("unknown function %s", exprString(c.Fun)))
+				case len(c.Args) != nargs:
+					errs.RuleError(fset.Position(c.Pos()), "call",
+						fmt.Sprintf("%s takes %d arguments, not %d", name, nargs, len(c.Args)))
+				}
+				return true
+			})
+		}
+	}
+	return errs.GetError(Sorted)
+}
@@ -0,0 +1,213 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// checkSeries checks that the values of name in each of series are
+// want, at the times given by want's keys.
+func checkSeries(t *testing.T, name string, want map[float64]float64, series ...TimeSeries) {
+	for _, ts := range series {
+		vals, ok := ts.Vars[name]
+		if !ok {
+			t.Errorf("no %s in the results", name)
+			continue
+		}
+		found := 0
+		for i, time := range ts.Time {
+			w, ok := want[time]
+			if !ok {
+				continue
+			}
+			found++
+			if math.Abs(vals[i]-w) > 1e-9 {
+				t.Errorf("%s at TIME %g: got %g, want %g", name, time, vals[i], w)
+			}
+		}
+		if found != len(want) {
+			t.Errorf("%s: got %d of the %d times wanted", name, found, len(want))
+		}
+	}
+}
+
+func TestClip(t *testing.T) {
+	tests := []struct {
+		src string
+		v   float64
+	}{
+		{"CLIP(1,2,5,3)", 1},
+		{"CLIP(1,2,3,5)", 2},
+		{"CLIP(1,2,4,4)", 1}, // X == Y is A's
+	}
+	for _, test := range tests {
+		if v, err := EvalExpr(test.src, nil); err != nil || v != test.v {
+			t.Errorf("%s: got %g (%v), want %g", test.src, v, err, test.v)
+		}
+	}
+
+	// the birth multiplier is 1 until the population reaches
+	// its capacity, and .5 from then on.
+	const src = `* clip
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=100
+R	B.KL=(25)(BM.K)
+A	BM.K=CLIP(.5,1,POP.K/CAP,1)
+C	CAP=200
+C	LENGTH=6
+C	DT=1
+C	SAVPER=1
+`
+	sim, gen := simulateBoth(t, src)
+	checkSeries(t, "BM", map[float64]float64{0: 1, 3: 1, 4: .5, 6: .5}, sim, gen)
+	checkSeries(t, "POP", map[float64]float64{4: 200, 5: 212.5, 6: 225}, sim, gen)
+}
+
+// TestLazyBranches checks that IF and CLIP compute only the value
+// they choose, so the other may divide by zero, or draw from NOISE,
+// without it showing in the results.
+func TestLazyBranches(t *testing.T) {
+	// X is 0 until TIME 2, and Y and Z are only 1/X from then on
+	const src = `* lazy branches
+A	X.K=STEP(2,2)
+A	Y.K=IF X.K>0 THEN 1/X.K ELSE -1
+A	Z.K=CLIP(1/X.K,-1,X.K,1)
+C	LENGTH=4
+C	DT=1
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	sim, gen := simulateBoth(t, src)
+	cSrc, err := GenC(f)
+	if err != nil {
+		t.Fatalf("GenC: %s", err)
+	}
+	pySrc, err := GenPython(f)
+	if err != nil {
+		t.Fatalf("GenPython: %s", err)
+	}
+	series := []TimeSeries{sim, gen}
+	for _, out := range []string{runC(t, cSrc), runPython(t, pySrc)} {
+		ts, err := ParseCSV(strings.NewReader(out))
+		if err != nil {
+			t.Fatalf("ParseCSV: %s", err)
+		}
+		series = append(series, ts)
+	}
+	want := map[float64]float64{0: -1, 1: -1, 2: .5, 4: .5}
+	checkSeries(t, "Y", want, series...)
+	checkSeries(t, "Z", want, series...)
+
+	// an untaken NOISE doesn't draw, so N's numbers are those of
+	// a model without U
+	const noise = `* untaken noise
+A	N.K=NOISE()
+%s
+C	LENGTH=4
+C	DT=1
+C	SAVPER=1
+`
+	withU, genWithU := simulateBoth(t, fmt.Sprintf(noise, "A\tU.K=CLIP(NOISE(),IF TIME.K<0 THEN NOISE() ELSE 0,-1,0)"))
+	without, _ := simulateBoth(t, fmt.Sprintf(noise, "A\tU.K=0"))
+	for _, ts := range []TimeSeries{withU, genWithU} {
+		for i, n := range without.Vars["N"] {
+			if ts.Vars["N"][i] != n {
+				t.Errorf("TIME %g: got N %g, want %g", ts.Time[i], ts.Vars["N"][i], n)
+			}
+		}
+	}
+}
+
+func TestInputFunctions(t *testing.T) {
+	const src = `* inputs
+A	S.K=STEP(10,5)
+A	R.K=RAMP(2,5)
+A	P.K=PULSE(10,5,2)
+C	LENGTH=10
+C	DT=.5
+C	SAVPER=.5
+`
+	sim, gen := simulateBoth(t, src)
+	checkSeries(t, "S", map[float64]float64{0: 0, 1: 0, 5: 10, 10: 10}, sim, gen)
+	checkSeries(t, "R", map[float64]float64{0: 0, 1: 0, 5: 0, 10: 10}, sim, gen)
+	// PULSE is H/DT from ST until ST+PT
+	checkSeries(t, "P", map[float64]float64{0: 0, 1: 0, 5: 20, 6.5: 20, 7: 0, 10: 0}, sim, gen)
+}
+
+func TestDelay3(t *testing.T) {
+	// a unit step at TIME 1 into a delay of 6
+	const src = `* delay
+A	IN.K=STEP(1,1)
+A	OUT.K=DELAY3(IN.K,6)
+C	LENGTH=40
+C	DT=.0625
+C	SAVPER=1
+`
+	// a third-order delay's step response reaches
+	// 1 - e^-3 (1 + 3 + 9/2) at T = DEL.
+	exact := 1 - math.Exp(-3)*(1+3+4.5)
+	f, _ := parseSrc(t, src)
+	for _, method := range []IntegrationMethod{Euler, RK4} {
+		ts, err := Simulate(f, SimulateOptions{IntegrationMethod: method})
+		if err != nil {
+			t.Fatalf("Simulate: %s", err)
+		}
+		out := ts.Vars["OUT"]
+		if out[1] != 0 {
+			t.Errorf("method %d: got OUT %g at the step, want 0", method, out[1])
+		}
+		if math.Abs(out[7]-exact) > .005 {
+			t.Errorf("method %d: got OUT %g at T = DEL, want %g", method, out[7], exact)
+		}
+		if math.Abs(out[40]-1) > 1e-3 {
+			t.Errorf("method %d: got OUT %g at the end, want 1", method, out[40])
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	const src = `* noise
+A	U.K=NOISE()
+A	N.K=NORMRN(10,2)
+C	LENGTH=10
+C	DT=1
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, src)
+	prog := genGo(t, f, fset)
+	a, b := runGo(t, prog, "-seed", "7"), runGo(t, prog, "-seed", "7")
+	if a != b {
+		t.Errorf("seed 7 gave different output:\n%s\nthen\n%s", a, b)
+	}
+	if c := runGo(t, prog, "-seed", "8"); c == a {
+		t.Errorf("seeds 7 and 8 gave the same output:\n%s", a)
+	}
+
+	// Simulate draws the same numbers as a program run without -seed
+	sim, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	gen, err := ParseCSV(strings.NewReader(runGo(t, prog)))
+	if err != nil {
+		t.Fatalf("ParseCSV: %s", err)
+	}
+	for _, name := range []string{"U", "N"} {
+		if len(sim.Vars[name]) != 11 || len(gen.Vars[name]) != 11 {
+			t.Errorf("%s: got %d and %d values, want 11", name, len(sim.Vars[name]), len(gen.Vars[name]))
+			continue
+		}
+		for i, v := range gen.Vars[name] {
+			if math.Abs(sim.Vars[name][i]-v) > 1e-9 {
+				t.Errorf("%s at TIME %g: Simulate gave %g, the program %g",
+					name, gen.Time[i], sim.Vars[name][i], v)
+			}
+		}
+	}
+}
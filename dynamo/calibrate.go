@@ -0,0 +1,326 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"sort"
+	"strings"
+)
+
+// CalibrationOptions control the fitting of a model's constants to
+// observed data.
+type CalibrationOptions struct {
+	// TargetVars names the variables compared with the observed
+	// data.  If it is empty, they're all the observed variables.
+	TargetVars []string
+
+	// ParamBounds gives the lowest and highest value a constant
+	// may take, by name.  Constants without bounds are free.
+	ParamBounds map[string][2]float64
+
+	// MaxIter is the most simulations that are run; 1000 if zero.
+	MaxIter int
+
+	// Tolerance is the difference between the best and worst
+	// errors of the simplex below which the fit stops; 1e-10 if
+	// zero.
+	Tolerance float64
+}
+
+// A Calibration is the result of fitting a model's constants.
+type Calibration struct {
+	Params map[string]float64 // the best fit, by upper-cased name
+	MSE    float64            // the mean squared error at Params
+	Evals  int                // the number of simulations run
+}
+
+// ParameterEstimation parses the DYNAMO model src and returns the
+// values of the constants named by params that best fit it to
+// observed, as Calibrate does with the default options.
+func ParameterEstimation(src string, observed TimeSeries, params []string) (map[string]float64, error) {
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Calibrate(f, observed, params, CalibrationOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return c.Params, nil
+}
+
+// Calibrate finds the values of the constants of the model named
+// main in f named by params that minimize the mean squared error
+// between its simulation and observed, over each target variable at
+// each observed time.  Simulated values between save steps are
+// interpolated linearly.  The search is a Nelder-Mead simplex,
+// starting from the constants' values in f and kept within their
+// bounds; it finds a local minimum, so a starting point near the
+// fit helps.
+func Calibrate(f *File, observed TimeSeries, params []string, opts CalibrationOptions) (Calibration, error) {
+	var c Calibration
+	if len(params) == 0 {
+		return c, fmt.Errorf("no parameters to calibrate")
+	}
+	if opts.MaxIter <= 0 {
+		opts.MaxIter = 1000
+	}
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = 1e-10
+	}
+	targets := append([]string(nil), opts.TargetVars...)
+	if len(targets) == 0 {
+		for name := range observed.Vars {
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
+	}
+	if len(targets) == 0 {
+		return c, fmt.Errorf("no observed variables")
+	}
+	obs := make(map[string][]float64, len(targets))
+	for i, name := range targets {
+		vals, ok := observed.Vars[name]
+		if !ok {
+			return c, fmt.Errorf("no observations of %s", name)
+		}
+		if len(vals) != len(observed.Time) {
+			return c, fmt.Errorf("%s has %d observations for %d times", name, len(vals), len(observed.Time))
+		}
+		targets[i] = strings.ToUpper(name)
+		obs[targets[i]] = vals
+	}
+
+	// the starting point, within bounds
+	main := f.GetModel("main")
+	if main == nil {
+		return c, fmt.Errorf("no model named main")
+	}
+	consts := map[string]float64{}
+	for _, s := range main.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		if ty := assign.Lhs.Type.Name; ty == "const" || ty == "external" {
+			if v, err := constEval(assign.Rhs); err == nil {
+				consts[strings.ToUpper(assign.Lhs.Name.Name)] = v
+			}
+		}
+	}
+	names := make([]string, len(params))
+	x0 := make([]float64, len(params))
+	bounds := make([][2]float64, len(params))
+	for i, p := range params {
+		names[i] = strings.ToUpper(p)
+		v, ok := consts[names[i]]
+		if !ok {
+			return c, fmt.Errorf("%s isn't a constant", names[i])
+		}
+		bounds[i] = [2]float64{math.Inf(-1), math.Inf(1)}
+		for n, b := range opts.ParamBounds {
+			if strings.ToUpper(n) == names[i] {
+				if !(b[0] <= b[1]) {
+					return c, fmt.Errorf("%s has bounds %g > %g", names[i], b[0], b[1])
+				}
+				bounds[i] = b
+			}
+		}
+		if v < bounds[i][0] || v > bounds[i][1] {
+			v = (bounds[i][0] + bounds[i][1]) / 2
+		}
+		x0[i] = v
+	}
+	clamp := func(x []float64) {
+		for i := range x {
+			x[i] = math.Max(bounds[i][0], math.Min(bounds[i][1], x[i]))
+		}
+	}
+
+	// mse simulates the model at x, returning +Inf if it fails
+	var firstErr error
+	mse := func(x []float64) float64 {
+		c.Evals++
+		set := make(map[string]float64, len(x))
+		for i, v := range x {
+			set[names[i]] = v
+		}
+		g, err := withParams(f, set)
+		if err != nil {
+			return math.Inf(1)
+		}
+		ts, err := Simulate(g, SimulateOptions{OutputVars: targets})
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return math.Inf(1)
+		}
+		sum, n := 0.0, 0
+		for _, name := range targets {
+			for i, t := range observed.Time {
+				o := obs[name][i]
+				if math.IsNaN(o) {
+					continue
+				}
+				v, ok := interpolate(ts.Time, ts.Vars[name], t)
+				if !ok {
+					continue
+				}
+				sum += (v - o) * (v - o)
+				n++
+			}
+		}
+		if n == 0 || math.IsNaN(sum) {
+			return math.Inf(1)
+		}
+		return sum / float64(n)
+	}
+
+	best, fx := nelderMead(mse, x0, clamp, opts.MaxIter, opts.Tolerance)
+	if math.IsInf(fx, 1) {
+		if firstErr != nil {
+			return c, firstErr
+		}
+		return c, fmt.Errorf("no observed times are within the simulation")
+	}
+	c.Params = make(map[string]float64, len(best))
+	for i, v := range best {
+		c.Params[names[i]] = v
+	}
+	c.MSE = fx
+	return c, nil
+}
+
+// interpolate returns the value of vals, at the increasing times
+// ts, at time t, or false if t is outside them.
+func interpolate(ts, vals []float64, t float64) (float64, bool) {
+	near := func(u float64) bool { return math.Abs(u-t) <= 1e-9*math.Max(1, math.Abs(t)) }
+	i := sort.SearchFloat64s(ts, t)
+	switch {
+	case i < len(ts) && near(ts[i]):
+		return vals[i], true
+	case i > 0 && near(ts[i-1]):
+		return vals[i-1], true
+	case i == 0 || i == len(ts):
+		return 0, false
+	}
+	w := (t - ts[i-1]) / (ts[i] - ts[i-1])
+	return vals[i-1] + w*(vals[i]-vals[i-1]), true
+}
+
+// nelderMead minimizes fn from x0 with the Nelder-Mead simplex
+// method, keeping each point it tries within bounds with clamp.  It
+// stops once the values at the simplex's points are within tol of
+// each other, or fn has been called maxEvals times, and returns the
+// best point and its value.  Points past maxEvals, even those of
+// the starting simplex, are taken as +Inf without calling fn.
+func nelderMead(fn func([]float64) float64, x0 []float64, clamp func([]float64), maxEvals int, tol float64) ([]float64, float64) {
+	const (
+		reflect  = 1
+		expand   = 2
+		contract = 0.5
+		shrink   = 0.5
+	)
+	n := len(x0)
+	evals := 0
+	eval := func(x []float64) float64 {
+		if evals >= maxEvals {
+			return math.Inf(1)
+		}
+		evals++
+		return fn(x)
+	}
+	pts := make([][]float64, n+1)
+	vals := make([]float64, n+1)
+	pts[0] = append([]float64(nil), x0...)
+	clamp(pts[0])
+	vals[0] = eval(pts[0])
+	for i := 0; i < n; i++ {
+		p := append([]float64(nil), pts[0]...)
+		step := 0.05 * math.Abs(p[i])
+		if step == 0 {
+			step = 0.00025
+		}
+		p[i] += step
+		clamp(p)
+		if p[i] == pts[0][i] {
+			p[i] -= 2 * step
+			clamp(p)
+		}
+		pts[i+1] = p
+		vals[i+1] = eval(p)
+	}
+
+	point := func(c []float64, coef float64, x []float64) []float64 {
+		p := make([]float64, n)
+		for i := range p {
+			p[i] = c[i] + coef*(x[i]-c[i])
+		}
+		clamp(p)
+		return p
+	}
+	for evals < maxEvals {
+		sort.Sort(simplex{pts, vals})
+		if math.Abs(vals[n]-vals[0]) <= tol {
+			break
+		}
+		// the centroid of all but the worst point
+		c := make([]float64, n)
+		for _, p := range pts[:n] {
+			for i, v := range p {
+				c[i] += v / float64(n)
+			}
+		}
+		r := point(c, -reflect, pts[n])
+		fr := eval(r)
+		switch {
+		case fr < vals[0]:
+			e := point(c, -expand, pts[n])
+			if fe := eval(e); fe < fr {
+				pts[n], vals[n] = e, fe
+			} else {
+				pts[n], vals[n] = r, fr
+			}
+		case fr < vals[n-1]:
+			pts[n], vals[n] = r, fr
+		default:
+			// contract towards the better of r and the worst
+			toward, ft := pts[n], vals[n]
+			if fr < ft {
+				toward, ft = r, fr
+			}
+			k := point(c, contract, toward)
+			if fk := eval(k); fk < ft {
+				pts[n], vals[n] = k, fk
+				break
+			}
+			for j := 1; j <= n && evals < maxEvals; j++ {
+				pts[j] = point(pts[0], shrink, pts[j])
+				vals[j] = eval(pts[j])
+			}
+		}
+	}
+	sort.Sort(simplex{pts, vals})
+	return pts[0], vals[0]
+}
+
+// A simplex sorts the points of a Nelder-Mead simplex by their
+// values.
+type simplex struct {
+	pts  [][]float64
+	vals []float64
+}
+
+func (s simplex) Len() int           { return len(s.vals) }
+func (s simplex) Less(i, j int) bool { return s.vals[i] < s.vals[j] }
+func (s simplex) Swap(i, j int) {
+	s.pts[i], s.pts[j] = s.pts[j], s.pts[i]
+	s.vals[i], s.vals[j] = s.vals[j], s.vals[i]
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// noisy returns the variables vars of the model src simulated with
+// the constants params, each value with 5% Gaussian noise.
+func noisy(t *testing.T, src string, params map[string]float64, vars ...string) TimeSeries {
+	f, _ := parseSrc(t, src)
+	f, err := withParams(f, params)
+	if err != nil {
+		t.Fatalf("withParams: %s", err)
+	}
+	ts, err := Simulate(f, SimulateOptions{OutputVars: vars})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for _, vals := range ts.Vars {
+		for i := range vals {
+			vals[i] *= 1 + .05*r.NormFloat64()
+		}
+	}
+	return ts
+}
+
+func TestCalibrate(t *testing.T) {
+	// births identify NB, and the population NB-ND
+	truth := map[string]float64{"NB": .05, "ND": .02}
+	observed := noisy(t, growth, truth, "B", "POP")
+
+	// growth starts from NB .04 and ND .01
+	f, _ := parseSrc(t, growth)
+	c, err := Calibrate(f, observed, []string{"NB", "nd"}, CalibrationOptions{})
+	if err != nil {
+		t.Fatalf("Calibrate: %s", err)
+	}
+	for name, want := range truth {
+		if got := c.Params[name]; math.Abs(got-want) > .1*want {
+			t.Errorf("%s: got %g, want within 10%% of %g", name, got, want)
+		}
+	}
+	if c.MSE <= 0 || c.Evals == 0 || c.Evals > 1000 {
+		t.Errorf("got MSE %g after %d simulations", c.MSE, c.Evals)
+	}
+
+	// the fit is better than the start, found with a single
+	// simulation
+	start, err := Calibrate(f, observed, []string{"NB", "ND"}, CalibrationOptions{MaxIter: 1})
+	if err != nil {
+		t.Fatalf("Calibrate: %s", err)
+	}
+	if start.Evals != 1 || start.Params["NB"] != .04 || start.Params["ND"] != .01 {
+		t.Errorf("MaxIter 1: got %v after %d simulations, want the start after 1", start.Params, start.Evals)
+	}
+	if c.MSE >= start.MSE {
+		t.Errorf("got MSE %g, no better than %g at the start", c.MSE, start.MSE)
+	}
+
+	// bounds hold the fit away from the truth
+	c, err = Calibrate(f, observed, []string{"NB", "ND"}, CalibrationOptions{
+		TargetVars:  []string{"POP"},
+		ParamBounds: map[string][2]float64{"NB": {0, .045}},
+		MaxIter:     200,
+	})
+	if err != nil {
+		t.Fatalf("Calibrate: %s", err)
+	}
+	if c.Params["NB"] > .045 || c.Evals > 200 {
+		t.Errorf("got NB %g after %d simulations, want at most .045 after at most 200", c.Params["NB"], c.Evals)
+	}
+
+	params, err := ParameterEstimation(growth, observed, []string{"NB", "ND"})
+	if err != nil {
+		t.Fatalf("ParameterEstimation: %s", err)
+	}
+	if math.Abs(params["NB"]-.05) > .005 {
+		t.Errorf("ParameterEstimation: got NB %g, want about .05", params["NB"])
+	}
+}
+
+func TestCalibrateErrors(t *testing.T) {
+	f, _ := parseSrc(t, growth)
+	observed := TimeSeries{Time: []float64{0, 1}, Vars: map[string][]float64{"POP": {100, 103}}}
+	tests := []struct {
+		params []string
+		opts   CalibrationOptions
+		err    string
+	}{
+		{nil, CalibrationOptions{}, "no parameters"},
+		{[]string{"POP"}, CalibrationOptions{}, "POP"},
+		{[]string{"NB"}, CalibrationOptions{TargetVars: []string{"B"}}, "no observations of B"},
+	}
+	for _, test := range tests {
+		if _, err := Calibrate(f, observed, test.params, test.opts); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got error %v, want %s", test.params, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"strings"
+)
+
+// constants returns the values of m's constants that can be
+// evaluated at compile time, indexed by upper-cased name.
+func constants(m *ModelDecl) map[string]float64 {
+	consts := map[string]float64{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Type.Name != "const" {
+			continue
+		}
+		if v, err := constEval(assign.Rhs); err == nil {
+			consts[strings.ToUpper(assign.Lhs.Name.Name)] = v
+		}
+	}
+	return consts
+}
+
+// foldConst returns the value of e if it is made up only of literals,
+// the given constants and arithmetic on them.
+func foldConst(e Expr, consts map[string]float64) (float64, bool) {
+	switch x := stripUnits(e).(type) {
+	case *BasicLit:
+		v, err := constEval(x)
+		return v, err == nil
+	case *Ident:
+		v, ok := consts[strings.ToUpper(x.Name)]
+		return v, ok
+	case *RefExpr:
+		v, ok := consts[strings.ToUpper(x.Name)]
+		return v, ok
+	case *SubscriptExpr:
+		return foldConst(x.Base, consts)
+	case *ParenExpr:
+		return foldConst(x.X, consts)
+	case *UnaryExpr:
+		v, ok := foldConst(x.X, consts)
+		if x.Op == token.SUB {
+			v = -v
+		}
+		return v, ok
+	case *BinaryExpr:
+		l, ok := foldConst(x.X, consts)
+		if !ok {
+			return 0, false
+		}
+		r, ok := foldConst(x.Y, consts)
+		if !ok {
+			return 0, false
+		}
+		switch x.Op {
+		case token.ADD:
+			return l + r, true
+		case token.SUB:
+			return l - r, true
+		case token.MUL:
+			return l * r, true
+		case token.QUO:
+			if r == 0 {
+				return 0, false
+			}
+			return l / r, true
+		case token.XOR:
+			return math.Pow(l, r), true
+		}
+	}
+	return 0, false
+}
+
+// checkDivZero reports each division in m whose denominator is, or
+// folds to, the constant zero.  Denominators that depend on levels,
+// rates or auxiliaries are left for the simulation to deal with.
+func checkDivZero(m *ModelDecl, fset *token.FileSet, h ErrorHandler) {
+	consts := constants(m)
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		Inspect(assign.Rhs, func(n Node) bool {
+			div, ok := n.(*BinaryExpr)
+			if !ok || div.Op != token.QUO {
+				return true
+			}
+			if v, ok := foldConst(div.Y, consts); ok && v == 0 {
+				msg := fmt.Sprintf("%s: division by zero", assign.Lhs.Name.Name)
+				if _, ok := stripUnits(div.Y).(*BasicLit); !ok {
+					msg += fmt.Sprintf(" (%s is 0)", exprString(div.Y))
+				}
+				h.Error(fset.Position(div.Y.Pos()), msg)
+			}
+			return true
+		})
+	}
+}
+
+// declSubscripts maps each type of variable to the time subscript
+// its name carries on the left of its equation.  Initial values,
+// constants and tables are computed once, and take none.
+var declSubscripts = map[string]string{
+	"stock":         "K",
+	"flow":          "KL",
+	"aux":           "K",
+	"supplementary": "K",
+	"initial":       "",
+	"const":         "",
+	"external":      "",
+	"table":         "",
+}
+
+// refSubscript returns the time subscript a reference to a variable
+// of type ref takes in an equation of type eqn.  A level equation
+// moves its level from J to K, so references levels and auxiliaries
+// at J; auxiliaries and rates are computed at K.  Both see the rates
+// over the interval JK just past.
+func refSubscript(eqn, ref string) string {
+	if declSubscripts[eqn] == "" || declSubscripts[ref] == "" {
+		return ""
+	}
+	switch {
+	case ref == "flow":
+		return "JK"
+	case eqn == "stock":
+		return "J"
+	}
+	return "K"
+}
+
+// checkSubscripts reports each time subscript in m that doesn't
+// match the type of its equation or of the variable it's on.
+// References without a subscript are allowed, as are references to
+// TIME, which DYNAMO provides at K to every equation.
+func checkSubscripts(m *ModelDecl, fset *token.FileSet, h ErrorHandler) {
+	// an N card gives the initial value of the level of the same
+	// name, which references to the name are to.
+	types := map[string]string{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		if _, ok := types[name]; !ok || assign.Lhs.Type.Name != "initial" {
+			types[name] = assign.Lhs.Type.Name
+		}
+	}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		d := assign.Lhs
+		if want := declSubscripts[d.Type.Name]; d.Sub != "" && d.Sub != want {
+			h.Error(fset.Position(d.Name.Pos()), subscriptMsg(d.Name.Name, d.Name.Name, d.Sub, want))
+		}
+		Inspect(assign.Rhs, func(n Node) bool {
+			x, ok := n.(*SubscriptExpr)
+			if !ok {
+				return true
+			}
+			name := strings.ToUpper(x.Base.Name)
+			ty, ok := types[name]
+			if !ok || name == "TIME" {
+				return false
+			}
+			if want := refSubscript(d.Type.Name, ty); x.Sub != want {
+				h.Error(fset.Position(x.Pos()), subscriptMsg(d.Name.Name, x.Base.Name, x.Sub, want))
+			}
+			return false
+		})
+	}
+}
+
+// subscriptMsg describes the subscript sub on name, in the equation
+// for eqn, where want was expected.
+func subscriptMsg(eqn, name, sub, want string) string {
+	if want == "" {
+		return fmt.Sprintf("%s: %s.%s takes no time subscript", eqn, name, sub)
+	}
+	return fmt.Sprintf("%s: %s.%s should be %s.%s", eqn, name, sub, name, want)
+}
+
+// DiagSeverity is how serious a Diagnostic is.
+type DiagSeverity int
+
+// An Error keeps a model from being simulated correctly; a Warning
+// points out something that is allowed but probably a mistake.  The
+// names are prefixed to stay clear of the Error type.
+const (
+	SeverityError DiagSeverity = iota
+	SeverityWarning
+)
+
+var severityStrings = [...]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+}
+
+func (s DiagSeverity) String() string { return severityStrings[s] }
+
+// A Diagnostic is a problem found by Check.  Code identifies the
+// check that found it, for tools that want to filter or look up
+// diagnostics without matching on Msg.  Pos is NoPos for problems
+// with the timespec, which has no position of its own.
+type Diagnostic struct {
+	Pos      token.Pos
+	Severity DiagSeverity
+	Code     string
+	Msg      string
+}
+
+// lookupFuncs are the functions taking a table as their first
+// argument.
+var lookupFuncs = map[string]bool{
+	"TABHL": true,
+}
+
+// Check returns the semantic problems in f's models, in the order
+// they appear:
+//
+//	undeclared    a reference to a variable that isn't declared
+//	flow-ref      a rate referenced outside a level or supplementary
+//	              equation (a warning, as rates can be read at JK)
+//	supplementary-ref
+//	              a supplementary referenced outside another
+//	              supplementary's equation; supplementaries are only
+//	              computed for output
+//	table-ref     a table used other than as the first argument of
+//	              a TABHL, or named on a PRINT or PLOT card
+//	initial       an initial value referencing an auxiliary, rate
+//	              or supplementary, which have no value yet
+//	boolean       a comparison used as a TABHL input or as an
+//	              operand of arithmetic, where a number is meant
+//	timespec      a DT that isn't positive, a LENGTH not after the
+//	              start time, or a SAVPER smaller than DT
+//
+// TIME and DT are always declared, as is any name found in scope,
+// which may be nil.
+func Check(f *File, scope *Scope) []Diagnostic {
+	var diags []Diagnostic
+	for _, d := range f.Decls {
+		m, ok := d.(*ModelDecl)
+		if !ok || m.Body == nil {
+			continue
+		}
+		diags = append(diags, checkModel(m, scope)...)
+	}
+	return diags
+}
+
+// checkModel returns the problems Check finds in m.
+func checkModel(m *ModelDecl, scope *Scope) []Diagnostic {
+	var diags []Diagnostic
+	report := func(pos token.Pos, sev DiagSeverity, code, format string, args ...interface{}) {
+		diags = append(diags, Diagnostic{pos, sev, code, fmt.Sprintf(format, args...)})
+	}
+
+	types := map[string]string{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Name.Name == "timespec" {
+			continue
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		ty := assign.Lhs.Type.Name
+		if ty == "table" && isLookup(assign.Rhs) {
+			ty = "lookup"
+		}
+		if _, ok := types[name]; !ok || ty != "initial" {
+			types[name] = ty
+		}
+	}
+
+	// ref checks a reference to id, made in an equation of type
+	// eqn.  arg is true if id is a table argument of a lookup.
+	ref := func(eqn string, id *Ident, arg bool) {
+		name := strings.ToUpper(id.Name)
+		ty, ok := types[name]
+		switch {
+		case name == "TIME" || name == "DT":
+		case !ok:
+			if scope == nil || scope.Lookup(name) == nil {
+				report(id.Pos(), SeverityError, "undeclared", "undeclared: %s", id.Name)
+			}
+		case ty == "table" && !arg:
+			report(id.Pos(), SeverityError, "table-ref", "table %s used outside of TABHL", id.Name)
+		case eqn == "initial" && (ty == "aux" || ty == "flow" || ty == "supplementary" || ty == "lookup"):
+			report(id.Pos(), SeverityError, "initial", "initial value references %s %s", ty, id.Name)
+		case eqn == "output":
+			// PRINT and PLOT may name any variable
+		case ty == "flow" && eqn != "stock" && eqn != "supplementary":
+			report(id.Pos(), SeverityWarning, "flow-ref", "rate %s referenced in %s equation", id.Name, eqn)
+		case ty == "supplementary" && eqn != "supplementary":
+			report(id.Pos(), SeverityError, "supplementary-ref", "supplementary %s referenced in %s equation", id.Name, eqn)
+		}
+	}
+
+	var refs func(eqn string, e Expr)
+	refs = func(eqn string, e Expr) {
+		Inspect(e, func(n Node) bool {
+			switch x := n.(type) {
+			case *CallExpr:
+				for i, arg := range x.Args {
+					if id, ok := stripUnits(arg).(*Ident); ok && i == 0 && lookupFuncs[funcName(x)] {
+						ref(eqn, id, true)
+						continue
+					}
+					refs(eqn, arg)
+				}
+				return false
+			case *UnitExpr:
+				refs(eqn, x.X)
+				return false
+			case *KeyValueExpr:
+				// the parts of a stock built by a
+				// ModelBuilder
+				if k, _, err := kvConvert(x); err == nil && k == "initial" {
+					refs("initial", x.Value)
+				} else {
+					refs(eqn, x.Value)
+				}
+				return false
+			case *Ident:
+				ref(eqn, x, false)
+			case *RefExpr:
+				ref(eqn, &x.Ident, false)
+			case *SubscriptExpr:
+				ref(eqn, x.Base, false)
+				return false
+			}
+			return true
+		})
+	}
+	// boolean checks that e, used where a number is meant, isn't a
+	// comparison; use describes where.
+	boolean := func(e Expr, use string) {
+		if x, ok := stripParens(e).(*BinaryExpr); ok && isComparison(x.Op) {
+			report(e.Pos(), SeverityError, "boolean", "comparison %s used as %s", exprString(e), use)
+		}
+	}
+	for _, s := range m.Body.List {
+		switch x := s.(type) {
+		case *AssignStmt:
+			if x.Lhs.Type != nil && x.Lhs.Name.Name != "timespec" {
+				refs(x.Lhs.Type.Name, x.Rhs)
+				Inspect(x.Rhs, func(n Node) bool {
+					switch y := n.(type) {
+					case *BinaryExpr:
+						switch y.Op {
+						case token.ADD, token.SUB, token.MUL, token.QUO, token.XOR:
+							boolean(y.X, "an operand of "+y.Op.String())
+							boolean(y.Y, "an operand of "+y.Op.String())
+						}
+					case *UnaryExpr:
+						boolean(y.X, "an operand of "+y.Op.String())
+					case *CallExpr:
+						if name := funcName(y); lookupFuncs[name] && len(y.Args) > 1 {
+							boolean(y.Args[1], name+" input")
+						}
+					}
+					return true
+				})
+			}
+		case *OutputStmt:
+			for _, id := range x.Names {
+				ref("output", id, false)
+			}
+		}
+	}
+
+	if timespecStmt(m) == nil {
+		return diags
+	}
+	ts, err := m.Timespec()
+	switch {
+	case err != nil:
+		report(token.NoPos, SeverityError, "timespec", "%s", err)
+	case ts.DT <= 0:
+		report(token.NoPos, SeverityError, "timespec", "DT is %g, must be positive", ts.DT)
+	case ts.End <= ts.Start:
+		report(token.NoPos, SeverityError, "timespec", "LENGTH %g isn't after the start time %g", ts.End, ts.Start)
+	case ts.SaveStep < ts.DT:
+		report(token.NoPos, SeverityError, "timespec", "SAVPER %g is less than DT %g", ts.SaveStep, ts.DT)
+	}
+	return diags
+}
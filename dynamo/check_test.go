@@ -0,0 +1,102 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestDivZero(t *testing.T) {
+	tests := []struct {
+		eqns string
+		err  string // or empty if there should be none
+	}{
+		{"A X.K=1/0", "X: division by zero"},
+		{"A X.K=1/C\nC C=0", "X: division by zero (C is 0)"},
+		{"A X.K=1/(C-1)\nC C=1", "X: division by zero ((C-1) is 0)"},
+		{"A X.K=1/C\nC C=2", ""},
+		{"A X.K=1/Y.K\nA Y.K=0", ""},
+	}
+	for _, test := range tests {
+		src := "* div\n" + test.eqns + "\n"
+		fset := token.NewFileSet()
+		_, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %s", test.eqns, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: got error %v, want %s", test.eqns, err, test.err)
+		}
+	}
+}
+
+func TestCheckOutputCards(t *testing.T) {
+	tests := []struct {
+		eqns string
+		code string // or empty if there should be no diagnostic
+	}{
+		{"S R.K=X.K*2\nA X.K=TIME.K\nPRINT R,X", ""},
+		{"S R.K=X.K*2\nA X.K=TIME.K\nA Y.K=R.K+1", "supplementary-ref"},
+		{"S R.K=X.K*2\nS Q.K=R.K+1\nA X.K=TIME.K", ""},
+		{"A X.K=TIME.K\nPLOT X=X(0,10)/Z", "undeclared"},
+		{"A X.K=TABHL(T,TIME.K,0,1,1)\nT T=1/2\nPRINT T", "table-ref"},
+	}
+	for _, test := range tests {
+		f, _ := parseSrc(t, "* output\n"+test.eqns+"\nC LENGTH=1\n")
+		var codes []string
+		for _, d := range Check(f, nil) {
+			codes = append(codes, d.Code)
+		}
+		if got := strings.Join(codes, ","); got != test.code {
+			t.Errorf("%q: got diagnostics %q, want %q", test.eqns, got, test.code)
+		}
+	}
+}
+
+// TestCheckBoolean checks that comparisons used where a number is
+// meant are reported at the comparison.
+func TestCheckBoolean(t *testing.T) {
+	tests := []struct {
+		eqn string
+		msg string // or empty if there should be no diagnostic
+	}{
+		{"A Y.K=TABHL(T,X.K>1,0,1,1)", "comparison X.K>1 used as TABHL input"},
+		{"A Y.K=(X.K>1)*2", "comparison (X.K>1) used as an operand of *"},
+		{"A Y.K=3-(X.K<>1)", "comparison (X.K<>1) used as an operand of -"},
+		{"A Y.K=X.K>1", ""},
+		{"A Y.K=IF X.K>1 THEN 1 ELSE 2", ""},
+		{"A Y.K=TABHL(T,X.K+1,0,1,1)", ""},
+	}
+	for _, test := range tests {
+		f, fset := parseSrc(t, "* boolean\n"+test.eqn+"\nA X.K=TIME.K\nT T=1/2\nC LENGTH=1\n")
+		var msgs []string
+		for _, d := range Check(f, nil) {
+			msgs = append(msgs, d.Msg)
+			if d.Code != "boolean" {
+				continue
+			}
+			// the comparison is the node in Y's equation
+			// that the message quotes
+			var cmp Expr
+			Inspect(f.GetModel("main").Body.List[0].(*AssignStmt).Rhs, func(n Node) bool {
+				switch x := n.(type) {
+				case *ParenExpr, *BinaryExpr:
+					if cmp == nil && strings.Contains(test.msg, exprString(x.(Expr))+" used") {
+						cmp = x.(Expr)
+					}
+				}
+				return cmp == nil
+			})
+			if cmp == nil || d.Pos != cmp.Pos() {
+				t.Errorf("%q: reported at %s, want the comparison", test.eqn, fset.Position(d.Pos))
+			}
+		}
+		if got := strings.Join(msgs, "; "); got != test.msg {
+			t.Errorf("%q: got diagnostics %q, want %q", test.eqn, got, test.msg)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+)
+
+// A cloner copies the nodes of a File, keeping one copy of each
+// comment group so that a declaration's Doc is still one of the
+// File's Comments.
+type cloner struct {
+	groups map[*CommentGroup]*CommentGroup
+}
+
+func (c *cloner) group(g *CommentGroup) *CommentGroup {
+	if g == nil {
+		return nil
+	}
+	if cg, ok := c.groups[g]; ok {
+		return cg
+	}
+	cg := &CommentGroup{List: make([]*Comment, len(g.List))}
+	for i, com := range g.List {
+		cc := *com
+		cg.List[i] = &cc
+	}
+	c.groups[g] = cg
+	return cg
+}
+
+func (c *cloner) ident(id *Ident) *Ident {
+	if id == nil {
+		return nil
+	}
+	cid := *id
+	return &cid
+}
+
+func (c *cloner) basicLit(lit *BasicLit) *BasicLit {
+	if lit == nil {
+		return nil
+	}
+	// the copy parses its Value afresh, rather than sharing the
+	// original's cache and the lock guarding it
+	return &BasicLit{ValuePos: lit.ValuePos, Kind: lit.Kind, Value: lit.Value}
+}
+
+// node returns a shallow copy of n, with its slices and the nodes
+// Apply doesn't visit copied too.  Apply then replaces the copy's
+// children with copies of their own.
+func (c *cloner) node(n Node) Node {
+	switch x := n.(type) {
+	case *Field:
+		cx := *x
+		cx.Doc, cx.Comment = c.group(x.Doc), c.group(x.Comment)
+		cx.Names = append([]*Ident(nil), x.Names...)
+		return &cx
+	case *FieldList:
+		cx := *x
+		cx.List = append([]*Field(nil), x.List...)
+		return &cx
+	case *BadExpr:
+		cx := *x
+		return &cx
+	case *Ident:
+		return c.ident(x)
+	case *BasicLit:
+		return c.basicLit(x)
+	case *CompositeLit:
+		cx := *x
+		cx.Elts = append([]Expr(nil), x.Elts...)
+		return &cx
+	case *ParenExpr:
+		cx := *x
+		return &cx
+	case *SelectorExpr:
+		cx := *x
+		return &cx
+	case *IndexExpr:
+		cx := *x
+		return &cx
+	case *CallExpr:
+		cx := *x
+		cx.Args = append([]Expr(nil), x.Args...)
+		return &cx
+	case *UnaryExpr:
+		cx := *x
+		return &cx
+	case *PairExpr:
+		cx := *x
+		return &cx
+	case *BinaryExpr:
+		cx := *x
+		return &cx
+	case *UnitExpr:
+		cx := *x
+		return &cx
+	case *RefExpr:
+		cx := *x
+		return &cx
+	case *IfExpr:
+		cx := *x
+		return &cx
+	case *SubscriptExpr:
+		cx := *x
+		return &cx
+	case *KeyValueExpr:
+		cx := *x
+		return &cx
+	case *TableExpr:
+		cx := *x
+		cx.Pairs = append([]*PairExpr(nil), x.Pairs...)
+		return &cx
+	case *TableFwdExpr:
+		cx := *x
+		cx.Ys = append([]*BasicLit(nil), x.Ys...)
+		return &cx
+	case *InterfaceType:
+		cx := *x
+		return &cx
+	case *BadStmt:
+		cx := *x
+		return &cx
+	case *DeclStmt:
+		cx := *x
+		return &cx
+	case *EmptyStmt:
+		cx := *x
+		return &cx
+	case *ExprStmt:
+		cx := *x
+		return &cx
+	case *AssignStmt:
+		cx := *x
+		return &cx
+	case *SpecStmt:
+		cx := *x
+		cx.Elts = append([]Expr(nil), x.Elts...)
+		return &cx
+	case *OutputStmt:
+		cx := *x
+		cx.Names = append([]*Ident(nil), x.Names...)
+		return &cx
+	case *BlockStmt:
+		cx := *x
+		cx.List = append([]Stmt(nil), x.List...)
+		return &cx
+	case *ImportSpec:
+		cx := *x
+		cx.Doc, cx.Comment = c.group(x.Doc), c.group(x.Comment)
+		return &cx
+	case *BadDecl:
+		cx := *x
+		return &cx
+	case *GenDecl:
+		cx := *x
+		cx.Doc = c.group(x.Doc)
+		cx.Specs = append([]Spec(nil), x.Specs...)
+		return &cx
+	case *VarDecl:
+		cx := *x
+		cx.Doc = c.group(x.Doc)
+		return &cx
+	case *InterfaceDecl:
+		cx := *x
+		cx.Doc = c.group(x.Doc)
+		cx.Name, cx.Super = c.ident(x.Name), c.ident(x.Super)
+		return &cx
+	case *ModelDecl:
+		cx := *x
+		cx.Doc = c.group(x.Doc)
+		cx.Name, cx.Super = c.ident(x.Name), c.ident(x.Super)
+		cx.Units = c.basicLit(x.Units)
+		cx.Objects = nil
+		return &cx
+	case *MacroDecl:
+		cx := *x
+		cx.Doc = c.group(x.Doc)
+		cx.Params = append([]*Ident(nil), x.Params...)
+		return &cx
+	case *File:
+		cx := *x
+		cx.Doc = c.group(x.Doc)
+		cx.Name = c.ident(x.Name)
+		cx.Decls = append([]Decl(nil), x.Decls...)
+		cx.Macros = append([]*MacroDecl(nil), x.Macros...)
+		cx.Imports = append([]*ImportSpec(nil), x.Imports...)
+		cx.Comments = make([]*CommentGroup, len(x.Comments))
+		for i, g := range x.Comments {
+			cx.Comments[i] = c.group(g)
+		}
+		cx.Scope, cx.Unresolved = nil, nil
+		return &cx
+	}
+	return n
+}
+
+// Clone returns a deep copy of f, sharing no nodes or slices with
+// it, so that the copy can be changed, as by Apply, leaving f as it
+// is.  The copy's models are resolved again, giving it scopes and
+// objects of its own.
+func Clone(f *File) *File {
+	if f == nil {
+		return nil
+	}
+	c := &cloner{groups: map[*CommentGroup]*CommentGroup{}}
+	clone := Apply(f, c.node, nil).(*File)
+	for _, d := range clone.Decls {
+		if m, ok := d.(*ModelDecl); ok && m.Body != nil {
+			// redeclarations were reported when f was
+			// parsed or built, so there are no errors to
+			// position
+			var errs ErrorVector
+			clone.Unresolved = append(clone.Unresolved, resolveModel(m, token.NewFileSet(), &errs)...)
+		}
+	}
+	return clone
+}
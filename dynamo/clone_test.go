@@ -0,0 +1,58 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	before := equations(f)
+	c := Clone(f)
+	if got := equations(c); !reflect.DeepEqual(got, before) {
+		t.Fatalf("clone has equations\n%v\nwant\n%v", got, before)
+	}
+
+	// no node of f is in the clone
+	nodes := map[Node]bool{}
+	Inspect(f, func(n Node) bool {
+		if n != nil {
+			nodes[n] = true
+		}
+		return true
+	})
+	Inspect(c, func(n Node) bool {
+		if n != nil && nodes[n] {
+			t.Errorf("%T %v is shared with the original", n, n)
+		}
+		return true
+	})
+
+	renamed, err := Rename(c, "POP", "PEOPLE")
+	if err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if _, ok := equations(renamed)["PEOPLE"]; !ok {
+		t.Errorf("the renamed clone has no PEOPLE")
+	}
+	// changing the clone in place leaves f alone
+	Apply(c, nil, func(n Node) Node {
+		if id, ok := n.(*Ident); ok && id.Name == "POP" {
+			id.Name = "PEOPLE"
+		}
+		return n
+	})
+	if _, ok := equations(c)["PEOPLE"]; !ok {
+		t.Errorf("Apply didn't rename POP in the clone")
+	}
+	if got := equations(f); !reflect.DeepEqual(got, before) {
+		t.Errorf("changing the clone changed f:\n%v\nwas\n%v", got, before)
+	}
+	if _, ok := equations(f)["POP"]; !ok {
+		t.Errorf("f no longer has POP")
+	}
+}
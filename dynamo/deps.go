@@ -0,0 +1,269 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"io"
+	"sort"
+	"strings"
+)
+
+// refNames returns the upper-cased names of the variables e refers
+// to.  Function names and units aren't variable references.
+func refNames(e Expr) []string {
+	var names []string
+	var refs func(e Expr)
+	refs = func(e Expr) {
+		Inspect(e, func(n Node) bool {
+			switch x := n.(type) {
+			case *CallExpr:
+				for _, arg := range x.Args {
+					refs(arg)
+				}
+				return false
+			case *UnitExpr:
+				refs(x.X)
+				return false
+			case *KeyValueExpr:
+				refs(x.Value)
+				return false
+			case *RefExpr:
+				names = append(names, strings.ToUpper(x.Name))
+			case *Ident:
+				names = append(names, strings.ToUpper(x.Name))
+			}
+			return true
+		})
+	}
+	refs(e)
+	return names
+}
+
+// isAux returns true if d declares a variable computed anew from
+// the others at each step, without a level or a rate in between.
+func isAux(d *VarDecl) bool {
+	return d.Type != nil && (d.Type.Name == "aux" || d.Type.Name == "supplementary")
+}
+
+// auxGraph returns the auxiliary equations in m by upper-cased name,
+// and for each the names of the auxiliaries it refers to.
+func auxGraph(m *ModelDecl) (map[string]*AssignStmt, map[string][]string) {
+	auxes := map[string]*AssignStmt{}
+	for _, s := range m.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && isAux(assign.Lhs) {
+			auxes[strings.ToUpper(assign.Lhs.Name.Name)] = assign
+		}
+	}
+	deps := map[string][]string{}
+	for n, assign := range auxes {
+		for _, ref := range refNames(assign.Rhs) {
+			if _, ok := auxes[ref]; ok {
+				deps[n] = append(deps[n], ref)
+			}
+		}
+		sort.Strings(deps[n])
+	}
+	return auxes, deps
+}
+
+// sortedKeys returns the names in auxes in order.
+func sortedKeys(auxes map[string]*AssignStmt) []string {
+	names := make([]string, 0, len(auxes))
+	for n := range auxes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A CycleError reports auxiliaries defined in terms of each other,
+// which can't be computed.  Path lists the variables in the cycle,
+// starting and ending with the same one, each referring to the next;
+// Pos is the position of the first one's declaration.
+type CycleError struct {
+	Pos  token.Pos
+	Path []string
+}
+
+func (e CycleError) Error() string {
+	return fmt.Sprintf("circular definition: %s", strings.Join(e.Path, " -> "))
+}
+
+// CheckCycles returns an error for each cycle of auxiliaries in f.
+// Levels break cycles, as a level's equation refers to its previous
+// value, so only auxiliaries, which DYNAMO computes in dependency
+// order, can't be part of one.
+func CheckCycles(f *File) []CycleError {
+	var cycles []CycleError
+	for _, d := range f.Decls {
+		if m, ok := d.(*ModelDecl); ok && m.Body != nil {
+			cycles = append(cycles, modelCycles(m)...)
+		}
+	}
+	return cycles
+}
+
+// modelCycles returns the cycles of auxiliaries in m, found with a
+// depth-first search.  Each cycle is reported once, starting from
+// the first of its variables the search reached.
+func modelCycles(m *ModelDecl) []CycleError {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	auxes, deps := auxGraph(m)
+	state := map[string]int{}
+	var stack []string
+	var cycles []CycleError
+
+	var visit func(n string)
+	visit = func(n string) {
+		state[n] = visiting
+		stack = append(stack, n)
+		for _, dep := range deps[n] {
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case visiting:
+				i := len(stack) - 1
+				for stack[i] != dep {
+					i--
+				}
+				path := append(append([]string(nil), stack[i:]...), dep)
+				cycles = append(cycles, CycleError{auxes[dep].Lhs.Name.Pos(), path})
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[n] = done
+	}
+	for _, n := range sortedKeys(auxes) {
+		if state[n] == unvisited {
+			visit(n)
+		}
+	}
+	return cycles
+}
+
+// TopoSort returns m's auxiliary equations ordered so that each comes
+// after those of the auxiliaries it refers to, as they must be
+// computed.  Equations already in order keep their source order.  If
+// the auxiliaries form a cycle, the error is a CycleError.
+func TopoSort(m *ModelDecl) ([]*AssignStmt, error) {
+	if cycles := modelCycles(m); len(cycles) > 0 {
+		return nil, cycles[0]
+	}
+	auxes, _ := auxGraph(m)
+	sorted := make([]*AssignStmt, 0, len(auxes))
+	visited := map[string]bool{}
+	var visit func(n string)
+	visit = func(n string) {
+		visited[n] = true
+		assign := auxes[n]
+		for _, ref := range refNames(assign.Rhs) {
+			if _, ok := auxes[ref]; ok && !visited[ref] {
+				visit(ref)
+			}
+		}
+		sorted = append(sorted, assign)
+	}
+	for _, s := range m.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && isAux(assign.Lhs) {
+			n := strings.ToUpper(assign.Lhs.Name.Name)
+			if !visited[n] && auxes[n] == assign {
+				visit(n)
+			}
+		}
+	}
+	return sorted, nil
+}
+
+// A DepNode is a variable in a DepGraph.  Type is the type of its
+// declaration, like stock, flow, aux or const.
+type DepNode struct {
+	Name, Type string
+}
+
+// A DepGraph is the graph of dependencies between a model's
+// variables.  Each edge is a pair of upper-cased variable names, the
+// first used in the equation of the second.
+type DepGraph struct {
+	Nodes []DepNode
+	Edges [][2]string
+}
+
+// BuildDepGraph returns the dependency graph of m's variables, in the
+// order they're declared.  A level and its N card are one node, with
+// the dependencies of both.  References to TIME and DT, to
+// undeclared names, and of a level to its own previous value aren't
+// edges.
+func BuildDepGraph(m *ModelDecl) *DepGraph {
+	g := new(DepGraph)
+	types := map[string]string{}
+	var assigns []*AssignStmt
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Name.Name == "timespec" {
+			continue
+		}
+		assigns = append(assigns, assign)
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		ty := assign.Lhs.Type.Name
+		if ty == "initial" {
+			ty = "stock"
+		}
+		if _, ok := types[name]; !ok {
+			g.Nodes = append(g.Nodes, DepNode{name, ty})
+		}
+		types[name] = ty
+	}
+
+	seen := map[[2]string]bool{}
+	for _, assign := range assigns {
+		to := strings.ToUpper(assign.Lhs.Name.Name)
+		for _, from := range refNames(assign.Rhs) {
+			e := [2]string{from, to}
+			if _, ok := types[from]; ok && from != to && !seen[e] {
+				seen[e] = true
+				g.Edges = append(g.Edges, e)
+			}
+		}
+	}
+	return g
+}
+
+// dotColors are the colors WriteDOT draws the types of variables in.
+var dotColors = map[string]string{
+	"stock": "blue",
+	"aux":   "green",
+	"flow":  "red",
+	"const": "gray",
+}
+
+// WriteDOT writes g to w as a Graphviz digraph, with levels in blue,
+// auxiliaries in green, rates in red and constants in gray.
+func (g *DepGraph) WriteDOT(w io.Writer) error {
+	if _, err := io.WriteString(w, "digraph model {\n"); err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		color := dotColors[n.Type]
+		if color == "" {
+			color = "black"
+		}
+		if _, err := fmt.Fprintf(w, "\t%q [color=%s];\n", n.Name, color); err != nil {
+			return err
+		}
+	}
+	for _, e := range g.Edges {
+		if _, err := fmt.Fprintf(w, "\t%q -> %q;\n", e[0], e[1]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "}\n")
+	return err
+}
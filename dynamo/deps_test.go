@@ -0,0 +1,63 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDepGraph(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	g := BuildDepGraph(f.Decls[0].(*ModelDecl))
+
+	var nodes []string
+	for _, n := range g.Nodes {
+		nodes = append(nodes, n.Name+" "+n.Type)
+	}
+	const wantNodes = "POP stock, POPN const, B flow, NB const, D flow, ND const"
+	if got := strings.Join(nodes, ", "); got != wantNodes {
+		t.Errorf("got nodes %s, want %s", got, wantNodes)
+	}
+	edges := map[[2]string]bool{}
+	for _, e := range g.Edges {
+		edges[e] = true
+	}
+	for _, e := range [][2]string{{"B", "POP"}, {"D", "POP"}, {"POPN", "POP"}, {"NB", "B"}, {"POP", "B"}, {"ND", "D"}, {"POP", "D"}} {
+		if !edges[e] {
+			t.Errorf("no edge %s -> %s", e[0], e[1])
+		}
+	}
+	if len(g.Edges) != 7 {
+		t.Errorf("got %d edges, want 7: %v", len(g.Edges), g.Edges)
+	}
+
+	var buf bytes.Buffer
+	if err := g.WriteDOT(&buf); err != nil {
+		t.Fatalf("WriteDOT: %s", err)
+	}
+	dot := buf.String()
+	want := []string{"digraph", `"POP" -> "B";`, `"NB" [color=gray];`}
+	for _, n := range []string{"POP", "B", "D"} {
+		want = append(want, fmt.Sprintf("%q [", n))
+	}
+	for _, w := range want {
+		if !strings.Contains(dot, w) {
+			t.Errorf("DOT doesn't contain %s:\n%s", w, dot)
+		}
+	}
+
+	// levels are blue, auxiliaries green and rates red
+	f, _ = parseSrc(t, "* colors\nL S.K=S.J+(DT)(R.JK)\nN S=0\nR R.KL=A.K\nA A.K=S.K+1\n")
+	buf.Reset()
+	BuildDepGraph(f.Decls[0].(*ModelDecl)).WriteDOT(&buf)
+	for _, w := range []string{`"S" [color=blue];`, `"A" [color=green];`, `"R" [color=red];`} {
+		if !strings.Contains(buf.String(), w) {
+			t.Errorf("DOT doesn't contain %s:\n%s", w, &buf)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type ChangeKind int
+
+const (
+	Added ChangeKind = iota
+	Removed
+	Modified
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "+"
+	case Removed:
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+// A Change describes a single semantic difference between two
+// versions of a model.  Old and New hold the canonical equation
+// before and after the change, and are empty for added and removed
+// variables respectively.
+type Change struct {
+	Kind ChangeKind
+	Name string
+	Old  string
+	New  string
+}
+
+func (c Change) String() string {
+	// a level's equation is two cards
+	indent := func(eqn, prefix string) string {
+		return strings.Replace(eqn, "\n", "\n"+prefix, -1)
+	}
+	switch c.Kind {
+	case Added:
+		return fmt.Sprintf("+ %s", indent(c.New, "  "))
+	case Removed:
+		return fmt.Sprintf("- %s", indent(c.Old, "  "))
+	default:
+		return fmt.Sprintf("~ %s\n\t- %s\n\t+ %s", c.Name, indent(c.Old, "\t  "), indent(c.New, "\t  "))
+	}
+}
+
+// timespecNames maps the keys of the synthesized timespec
+// CompositeLit back to the DYNAMO constants they were extracted from.
+var timespecNames = map[string]string{
+	"start":     "TIME",
+	"end":       "LENGTH",
+	"dt":        "DT",
+	"save_step": "SAVPER",
+}
+
+// equations returns a map of upper-cased variable name to canonical
+// equation for every assignment in f, with the timespec expanded
+// into its individual DYNAMO constants.  A level's equation is its
+// L card and then its N card, on separate lines.
+func equations(f *File) map[string]string {
+	eqns := map[string]string{}
+	for _, d := range f.Decls {
+		md, ok := d.(*ModelDecl)
+		if !ok || md.Body == nil {
+			continue
+		}
+		for _, s := range md.Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok {
+				continue
+			}
+			if assign.Lhs.Name.Name == "timespec" {
+				cl, ok := assign.Rhs.(*CompositeLit)
+				if !ok {
+					continue
+				}
+				for _, e := range cl.Elts {
+					k, v, err := kvConvert(e)
+					if err != nil {
+						continue
+					}
+					if n, ok := timespecNames[k]; ok {
+						eqns[n] = fmt.Sprintf("C %s=%s", n, exprString(v))
+					}
+				}
+				continue
+			}
+			name := strings.ToUpper(assign.Lhs.Name.Name)
+			eqn := fmt.Sprintf("%s %s=%s", typeLetter(assign.Lhs),
+				lhsString(assign.Lhs), exprString(assign.Rhs))
+			switch prev := eqns[name]; {
+			case strings.HasPrefix(prev, "L ") && eqn[0] == 'N':
+				eqn = prev + "\n" + eqn
+			case strings.HasPrefix(prev, "N ") && eqn[0] == 'L':
+				eqn = eqn + "\n" + prev
+			}
+			eqns[name] = eqn
+		}
+	}
+	return eqns
+}
+
+// Diff reports the variables and timespec values that were added,
+// removed or modified between a and b, sorted by name.  Equations
+// are compared in their canonical form, so differences in
+// formatting, comments and the case of names are ignored.
+func Diff(a, b *File) []Change {
+	before, after := equations(a), equations(b)
+
+	var changes []Change
+	for n, old := range before {
+		eqn, ok := after[n]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Kind: Removed, Name: n, Old: old})
+		case eqn != old:
+			changes = append(changes, Change{Kind: Modified, Name: n, Old: old, New: eqn})
+		}
+	}
+	for n, eqn := range after {
+		if _, ok := before[n]; !ok {
+			changes = append(changes, Change{Kind: Added, Name: n, New: eqn})
+		}
+	}
+
+	sort.Sort(changeList(changes))
+	return changes
+}
+
+type changeList []Change
+
+func (l changeList) Len() int           { return len(l) }
+func (l changeList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l changeList) Less(i, j int) bool { return l[i].Name < l[j].Name }
@@ -0,0 +1,69 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(string) string
+		want []Change
+	}{
+		{"unchanged", func(s string) string { return s }, nil},
+		{
+			"reformatted",
+			func(s string) string { return strings.Replace(s, "B.KL=(NB)(POP.K)", "b.kl=(nb)(pop.k)", 1) },
+			nil,
+		},
+		{
+			"added",
+			func(s string) string { return s + "A\tGR.K=B.JK/POP.K\n" },
+			[]Change{{Kind: Added, Name: "GR", New: "A GR.K=B.JK/POP.K"}},
+		},
+		{
+			"removed",
+			func(s string) string { return strings.Replace(s, "C\tND=.01\n", "", 1) },
+			[]Change{{Kind: Removed, Name: "ND", Old: "C ND=0.01"}},
+		},
+		{
+			"modified",
+			func(s string) string { return strings.Replace(s, "NB=.04", "NB=.05", 1) },
+			[]Change{{Kind: Modified, Name: "NB", Old: "C NB=0.04", New: "C NB=0.05"}},
+		},
+		{
+			"level",
+			func(s string) string { return strings.Replace(s, "(B.JK-D.JK)", "(B.JK)", 1) },
+			[]Change{{
+				Kind: Modified,
+				Name: "POP",
+				Old:  "L POP.K=POP.J+(DT)*(B.JK-D.JK)\nN POP=POPN",
+				New:  "L POP.K=POP.J+(DT)*(B.JK)\nN POP=POPN",
+			}},
+		},
+		{
+			"timespec",
+			func(s string) string { return strings.Replace(s, "DT=5", "DT=2.5", 1) },
+			[]Change{{Kind: Modified, Name: "DT", Old: "C DT=5", New: "C DT=2.5"}},
+		},
+	}
+	a, _ := parseSrc(t, helloWorld)
+	for _, test := range tests {
+		b, _ := parseSrc(t, test.edit(helloWorld))
+		got := Diff(a, b)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got[i], test.want[i])
+			}
+		}
+	}
+}
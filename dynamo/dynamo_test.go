@@ -0,0 +1,65 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"flag"
+	"go/token"
+	"io/ioutil"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files in testdata")
+
+// helloWorld is the population sector of House5, the model dplay
+// starts with, filled out so that it runs.
+const helloWorld = `*
+NOTE	House5 -- Three sector urban model with housing filter down
+NOTE
+NOTE	Population Sector
+NOTE
+L	POP.K=POP.J+(DT)(B.JK-D.JK)
+N	POP=POPN
+C	POPN=133000
+R	B.KL=(NB)(POP.K)
+C	NB=.04
+R	D.KL=(ND)(POP.K)
+C	ND=.01
+NOTE
+NOTE	control cards
+NOTE
+C	LENGTH=250
+C	DT=5
+C	SAVPER=5
+`
+
+// parseSrc parses the model src, failing the test if it can't.
+func parseSrc(t testing.TB, src string) (*File, *token.FileSet) {
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	return f, fset
+}
+
+// checkGolden compares got to the golden file at path, rewriting it
+// instead with -update-golden.
+func checkGolden(t *testing.T, path string, got []byte) {
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s; got:\n%s", path, got)
+	}
+}
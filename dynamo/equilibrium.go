@@ -0,0 +1,149 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// divergenceLimit is the magnitude past which a variable is taken
+// to have diverged.
+const divergenceLimit = 1e15
+
+// EquilOptions control the search of EquilibriumAnalysis.
+type EquilOptions struct {
+	// Tolerance is the most any level may change in a step for
+	// the model to be at equilibrium; 1e-6 if zero.
+	Tolerance float64
+
+	// MaxSteps is the most steps of DT that are run; 100000 if
+	// zero.
+	MaxSteps int
+}
+
+// An EquilibriumResult is the state a model settles to.
+type EquilibriumResult struct {
+	Time      float64            // the time it was reached
+	Vars      map[string]float64 // the values of the output variables, by name
+	Converged bool               // whether the model settled
+}
+
+// String returns the time of r and its values, a line for each
+// variable in sorted order.
+func (r *EquilibriumResult) String() string {
+	var buf bytes.Buffer
+	if r.Converged {
+		fmt.Fprintf(&buf, "equilibrium at time %s\n", formatValue(r.Time))
+	} else {
+		fmt.Fprintf(&buf, "no equilibrium by time %s\n", formatValue(r.Time))
+	}
+	names := make([]string, 0, len(r.Vars))
+	for n := range r.Vars {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(&buf, "\t%s = %s\n", n, formatValue(r.Vars[n]))
+	}
+	return buf.String()
+}
+
+// A DivergenceError reports a variable that grew past 1e15, or
+// stopped being a number, before its model settled.
+type DivergenceError struct {
+	Time  float64
+	Var   string
+	Value float64
+}
+
+func (e DivergenceError) Error() string {
+	return fmt.Sprintf("%s diverged to %s at time %s", e.Var, formatValue(e.Value), formatValue(e.Time))
+}
+
+// EquilibriumAnalysis simulates the model named main in f, with
+// Euler's method and past its LENGTH, until no level, including
+// those hidden in SMOOTH and DELAY3, changes by more than the
+// tolerance in a step.  The result is the state the model then
+// holds.  If it hasn't settled within the most steps allowed, the
+// result is the last state with Converged false.  If a variable
+// diverges first, the result is the state it diverged in, with
+// Converged false, and the error is a DivergenceError.
+func EquilibriumAnalysis(f *File, opts EquilOptions) (*EquilibriumResult, error) {
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = 1e-6
+	}
+	if opts.MaxSteps <= 0 {
+		opts.MaxSteps = 100000
+	}
+	s, err := newSimulator(f, Euler)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.init()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(st); err != nil {
+		return nil, err
+	}
+
+	r := &EquilibriumResult{}
+	result := func() *EquilibriumResult {
+		// the supplementaries aren't computed by a step; their
+		// equations were evaluated without error above
+		s.save(st)
+		r.Time = st.vals["TIME"]
+		r.Vars = make(map[string]float64, len(s.g.Output))
+		for _, out := range s.g.Output {
+			r.Vars[out.Name] = st.vals[out.Name]
+		}
+		return r
+	}
+	diverged := func() error {
+		names := make([]string, 0, len(st.vals))
+		for n := range st.vals {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if v := st.vals[n]; !(math.Abs(v) <= divergenceLimit) {
+				return DivergenceError{st.vals["TIME"], n, v}
+			}
+		}
+		return nil
+	}
+	if err := diverged(); err != nil {
+		return result(), err
+	}
+
+	n := len(s.levels) + len(st.hidden)
+	prev := make([]float64, n)
+	for i := 0; i < opts.MaxSteps; i++ {
+		for j := range prev {
+			prev[j] = s.level(st, j)
+		}
+		if err := s.step(st); err != nil {
+			return nil, err
+		}
+		if err := diverged(); err != nil {
+			return result(), err
+		}
+		settled := true
+		for j, v := range prev {
+			if math.Abs(s.level(st, j)-v) > opts.Tolerance {
+				settled = false
+				break
+			}
+		}
+		if settled {
+			r.Converged = true
+			return result(), nil
+		}
+	}
+	return result(), nil
+}
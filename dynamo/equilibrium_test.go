@@ -0,0 +1,68 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEquilibriumAnalysis(t *testing.T) {
+	// S seeks GOAL, closing the gap over ADJ
+	const src = `* goal seeking
+L	S.K=S.J+(DT)(R.JK)
+N	S=0
+R	R.KL=(GOAL-S.K)/ADJ
+C	GOAL=100
+C	ADJ=5
+C	LENGTH=10
+C	DT=.01
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	const tol = 1e-6
+	r, err := EquilibriumAnalysis(f, EquilOptions{Tolerance: tol})
+	if err != nil {
+		t.Fatalf("EquilibriumAnalysis: %s", err)
+	}
+	if !r.Converged {
+		t.Fatalf("didn't converge: %s", r)
+	}
+	// S is GOAL(1-e^(-t/ADJ)), so it changes by DT(GOAL/ADJ)e^(-t/ADJ)
+	// a step, which falls to the tolerance at ADJ ln(DT GOAL/(ADJ tol)).
+	wantTime := 5 * math.Log(.01*100/(5*tol))
+	if math.Abs(r.Time-wantTime) > .01*wantTime {
+		t.Errorf("got equilibrium at time %g, want %g", r.Time, wantTime)
+	}
+	wantS := 100 * (1 - math.Exp(-r.Time/5))
+	if s := r.Vars["S"]; math.Abs(s-wantS) > .01*wantS || math.Abs(s-100) > 1 {
+		t.Errorf("got S %g, want %g", s, wantS)
+	}
+	if got := r.String(); !strings.HasPrefix(got, "equilibrium at time ") || !strings.Contains(got, "\tS = 99.99") {
+		t.Errorf("got String\n%s", got)
+	}
+
+	// too few steps to settle
+	r, err = EquilibriumAnalysis(f, EquilOptions{Tolerance: tol, MaxSteps: 100})
+	if err != nil || r.Converged || math.Abs(r.Time-1) > 1e-9 {
+		t.Errorf("100 steps: got %v (%v), want no equilibrium at time 1", r, err)
+	}
+	if got := r.String(); !strings.HasPrefix(got, "no equilibrium by time 1") {
+		t.Errorf("got String\n%s", got)
+	}
+
+	// growth without limit diverges
+	f, _ = parseSrc(t, "* growth\nL S.K=S.J+(DT)(R.JK)\nN S=1\nR R.KL=S.K\nC LENGTH=1\nC DT=1\nC SAVPER=1\n")
+	r, err = EquilibriumAnalysis(f, EquilOptions{})
+	derr, ok := err.(DivergenceError)
+	if !ok || r == nil || r.Converged {
+		t.Fatalf("growth: got %v (%v), want a DivergenceError", r, err)
+	}
+	// S doubles each step, passing 1e15 at 2^50
+	if derr.Var != "R" && derr.Var != "S" || derr.Value <= divergenceLimit || derr.Time != 50 {
+		t.Errorf("got %s, want divergence at time 50", derr)
+	}
+}
@@ -41,20 +41,29 @@ func (h *ErrorVector) ErrorCount() int { return len(h.errors) }
 
 // Within ErrorVector, an error is represented by an Error node. The
 // position Pos, if valid, points to the beginning of the offending
-// token, and the error condition is described by Msg.
+// token, and the error condition is described by Msg.  Rule, if not
+// empty, names the check that found the error, like lex or syntax.
+// Severity is SeverityWarning for a problem that doesn't stop the
+// model from being compiled.
 //
 type Error struct {
-	Pos token.Position
-	Msg string
+	Pos      token.Position
+	Msg      string
+	Rule     string
+	Severity DiagSeverity
 }
 
 func (e *Error) Error() string {
+	msg := e.Msg
+	if e.Severity == SeverityWarning {
+		msg = "warning: " + msg
+	}
 	if e.Pos.Filename != "" || e.Pos.IsValid() {
 		// don't print "<unknown position>"
 		// TODO(gri) reconsider the semantics of Position.IsValid
-		return e.Pos.String() + ": " + e.Msg
+		return e.Pos.String() + ": " + msg
 	}
-	return e.Msg
+	return msg
 }
 
 // An ErrorList is a (possibly sorted) list of Errors.
@@ -149,7 +158,18 @@ func (h *ErrorVector) GetError(mode int) error {
 
 // ErrorVector implements the ErrorHandler interface.
 func (h *ErrorVector) Error(pos token.Position, msg string) {
-	h.errors = append(h.errors, &Error{pos, msg})
+	h.errors = append(h.errors, &Error{Pos: pos, Msg: msg})
+}
+
+// RuleError is like Error, but records that the error was found by
+// rule.
+func (h *ErrorVector) RuleError(pos token.Position, rule, msg string) {
+	h.errors = append(h.errors, &Error{Pos: pos, Msg: msg, Rule: rule})
+}
+
+// RuleWarning is like RuleError, but records a warning.
+func (h *ErrorVector) RuleWarning(pos token.Position, rule, msg string) {
+	h.errors = append(h.errors, &Error{pos, msg, rule, SeverityWarning})
 }
 
 // PrintError is a utility function that prints a list of errors to w,
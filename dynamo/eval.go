@@ -0,0 +1,349 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"strings"
+)
+
+// An EvalError is an error evaluating the expression at Pos.
+type EvalError struct {
+	Pos token.Pos
+	Msg string
+}
+
+func (e EvalError) Error() string {
+	return e.Msg
+}
+
+// evalErr returns an EvalError at the position of n.
+func evalErr(n Node, format string, args ...interface{}) error {
+	return EvalError{n.Pos(), fmt.Sprintf(format, args...)}
+}
+
+// A TableRegistry holds the tables looked up by TABHL, by upper-cased
+// name.
+type TableRegistry map[string]*TableFwdExpr
+
+// An evalEnv gives eval the values of variables and of the function
+// calls that aren't computed from their arguments alone.
+type evalEnv interface {
+	// ref returns the value of the variable id.
+	ref(id *Ident) (float64, error)
+	// call returns the value of c, a call of the function name,
+	// or ok false if it is computed from its arguments.
+	call(c *CallExpr, name string) (v float64, ok bool, err error)
+}
+
+// Eval returns the value of e, given the values of the variables it
+// references in env, by upper-cased name.  TABHL looks up its table
+// in tables, as TableFwdExpr's Interpolate does, and the input
+// functions STEP, RAMP and PULSE read TIME, and PULSE DT, from env.
+// The functions with state of their own, like SMOOTH and NOISE, can
+// only be computed by Simulate.  Neither env nor tables is changed.
+// Errors are EvalErrors.
+func Eval(e Expr, env map[string]float64, tables TableRegistry) (float64, error) {
+	return eval(e, mapEnv{env, tables})
+}
+
+// EvalExpr parses the expression src, as ParseExpr does, and returns
+// its value given the values of the variables it references in env,
+// as Eval does.  There are no tables for TABHL to look up.
+func EvalExpr(src string, env map[string]float64) (float64, error) {
+	e, err := ParseExpr(src)
+	if err != nil {
+		return 0, err
+	}
+	return Eval(e, env, nil)
+}
+
+// Constants returns the values of the constants of the model named
+// main in f, by upper-cased name.  A constant may be defined in
+// terms of others, and by a TABHL of one of the model's tables at a
+// constant input.  Errors evaluating a constant are EvalErrors.
+func (f *File) Constants() (map[string]float64, error) {
+	m := f.GetModel("main")
+	if m == nil {
+		return nil, fmt.Errorf("no model named main")
+	}
+	if _, err := tableRanges(m); err != nil {
+		return nil, err
+	}
+	names, eqns, err := initialEqns(m)
+	if err != nil {
+		return nil, err
+	}
+	consts, tables := map[string]bool{}, TableRegistry{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		n := strings.ToUpper(assign.Lhs.Name.Name)
+		switch assign.Lhs.Type.Name {
+		case "const":
+			consts[n] = true
+		case "table":
+			if t, ok := stripUnits(assign.Rhs).(*TableFwdExpr); ok {
+				tables[n] = t
+			}
+		}
+	}
+
+	vals := map[string]float64{}
+	for _, n := range names {
+		if !consts[n] {
+			continue
+		}
+		v, err := Eval(eqns[n], vals, tables)
+		if e, ok := err.(EvalError); ok {
+			e.Msg = n + ": " + e.Msg
+			return nil, e
+		} else if err != nil {
+			return nil, err
+		}
+		vals[n] = v
+	}
+	return vals, nil
+}
+
+// A mapEnv is the evalEnv of Eval.
+type mapEnv struct {
+	vals   map[string]float64
+	tables TableRegistry
+}
+
+func (env mapEnv) ref(id *Ident) (float64, error) {
+	v, ok := env.vals[strings.ToUpper(id.Name)]
+	if !ok {
+		return 0, evalErr(id, "undefined: %s", id.Name)
+	}
+	return v, nil
+}
+
+func (env mapEnv) call(c *CallExpr, name string) (float64, bool, error) {
+	switch name {
+	case "TABHL":
+		id, ok := c.Args[0].(*Ident)
+		if !ok {
+			return 0, true, evalErr(c.Args[0], "TABHL of %s, not a table", exprString(c.Args[0]))
+		}
+		table, ok := env.tables[strings.ToUpper(id.Name)]
+		if !ok {
+			return 0, true, evalErr(id, "undefined table: %s", id.Name)
+		}
+		args, err := evalArgs(c.Args[1:4], env)
+		if err != nil {
+			return 0, true, err
+		}
+		return table.Interpolate(args[0], args[1], args[2]), true, nil
+	case "SMOOTH", "DELAY3", "NOISE", "NORMRN":
+		return 0, true, evalErr(c, "%s has state of its own, and can't be evaluated alone", name)
+	}
+	return 0, false, nil
+}
+
+// eval returns the value of e in env.
+func eval(e Expr, env evalEnv) (float64, error) {
+	switch x := e.(type) {
+	case *BasicLit:
+		v, err := x.Float64()
+		if err != nil {
+			return 0, evalErr(x, "bad number %s", x.Value)
+		}
+		return v, nil
+	case *Ident:
+		return env.ref(x)
+	case *RefExpr:
+		return env.ref(&x.Ident)
+	case *SubscriptExpr:
+		return env.ref(x.Base)
+	case *UnitExpr:
+		return eval(x.X, env)
+	case *ParenExpr:
+		return eval(x.X, env)
+	case *UnaryExpr:
+		v, err := eval(x.X, env)
+		if err != nil {
+			return 0, err
+		}
+		switch x.Op {
+		case token.ADD:
+			return v, nil
+		case token.SUB:
+			return -v, nil
+		}
+		return 0, evalErr(x, "unknown unary operator %s", x.Op)
+	case *BinaryExpr:
+		if isComparison(x.Op) {
+			return 0, evalErr(x, "comparison %s outside of an IF", exprString(x))
+		}
+		l, err := eval(x.X, env)
+		if err != nil {
+			return 0, err
+		}
+		r, err := eval(x.Y, env)
+		if err != nil {
+			return 0, err
+		}
+		switch x.Op {
+		case token.ADD:
+			return l + r, nil
+		case token.SUB:
+			return l - r, nil
+		case token.MUL:
+			return l * r, nil
+		case token.QUO:
+			return l / r, nil
+		case token.XOR:
+			return math.Pow(l, r), nil
+		}
+		return 0, evalErr(x, "unknown operator %s", x.Op)
+	case *CallExpr:
+		return evalCall(x, env)
+	case *IfExpr:
+		// only the branch taken is evaluated, as in the
+		// generated code, so the other can't draw from NOISE
+		// or fail
+		cond, err := evalCond(x.Cond, env)
+		if err != nil {
+			return 0, err
+		}
+		if cond {
+			return eval(x.Then, env)
+		}
+		return eval(x.Else, env)
+	}
+	return 0, evalErr(e, "can't evaluate %T", e)
+}
+
+// evalCond returns the value of the condition of an IF.  Anything
+// other than a comparison holds when it is non-zero.
+func evalCond(e Expr, env evalEnv) (bool, error) {
+	for {
+		p, ok := stripUnits(e).(*ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.X
+	}
+	x, ok := stripUnits(e).(*BinaryExpr)
+	if !ok || !isComparison(x.Op) {
+		v, err := eval(e, env)
+		return v != 0, err
+	}
+	l, err := eval(x.X, env)
+	if err != nil {
+		return false, err
+	}
+	r, err := eval(x.Y, env)
+	if err != nil {
+		return false, err
+	}
+	switch x.Op {
+	case token.LSS:
+		return l < r, nil
+	case token.GTR:
+		return l > r, nil
+	case token.LEQ:
+		return l <= r, nil
+	case token.GEQ:
+		return l >= r, nil
+	}
+	return l != r, nil
+}
+
+// evalArgs returns the values of args, in order.
+func evalArgs(args []Expr, env evalEnv) ([]float64, error) {
+	vals := make([]float64, len(args))
+	for i, arg := range args {
+		var err error
+		if vals[i], err = eval(arg, env); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+// mathFuncs maps the built-ins computed from their arguments alone
+// to the function computing them.
+var mathFuncs = map[string]func(args []float64) float64{
+	"MAX":  func(a []float64) float64 { return math.Max(a[0], a[1]) },
+	"MIN":  func(a []float64) float64 { return math.Min(a[0], a[1]) },
+	"ABS":  func(a []float64) float64 { return math.Abs(a[0]) },
+	"SQRT": func(a []float64) float64 { return math.Sqrt(a[0]) },
+	"EXP":  func(a []float64) float64 { return math.Exp(a[0]) },
+	"LOG":  func(a []float64) float64 { return math.Log(a[0]) },
+	"SIN":  func(a []float64) float64 { return math.Sin(a[0]) },
+	"COS":  func(a []float64) float64 { return math.Cos(a[0]) },
+}
+
+// evalCall returns the value of a call of a built-in function.  Those
+// env doesn't compute are computed from their arguments, and for the
+// input functions TIME and DT.
+func evalCall(c *CallExpr, env evalEnv) (float64, error) {
+	name := funcName(c)
+	if name == "" {
+		return 0, evalErr(c, "call of non-function %T", c.Fun)
+	}
+	if n, ok := builtins[name]; ok && len(c.Args) != n {
+		return 0, evalErr(c, "%s takes %d arguments, not %d", name, n, len(c.Args))
+	}
+	if v, ok, err := env.call(c, name); ok {
+		return v, err
+	}
+	if name == "CLIP" {
+		// like IF, only the argument chosen is evaluated
+		args, err := evalArgs(c.Args[2:], env)
+		if err != nil {
+			return 0, err
+		}
+		if args[0] >= args[1] {
+			return eval(c.Args[0], env)
+		}
+		return eval(c.Args[1], env)
+	}
+
+	args, err := evalArgs(c.Args, env)
+	if err != nil {
+		return 0, err
+	}
+	if fn, ok := mathFuncs[name]; ok {
+		return fn(args), nil
+	}
+	var time, dt float64
+	switch name {
+	case "PULSE":
+		if dt, err = env.ref(&Ident{NamePos: c.Pos(), Name: "DT"}); err != nil {
+			return 0, err
+		}
+		fallthrough
+	case "STEP", "RAMP":
+		if time, err = env.ref(&Ident{NamePos: c.Pos(), Name: "TIME"}); err != nil {
+			return 0, err
+		}
+	}
+	switch name {
+	case "STEP":
+		if time >= args[1] {
+			return args[0], nil
+		}
+		return 0, nil
+	case "RAMP":
+		if time >= args[1] {
+			return args[0] * (time - args[1]), nil
+		}
+		return 0, nil
+	case "PULSE":
+		if time >= args[1] && time < args[1]+args[2] {
+			return args[0] / dt, nil
+		}
+		return 0, nil
+	}
+	return 0, evalErr(c, "can't evaluate function %s", exprString(c.Fun))
+}
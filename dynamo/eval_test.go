@@ -0,0 +1,191 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestEvalExpr(t *testing.T) {
+	env := map[string]float64{"X": 3, "TIME": 4, "DT": 1}
+	tests := []struct {
+		src string
+		v   float64
+		err string // or empty if there should be none
+	}{
+		{"2*(X+1)/4", 2, ""},
+		{"-x+10", 7, ""},
+		{"MAX(X,5)+CLIP(1,2,TIME,5)", 7, ""},
+		{"STEP(10,2)+RAMP(1,2)", 12, ""},
+		{"IF X>2 THEN 1 ELSE 0", 1, ""},
+		{"TABHL(T,X,0,4,2)", 0, "undefined table: T"},
+		{"Y+1", 0, "undefined: Y"},
+		{"SMOOTH(X,3)", 0, "SMOOTH has state of its own"},
+		{"X.K", 0, "time subscripts aren't allowed"},
+		{"X+", 0, "1:"},
+	}
+	for _, test := range tests {
+		v, err := EvalExpr(test.src, env)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.src, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %s", test.src, err, test.err)
+		case test.err == "" && v != test.v:
+			t.Errorf("%s: got %g, want %g", test.src, v, test.v)
+		}
+	}
+
+	// with a table to look up, as Eval has
+	e, err := ParseExpr("TABHL(T,X,0,4,2)")
+	if err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	tables := TableRegistry{"T": {Ys: []*BasicLit{num(0), num(10), num(30)}}}
+	if v, err := Eval(e, env, tables); err != nil || v != 20 {
+		t.Errorf("TABHL: got %g (%v), want 20", v, err)
+	}
+}
+
+func TestEval(t *testing.T) {
+	id := func(name string) *Ident { return &Ident{NamePos: 7, Name: name} }
+	bin := func(x Expr, op token.Token, y Expr) *BinaryExpr { return &BinaryExpr{X: x, Op: op, Y: y} }
+	call := func(fn string, args ...Expr) *CallExpr { return &CallExpr{Fun: id(fn), Args: args} }
+	ifx := func(cond Expr) *IfExpr { return &IfExpr{Cond: cond, Then: num(1), Else: num(2)} }
+
+	env := map[string]float64{"X": 3, "TIME": 4, "DT": .5}
+	tables := TableRegistry{"T": {Ys: []*BasicLit{num(0), num(10), num(30)}}}
+	tests := []struct {
+		name string
+		e    Expr
+		v    float64
+		err  string // or empty if there should be none
+	}{
+		{"BasicLit", num(2.5), 2.5, ""},
+		{"bad BasicLit", &BasicLit{Kind: token.FLOAT, Value: "1x"}, 0, "bad number 1x"},
+		{"Ident", id("X"), 3, ""},
+		{"lower-case Ident", id("x"), 3, ""},
+		{"undefined Ident", id("Y"), 0, "undefined: Y"},
+		{"RefExpr", &RefExpr{Ident: *id("X")}, 3, ""},
+		{"SubscriptExpr", &SubscriptExpr{Base: id("X"), Sub: "K"}, 3, ""},
+		{"UnitExpr", &UnitExpr{X: id("X"), Unit: id("people")}, 3, ""},
+		{"ParenExpr", &ParenExpr{X: id("X")}, 3, ""},
+		{"unary +", &UnaryExpr{Op: token.ADD, X: id("X")}, 3, ""},
+		{"unary -", &UnaryExpr{Op: token.SUB, X: id("X")}, -3, ""},
+		{"unary !", &UnaryExpr{Op: token.NOT, X: id("X")}, 0, "unknown unary operator !"},
+		{"unary of undefined", &UnaryExpr{Op: token.SUB, X: id("Y")}, 0, "undefined: Y"},
+		{"+", bin(id("X"), token.ADD, num(1)), 4, ""},
+		{"-", bin(id("X"), token.SUB, num(1)), 2, ""},
+		{"*", bin(id("X"), token.MUL, num(2)), 6, ""},
+		{"/", bin(id("X"), token.QUO, num(2)), 1.5, ""},
+		{"^", bin(id("X"), token.XOR, num(2)), 9, ""},
+		{"%", bin(id("X"), token.REM, num(2)), 0, "unknown operator %"},
+		{"comparison", bin(id("X"), token.GTR, num(2)), 0, "outside of an IF"},
+		{"binary of undefined", bin(num(1), token.ADD, id("Y")), 0, "undefined: Y"},
+		{"MAX", call("MAX", num(1), id("X")), 3, ""},
+		{"SQRT", call("sqrt", num(16)), 4, ""},
+		{"CLIP", call("CLIP", num(1), num(2), id("X"), num(3)), 1, ""},
+		{"STEP", call("STEP", num(5), num(4)), 5, ""},
+		{"RAMP", call("RAMP", num(2), num(3)), 2, ""},
+		{"PULSE", call("PULSE", num(1), num(4), num(1)), 2, ""},
+		{"TABHL", call("TABHL", id("T"), id("X"), num(0), num(4), num(2)), 20, ""},
+		{"TABHL of a number", call("TABHL", num(1), id("X"), num(0), num(4), num(2)), 0, "not a table"},
+		{"TABHL of no table", call("TABHL", id("U"), id("X"), num(0), num(4), num(2)), 0, "undefined table: U"},
+		{"argument count", call("MAX", num(1)), 0, "MAX takes 2 arguments, not 1"},
+		{"undefined function", call("FOO", num(1)), 0, "can't evaluate function FOO"},
+		{"non-function", &CallExpr{Fun: num(1)}, 0, "call of non-function"},
+		{"argument undefined", call("ABS", id("Y")), 0, "undefined: Y"},
+		{"NOISE", call("NOISE"), 0, "NOISE has state of its own"},
+		{"IF <", ifx(bin(id("X"), token.LSS, num(3))), 2, ""},
+		{"IF <=", ifx(bin(id("X"), token.LEQ, num(3))), 1, ""},
+		{"IF >", ifx(bin(id("X"), token.GTR, num(3))), 2, ""},
+		{"IF >=", ifx(bin(id("X"), token.GEQ, num(3))), 1, ""},
+		{"IF <>", ifx(bin(id("X"), token.NEQ, num(3))), 2, ""},
+		{"IF (())", ifx(&ParenExpr{X: &ParenExpr{X: bin(id("X"), token.GTR, num(2))}}), 1, ""},
+		{"IF non-zero", ifx(id("X")), 1, ""},
+		{"IF zero", ifx(num(0)), 2, ""},
+		{"IF undefined", ifx(bin(id("Y"), token.GTR, num(2))), 0, "undefined: Y"},
+		{"IF branch undefined", &IfExpr{Cond: num(0), Then: num(1), Else: id("Y")}, 0, "undefined: Y"},
+		{"IF untaken branch undefined", &IfExpr{Cond: num(1), Then: num(1), Else: id("Y")}, 1, ""},
+		{"CLIP untaken undefined", call("CLIP", num(1), id("Y"), num(1), num(0)), 1, ""},
+		{"CLIP undefined", call("CLIP", num(1), id("Y"), num(0), num(1)), 0, "undefined: Y"},
+		{"KeyValueExpr", &KeyValueExpr{Key: id("X"), Value: num(1)}, 0, "can't evaluate *dynamo.KeyValueExpr"},
+	}
+	for _, test := range tests {
+		v, err := Eval(test.e, env, tables)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+		case test.err != "":
+			if _, ok := err.(EvalError); !ok {
+				t.Errorf("%s: got a %T, want an EvalError", test.name, err)
+			}
+		case v != test.v:
+			t.Errorf("%s: got %g, want %g", test.name, v, test.v)
+		}
+	}
+
+	// an EvalError is at the node that caused it
+	if _, err := Eval(bin(num(1), token.ADD, id("Y")), env, nil); err.(EvalError).Pos != 7 {
+		t.Errorf("got error at %d, want 7", err.(EvalError).Pos)
+	}
+	// the input functions need TIME, and PULSE DT
+	if _, err := Eval(call("PULSE", num(1), num(4), num(1)), map[string]float64{"TIME": 1}, nil); err == nil || !strings.Contains(err.Error(), "undefined: DT") {
+		t.Errorf("PULSE without DT: got error %v", err)
+	}
+	// Eval changes neither env nor tables
+	if len(env) != 3 || env["X"] != 3 || len(tables) != 1 || len(tables["T"].Ys) != 3 {
+		t.Errorf("Eval changed env %v or tables %v", env, tables)
+	}
+}
+
+func TestConstants(t *testing.T) {
+	const model = `* constants from a table
+L	S.K=S.J+(DT)(R.JK)
+N	S=BASE
+R	R.KL=RATE
+C	P=2.5
+C	BASE=TABHL(TT,P,0,10,5)
+C	RATE=TABHL(TT,P*2,0,10,5)/100
+T	TT=100/200/300
+C	LENGTH=2
+C	DT=1
+C	SAVPER=1
+%s
+`
+	// P is halfway between TT's first two xs, and P*2 its second x
+	f, _ := parseSrc(t, fmt.Sprintf(model, ""))
+	consts, err := f.Constants()
+	if err != nil {
+		t.Fatalf("Constants: %s", err)
+	}
+	for name, want := range map[string]float64{"P": 2.5, "BASE": 150, "RATE": 2} {
+		if v, ok := consts[name]; !ok || v != want {
+			t.Errorf("%s: got %g (%v), want %g", name, v, ok, want)
+		}
+	}
+	if _, ok := consts["S"]; ok {
+		t.Errorf("the level S is among the constants")
+	}
+	// and the simulation starts from them
+	sim, gen := simulateBoth(t, fmt.Sprintf(model, ""))
+	checkSeries(t, "S", map[float64]float64{0: 150, 1: 152, 2: 154}, sim, gen)
+
+	for _, test := range []struct{ card, err string }{
+		{"C\tBAD=TABHL(NONE,P,0,10,5)", "BAD: undefined table: NONE"},
+		{"C\tBAD=TABHL(P,P,0,10,5)", "BAD: undefined table: P"},
+		{"C\tBAD=TABHL(TT,P,10,0,5)", "bad range"},
+	} {
+		f, _ := parseSrc(t, fmt.Sprintf(model, test.card))
+		if _, err := f.Constants(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %s", test.card, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,617 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const cFileTmpl = `/* generated by GenC from a DYNAMO model */
+#include <math.h>
+#include <stdio.h>
+{{if .Random}}#include <stdlib.h>
+{{end}}
+/* the simulation starts at start and takes steps of dt, writing the
+ * model's state every save_every steps. */
+static const double start = {{.Start}};
+static const double dt = {{.DT}};
+static const int steps = {{.Steps}};
+static const int save_every = {{.SaveEvery}};
+
+/* Model holds the value of each of the model's variables at TIME. */
+typedef struct {
+	double TIME;{{range .Fields}}
+	{{.}}{{end}}
+} Model;
+
+static Model m;
+{{range .Tables}}
+static const double tab_{{.Name}}_xs[] = { {{.Xs}} };
+static const double tab_{{.Name}}_ys[] = { {{.Ys}} };
+{{end}}{{if .Tables}}
+/* lookup interpolates linearly between the n points of a table,
+ * holding the first and last y beyond them. */
+static double lookup(const double *xs, const double *ys, int n, double x)
+{
+	int i;
+	if (x <= xs[0])
+		return ys[0];
+	if (x >= xs[n-1])
+		return ys[n-1];
+	for (i = 1; x > xs[i]; i++)
+		;
+	return ys[i-1] + (x - xs[i-1]) / (xs[i] - xs[i-1]) * (ys[i] - ys[i-1]);
+}
+{{end}}{{if .Funcs.STEP}}
+/* step_input is h from st on. */
+static double step_input(double h, double st, double time)
+{
+	return time >= st ? h : 0;
+}
+{{end}}{{if .Funcs.RAMP}}
+/* ramp_input rises with slope sl from st on. */
+static double ramp_input(double sl, double st, double time)
+{
+	return time >= st ? sl * (time - st) : 0;
+}
+{{end}}{{if .Funcs.PULSE}}
+/* pulse_input is h/dt for the duration pt from st, adding h to a
+ * level it flows into. */
+static double pulse_input(double h, double st, double pt, double time, double dt)
+{
+	return time >= st && time < st + pt ? h / dt : 0;
+}
+{{end}}{{if .Funcs.NOISE}}
+/* noise is uniformly distributed over [-0.5, 0.5). */
+static double noise(void)
+{
+	return rand() / ((double)RAND_MAX + 1) - 0.5;
+}
+{{end}}{{if .Funcs.NORMRN}}
+/* normrn is normally distributed with mean mu and standard
+ * deviation sigma. */
+static double normrn(double mu, double sigma)
+{
+	double u1 = (rand() + 1.0) / ((double)RAND_MAX + 2);
+	double u2 = rand() / ((double)RAND_MAX + 1);
+	return mu + sigma * sqrt(-2 * log(u1)) * cos(6.283185307179586 * u2);
+}
+{{end}}
+/* calc computes the auxiliaries, then the rates, from the levels. */
+static void calc(void)
+{
+{{- range .Calc}}
+	{{.}};{{end}}
+}
+{{if .Save}}
+/* save computes the supplementaries, which are only needed when m is
+ * written. */
+static void save(void)
+{
+{{- range .Save}}
+	{{.}};{{end}}
+}
+{{end}}
+/* init_model sets m to the model's state at the start of the
+ * simulation. */
+void init_model(void)
+{
+	m.TIME = start;{{range .Initials}}
+	{{.}};{{end}}
+	calc();{{if .Hidden}}
+
+	/* the hidden levels start from their inputs */{{range .Hidden}}
+	{{.}};{{end}}
+	calc();{{end}}
+}
+
+/* step advances m by dt: the levels at K are integrated from the
+ * model at J, and the auxiliaries and rates at K then computed from
+ * the new levels. */
+void step(double dt)
+{
+{{- if .Step}}
+	Model j = m;{{range .Step}}
+	{{.}};{{end}}{{end}}
+	m.TIME += dt;
+	calc();
+}
+
+/* write_row writes m's time and variables as a row of CSV. */
+static void write_row(void)
+{
+	printf("{{.Format}}\n", m.TIME{{range .Output}}, m.{{.}}{{end}});
+}
+
+int main(void)
+{
+	int i;
+{{if .Random}}
+	srand(1);{{end}}
+	puts({{.Header}});
+	init_model();
+	for (i = 0; i <= steps; i++) {
+		if (i > 0)
+			step(dt);
+		if (i % save_every == 0){{if .Save}} {
+			save();
+			write_row();
+		}{{else}}
+			write_row();{{end}}
+	}
+	return 0;
+}
+`
+
+// A cTable is a table in the generated C, with its points as C
+// initializers.
+type cTable struct {
+	Name   string
+	Xs, Ys string
+}
+
+// A cgen generates C for a model prepared by a simulator, whose
+// equations are already in the order they're computed in.
+type cgen struct {
+	s      *simulator
+	hidden map[*CallExpr]string // the hidden level of each SMOOTH, or base name of DELAY3's
+	used   map[string]bool      // the tables looked up, by upper-cased name
+
+	Start, DT        string
+	Steps, SaveEvery int
+	Fields           []string // declarations of the Model's fields
+	Tables           []cTable
+	Funcs            map[string]bool // the helpers used, by built-in
+	Random           bool            // NOISE or NORMRN is used
+	Calc             []string
+	Save             []string // statements computing the supplementaries
+	Initials         []string
+	Hidden           []string // statements starting the hidden levels
+	Step             []string
+	Header, Format   string
+	Output           []string // the fields written each save step
+}
+
+// cName returns the C name of the variable name.
+func cName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// cNum returns a C double literal for v, which C won't take for an
+// int.
+func cNum(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "HUGE_VAL"
+	case math.IsInf(v, -1):
+		return "-HUGE_VAL"
+	case math.IsNaN(v):
+		return "NAN"
+	}
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// cExpr returns C computing e from the variables of the Model recv.
+func (c *cgen) cExpr(e Expr, recv string) (string, error) {
+	switch x := e.(type) {
+	case *BasicLit:
+		v, err := x.Float64()
+		if err != nil {
+			return "", fmt.Errorf("bad number %s", x.Value)
+		}
+		return cNum(v), nil
+	case *Ident:
+		return c.cRef(x, recv)
+	case *RefExpr:
+		return c.cRef(&x.Ident, recv)
+	case *SubscriptExpr:
+		return c.cRef(x.Base, recv)
+	case *UnitExpr:
+		return c.cExpr(x.X, recv)
+	case *ParenExpr:
+		inner, err := c.cExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		return "(" + inner + ")", nil
+	case *UnaryExpr:
+		inner, err := c.cExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(inner, "-") || strings.HasPrefix(inner, "+") {
+			inner = "(" + inner + ")"
+		}
+		return x.Op.String() + inner, nil
+	case *BinaryExpr:
+		if isComparison(x.Op) {
+			return "", fmt.Errorf("comparison %s outside of an IF", exprString(x))
+		}
+		l, err := c.cExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		r, err := c.cExpr(x.Y, recv)
+		if err != nil {
+			return "", err
+		}
+		if x.Op == token.XOR {
+			return fmt.Sprintf("pow(%s, %s)", l, r), nil
+		}
+		return fmt.Sprintf("%s %s %s", l, x.Op, r), nil
+	case *CallExpr:
+		return c.cCall(x, recv)
+	case *IfExpr:
+		cond, err := c.cCond(x.Cond, recv)
+		if err != nil {
+			return "", err
+		}
+		then, err := c.cExpr(x.Then, recv)
+		if err != nil {
+			return "", err
+		}
+		els, err := c.cExpr(x.Else, recv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s ? %s : %s)", cond, then, els), nil
+	}
+	return "", fmt.Errorf("can't generate C for %T", e)
+}
+
+// cCond returns C for the condition of an IF.  Anything other than a
+// comparison holds when it is non-zero.
+func (c *cgen) cCond(e Expr, recv string) (string, error) {
+	for {
+		p, ok := stripUnits(e).(*ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.X
+	}
+	if x, ok := stripUnits(e).(*BinaryExpr); ok && isComparison(x.Op) {
+		l, err := c.cExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		r, err := c.cExpr(x.Y, recv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", l, x.Op, r), nil
+	}
+	v, err := c.cExpr(e, recv)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%s) != 0", v), nil
+}
+
+// cRef returns C for a reference to a variable.  DT is the step of
+// the simulation, dt.
+func (c *cgen) cRef(id *Ident, recv string) (string, error) {
+	n := strings.ToUpper(id.Name)
+	switch ty, ok := c.s.g.types[n]; {
+	case n == "DT":
+		return "dt", nil
+	case n == "TIME":
+		return recv + ".TIME", nil
+	case !ok:
+		return "", fmt.Errorf("undefined: %s", id.Name)
+	case ty == "table":
+		return "", fmt.Errorf("table %s used outside of TABHL", id.Name)
+	}
+	return recv + "." + cName(n), nil
+}
+
+// cMath maps the built-ins with an equivalent in C's math library to
+// it.
+var cMath = map[string]string{
+	"MAX":  "fmax",
+	"MIN":  "fmin",
+	"ABS":  "fabs",
+	"SQRT": "sqrt",
+	"EXP":  "exp",
+	"LOG":  "log",
+	"SIN":  "sin",
+	"COS":  "cos",
+}
+
+// cHelpers maps the built-ins computed by a helper function in the
+// generated C to the helper.  The input functions are passed the
+// time, and PULSE the step too.
+var cHelpers = map[string]string{
+	"STEP":   "step_input",
+	"RAMP":   "ramp_input",
+	"PULSE":  "pulse_input",
+	"NOISE":  "noise",
+	"NORMRN": "normrn",
+}
+
+// cCall returns C for a function call.
+func (c *cgen) cCall(call *CallExpr, recv string) (string, error) {
+	name := funcName(call)
+	if name == "" {
+		return "", fmt.Errorf("call of non-function %T", call.Fun)
+	}
+	if n, ok := builtins[name]; ok && len(call.Args) != n {
+		return "", fmt.Errorf("%s takes %d arguments, not %d", name, n, len(call.Args))
+	}
+
+	switch name {
+	case "TABHL":
+		table, ok := call.Args[0].(*Ident)
+		if !ok || c.s.g.types[strings.ToUpper(table.Name)] != "table" {
+			return "", fmt.Errorf("TABHL of %s, not a table", exprString(call.Args[0]))
+		}
+		x, err := c.cExpr(call.Args[1], recv)
+		if err != nil {
+			return "", err
+		}
+		return c.lookup(strings.ToUpper(table.Name), x), nil
+	case "SMOOTH":
+		return recv + "." + c.hidden[call], nil
+	case "DELAY3":
+		del, err := c.cExpr(call.Args[1], recv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s.%s_3)/((%s)/3.0)", recv, c.hidden[call], del), nil
+	}
+
+	args := make([]string, len(call.Args))
+	for i, arg := range call.Args {
+		var err error
+		if args[i], err = c.cExpr(arg, recv); err != nil {
+			return "", err
+		}
+	}
+	if fn, ok := cMath[name]; ok {
+		return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", ")), nil
+	}
+	if name == "CLIP" {
+		// like IF, only the argument chosen is computed
+		return fmt.Sprintf("(%s >= %s ? %s : %s)", args[2], args[3], args[0], args[1]), nil
+	}
+	fn, ok := cHelpers[name]
+	if !ok {
+		return "", fmt.Errorf("can't generate C for function %s", exprString(call.Fun))
+	}
+	c.Funcs[name] = true
+	switch name {
+	case "STEP", "RAMP":
+		args = append(args, recv+".TIME")
+	case "PULSE":
+		args = append(args, recv+".TIME", "dt")
+	case "NOISE", "NORMRN":
+		c.Random = true
+	}
+	return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", ")), nil
+}
+
+// lookup returns C looking up x in the table name.
+func (c *cgen) lookup(name, x string) string {
+	c.used[name] = true
+	t := c.s.tables[name]
+	return fmt.Sprintf("lookup(tab_%s_xs, tab_%s_ys, %d, %s)",
+		cName(name), cName(name), len(t.Xs), x)
+}
+
+// model generates the C statements for the model prepared by c.s.
+func (c *cgen) model() error {
+	s := c.s
+	c.Start, c.DT = cNum(s.g.Time.Start), cNum(s.dt)
+	c.Steps, c.SaveEvery = s.g.Steps, s.g.SaveEvery
+
+	fields := map[string]string{}
+	for _, f := range s.g.Fields {
+		doc := strings.Replace(f.Doc, "\n", "\n\t", -1)
+		fields[cName(f.Name)] = doc + "double " + cName(f.Name) + ";"
+	}
+	counts := map[string]int{}
+	for _, call := range s.calls {
+		name := funcName(call)
+		field := fmt.Sprintf("_%s_%d", strings.ToLower(name), counts[name])
+		counts[name]++
+		c.hidden[call] = field
+		if name == "SMOOTH" {
+			fields[field] = "double " + field + ";"
+			continue
+		}
+		for i := 1; i <= 3; i++ {
+			f := fmt.Sprintf("%s_%d", field, i)
+			fields[f] = "double " + f + ";"
+		}
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.Fields = append(c.Fields, fields[name])
+	}
+
+	for _, eqn := range s.initials {
+		rhs, err := c.cExpr(eqn.rhs, "m")
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		c.Initials = append(c.Initials, fmt.Sprintf("m.%s = %s", cName(eqn.name), rhs))
+	}
+	for _, eqn := range s.calc {
+		rhs, err := c.cExpr(eqn.rhs, "m")
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		if eqn.lookup {
+			rhs = c.lookup(eqn.name, rhs)
+		}
+		c.Calc = append(c.Calc, fmt.Sprintf("m.%s = %s", cName(eqn.name), rhs))
+	}
+	for _, eqn := range s.supps {
+		rhs, err := c.cExpr(eqn.rhs, "m")
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		c.Save = append(c.Save, fmt.Sprintf("m.%s = %s", cName(eqn.name), rhs))
+	}
+	for _, l := range s.levels {
+		rhs, err := c.level(l)
+		if err != nil {
+			return err
+		}
+		c.Step = append(c.Step, fmt.Sprintf("m.%s = %s", cName(l.name), rhs))
+	}
+	if err := c.hiddenLevels(); err != nil {
+		return err
+	}
+
+	var tables []string
+	for name := range c.used {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	for _, name := range tables {
+		t := s.tables[name]
+		ct := cTable{Name: cName(name)}
+		var xs, ys []string
+		for i := range t.Xs {
+			xs = append(xs, cNum(t.Xs[i]))
+			ys = append(ys, cNum(t.Ys[i]))
+		}
+		ct.Xs, ct.Ys = strings.Join(xs, ", "), strings.Join(ys, ", ")
+		c.Tables = append(c.Tables, ct)
+	}
+
+	header := []string{"TIME"}
+	format := []string{"%.15g"}
+	for _, f := range s.g.Output {
+		header = append(header, f.Name)
+		format = append(format, "%.15g")
+		c.Output = append(c.Output, cName(f.Name))
+	}
+	c.Header = strconv.Quote(strings.Join(header, ","))
+	c.Format = strings.Join(format, ",")
+	return nil
+}
+
+// level returns C for the value of the level l at K, computed from
+// the model at J.  A level built by ModelBuilder gives its flows,
+// rather than the equation for its next value.
+func (c *cgen) level(l simEqn) (string, error) {
+	cl, ok := l.rhs.(*CompositeLit)
+	if !ok {
+		rhs, err := c.cExpr(l.rhs, "j")
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", l.name, err)
+		}
+		return rhs, nil
+	}
+	var flows string
+	for _, e := range cl.Elts {
+		k, val, err := kvConvert(e)
+		if err != nil {
+			return "", fmt.Errorf("stock(%s): %s", l.name, err)
+		}
+		switch k {
+		case "initial":
+			// set by init_model
+		case "biflow", "inflow", "outflow":
+			flow, err := c.cExpr(val, "j")
+			if err != nil {
+				return "", fmt.Errorf("stock(%s) %s: %s", l.name, k, err)
+			}
+			if k == "outflow" {
+				flows += "-(" + flow + ")"
+			} else {
+				flows += "+" + flow
+			}
+		default:
+			return "", fmt.Errorf("stock(%s): unknown key %s", l.name, k)
+		}
+	}
+	return fmt.Sprintf("j.%s + (%s)*dt", cName(l.name), strings.TrimPrefix(flows, "+")), nil
+}
+
+// hiddenLevels adds the statements starting and integrating the
+// hidden levels of SMOOTH and DELAY3, as GenGo's do.
+func (c *cgen) hiddenLevels() error {
+	for _, call := range c.s.calls {
+		field := c.hidden[call]
+		var args [2][2]string // the arguments from m, then from j
+		for i, recv := range []string{"m", "j"} {
+			for k := range args[i] {
+				var err error
+				if args[i][k], err = c.cExpr(call.Args[k], recv); err != nil {
+					return err
+				}
+			}
+		}
+		if funcName(call) == "SMOOTH" {
+			c.Hidden = append(c.Hidden, fmt.Sprintf("m.%s = %s", field, args[0][0]))
+			c.Step = append(c.Step, fmt.Sprintf("m.%s = j.%s + dt*(%s - j.%s)/(%s)",
+				field, field, args[1][0], field, args[1][1]))
+			continue
+		}
+		rate := args[1][0]
+		for i := 1; i <= 3; i++ {
+			f := fmt.Sprintf("%s_%d", field, i)
+			out := fmt.Sprintf("(j.%s)/((%s)/3.0)", f, args[1][1])
+			c.Hidden = append(c.Hidden, fmt.Sprintf("m.%s = (%s)*(%s)/3.0", f, args[0][0], args[0][1]))
+			c.Step = append(c.Step, fmt.Sprintf("m.%s = j.%s + dt*(%s - %s)", f, f, rate, out))
+			rate = out
+		}
+	}
+	return nil
+}
+
+// GenC returns a self-contained C program simulating the model named
+// main in f, like the Go program from GenGo.  The levels are
+// integrated with Euler's method; the program writes the time and
+// the model's levels, rates and auxiliaries to standard output as
+// CSV, a row each save step.  It needs only the C library, and is
+// built with cc model.c -lm.
+func GenC(f *File) ([]byte, error) {
+	s, err := newSimulator(f, Euler)
+	if err != nil {
+		return nil, err
+	}
+	c := &cgen{
+		s:      s,
+		hidden: map[*CallExpr]string{},
+		used:   map[string]bool{},
+		Funcs:  map[string]bool{},
+	}
+	if err := c.model(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tmpl, err := template.New("model.c").Parse(cFileTmpl)
+	if err != nil {
+		panic(fmt.Sprintf("Parse(cFileTmpl): %s", err))
+	}
+	if err := tmpl.Execute(&buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
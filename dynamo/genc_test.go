@@ -0,0 +1,45 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenCGolden(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	src, err := GenC(f)
+	if err != nil {
+		t.Fatalf("GenC: %s", err)
+	}
+	checkGolden(t, "testdata/hello.c.golden", src)
+}
+
+func TestGenCCompiles(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		f, err := ParseFile(path, token.NewFileSet())
+		if err != nil {
+			t.Errorf("ParseFile: %s", err)
+			continue
+		}
+		src, err := GenC(f)
+		if err != nil {
+			t.Errorf("%s: GenC: %s", path, err)
+			continue
+		}
+		// runC fails on any warning from gcc -Wall
+		out := runC(t, src)
+		if !strings.HasPrefix(out, "TIME") {
+			t.Errorf("%s: got output\n%s\nwant CSV headed TIME", path, out)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"text/template"
+)
+
+const docMarkdownTmpl = `{{range .}}# {{.Name}}
+{{range .Groups}}
+## {{.Title}}
+
+| Name | Equation | Units | Description |
+|------|----------|-------|-------------|
+{{range .Vars}}| {{.Name}} | ` + "`{{md .Equation}}`" + ` | {{md .Units}} | {{md .Doc}} |
+{{end}}{{end}}{{end}}`
+
+const docHTMLTmpl = `<!doctype html>
+<html>
+<body>
+{{range .}}<h1>{{.Name}}</h1>
+{{range .Groups}}<h2>{{.Title}}</h2>
+<table>
+<tr><th>Name</th><th>Equation</th><th>Units</th><th>Description</th></tr>
+{{range .Vars}}<tr><td>{{.Name}}</td><td><code>{{.Equation}}</code></td><td>{{.Units}}</td><td>{{.Doc}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body>
+</html>
+`
+
+type docVar struct {
+	Name     string
+	Equation string
+	Units    string
+	Doc      string
+}
+
+type docGroup struct {
+	Title string
+	Vars  []docVar
+}
+
+type docModel struct {
+	Name   string
+	Groups []*docGroup
+}
+
+// docGroupOrder is the order variables are documented in, by card
+// letter, along with the section title for each.
+var docGroupOrder = []struct {
+	letter, title string
+}{
+	{"L", "Levels"},
+	{"N", "Initial values"},
+	{"R", "Rates"},
+	{"A", "Auxiliaries"},
+	{"S", "Supplementaries"},
+	{"C", "Constants"},
+	{"X", "External constants"},
+	{"T", "Tables"},
+	{"", "Timespec"},
+}
+
+// commentText returns the text of g on a single line.
+func commentText(g *CommentGroup) string {
+	return strings.Replace(strings.TrimSpace(g.Text()), "\n", " ", -1)
+}
+
+func docModels(f *File) []docModel {
+	var models []docModel
+	for _, d := range f.Decls {
+		md, ok := d.(*ModelDecl)
+		if !ok || md.Body == nil {
+			continue
+		}
+		groups := map[string]*docGroup{}
+		for _, s := range md.Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok {
+				continue
+			}
+			if assign.Lhs.Name.Name == "timespec" {
+				cl, ok := assign.Rhs.(*CompositeLit)
+				if !ok {
+					continue
+				}
+				g := &docGroup{Title: "Timespec"}
+				for _, e := range cl.Elts {
+					k, v, err := kvConvert(e)
+					if err != nil {
+						continue
+					}
+					if n, ok := timespecNames[k]; ok {
+						g.Vars = append(g.Vars, docVar{
+							Name:     n,
+							Equation: fmt.Sprintf("%s=%s", n, exprString(v)),
+						})
+					}
+				}
+				groups[""] = g
+				continue
+			}
+			letter := typeLetter(assign.Lhs)
+			g, ok := groups[letter]
+			if !ok {
+				g = new(docGroup)
+				groups[letter] = g
+			}
+			name := strings.ToUpper(assign.Lhs.Name.Name)
+			v := docVar{
+				Name:     name,
+				Equation: fmt.Sprintf("%s=%s", lhsString(assign.Lhs), exprString(assign.Rhs)),
+				Units:    unitsText(assign.Lhs),
+				Doc:      commentText(assign.Lhs.Doc),
+			}
+			g.Vars = append(g.Vars, v)
+		}
+
+		m := docModel{Name: md.Name.Name}
+		for _, o := range docGroupOrder {
+			if g, ok := groups[o.letter]; ok {
+				g.Title = o.title
+				m.Groups = append(m.Groups, g)
+			}
+		}
+		models = append(models, m)
+	}
+	return models
+}
+
+// mdEscape escapes s for use inside a Markdown table cell.
+func mdEscape(s string) string {
+	return strings.Replace(s, "|", `\|`, -1)
+}
+
+// GenDoc returns a listing of the variables in f, grouped by type,
+// with their equations, units and descriptions.  format is either
+// "markdown" or "html".
+func GenDoc(f *File, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	models := docModels(f)
+
+	switch format {
+	case "markdown", "md":
+		tmpl := template.New("doc.md")
+		tmpl = tmpl.Funcs(template.FuncMap{"md": mdEscape})
+		if _, err := tmpl.Parse(docMarkdownTmpl); err != nil {
+			panic(fmt.Sprintf("Parse(docMarkdownTmpl): %s", err))
+		}
+		if err := tmpl.Execute(&buf, models); err != nil {
+			return nil, fmt.Errorf("Execute: %s", err)
+		}
+	case "html":
+		tmpl, err := htmltemplate.New("doc.html").Parse(docHTMLTmpl)
+		if err != nil {
+			panic(fmt.Sprintf("Parse(docHTMLTmpl): %s", err))
+		}
+		if err := tmpl.Execute(&buf, models); err != nil {
+			return nil, fmt.Errorf("Execute: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown doc format '%s'", format)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"testing"
+)
+
+func TestGenDocMarkdown(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	out, err := GenDoc(f, "markdown")
+	if err != nil {
+		t.Fatalf("GenDoc: %s", err)
+	}
+	checkGolden(t, "testdata/house5.md.golden", out)
+}
@@ -6,138 +6,365 @@ package dynamo
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/bpowers/boosd/runtime"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
 	"log"
+	"math"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
 	"unicode"
 )
 
-const fileTmpl = `
-{{define "modelTmpl"}}
-var m{{$.CamelName}} = mdl{{$.CamelName}}{
-	runtime.BaseModel{
-		MName: "{{$.Name}}",
-		Vars: runtime.VarMap{ {{range $.Vars}}
-			"{{.Name}}": runtime.Var{"{{.Name}}", runtime.{{.Type}}},{{end}}
-		},
-		Defaults: runtime.DefaultMap{ {{range $n, $_ := $.Initials}}
-			{{if simple . }}"{{$n}}": {{.}}, {{end}}{{end}}
-		},
-		Tables: map[string]runtime.Table{ {{range $n, $_ := $.Tables}}
-			"{{$n}}": {{printf "%#v" .}}, {{end}}
-		},
-	},
-}
+const fileTmpl = `{{if .Standalone}}// Command model simulates a DYNAMO model, writing its variables to
+// standard output as CSV each save step.  It was generated by dynamo
+// -standalone, and builds with the standard library alone:
+//
+//	go build model.go
+{{end}}package main
 
-type sim{{$.CamelName}} struct {
-	runtime.BaseSim
-}
+import (
+	"bufio"
+	{{if .Flags}}"flag"
+	{{end}}"fmt"
+	{{if .Math}}"math"
+	{{end}}{{if .Random}}"math/rand"
+	{{end}}"os"
+	{{if .Flags}}"strings"
+	{{end}})
 
-type mdl{{$.CamelName}} struct {
-	runtime.BaseModel
+// the simulation starts at start and takes steps of dt, writing the
+// model's state every saveEvery steps.
+const (
+	start     = {{.Time.Start}}
+	dt        = {{.Time.DT}}
+	steps     = {{.Steps}}
+	saveEvery = {{.SaveEvery}}
+)
+
+// Model holds the value of each of the model's variables at TIME.
+type Model struct {
+	TIME float64
+{{range .Fields}}
+	{{.Doc}}{{.Field}} float64{{end}}
 }
+{{if .Params}}
+// the external constants, which can be set on the command line
+var ({{range .Externals}}
+	flag{{.Field}} = flag.Float64("{{.Name}}", {{.Value}}, "value of the external constant {{.Name}}"){{end}}
+)
+{{end}}{{if .Random}}
+// rng is the source of NOISE and NORMRN, seeded from the command
+// line so a run can be repeated.
+var (
+	seed = flag.Int64("seed", 1, "seed for NOISE and NORMRN")
+	rng  *rand.Rand
+)
+{{end}}{{if .Flags}}
+// outTmpl names the file the results are written to, standard
+// output if empty.
+var outTmpl = flag.String("o", "", "file to write to, with {NAME} replaced by the value of the external constant NAME{{if .Random}} and {seed} by the seed{{end}}; standard output if empty")
+{{end}}{{range .Tables}}
+{{.Doc}}var tab{{.Field}} = table{
+	xs: {{printf "%#v" .Xs}},
+	ys: {{printf "%#v" .Ys}},
+}
+{{end}}
+// initModel sets m to the model's state at the start of the
+// simulation.
+func (m *Model) initModel() {
+	m.TIME = start{{range .Initials}}
+	{{.}}{{end}}
+	m.calc(){{if .Hidden}}
 
-func (s *sim{{$.CamelName}}) calcInitial(dt float64) { {{if $.Initials }}
-	c := s.Coord
-	{{end}} {{range $n, $_ := $.Initials}}
-	s.Curr["{{$n}}"] = {{if simple .}}c.Data(s, "{{$n}}"){{else}}{{.}}{{end}}{{end}}
+	// the hidden levels start from their inputs{{range .Hidden}}
+	m.{{.Field}} = {{.Init}}{{end}}
+	m.calc(){{end}}
 }
 
-func (s *sim{{$.CamelName}}) calcFlows(dt float64) { {{if $.UseCoordFlows }}
-	c := s.Coord
-	{{end}} {{range $.Equations}}
+// step advances m by dt: the levels at K are integrated from the
+// model at J, and the auxiliaries and rates at K then computed from
+// the new levels.
+{{.Step}}
+
+// calc computes the auxiliaries, then the rates, from the levels.
+func (m *Model) calc() { {{range .Auxes}}
+	{{.}}{{end}}{{range .Rates}}
 	{{.}}{{end}}
 }
-
-func (s *sim{{$.CamelName}}) calcStocks(dt float64) { {{if $.UseCoordStocks }}
-	c := s.Coord
-	{{end}} {{range $.Stocks}}
+{{if .Supplementaries}}
+// save computes the supplementaries, which are only needed when m is
+// written.
+func (m *Model) save() { {{range .Supplementaries}}
 	{{.}}{{end}}
 }
+{{end}}
+// write writes m's time and variables to w as a row of CSV.
+func (m *Model) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "%g{{range .Output}},%g{{end}}\n", m.TIME{{range .Output}}, m.{{.Field}}{{end}})
+}
 
-func (m *mdl{{$.CamelName}}) NewSim(name string, c runtime.Coordinator) runtime.Sim {
-	ts := runtime.Timespec{
-		Start:    {{$.Time.Start}},
-		End:      {{$.Time.End}},
-		DT:       {{$.Time.DT}},
-		SaveStep: {{$.Time.SaveStep}},
+{{if .Flags}}// outPath returns the file name outTmpl gives this run: each {NAME}
+// in it, in any case, is replaced by NAME's value.
+func outPath() (string, error) {
+	vals := map[string]string{ {{range .Externals}}
+		"{{.Name}}": fmt.Sprint(*flag{{.Field}}),{{end}}{{if .Random}}
+		"SEED": fmt.Sprint(*seed),{{end}}
 	}
+	tmpl, path := *outTmpl, ""
+	for {
+		i := strings.Index(tmpl, "{")
+		if i < 0 {
+			return path + tmpl, nil
+		}
+		j := strings.Index(tmpl[i:], "}")
+		if j < 0 {
+			return "", fmt.Errorf("unclosed { in %q", *outTmpl)
+		}
+		name := tmpl[i+1 : i+j]
+		v, ok := vals[strings.ToUpper(name)]
+		if !ok {
+			return "", fmt.Errorf("no value for {%s} in %q", name, *outTmpl)
+		}
+		path += tmpl[:i] + v
+		tmpl = tmpl[i+j+1:]
+	}
+}
 
-	s := new(sim{{$.CamelName}})
-	s.InstanceName = name
-	s.Parent = m
-	s.Coord = c
-
-	s.Init(m, ts, m.Tables)
+{{end}}func main() { {{if .Flags}}
+	flag.Parse()
+{{end}}{{if .Random}}	rng = rand.New(rand.NewSource(*seed))
+{{end}}
+{{if .Flags}}	out := os.Stdout
+	if *outTmpl != "" {
+		path, err := outPath()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if out, err = os.Create(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out){{else}}	w := bufio.NewWriter(os.Stdout){{end}}
+	defer w.Flush()
 
-	s.CalcInitial = s.calcInitial
-	s.CalcFlows = s.calcFlows
-	s.CalcStocks = s.calcStocks
+	fmt.Fprintln(w, "TIME{{range .Output}},{{.Name}}{{end}}")
 
-	return s
+	var m Model
+	m.initModel()
+	for i := 0; i <= steps; i++ {
+		if i > 0 {
+			m.step(dt)
+		}
+		if i%saveEvery == 0 { {{if .Supplementaries}}
+			m.save(){{end}}
+			m.write(w)
+			// so a reader sees each row as it's computed
+			w.Flush()
+		}
+	}
+}
+{{if .Funcs.STEP}}
+// stepInput is h from st on.
+func stepInput(h, st, time float64) float64 {
+	if time >= st {
+		return h
+	}
+	return 0
+}
+{{end}}{{if .Funcs.RAMP}}
+// rampInput rises with slope sl from st on.
+func rampInput(sl, st, time float64) float64 {
+	if time >= st {
+		return sl * (time - st)
+	}
+	return 0
+}
+{{end}}{{if .Funcs.PULSE}}
+// pulseInput is h/dt for the duration pt from st, adding h to a
+// level it flows into.
+func pulseInput(h, st, pt, time, dt float64) float64 {
+	if time >= st && time < st+pt {
+		return h / dt
+	}
+	return 0
+}
+{{end}}{{if .Funcs.NOISE}}
+// noise is uniformly distributed over [-0.5, 0.5).
+func noise(r *rand.Rand) float64 {
+	return r.Float64() - 0.5
+}
+{{end}}{{if .Funcs.NORMRN}}
+// normrn is normally distributed with mean mu and standard deviation
+// sigma.
+func normrn(r *rand.Rand, mu, sigma float64) float64 {
+	return mu + sigma*r.NormFloat64()
+}
+{{end}}{{if .Tables}}
+// table is a function given by points, interpolated linearly between
+// them and held at the first and last y beyond them.
+type table struct {
+	xs, ys []float64
 }
-{{end}}
 
-package main
+func (t table) lookup(x float64) float64 {
+	n := len(t.xs)
+	switch {
+	case x <= t.xs[0]:
+		return t.ys[0]
+	case x >= t.xs[n-1]:
+		return t.ys[n-1]
+	}
+	i := 1
+	for x > t.xs[i] {
+		i++
+	}
+	frac := (x - t.xs[i-1]) / (t.xs[i] - t.xs[i-1])
+	return t.ys[i-1] + frac*(t.ys[i]-t.ys[i-1])
+}
+{{end}}`
 
-import (
-	"github.com/bpowers/boosd/runtime"
-)
+// A genField is a variable of the model, and a field of the
+// generated Model struct.
+type genField struct {
+	Name  string // upper-cased DYNAMO name
+	Field string // Go name
+	Doc   string // Go comment, each line followed by a newline
+	Value string // the value of an external constant
+}
 
-{{range $.Models}}{{template "modelTmpl" .}}{{end}}
+type genTable struct {
+	Field  string
+	Doc    string
+	Xs, Ys []float64
+}
 
-func main() {
-	runtime.Main(&mMain)
+// lookup returns the value of t at x, as the generated table's
+// lookup method does.
+func (t *genTable) lookup(x float64) float64 {
+	n := len(t.Xs)
+	switch {
+	case x <= t.Xs[0]:
+		return t.Ys[0]
+	case x >= t.Xs[n-1]:
+		return t.Ys[n-1]
+	}
+	i := 1
+	for x > t.Xs[i] {
+		i++
+	}
+	frac := (x - t.Xs[i-1]) / (t.Xs[i] - t.Xs[i-1])
+	return t.Ys[i-1] + frac*(t.Ys[i]-t.Ys[i-1])
 }
-`
 
-type genModel struct {
-	Name           string
-	CamelName      string // camelcased
-	Vars           map[string]runtime.Var
-	Tables         map[string]runtime.Table
-	Time           runtime.Timespec
-	Equations      []string
-	Stocks         []string
-	Initials       map[string]string
-	Abstract       bool
-	UseCoordFlows  bool
-	UseCoordStocks bool
+// A hiddenLevel is a level added by GenGo to hold the state of a
+// built-in function, such as SMOOTH.
+type hiddenLevel struct {
+	Name  string // output name, from the call site
+	Field string // Go name
+	Init  string // initial value, from the model's initial state
+	Eqn   string // value at K, from the model at J
 }
 
 type generator struct {
-	Models map[string]*genModel
-	curr   *genModel
-}
+	Time      runtime.Timespec
+	Steps     int
+	SaveEvery int
+	Fields    []genField // in name order
+	Output    []genField // the fields written each save step
+	Externals []genField
+	Tables    []genTable
+	Hidden    []hiddenLevel
+
+	// the step method, and the statements run by initModel, calc
+	// and save
+	Step            string
+	Initials        []string
+	Auxes           []string
+	Rates           []string
+	Supplementaries []string
+
+	Math   bool            // the generated code uses package math
+	Funcs  map[string]bool // the helpers it uses, by built-in
+	Params bool            // the generated code has external constants
 
-func (g *generator) declList(list []Decl) {
+	Standalone bool // the program is documented as a single file to build
+
+	method     IntegrationMethod
+	debugState bool                 // the hidden levels are output
+	eqn        string               // the variable whose equation is being generated
+	eqnSites   map[string]int       // calls to each stateful built-in by eqn so far
+	sites      map[string]int       // calls to each stateful built-in so far
+	types      map[string]string    // variable types, by upper-cased name
+	fields     map[string]*genField // by upper-cased name
+	xs         map[string][]float64 // table x values, from TABHL calls
 }
 
+// ErrNotConstant is returned by constEval for an expression that
+// refers to a variable, and so can't be evaluated at compile time.
+var ErrNotConstant = errors.New("expression isn't constant")
+
 // constEval returns the float64 value represented by Expr, or an
-// error if it can't be evaluated at compile time.
+// error if it can't be evaluated at compile time.  Literals may be
+// combined with parentheses, signs and the + - * / operators, so
+// that C DT=1/4 is 0.25, and ^, which raises to a power.
 func constEval(e Expr) (v float64, err error) {
 	// if we're wrapped in units, remove them.  Unit safety is a
 	// separate issue.
-	e = stripUnits(e)
-	basic, ok := e.(*BasicLit)
-	if !ok {
-		err = fmt.Errorf("val %T not BasicLit", e)
-		return
-	}
-	return strconv.ParseFloat(basic.Value, 64)
-}
-
-func isConst(e Expr) bool {
-	if _, err := constEval(e); err == nil {
-		return true
+	switch x := stripUnits(e).(type) {
+	case *BasicLit:
+		return x.Float64()
+	case *ParenExpr:
+		return constEval(x.X)
+	case *UnaryExpr:
+		if v, err = constEval(x.X); err != nil {
+			return
+		}
+		switch x.Op {
+		case token.ADD:
+			return v, nil
+		case token.SUB:
+			return -v, nil
+		}
+		return 0, fmt.Errorf("unary operator %s isn't arithmetic", x.Op)
+	case *BinaryExpr:
+		var l, r float64
+		if l, err = constEval(x.X); err != nil {
+			return
+		}
+		if r, err = constEval(x.Y); err != nil {
+			return
+		}
+		switch x.Op {
+		case token.ADD:
+			return l + r, nil
+		case token.SUB:
+			return l - r, nil
+		case token.MUL:
+			return l * r, nil
+		case token.QUO:
+			if r == 0 {
+				return 0, fmt.Errorf("division by zero in %s", exprString(x))
+			}
+			return l / r, nil
+		case token.XOR:
+			return math.Pow(l, r), nil
+		}
+		return 0, fmt.Errorf("operator %s isn't arithmetic", x.Op)
+	case *Ident, *RefExpr, *SubscriptExpr:
+		return 0, ErrNotConstant
 	}
-	return false
+	return 0, fmt.Errorf("val %T not BasicLit", e)
 }
 
 func kvConvert(e Expr) (k string, v Expr, err error) {
@@ -154,96 +381,739 @@ func kvConvert(e Expr) (k string, v Expr, err error) {
 	return ident.Name, kv.Value, nil
 }
 
-func (g *generator) timespec(elts []Expr) {
-	for _, e := range elts {
-		k, val, err := kvConvert(e)
+// goName returns the Go identifier for the variable with the given
+// upper-cased name.
+func goName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// goExpr returns Go source computing e from the current values of
+// the variables it references.
+func (g *generator) goExpr(e Expr) (string, error) {
+	switch x := e.(type) {
+	case *BasicLit:
+		return x.Value, nil
+	case *Ident:
+		return g.goRef(x)
+	case *RefExpr:
+		return g.goRef(&x.Ident)
+	case *SubscriptExpr:
+		return g.goRef(x.Base)
+	case *UnitExpr:
+		return g.goExpr(x.X)
+	case *ParenExpr:
+		inner, err := g.goExpr(x.X)
 		if err != nil {
-			panic(fmt.Sprintf("kvConvert(%v): %s", e, err))
+			return "", err
 		}
-		v, err := constEval(val)
+		return "(" + inner + ")", nil
+	case *UnaryExpr:
+		inner, err := g.goExpr(x.X)
 		if err != nil {
-			panic(fmt.Sprintf("timespec constEval(%v): %s",
-				val, err))
+			return "", err
 		}
-		switch k {
-		case "start":
-			g.curr.Time.Start = v
-		case "end":
-			g.curr.Time.End = v
-		case "dt":
-			g.curr.Time.DT = v
-		case "save_step":
-			g.curr.Time.SaveStep = v
-		default:
-			panic(fmt.Sprintf("timespec unknown key %s", k))
+		return x.Op.String() + inner, nil
+	case *BinaryExpr:
+		if isComparison(x.Op) {
+			return "", fmt.Errorf("comparison %s outside of an IF", exprString(x))
+		}
+		// arithmetic on literals is done here, as Go would
+		// do 1/4 in integers
+		if v, err := constEval(x); err == nil {
+			return strconv.FormatFloat(v, 'g', -1, 64), nil
+		}
+		l, err := g.goExpr(x.X)
+		if err != nil {
+			return "", err
+		}
+		r, err := g.goExpr(x.Y)
+		if err != nil {
+			return "", err
+		}
+		if x.Op == token.XOR {
+			g.Math = true
+			return fmt.Sprintf("math.Pow(%s, %s)", l, r), nil
+		}
+		return fmt.Sprintf("%s %s %s", l, x.Op, r), nil
+	case *CallExpr:
+		return g.goCall(x)
+	case *IfExpr:
+		cond, err := g.goCond(x.Cond)
+		if err != nil {
+			return "", err
+		}
+		var parts [2]string
+		for i, x := range []Expr{x.Then, x.Else} {
+			if parts[i], err = g.goExpr(x); err != nil {
+				return "", err
+			}
 		}
+		return goChoice(cond, parts[0], parts[1]), nil
 	}
+	return "", fmt.Errorf("can't generate Go for %T", e)
 }
 
-func varFromDecl(d *VarDecl) (v runtime.Var, err error) {
-	//log.Printf("var '%s': %s - %s", d.Name.Name, d.Type.Name, runtime.TypeForName(d.Type.Name))
-	return runtime.Var{d.Name.Name, runtime.TypeForName(d.Type.Name)}, nil
+// goChoice returns Go source for a, if the condition cond holds, or
+// else b.  Only the one chosen is computed, so the other may divide
+// by zero, look a table up out of its range or draw a random number
+// without it affecting the result.
+func goChoice(cond, a, b string) string {
+	return fmt.Sprintf("func() float64 {\n\tif %s {\n\t\treturn %s\n\t}\n\treturn %s\n}()", cond, a, b)
 }
 
-func (g *generator) initial(name string, expr Expr) (err error) {
-	val, err := constEval(expr)
-	if err == nil {
-		init := fmt.Sprintf(`%f`, val)
-		g.curr.Initials[name] = init
+// goCond returns Go source for the condition of an IF.  Anything
+// other than a comparison holds when it is non-zero.
+func (g *generator) goCond(e Expr) (string, error) {
+	for {
+		p, ok := stripUnits(e).(*ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.X
+	}
+	if x, ok := stripUnits(e).(*BinaryExpr); ok && isComparison(x.Op) {
+		l, err := g.goExpr(x.X)
+		if err != nil {
+			return "", err
+		}
+		r, err := g.goExpr(x.Y)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", l, x.Op, r), nil
+	}
+	v, err := g.goExpr(e)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%s) != 0", v), nil
+}
+
+// goMath maps the built-ins with an equivalent in Go's math package
+// to it.
+var goMath = map[string]string{
+	"MAX":  "math.Max",
+	"MIN":  "math.Min",
+	"ABS":  "math.Abs",
+	"SQRT": "math.Sqrt",
+	"EXP":  "math.Exp",
+	"LOG":  "math.Log",
+	"SIN":  "math.Sin",
+	"COS":  "math.Cos",
+}
+
+// helpers maps the built-ins computed by a helper function in the
+// generated code to the helper, and the arguments passed to it after
+// the call's own.  The input functions are passed the time, and
+// PULSE the step too.
+var helpers = map[string]struct{ fn, extra string }{
+	"STEP":  {"stepInput", "m.TIME"},
+	"RAMP":  {"rampInput", "m.TIME"},
+	"PULSE": {"pulseInput", "m.TIME, dt"},
+}
+
+// randomHelpers maps the stochastic built-ins to the helper computing
+// them from the generated program's rng.
+var randomHelpers = map[string]string{
+	"NOISE":  "noise",
+	"NORMRN": "normrn",
+}
+
+// goCall returns Go source for a function call.  Built-ins with a Go
+// equivalent are computed in place, those in helpers by a helper
+// function in the generated code and TABHL looks up its table.  CLIP
+// computes only the argument it chooses, as IF does.
+// SMOOTH and DELAY3 read the hidden levels holding their state, and
+// the stochastic built-ins are passed the program's random source.
+func (g *generator) goCall(c *CallExpr) (string, error) {
+	name := funcName(c)
+	if name == "" {
+		return "", fmt.Errorf("call of non-function %T", c.Fun)
+	}
+	if n, ok := builtins[name]; ok && len(c.Args) != n {
+		return "", fmt.Errorf("%s takes %d arguments, not %d", name, n, len(c.Args))
+	}
+
+	if name == "TABHL" {
+		// the table is passed by name, not value, and its x
+		// values were collected by tableXs
+		table, ok := c.Args[0].(*Ident)
+		if !ok || g.types[strings.ToUpper(table.Name)] != "table" {
+			return "", fmt.Errorf("TABHL of %s, not a table", exprString(c.Args[0]))
+		}
+		x, err := g.goExpr(c.Args[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("tab%s.lookup(%s)", goName(strings.ToUpper(table.Name)), x), nil
+	}
+
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		var err error
+		if args[i], err = g.goExpr(arg); err != nil {
+			return "", err
+		}
+	}
+	var fn string
+	if name == "CLIP" {
+		return goChoice(fmt.Sprintf("%s >= %s", args[2], args[3]), args[0], args[1]), nil
+	} else if f, ok := goMath[name]; ok {
+		fn = f
+		g.Math = true
+	} else if name == "SMOOTH" {
+		return g.smooth(args[0], args[1]), nil
+	} else if name == "DELAY3" {
+		return g.delay3(args[0], args[1]), nil
+	} else if r, ok := randomHelpers[name]; ok {
+		fn = r
+		args = append([]string{"rng"}, args...)
+		g.Funcs[name] = true
+	} else if h, ok := helpers[name]; ok {
+		fn = h.fn
+		if h.extra != "" {
+			args = append(args, h.extra)
+		}
+		g.Funcs[name] = true
 	} else {
-		expr := stripUnits(expr)
-		switch e := expr.(type) {
-		case *RefExpr:
-			if _, ok := g.curr.Vars[e.Ident.Name]; ok {
-				init := fmt.Sprintf(`s.Curr["%s"]`, e.Name)
-				g.curr.Initials[name] = init
-				err = nil
-			} else {
-				err = fmt.Errorf("initial(%s): non-const ident %v",
-					name, e.Name)
+		return "", fmt.Errorf("can't generate Go for function %s", exprString(c.Fun))
+	}
+	return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", ")), nil
+}
+
+// Random returns true if the generated code uses random numbers, and
+// so seeds a random source from the command line.
+func (g *generator) Random() bool {
+	for name := range randomHelpers {
+		if g.Funcs[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags returns true if the generated code has command line flags.
+func (g *generator) Flags() bool {
+	return g.Params || g.Random()
+}
+
+// hide adds the hidden level field, output as name, to the model.
+func (g *generator) hide(name, field, init, eqn string) {
+	g.Fields = append(g.Fields, genField{Field: field})
+	g.Hidden = append(g.Hidden, hiddenLevel{Name: name, Field: field, Init: init, Eqn: eqn})
+}
+
+// hiddenName returns the name the hidden state of a call of the
+// built-in fn is output as, tying it to the call site: the variable
+// whose equation makes the call and fn, as in AVG.SMOOTH, numbered
+// from the second call of fn in the same equation, as in
+// AVG.SMOOTH#2.
+func (g *generator) hiddenName(fn string) string {
+	name := g.eqn + "." + fn
+	g.eqnSites[name]++
+	if n := g.eqnSites[name]; n > 1 {
+		name += fmt.Sprintf("#%d", n)
+	}
+	return name
+}
+
+// smooth returns Go source for SMOOTH(x, avt), the exponential
+// average of x over the averaging time avt.  The average is a hidden
+// level of its own for each call, starting at x and moving towards it
+// by 1/avt of the difference each unit of time.
+func (g *generator) smooth(x, avt string) string {
+	field := fmt.Sprintf("_smooth_%d", g.sites["SMOOTH"])
+	g.sites["SMOOTH"]++
+	g.hide(g.hiddenName("SMOOTH"), field, x, fmt.Sprintf("m.%s + dt*(%s-m.%s)/(%s)", field, x, field, avt))
+	return "m." + field
+}
+
+// delay3 returns Go source for DELAY3(in, del), in delayed by del
+// through three hidden levels in series, each emptying into the next
+// with a delay of del/3.  The output is the rate out of the last.
+// Each stage starts in equilibrium, holding in*del/3.
+func (g *generator) delay3(in, del string) string {
+	n := g.sites["DELAY3"]
+	g.sites["DELAY3"]++
+	name := g.hiddenName("DELAY3")
+	// 3.0, as Go divides a literal del by 3 in integers
+	stage := "(%s)/((%s)/3.0)"
+	rate := in
+	for i := 1; i <= 3; i++ {
+		field := fmt.Sprintf("_delay3_%d_%d", n, i)
+		out := fmt.Sprintf(stage, "m."+field, del)
+		g.hide(fmt.Sprintf("%s.%d", name, i), field, fmt.Sprintf("(%s)*(%s)/3.0", in, del),
+			fmt.Sprintf("m.%s + dt*(%s-%s)", field, rate, out))
+		rate = out
+	}
+	return rate
+}
+
+// A tableRange is the range of x values a table is looked up over,
+// from lo to hi by step, as given to TABHL.  A range may descend,
+// with hi below lo and a negative step.
+type tableRange struct {
+	lo, hi, step float64
+}
+
+// xs returns the x values of r, in the order TABHL gives them.
+func (r tableRange) xs() []float64 {
+	n := int(math.Floor((r.hi-r.lo)/r.step+0.5)) + 1
+	xs := make([]float64, n)
+	for i := range xs {
+		xs[i] = r.lo + float64(i)*r.step
+	}
+	return xs
+}
+
+// descending reports whether r's x values decrease.
+func (r tableRange) descending() bool {
+	return r.step < 0
+}
+
+// A RangeError reports a TABHL call at Pos whose range can't be
+// looked up over.
+type RangeError struct {
+	Pos   token.Pos
+	Table string
+	Msg   string
+}
+
+func (e RangeError) Error() string {
+	return fmt.Sprintf("TABHL(%s): %s", e.Table, e.Msg)
+}
+
+// tableRanges returns the range each table in m is looked up over
+// with TABHL, by upper-cased name.  TABHL takes the first and last x
+// and the step between them, rather than the T card giving them.
+// The step must be nonzero, and go from the first x toward the last.
+// Errors are RangeErrors.
+func tableRanges(m *ModelDecl) (ranges map[string]tableRange, err error) {
+	ranges = map[string]tableRange{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		Inspect(assign.Rhs, func(n Node) bool {
+			c, ok := n.(*CallExpr)
+			if !ok || err != nil || funcName(c) != "TABHL" || len(c.Args) != 5 {
+				return err == nil
 			}
-		default:
-			err = fmt.Errorf("initial(%s): non-const %v (%T)",
-				name, expr, expr)
+			table, ok := c.Args[0].(*Ident)
+			if !ok {
+				return true
+			}
+			var lim [3]float64
+			for i := range lim {
+				if lim[i], ok = foldConst(c.Args[2+i], nil); !ok {
+					err = RangeError{c.Args[2+i].Pos(), table.Name,
+						fmt.Sprintf("non-constant %s", exprString(c.Args[2+i]))}
+					return false
+				}
+			}
+			r := tableRange{lim[0], lim[1], lim[2]}
+			if r.step == 0 || (r.hi-r.lo)*r.step < 0 {
+				err = RangeError{c.Args[4].Pos(), table.Name,
+					fmt.Sprintf("bad range %g to %g by %g", r.lo, r.hi, r.step)}
+				return false
+			}
+			name := strings.ToUpper(table.Name)
+			if prev, ok := ranges[name]; ok && !reflect.DeepEqual(prev.xs(), r.xs()) {
+				err = RangeError{c.Pos(), table.Name, "used with different ranges"}
+				return false
+			}
+			ranges[name] = r
+			return true
+		})
+	}
+	return
+}
+
+// tableXs returns the x values of each table in m looked up with
+// TABHL, by upper-cased name.
+func tableXs(m *ModelDecl) (map[string][]float64, error) {
+	ranges, err := tableRanges(m)
+	if err != nil {
+		return nil, err
+	}
+	xs := map[string][]float64{}
+	for name, r := range ranges {
+		xs[name] = r.xs()
+	}
+	return xs, nil
+}
+
+// goRef returns Go source for a reference to a variable.  DT is
+// removed from the model into its timespec, and is available to the
+// generated code as dt.
+func (g *generator) goRef(id *Ident) (string, error) {
+	n := strings.ToUpper(id.Name)
+	switch ty, ok := g.types[n]; {
+	case n == "DT":
+		return "dt", nil
+	case n == "TIME":
+		return "m.TIME", nil
+	case !ok:
+		return "", fmt.Errorf("undefined: %s", id.Name)
+	case ty == "table":
+		return "", fmt.Errorf("table %s used outside of TABHL", id.Name)
+	}
+	return "m." + goName(n), nil
+}
+
+// goComment returns the documentation and units of d as Go line
+// comments, each followed by a newline, or "" if d has neither.
+func goComment(d *VarDecl) string {
+	text := strings.TrimSuffix(d.Doc.Text(), "\n")
+	if u := unitsText(d); u != "" {
+		if text != "" {
+			text += "\n"
+		}
+		text += "units: " + u
+	}
+	if text == "" {
+		return ""
+	}
+	return "// " + strings.Replace(text, "\n", "\n// ", -1) + "\n"
+}
+
+// initialEqns returns the equations of m's constants, external
+// constants and the initial values of its levels, by upper-cased
+// name, and their names ordered so that each comes after the ones it
+// references.
+func initialEqns(m *ModelDecl) ([]string, map[string]Expr, error) {
+	var names []string
+	eqns := map[string]Expr{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		n := strings.ToUpper(assign.Lhs.Name.Name)
+		switch assign.Lhs.Type.Name {
+		case "const", "initial", "external":
+			eqns[n] = assign.Rhs
+		case "stock":
+			// a level built by ModelBuilder carries its
+			// initial value with it
+			cl, ok := assign.Rhs.(*CompositeLit)
+			if !ok {
+				continue
+			}
+			for _, e := range cl.Elts {
+				if k, v, err := kvConvert(e); err == nil && k == "initial" {
+					eqns[n] = v
+				}
+			}
+		}
+		if _, ok := eqns[n]; ok {
+			names = append(names, n)
+		}
+	}
+
+	for _, n := range names {
+		if err := checkInitLookups(n, eqns); err != nil {
+			return nil, nil, err
 		}
 	}
+
+	const (
+		visiting = iota + 1
+		done
+	)
+	var sorted []string
+	state := map[string]int{}
+	var visit func(n string) error
+	visit = func(n string) error {
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("%s: circular initial value", n)
+		case done:
+			return nil
+		}
+		state[n] = visiting
+		for _, ref := range refNames(eqns[n]) {
+			if _, ok := eqns[ref]; ok {
+				if err := visit(ref); err != nil {
+					return err
+				}
+			}
+		}
+		state[n] = done
+		sorted = append(sorted, n)
+		return nil
+	}
+	for _, n := range names {
+		if err := visit(n); err != nil {
+			return nil, nil, err
+		}
+	}
+	return sorted, eqns, nil
+}
+
+// checkInitLookups returns an error if a TABHL in the initial
+// equation of n, one of eqns, looks up its table with an input that
+// can't be computed before the simulation starts: one referring to n
+// itself, or to anything but TIME and the other constants and
+// initial values in eqns.
+func checkInitLookups(n string, eqns map[string]Expr) (err error) {
+	Inspect(eqns[n], func(node Node) bool {
+		c, ok := node.(*CallExpr)
+		if !ok || err != nil || funcName(c) != "TABHL" || len(c.Args) < 2 {
+			return err == nil
+		}
+		for _, ref := range refNames(c.Args[1]) {
+			if _, ok := eqns[ref]; (!ok || ref == n) && ref != "TIME" {
+				err = fmt.Errorf("%s: lookup input isn't constant-evaluable at init: %s",
+					n, exprString(c.Args[1]))
+				return false
+			}
+		}
+		return true
+	})
 	return
 }
 
-func (g *generator) stock(name string, expr Expr) error {
+// initials adds the statements setting m's constants, external
+// constants and the initial values of its levels to g.Initials, each
+// after the ones it references.
+func (g *generator) initials(m *ModelDecl) error {
+	names, eqns, err := initialEqns(m)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if g.types[n] == "external" {
+			v, ok := foldConst(eqns[n], nil)
+			if !ok {
+				return fmt.Errorf("external %s: value isn't a number", n)
+			}
+			f := *g.fields[n]
+			f.Value = strconv.FormatFloat(v, 'g', -1, 64)
+			g.Externals = append(g.Externals, f)
+			g.Initials = append(g.Initials, fmt.Sprintf("m.%s = *flag%s", f.Field, f.Field))
+			continue
+		}
+		g.eqn = n
+		rhs, err := g.goExpr(eqns[n])
+		if err != nil {
+			return fmt.Errorf("%s: %s", n, err)
+		}
+		g.Initials = append(g.Initials, fmt.Sprintf("m.%s = %s", goName(n), rhs))
+	}
+	sort.Sort(byField(g.Externals))
+	g.Params = len(g.Externals) > 0
+	return nil
+}
+
+// level returns Go source for the value of the level name at K,
+// computed from the model at J.  A level built by ModelBuilder gives
+// its flows, rather than the equation for its next value.
+func (g *generator) level(name string, expr Expr) (string, error) {
+	g.eqn = name
 	cl, ok := expr.(*CompositeLit)
 	if !ok {
-		panic(fmt.Sprintf("stock is %T, not CompositeLit", expr))
+		rhs, err := g.goExpr(expr)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", name, err)
+		}
+		return rhs, nil
 	}
 	var bi, in, out string
 	for _, e := range cl.Elts {
 		k, val, err := kvConvert(e)
 		if err != nil {
-			panic(fmt.Sprintf("kvConvert(%s): %s", name, err))
+			return "", fmt.Errorf("stock(%s): %s", name, err)
 		}
 		switch k {
 		case "initial":
-			if err := g.initial(name, val); err != nil {
-				return fmt.Errorf("initial(%s, %s): %s",
-					name, val, err)
+			// set by initModel
+		case "biflow", "inflow", "outflow":
+			flow, err := g.goExpr(val)
+			if err != nil {
+				return "", fmt.Errorf("stock(%s) %s: %s", name, k, err)
+			}
+			switch k {
+			case "biflow":
+				bi = "+" + flow
+			case "inflow":
+				in = "+" + flow
+			case "outflow":
+				out = "-(" + flow + ")"
 			}
-		case "biflow":
-			bi = fmt.Sprintf("+%s", val)
-		case "inflow":
-			in = fmt.Sprintf("+%s", val)
-		case "outflow":
-			out = fmt.Sprintf("-(%s)", val)
 		default:
-			panic(fmt.Sprintf("stock(%s): unknown k %s",
-				name, k))
+			return "", fmt.Errorf("stock(%s): unknown key %s", name, k)
+		}
+	}
+	return fmt.Sprintf("m.%s + (%s)*dt", goName(name), strings.TrimPrefix(bi+in+out, "+")), nil
+}
+
+// rebase returns the Go expression src, which reads the fields of
+// m, reading the fields of recv instead.
+func rebase(src, recv string) (string, error) {
+	x, err := parser.ParseExpr(src)
+	if err != nil {
+		return "", err
+	}
+	ast.Inspect(x, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Name == "m" {
+				id.Name = recv
+			}
+		}
+		return true
+	})
+	var buf bytes.Buffer
+	if err := format.Node(&buf, token.NewFileSet(), x); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// genSimLoop returns the step method of the generated Model, which
+// advances the simulation of m by dt.  With Euler, it's DYNAMO's
+// two-phase update: every level equation reads the values at J from
+// a copy of the model taken before any level changes, and writes the
+// level at K, so no level sees another's new value whatever their
+// order.  With RK4, the level equations are evaluated over DT at the
+// four stages of the Runge-Kutta method, each from a copy of the
+// model with the levels moved along and the auxiliaries and rates
+// recomputed, and the levels at K are the weighted average.
+func (g *generator) genSimLoop(m *ModelDecl) (*ast.FuncDecl, error) {
+	var names, levels []string
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Type.Name != "stock" {
+			continue
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		eqn, err := g.level(name, assign.Rhs)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, goName(name))
+		levels = append(levels, eqn)
+	}
+	for _, h := range g.Hidden {
+		names = append(names, h.Field)
+		levels = append(levels, h.Eqn)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("package main\n\nfunc (m *Model) step(dt float64) {\n")
+	switch {
+	case len(levels) == 0:
+	case g.method == RK4:
+		// the rate of change of each level at a stage is its
+		// Euler step from there over dt
+		buf.WriteString("j := *m\ns := j\n")
+		for stage := 1; stage <= 4; stage++ {
+			if stage > 1 {
+				h := "dt / 2"
+				if stage == 4 {
+					h = "dt"
+				}
+				buf.WriteString("s = j\n")
+				for _, n := range names {
+					fmt.Fprintf(&buf, "s.%s = j.%s + %s*k%d%s\n", n, n, h, stage-1, n)
+				}
+				fmt.Fprintf(&buf, "s.TIME = j.TIME + %s\ns.calc()\n", h)
+			}
+			for i, n := range names {
+				rhs, err := rebase(levels[i], "s")
+				if err != nil {
+					return nil, fmt.Errorf("genSimLoop: %s", err)
+				}
+				fmt.Fprintf(&buf, "k%d%s := (%s - s.%s) / dt\n", stage, n, rhs, n)
+			}
+		}
+		for _, n := range names {
+			fmt.Fprintf(&buf, "m.%s = j.%s + dt*(k1%s+2*k2%s+2*k3%s+k4%s)/6\n",
+				n, n, n, n, n, n)
+		}
+	default:
+		buf.WriteString("j := *m\n")
+		for i, n := range names {
+			rhs, err := rebase(levels[i], "j")
+			if err != nil {
+				return nil, fmt.Errorf("genSimLoop: %s", err)
+			}
+			fmt.Fprintf(&buf, "m.%s = %s\n", n, rhs)
+		}
+	}
+	buf.WriteString("m.TIME += dt\nm.calc()\n}\n")
+
+	f, err := parser.ParseFile(token.NewFileSet(), "step.go", buf.Bytes(), 0)
+	if err != nil {
+		return nil, fmt.Errorf("genSimLoop: %s", err)
+	}
+	return f.Decls[0].(*ast.FuncDecl), nil
+}
+
+// checkSupplementaries returns an error if an equation in m other
+// than a supplementary's references a supplementary.  Supplementaries
+// are only computed when the model is saved, for its output.
+func checkSupplementaries(m *ModelDecl) error {
+	supps := map[string]bool{}
+	for _, s := range m.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && assign.Lhs.Type != nil && assign.Lhs.Type.Name == "supplementary" {
+			supps[strings.ToUpper(assign.Lhs.Name.Name)] = true
+		}
+	}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Type.Name == "supplementary" {
+			continue
+		}
+		for _, ref := range refNames(assign.Rhs) {
+			if supps[ref] {
+				return fmt.Errorf("%s: references the supplementary %s, which is only computed for output",
+					assign.Lhs.Name.Name, ref)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPure returns an error if an auxiliary or rate in m references
+// a rate.  Its value is then the one from the last step, which RK4
+// can't recompute at each stage from the levels alone.
+func checkPure(m *ModelDecl) error {
+	flows := map[string]bool{}
+	for _, s := range m.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && assign.Lhs.Type != nil && assign.Lhs.Type.Name == "flow" {
+			flows[strings.ToUpper(assign.Lhs.Name.Name)] = true
+		}
+	}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		switch assign.Lhs.Type.Name {
+		case "aux", "supplementary", "flow":
+		default:
+			continue
+		}
+		for _, ref := range refNames(assign.Rhs) {
+			if flows[ref] {
+				return fmt.Errorf("%s: references the rate %s, which RK4 can't integrate",
+					assign.Lhs.Name.Name, ref)
+			}
 		}
 	}
-	eqn := fmt.Sprintf(`s.Next["%s"] = s.Curr["%s"] + (%s %s %s)*dt`, name, name, bi, in, out)
-	g.curr.Stocks = append(g.curr.Stocks, eqn)
 	return nil
 }
 
-func (g *generator) table(name string, e Expr) error {
+// table adds the table name to g.Tables.  A table indexed where it's
+// declared is also a variable, looked up by calc.
+func (g *generator) table(name string, doc string, e Expr) error {
 	var t *TableExpr
 
 	// if we're wrapped in units, remove them.  Unit safety is a
@@ -253,20 +1123,41 @@ func (g *generator) table(name string, e Expr) error {
 	switch r := e.(type) {
 	case *TableExpr:
 		t = r
+	case *TableFwdExpr:
+		xs, ok := g.xs[name]
+		if !ok {
+			return fmt.Errorf("table %s isn't used by any TABHL", name)
+		}
+		if len(xs) != len(r.Ys) {
+			return fmt.Errorf("table %s has %d values, TABHL expects %d",
+				name, len(r.Ys), len(xs))
+		}
+		// the lookup wants ascending xs, so a descending
+		// range's pairs are given last first.
+		t = new(TableExpr)
+		desc := len(xs) > 1 && xs[1] < xs[0]
+		for i := range r.Ys {
+			if desc {
+				i = len(xs) - 1 - i
+			}
+			t.Pairs = append(t.Pairs, &PairExpr{X: floatLit(xs[i]), Y: r.Ys[i]})
+		}
 	case *IndexExpr:
 		t, _ = r.X.(*TableExpr)
 
-		eqn := fmt.Sprintf(`s.Curr["%s"] = s.Tables["%s"].Lookup(%s)`,
-			name, name, r.Index)
-		g.curr.Equations = append(g.curr.Equations, eqn)
-
-	default:
+		index, err := g.goExpr(r.Index)
+		if err != nil {
+			return fmt.Errorf("table(%s) index: %s", name, err)
+		}
+		g.Auxes = append(g.Auxes, fmt.Sprintf("m.%s = tab%s.lookup(%s)",
+			goName(name), goName(name), index))
+		doc = ""
+	}
+	if t == nil || len(t.Pairs) == 0 {
 		return fmt.Errorf("table w/ non-table '%s': %#v", name, e)
 	}
 
-	l := len(t.Pairs)
-	tab := [2][]float64{make([]float64, l), make([]float64, l)}
-
+	tab := genTable{Field: goName(name), Doc: doc}
 	for i, p := range t.Pairs {
 		x, err := constEval(p.X)
 		if err != nil {
@@ -276,75 +1167,30 @@ func (g *generator) table(name string, e Expr) error {
 		if err != nil {
 			return fmt.Errorf("pair %d Y (%s): %s", i, p.Y, err)
 		}
-		tab[0][i] = x
-		tab[1][i] = y
+		tab.Xs = append(tab.Xs, x)
+		tab.Ys = append(tab.Ys, y)
 	}
-
-	g.curr.Tables[name] = tab
-
+	g.Tables = append(g.Tables, tab)
 	return nil
 }
 
-func (g *generator) expr(name string, expr Expr) {
-	var eqn string
-	switch g.curr.Vars[name].Type {
-	case runtime.TyConst:
-		g.initial(name, expr)
-		eqn := fmt.Sprintf(`s.Next["%s"] = s.Curr["%s"]`, name, name)
-		g.curr.Stocks = append(g.curr.Stocks, eqn)
-	case runtime.TyAux:
-		if isConst(expr) {
-			g.initial(name, expr)
-			eqn = fmt.Sprintf(`s.Curr["%s"] = c.Data(s, "%s")`, name, name)
-			g.curr.UseCoordFlows = true
-		} else {
-			eqn = fmt.Sprintf(`s.Curr["%s"] = %s`, name, expr)
-		}
-	case runtime.TyTable:
-		if err := g.table(name, expr); err != nil {
-			log.Printf("table(%s): %s", name, err)
-		}
-	default:
-		eqn = fmt.Sprintf(`s.Curr["%s"] = %s`, name, expr)
-	}
-	if len(eqn) > 0 {
-		g.curr.Equations = append(g.curr.Equations, eqn)
-	}
-}
-
-func (g *generator) assign(s *AssignStmt) error {
-	if s.Lhs.Name.Name == "timespec" {
-		c, ok := s.Rhs.(*CompositeLit)
-		if !ok {
-			return fmt.Errorf("timespec is %T, not CompositeLit",
-				s.Rhs)
-		}
-		g.timespec(c.Elts)
-		return nil
-	}
-	v, ok := g.curr.Vars[s.Lhs.Name.Name]
-	if !ok {
-		return fmt.Errorf("assign: unknown v '%s'?", s.Lhs.Name.Name)
-	}
-	if v.Type == runtime.TyStock {
-		if err := g.stock(v.Name, s.Rhs); err != nil {
-			return err
-		}
-	} else {
-		g.expr(v.Name, s.Rhs)
+// expr adds the equation computing the auxiliary, rate or
+// supplementary name to the statements run by calc, or for a
+// supplementary by save.
+func (g *generator) expr(name string, expr Expr) error {
+	g.eqn = name
+	rhs, err := g.goExpr(expr)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
 	}
-	return nil
-}
-
-func (g *generator) stmt(s Stmt) error {
-	switch ss := s.(type) {
-	case *AssignStmt:
-		if err := g.assign(ss); err != nil {
-			return err
-		}
-	case *DeclStmt:
-	default:
-		log.Printf("stmt(%T): unimplemented - %T", s, s)
+	eqn := fmt.Sprintf("m.%s = %s", goName(name), rhs)
+	switch g.types[name] {
+	case "aux":
+		g.Auxes = append(g.Auxes, eqn)
+	case "flow":
+		g.Rates = append(g.Rates, eqn)
+	case "supplementary":
+		g.Supplementaries = append(g.Supplementaries, eqn)
 	}
 	return nil
 }
@@ -394,84 +1240,215 @@ func resolveType(d *VarDecl, rhs Expr) error {
 	return nil
 }
 
-func (g *generator) vars(stmts ...Stmt) (err error) {
-	addVar := func(vd *VarDecl) error {
-		v, err := varFromDecl(vd)
-		if err != nil {
-			return fmt.Errorf("varFromDecl(%v): %s", vd, err)
-		}
-		if v.Name != "timespec" {
-			g.curr.Vars[v.Name] = v
-		}
-		return nil
-	}
-outer:
+// isLookup returns true if rhs is a table indexed where it's
+// declared, making it a variable rather than only a table.  Its type
+// is recorded as "lookup".
+func isLookup(rhs Expr) bool {
+	_, ok := stripUnits(rhs).(*IndexExpr)
+	return ok
+}
+
+// byField sorts fields by Go name.
+type byField []genField
+
+func (f byField) Len() int           { return len(f) }
+func (f byField) Less(i, j int) bool { return f[i].Field < f[j].Field }
+func (f byField) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+
+// vars records the type of each variable declared by stmts, and the
+// fields of the generated Model holding them.  An N card gives the
+// initial value of the level of the same name, rather than declaring
+// a variable of its own.  The variables named by PRINT and PLOT
+// cards, if there are any, are those written out, in the order
+// named; otherwise every level, rate, auxiliary and supplementary
+// is.
+func (g *generator) vars(stmts ...Stmt) error {
+	var selected []*Ident
 	for i, s := range stmts {
+		var d *VarDecl
+		var ty string
 		switch ss := s.(type) {
+		case *OutputStmt:
+			selected = append(selected, ss.Names...)
+			continue
+		case *SpecStmt:
+			// the timespec has the values it gave
+			continue
 		case *AssignStmt:
-			if err = resolveType(ss.Lhs, ss.Rhs); err != nil {
-				break outer
+			if ss.Lhs.Name.Name == "timespec" {
+				continue
+			}
+			if err := resolveType(ss.Lhs, ss.Rhs); err != nil {
+				return err
+			}
+			d = ss.Lhs
+			if d.Type.Name == "table" {
+				if !isLookup(ss.Rhs) {
+					g.types[strings.ToUpper(d.Name.Name)] = "table"
+					continue
+				}
+				ty = "lookup"
 			}
-			err = addVar(ss.Lhs)
 		case *DeclStmt:
-			g.curr.Abstract = true
-			err = addVar(ss.Decl)
+			return fmt.Errorf("%s: abstract variables can't be simulated",
+				ss.Decl.Name.Name)
 		default:
-			err = fmt.Errorf("stmt %d (%v): unknown ty %T",
-				i, s, ss)
+			return fmt.Errorf("stmt %d (%v): unknown ty %T", i, s, ss)
 		}
-		if err != nil {
-			break
+
+		if ty == "" {
+			ty = d.Type.Name
+		}
+		n := strings.ToUpper(d.Name.Name)
+		if prev, ok := g.types[n]; !ok || prev == "initial" {
+			g.types[n] = ty
+		}
+		f, ok := g.fields[n]
+		if !ok {
+			f = &genField{Name: n, Field: goName(n)}
+			g.fields[n] = f
+		}
+		if doc := goComment(d); doc != "" {
+			f.Doc = doc
 		}
 	}
-	return
+
+	if len(selected) > 0 {
+		seen := map[string]bool{}
+		for _, id := range selected {
+			n := strings.ToUpper(id.Name)
+			f, ok := g.fields[n]
+			switch {
+			case g.types[n] == "table":
+				return fmt.Errorf("table %s can't be output", n)
+			case !ok:
+				return fmt.Errorf("no variable %s to output", n)
+			}
+			if !seen[n] {
+				seen[n] = true
+				g.Output = append(g.Output, *f)
+			}
+		}
+	}
+	for n, f := range g.fields {
+		g.Fields = append(g.Fields, *f)
+		switch {
+		case len(selected) > 0:
+		case g.types[n] == "const" || g.types[n] == "external" || g.types[n] == "initial":
+		case strings.Contains(n, "$"):
+			// the variables of an expanded macro call are
+			// hidden, like SMOOTH's level
+		default:
+			g.Output = append(g.Output, *f)
+		}
+	}
+	sort.Sort(byField(g.Fields))
+	if len(selected) == 0 {
+		sort.Sort(byField(g.Output))
+	}
+	return nil
 }
 
 func (g *generator) model(m *ModelDecl) error {
-	name := m.Name.Name
-	camelName := fmt.Sprintf("%c%s", unicode.ToUpper(rune(name[0])), name[1:])
-	g.curr = &genModel{
-		Name:      name,
-		CamelName: camelName,
-		Vars:      map[string]runtime.Var{},
-		Tables:    map[string]runtime.Table{},
-		Equations: []string{},
-		Stocks:    []string{},
-		Initials:  map[string]string{},
-	}
-	g.vars(m.Body.List...)
+	var errs ErrorVector
+	checkDivZero(m, token.NewFileSet(), &errs)
+	checkSubscripts(m, token.NewFileSet(), &errs)
+	if err := errs.GetError(Sorted); err != nil {
+		return err
+	}
+
+	ts, err := m.Timespec()
+	if err != nil {
+		return err
+	}
+	if ts.DT <= 0 {
+		return fmt.Errorf("DT must be positive, not %g", ts.DT)
+	}
+	g.Time = ts
+	g.Steps = int(math.Max(0, math.Floor((ts.End-ts.Start)/ts.DT+0.5)))
+	g.SaveEvery = int(math.Max(1, math.Floor(ts.SaveStep/ts.DT+0.5)))
+
+	if g.method == RK4 {
+		if err = checkPure(m); err != nil {
+			return err
+		}
+	}
+	if err = checkSupplementaries(m); err != nil {
+		return err
+	}
+	if g.xs, err = tableXs(m); err != nil {
+		return err
+	}
+	if err = g.vars(m.Body.List...); err != nil {
+		return err
+	}
+	if err = g.initials(m); err != nil {
+		return err
+	}
+
 	for _, s := range m.Body.List {
-		if err := g.stmt(s); err != nil {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Name.Name == "timespec" {
+			continue
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		switch assign.Lhs.Type.Name {
+		case "flow":
+			err = g.expr(name, assign.Rhs)
+		case "table":
+			err = g.table(name, goComment(assign.Lhs), assign.Rhs)
+		}
+		if err != nil {
 			return err
 		}
 	}
-	g.Models[m.Name.Name] = g.curr
-	g.curr = nil
 
-	return nil
-}
+	// auxiliaries are computed in dependency order, before the
+	// rates using them
+	auxes, err := TopoSort(m)
+	if err != nil {
+		return err
+	}
+	for _, s := range auxes {
+		if err := g.expr(strings.ToUpper(s.Lhs.Name.Name), s.Rhs); err != nil {
+			return err
+		}
+	}
 
-func tmplSimple(eqn string) bool {
-	return !strings.HasPrefix(eqn, `s.Curr["`)
+	step, err := g.genSimLoop(m)
+	if err != nil {
+		return err
+	}
+	if g.debugState {
+		for _, h := range g.Hidden {
+			g.Output = append(g.Output, genField{Name: h.Name, Field: h.Field})
+		}
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, token.NewFileSet(), step); err != nil {
+		return fmt.Errorf("format step: %s", err)
+	}
+	g.Step = buf.String()
+	return nil
 }
 
 func (g *generator) file(f *File) ([]byte, error) {
-	for _, d := range f.Decls {
-		md, ok := d.(*ModelDecl)
-		if !ok {
-			log.Printf("top level decl that isn't a model: %v (%T)", d, d)
-			continue
-		}
-		if err := g.model(md); err != nil {
-			return nil, fmt.Errorf("g.model: %s", err)
-		}
+	main := f.GetModel("main")
+	if main == nil {
+		return nil, fmt.Errorf("no model named main")
+	}
+	main, err := expandMacros(main, f.Macros)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.model(main); err != nil {
+		return nil, fmt.Errorf("g.model: %s", err)
 	}
 
 	var buf bytes.Buffer
-	tmpl := template.New("model.go")
-	tmpl = tmpl.Funcs(template.FuncMap{"simple": tmplSimple})
-	if _, err := tmpl.Parse(fileTmpl); err != nil {
-		panic(fmt.Sprintf("Parse(modelTmpl): %s", err))
+	tmpl, err := template.New("model.go").Parse(fileTmpl)
+	if err != nil {
+		panic(fmt.Sprintf("Parse(fileTmpl): %s", err))
 	}
 	if err := tmpl.Execute(&buf, g); err != nil {
 		panic(fmt.Sprintf("Execute(%v): %s", g, err))
@@ -480,9 +1457,54 @@ func (g *generator) file(f *File) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func GenGo(f *File) (*ast.File, error) {
+// An IntegrationMethod is a way of integrating the levels of a model
+// over each step.
+type IntegrationMethod int
+
+const (
+	Euler IntegrationMethod = iota // DYNAMO's own, and the default
+	RK4                            // 4th-order Runge-Kutta
+)
+
+// Options control the program generated by GenGo.
+type Options struct {
+	IntegrationMethod IntegrationMethod
+
+	// DebugState adds the hidden levels of SMOOTH and DELAY3 to
+	// the output, after the model's variables.  Each is named
+	// for its call site: a SMOOTH in AVG's equation is
+	// AVG.SMOOTH, and the stages of a DELAY3 in OUT's are
+	// OUT.DELAY3.1 to OUT.DELAY3.3.
+	DebugState bool
+
+	// Standalone documents the program as a single file to be
+	// shared and built with the standard library alone, and
+	// checks that it imports nothing else.
+	Standalone bool
+}
+
+// GenGo returns a self-contained Go program simulating the model
+// named main in f, positioned in fset.  The program writes the time
+// and the model's levels, rates and auxiliaries to standard output as
+// CSV, a row each save step.  The documentation of each variable is
+// carried over as a comment on its field of the generated Model.
+func GenGo(fset *token.FileSet, f *File) (*ast.File, error) {
+	return new(Options).GenGo(fset, f)
+}
+
+// GenGo is like the package function GenGo, but integrates the
+// levels with o's IntegrationMethod.  RK4 requires that no auxiliary
+// or rate references a rate.
+func (o *Options) GenGo(fset *token.FileSet, f *File) (*ast.File, error) {
 	g := &generator{
-		Models: map[string]*genModel{},
+		method:     o.IntegrationMethod,
+		debugState: o.DebugState,
+		Standalone: o.Standalone,
+		Funcs:      map[string]bool{},
+		eqnSites:   map[string]int{},
+		sites:      map[string]int{},
+		types:      map[string]string{},
+		fields:     map[string]*genField{},
 	}
 
 	code, err := g.file(f)
@@ -491,11 +1513,20 @@ func GenGo(f *File) (*ast.File, error) {
 	}
 	log.Printf("c: %s", code)
 
-	fset := token.NewFileSet()
-	goFile, err := parser.ParseFile(fset, "model.go", code, 0)
+	goFile, err := parser.ParseFile(fset, "model.go", code, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
+	if o.Standalone {
+		for _, imp := range goFile.Imports {
+			// the standard library's import paths have no
+			// domain name
+			path, _ := strconv.Unquote(imp.Path.Value)
+			if strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+				return nil, fmt.Errorf("standalone program imports %s, outside the standard library", path)
+			}
+		}
+	}
 
 	return goFile, nil
 }
@@ -0,0 +1,659 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// genGo returns the formatted Go source GenGo generates for f.
+func genGo(t *testing.T, f *File, fset *token.FileSet) []byte {
+	af, err := GenGo(fset, f)
+	if err != nil {
+		t.Fatalf("GenGo: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, af); err != nil {
+		t.Fatalf("format.Node: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// runGo runs the Go program src with args, returning its output, or
+// skips the test if there's no go command to run it with.
+func runGo(t *testing.T, src []byte, args ...string) string {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to run the generated program")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "model.go")
+	if err := ioutil.WriteFile(path, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(gobin, append([]string{"run", path}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run: %s\n%s", err, out)
+	}
+	return string(out)
+}
+
+// buildGo checks that the Go program at path builds, or skips the
+// test if there's no go command to build it with.
+func buildGo(t *testing.T, path string) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the generated program")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go build won't take a file that doesn't end in .go
+	gopath := filepath.Join(dir, "model.go")
+	if err := ioutil.WriteFile(gopath, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(gobin, "build", "-o", filepath.Join(dir, "model"), gopath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%s doesn't build: %s\n%s", path, err, out)
+	}
+}
+
+// TestGenGoGolden compares the Go generated for each model in
+// testdata to its golden file, which must build.  Run the tests with
+// -update-golden to rewrite them.
+func TestGenGoGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 5 {
+		t.Fatalf("got %d models in testdata, want at least 5", len(paths))
+	}
+	for _, path := range paths {
+		fset := token.NewFileSet()
+		f, err := ParseFile(path, fset)
+		if err != nil {
+			t.Errorf("ParseFile: %s", err)
+			continue
+		}
+		golden := strings.TrimSuffix(path, ".dyn") + ".go.golden"
+		checkGolden(t, golden, genGo(t, f, fset))
+		buildGo(t, golden)
+	}
+}
+
+// simulateBoth runs the model src with Simulate and as the program
+// GenGo generates for it, returning both results.
+func simulateBoth(t *testing.T, src string) (sim, gen TimeSeries) {
+	f, fset := parseSrc(t, src)
+	sim, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	gen, err = ParseCSV(strings.NewReader(runGo(t, genGo(t, f, fset))))
+	if err != nil {
+		t.Fatalf("ParseCSV: %s", err)
+	}
+	return sim, gen
+}
+
+func TestGenGoComments(t *testing.T) {
+	const src = `* comments
+NOTE	population sector
+
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=100
+NOTE	births per person per year
+C	NB=.04
+R	B.KL=(NB)(POP.K)
+C	LENGTH=10
+C	DT=1
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, src)
+	out := string(genGo(t, f, fset))
+	doc := regexp.MustCompile(`\t// births per person per year\n\tNB +float64\n`)
+	if !doc.MatchString(out) {
+		t.Errorf("NB's NOTE isn't its field's comment:\n%s", out)
+	}
+	// a section heading, separated from the next card by a blank
+	// line, isn't documentation for it.
+	if strings.Contains(out, "population sector") {
+		t.Errorf("section heading attached to a variable:\n%s", out)
+	}
+}
+
+func TestGenGoDependencyOrder(t *testing.T) {
+	// each auxiliary uses the one after it
+	const src = `* reversed
+A	C.K=B.K*2
+A	B.K=A.K+1
+A	A.K=TIME.K
+C	LENGTH=3
+C	DT=1
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, src)
+	sorted, err := TopoSort(f.Decls[0].(*ModelDecl))
+	if err != nil {
+		t.Fatalf("TopoSort: %s", err)
+	}
+	var names []string
+	for _, s := range sorted {
+		names = append(names, s.Lhs.Name.Name)
+	}
+	if got := strings.Join(names, " "); got != "A B C" {
+		t.Errorf("TopoSort: got %s, want A B C", got)
+	}
+
+	// C is 2(TIME+1)
+	out := runGo(t, genGo(t, f, fset))
+	want := "TIME,A,B,C\n0,0,1,2\n1,1,2,4\n2,2,3,6\n3,3,4,8\n"
+	if out != want {
+		t.Errorf("got output\n%s\nwant\n%s", out, want)
+	}
+}
+
+// TestGenGoReference checks the generated simulation of House5's
+// population sector against testdata/hello.csv, the classic DYNAMO
+// results worked out by hand: with Euler's method POP grows by
+// 1+(NB-ND)*DT, or 15%, each step.
+func TestGenGoReference(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile("testdata/hello.dyn", fset)
+	if err != nil {
+		t.Fatalf("ParseFile: %s", err)
+	}
+	got, err := csv.NewReader(strings.NewReader(runGo(t, genGo(t, f, fset)))).ReadAll()
+	if err != nil {
+		t.Fatalf("reading output: %s", err)
+	}
+	ref, err := os.Open("testdata/hello.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	want, err := csv.NewReader(ref).ReadAll()
+	if err != nil {
+		t.Fatalf("reading testdata/hello.csv: %s", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(got), len(want))
+	}
+	if g, w := strings.Join(got[0], ","), strings.Join(want[0], ","); g != w {
+		t.Fatalf("got header %s, want %s", g, w)
+	}
+	for i := 1; i < len(want); i++ {
+		for j, ws := range want[i] {
+			g, err1 := strconv.ParseFloat(got[i][j], 64)
+			w, err2 := strconv.ParseFloat(ws, 64)
+			if err1 != nil || err2 != nil || math.Abs(g-w) > 1e-8*math.Abs(w) {
+				t.Errorf("row %d: %s is %s, want %s", i, want[0][j], got[i][j], ws)
+			}
+		}
+	}
+}
+
+func TestIntegrationMethods(t *testing.T) {
+	// dx/dt = -x, so X is exp(-TIME)
+	const src = `* decay
+L	X.K=X.J+(DT)(-D.JK)
+N	X=1
+R	D.KL=X.K
+C	LENGTH=1
+C	DT=.25
+C	SAVPER=1
+`
+	tests := []struct {
+		method IntegrationMethod
+		want   float64
+	}{
+		{Euler, math.Pow(.75, 4)},
+		{RK4, math.Exp(-1)},
+	}
+	f, fset := parseSrc(t, src)
+	for _, test := range tests {
+		ts, err := Simulate(f, SimulateOptions{IntegrationMethod: test.method})
+		if err != nil {
+			t.Fatalf("Simulate: %s", err)
+		}
+		xs := ts.Vars["X"]
+		if got := xs[len(xs)-1]; math.Abs(got-test.want) > 1e-4 {
+			t.Errorf("method %d: got X %g at TIME 1, want %g", test.method, got, test.want)
+		}
+	}
+
+	// the generated program agrees
+	af, err := (&Options{IntegrationMethod: RK4}).GenGo(fset, f)
+	if err != nil {
+		t.Fatalf("GenGo: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, af); err != nil {
+		t.Fatalf("format.Node: %s", err)
+	}
+	rows, err := csv.NewReader(strings.NewReader(runGo(t, buf.Bytes()))).ReadAll()
+	if err != nil {
+		t.Fatalf("reading output: %s", err)
+	}
+	last, found := rows[len(rows)-1], false
+	for i, name := range rows[0] {
+		if name != "X" {
+			continue
+		}
+		found = true
+		if got, err := strconv.ParseFloat(last[i], 64); err != nil || math.Abs(got-math.Exp(-1)) > 1e-4 {
+			t.Errorf("generated RK4: got X %s at TIME 1, want %g", last[i], math.Exp(-1))
+		}
+	}
+	if !found {
+		t.Errorf("generated RK4: no X in header %v", rows[0])
+	}
+
+	// RK4 can't integrate a rate referencing another rate
+	f, fset = parseSrc(t, `* impure
+L	X.K=X.J+(DT)(-E.JK)
+N	X=1
+R	D.KL=X.K
+R	E.KL=D.JK
+C	LENGTH=1
+C	DT=.25
+C	SAVPER=1
+`)
+	if _, err := (&Options{IntegrationMethod: RK4}).GenGo(fset, f); err == nil {
+		t.Errorf("rate of a rate: expected an error with RK4")
+	}
+}
+
+func TestConstEval(t *testing.T) {
+	tests := []struct {
+		src string
+		v   float64
+	}{
+		{"365/7", 365.0 / 7},
+		{"-2+3*4", 10},
+		{"(1+2)*(3-5)", -6},
+		{"((2))", 2},
+		{"-(-(1+1)/(4*(1/2)))", 1},
+		{"1/2/4", .125},
+		{"1-2-3", -4},
+		{"+.5E1", 5},
+		{"2^10", 1024},
+		{"-2^2", -4},
+		{"2^3^2", 512},
+		{"2^-1", .5},
+		{"(1+1)^(1+2)*3", 24},
+	}
+	for _, test := range tests {
+		if v, err := constEval(expr(t, test.src)); err != nil || v != test.v {
+			t.Errorf("%s: got %g (%v), want %g", test.src, v, err, test.v)
+		}
+	}
+
+	// the parser doesn't allow a division by a zero constant, so
+	// build one directly.
+	lit := func(v string) *BasicLit { return &BasicLit{Kind: token.FLOAT, Value: v} }
+	zero := &BinaryExpr{X: lit("1"), Op: token.QUO, Y: &BinaryExpr{X: lit("2"), Op: token.SUB, Y: lit("2")}}
+	if _, err := constEval(zero); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("1/(2-2): got error %v, want division by zero", err)
+	}
+
+	for _, src := range []string{"X", "1+X", "2*(3-POP)", "-RATE"} {
+		if _, err := constEval(expr(t, src)); err != ErrNotConstant {
+			t.Errorf("%s: got error %v, want ErrNotConstant", src, err)
+		}
+	}
+	if _, err := constEval(expr(t, "MAX(1, 2)")); err == nil || err == ErrNotConstant {
+		t.Errorf("MAX(1, 2): got error %v, want one for a call", err)
+	}
+}
+
+func TestGenGoProgram(t *testing.T) {
+	const src = `* save steps
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=100
+R	B.KL=(NB)(POP.K)
+C	NB=.04
+C	LENGTH=10
+C	DT=.5
+C	SAVPER=2
+`
+	f, fset := parseSrc(t, src)
+	out := genGo(t, f, fset)
+	for _, want := range []string{
+		"package main\n",
+		"\nfunc (m *Model) initModel() {\n",
+		"\nfunc (m *Model) step(dt float64) {\n",
+		"\nfunc main() {\n",
+		"\tPOP float64\n",
+		"\tNB  float64\n",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("generated program lacks %q:\n%s", want, out)
+		}
+	}
+	if bytes.Contains(out, []byte("boosd")) {
+		t.Errorf("generated program depends on the runtime:\n%s", out)
+	}
+
+	// a header, then a row every SAVPER from 0 to LENGTH
+	rows := strings.Split(strings.TrimSpace(runGo(t, out)), "\n")
+	if len(rows) != 7 || rows[0] != "TIME,B,POP" {
+		t.Fatalf("got output\n%s\nwant a header and 6 rows", strings.Join(rows, "\n"))
+	}
+	for i, row := range rows[1:] {
+		if time := strings.SplitN(row, ",", 2)[0]; time != strconv.Itoa(2*i) {
+			t.Errorf("row %d: got time %s, want %d", i+1, time, 2*i)
+		}
+	}
+}
+
+// TestPlotSupplementary plots a supplementary that is computed only
+// at each PLTPER, when the model is saved, rather than every DT.
+func TestPlotSupplementary(t *testing.T) {
+	const src = `* plotted ratio
+SPEC	DT=1/LENGTH=10/PLTPER=5
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=POPI
+R	B.KL=POP.K*.1
+C	POPI=100
+S	RATIO.K=POP.K/POPI
+PLOT	RATIO=R(0,5)/POP=P
+`
+	f, fset := parseSrc(t, src)
+	out := genGo(t, f, fset)
+	calc := out[bytes.Index(out, []byte("func (m *Model) calc()")):]
+	calc = calc[:bytes.Index(calc, []byte("\n}\n"))]
+	if bytes.Contains(calc, []byte("RATIO")) {
+		t.Errorf("calc computes the supplementary RATIO:\n%s", calc)
+	}
+	for _, want := range []string{
+		"func (m *Model) save() {\n\tm.RATIO = m.POP / m.POPI\n}\n",
+		"if i%saveEvery == 0 {\n\t\t\tm.save()\n\t\t\tm.write(w)\n",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("generated program lacks %q:\n%s", want, out)
+		}
+	}
+
+	// only the plotted variables, in the order plotted, at each
+	// PLTPER; POP grows by 10% a step
+	want := map[float64]float64{0: 1, 5: 1.61051, 10: 2.5937424601}
+	sim, gen := simulateBoth(t, src)
+	checkSeries(t, "RATIO", want, sim, gen)
+	for _, ts := range []TimeSeries{sim, gen} {
+		if len(ts.Time) != 3 || len(ts.Vars) != 2 {
+			t.Errorf("got %d rows of %d variables, want 3 rows of RATIO and POP", len(ts.Time), len(ts.Vars))
+		}
+	}
+	if rows := strings.SplitN(runGo(t, out), "\n", 2); rows[0] != "TIME,RATIO,POP" {
+		t.Errorf("got header %s, want TIME,RATIO,POP", rows[0])
+	}
+}
+
+// TestDebugState checks that Options.DebugState outputs the hidden
+// levels of SMOOTH and DELAY3, named for their call sites, and that
+// they move towards their inputs as they should.
+func TestDebugState(t *testing.T) {
+	const src = `* debug state
+A	IN.K=STEP(1,1)
+A	AVG.K=SMOOTH(IN.K,2)+SMOOTH(IN.K,4)
+A	OUT.K=DELAY3(IN.K,3)
+C	LENGTH=4
+C	DT=1
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, src)
+	af, err := (&Options{DebugState: true}).GenGo(fset, f)
+	if err != nil {
+		t.Fatalf("GenGo: %s", err)
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, af); err != nil {
+		t.Fatalf("format.Node: %s", err)
+	}
+	out := runGo(t, buf.Bytes())
+	const header = "TIME,AVG,IN,OUT,AVG.SMOOTH,AVG.SMOOTH#2,OUT.DELAY3.1,OUT.DELAY3.2,OUT.DELAY3.3"
+	if got := strings.SplitN(out, "\n", 2)[0]; got != header {
+		t.Fatalf("got header %s, want %s", got, header)
+	}
+	ts, err := ParseCSV(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("ParseCSV: %s", err)
+	}
+
+	// IN steps to 1 at TIME 1, which each level sees a step later
+	checkSeries(t, "AVG.SMOOTH", map[float64]float64{1: 0, 2: .5, 3: .75, 4: .875}, ts)
+	checkSeries(t, "AVG.SMOOTH#2", map[float64]float64{1: 0, 2: .25, 3: .4375, 4: .578125}, ts)
+	checkSeries(t, "AVG", map[float64]float64{2: .75, 4: 1.453125}, ts)
+	// each stage of the delay holds its outflow times DEL/3, 1
+	checkSeries(t, "OUT.DELAY3.1", map[float64]float64{1: 0, 2: 1, 3: 1, 4: 1}, ts)
+	checkSeries(t, "OUT.DELAY3.2", map[float64]float64{2: 0, 3: 1, 4: 1}, ts)
+	checkSeries(t, "OUT.DELAY3.3", map[float64]float64{3: 0, 4: 1}, ts)
+	checkSeries(t, "OUT", map[float64]float64{3: 0, 4: 1}, ts)
+
+	// and only when asked for
+	if bytes.Contains(genGo(t, f, fset), []byte("SMOOTH#2")) {
+		t.Errorf("hidden levels output without DebugState")
+	}
+}
+
+// TestTableRanges checks that a table looked up over a descending
+// range, from its last x to its first by a negative step, gives the
+// same values as the mirrored ascending one.
+func TestTableRanges(t *testing.T) {
+	const model = `* table ranges
+A	X.K=TIME.K-1
+A	Y.K=TABHL(TY,X.K,%s)
+T	TY=%s
+C	LENGTH=6
+C	DT=.5
+C	SAVPER=.5
+`
+	// Y is X squared from 0 to 4, and held beyond
+	want := map[float64]float64{0: 0, 1: 0, 1.5: .5, 2: 1, 3.5: 6.5, 5: 16, 6: 16}
+	for _, test := range []struct{ lim, ys string }{
+		{"0,4,1", "0/1/4/9/16"},
+		{"4,0,-1", "16/9/4/1/0"},
+	} {
+		src := fmt.Sprintf(model, test.lim, test.ys)
+		sim, gen := simulateBoth(t, src)
+		checkSeries(t, "Y", want, sim, gen)
+	}
+}
+
+// TestTableRangeErrors checks that a TABHL step that is zero, or
+// leads away from the last x, is reported at the step.
+func TestTableRangeErrors(t *testing.T) {
+	for _, lim := range []string{"0,4,-1", "4,0,1", "0,4,0"} {
+		src := "* bad range\nA\tY.K=TABHL(TY,TIME.K," + lim + ")\nT\tTY=0/1/4/9/16\nC\tLENGTH=1\n"
+		f, fset := parseSrc(t, src)
+		if _, err := GenGo(fset, f); err == nil || !strings.Contains(err.Error(), "bad range") {
+			t.Errorf("%s: GenGo error %v, want a bad range", lim, err)
+		}
+		_, err := Simulate(f, SimulateOptions{})
+		re, ok := err.(RangeError)
+		if !ok {
+			t.Errorf("%s: got %T %q, want a RangeError", lim, err, err)
+			continue
+		}
+		step := f.GetModel("main").Body.List[0].(*AssignStmt).Rhs.(*CallExpr).Args[4]
+		if re.Pos != step.Pos() {
+			t.Errorf("%s: error at %s, want %s", lim, fset.Position(re.Pos), fset.Position(step.Pos()))
+		}
+	}
+}
+
+// TestPower checks that ^ raises to a power in the simulator and
+// the generated Go, and survives unparsing and a trip through XMILE.
+func TestPower(t *testing.T) {
+	const src = `* power
+A	Y.K=TIME.K^2
+A	Z.K=2^-TIME.K*3
+A	W.K=-Y.K^.5
+C	LENGTH=3
+C	DT=1
+C	SAVPER=1
+`
+	sim, gen := simulateBoth(t, src)
+	checkSeries(t, "Y", map[float64]float64{0: 0, 1: 1, 2: 4, 3: 9}, sim, gen)
+	checkSeries(t, "Z", map[float64]float64{0: 3, 1: 1.5, 2: .75, 3: .375}, sim, gen)
+	checkSeries(t, "W", map[float64]float64{0: 0, 1: -1, 2: -2, 3: -3}, sim, gen)
+
+	f, _ := parseSrc(t, src)
+	out, err := Unparse(f)
+	if err != nil {
+		t.Fatalf("Unparse: %s", err)
+	}
+	if !strings.Contains(out, "Y.K=TIME.K^2\n") {
+		t.Errorf("Unparse lost the ^:\n%s", out)
+	}
+	data, err := GenXMILE(f)
+	if err != nil {
+		t.Fatalf("GenXMILE: %s", err)
+	}
+	g, err := ImportXMILE(data)
+	if err != nil {
+		t.Fatalf("ImportXMILE: %s", err)
+	}
+	imported, err := Simulate(g, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate imported: %s", err)
+	}
+	checkSeries(t, "Z", map[float64]float64{0: 3, 1: 1.5, 2: .75, 3: .375}, imported)
+}
+
+// TestSharedTable checks that a table looked up by two TABHLs with
+// the same range is defined once, and that differing ranges are
+// reported at the call that disagrees.
+func TestSharedTable(t *testing.T) {
+	const model = `* shared table
+A	Y.K=TABHL(TY,TIME.K,0,4,1)
+A	Z.K=TABHL(TY,TIME.K/2,%s)
+T	TY=0/1/4/9/16
+C	LENGTH=4
+C	DT=1
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, fmt.Sprintf(model, "0,4,1"))
+	prog := genGo(t, f, fset)
+	if n := bytes.Count(prog, []byte("var tabTY = table{")); n != 1 {
+		t.Errorf("TY defined %d times, want once:\n%s", n, prog)
+	}
+	sim, gen := simulateBoth(t, fmt.Sprintf(model, "0,4,1"))
+	checkSeries(t, "Z", map[float64]float64{0: 0, 1: .5, 3: 2.5, 4: 4}, sim, gen)
+
+	f, fset = parseSrc(t, fmt.Sprintf(model, "0,8,2"))
+	const want = "used with different ranges"
+	if _, err := GenGo(fset, f); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("GenGo error %v, want %q", err, want)
+	}
+	_, err := Simulate(f, SimulateOptions{})
+	re, ok := err.(RangeError)
+	if !ok || !strings.Contains(re.Msg, want) {
+		t.Fatalf("got %T %q, want a RangeError %q", err, err, want)
+	}
+	call := f.GetModel("main").Body.List[1].(*AssignStmt).Rhs.(*CallExpr)
+	if re.Pos != call.Pos() {
+		t.Errorf("error at %s, want %s", fset.Position(re.Pos), fset.Position(call.Pos()))
+	}
+}
+
+// TestOutTemplate checks that the generated program writes each run
+// to the file its -o template names, from the external constants and
+// seed it's run with.
+func TestOutTemplate(t *testing.T) {
+	const src = `* templated output
+A	Y.K=(GAIN)(10)+NOISE()
+X	GAIN=1
+C	LENGTH=1
+C	DT=1
+C	SAVPER=1
+`
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, fset := parseSrc(t, src)
+	prog := genGo(t, f, fset)
+	tmpl := filepath.Join(dir, "run_{gain}_{seed}.csv")
+	for _, gain := range []string{"2", "3"} {
+		if out := runGo(t, prog, "-GAIN", gain, "-seed", "4", "-o", tmpl); out != "" {
+			t.Errorf("GAIN %s: wrote %q to standard output", gain, out)
+		}
+		r, err := os.Open(filepath.Join(dir, "run_"+gain+"_4.csv"))
+		if err != nil {
+			t.Errorf("GAIN %s: %s", gain, err)
+			continue
+		}
+		ts, err := ParseCSV(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("GAIN %s: %s", gain, err)
+			continue
+		}
+		g, _ := strconv.ParseFloat(gain, 64)
+		if y := ts.Vars["Y"][0]; y < g*10-.5 || y > g*10+.5 {
+			t.Errorf("GAIN %s: got Y %g, want within .5 of %g", gain, y, g*10)
+		}
+	}
+}
+
+// TestTableInitial checks that an N card can look its initial value
+// up in a table, given an input known before the simulation starts,
+// and that other inputs are errors.
+func TestTableInitial(t *testing.T) {
+	const model = `* table-driven initial
+L	S.K=S.J+(DT)(R.JK)
+N	S=%s
+R	R.KL=S.K/10
+A	A.K=S.K*2
+C	P=2.5
+T	TT=100/200/300
+C	LENGTH=2
+C	DT=1
+C	SAVPER=1
+`
+	// P is halfway between the first two xs, for an S of 150
+	sim, gen := simulateBoth(t, fmt.Sprintf(model, "TABHL(TT,P,0,10,5)"))
+	checkSeries(t, "S", map[float64]float64{0: 150, 1: 165, 2: 181.5}, sim, gen)
+
+	for _, input := range []string{"A", "S", "R"} {
+		f, fset := parseSrc(t, fmt.Sprintf(model, "TABHL(TT,"+input+",0,10,5)"))
+		const want = "lookup input isn't constant-evaluable at init"
+		if _, err := Simulate(f, SimulateOptions{}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("input %s: Simulate error %v, want %q", input, err, want)
+		}
+		if _, err := GenGo(fset, f); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("input %s: GenGo error %v, want %q", input, err, want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// JSONVersion is the version of the format written by GenJSON.  It
+// changes when the format does, so that ParseJSON can reject models
+// it would misread.
+const JSONVersion = "1"
+
+// A jsonModel is a model in the form written by GenJSON.
+type jsonModel struct {
+	Version   string         `json:"version"`
+	Name      string         `json:"name"`
+	Title     string         `json:"title,omitempty"` // the title card's text
+	Timespec  *jsonTimespec  `json:"timespec,omitempty"`
+	Variables []jsonVariable `json:"variables"`
+	Tables    []jsonTable    `json:"tables"`
+	Macros    []string       `json:"macros,omitempty"` // the source of each
+}
+
+type jsonTimespec struct {
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	DT       float64 `json:"dt"`
+	SaveStep float64 `json:"saveStep"`
+}
+
+// A jsonVariable is a variable other than a table.  Type is the
+// variable's type as in the AST: stock, initial, const, flow, aux,
+// supplementary or external.  Equation is its equation in canonical
+// DYNAMO, and Initial the initial value of a stock.
+type jsonVariable struct {
+	Name      string `json:"name"`
+	Subscript string `json:"subscript,omitempty"`
+	Type      string `json:"type"`
+	Equation  string `json:"equation"`
+	Initial   string `json:"initial,omitempty"`
+	Units     string `json:"units,omitempty"`
+	Doc       string `json:"doc,omitempty"`
+}
+
+// A jsonTable is a table.  The range of x values it's looked up
+// over is given by the TABHL calls that use it, and is absent if
+// there are none.
+type jsonTable struct {
+	Name    string    `json:"name"`
+	YValues []float64 `json:"yValues"`
+	XMin    *float64  `json:"xMin,omitempty"`
+	XMax    *float64  `json:"xMax,omitempty"`
+	XInc    *float64  `json:"xInc,omitempty"`
+	Units   string    `json:"units,omitempty"`
+	Doc     string    `json:"doc,omitempty"`
+}
+
+// jsonTypes maps the variable types of a jsonVariable to their card
+// letters.
+var jsonTypes = map[string]string{
+	"stock":         "L",
+	"initial":       "N",
+	"const":         "C",
+	"flow":          "R",
+	"aux":           "A",
+	"supplementary": "S",
+	"external":      "X",
+}
+
+// GenJSON returns a JSON representation of the model in f, for
+// exchanging models with tools that don't read DYNAMO:
+//
+//	{"version": "1", "name": ..., "title": ..., "timespec": {...},
+//	 "variables": [{"name", "type", "equation", "units", "initial"}, ...],
+//	 "tables": [{"name", "yValues", "xMin", "xMax", "xInc"}, ...]}
+//
+// Equations are in canonical DYNAMO, as written by Unparse.  A
+// stock's initial value, from its N card, is held with it, and
+// stocks built with a ModelBuilder are written as the equivalent L
+// and N cards.  The title card is kept as its text, and macros as
+// their DYNAMO source.
+func GenJSON(f *File) ([]byte, error) {
+	if len(f.Decls) != 1 {
+		return nil, fmt.Errorf("can't write %d models as JSON", len(f.Decls))
+	}
+	md, ok := f.Decls[0].(*ModelDecl)
+	if !ok {
+		return nil, fmt.Errorf("can't write %T as JSON", f.Decls[0])
+	}
+	jm := jsonModel{
+		Version:   JSONVersion,
+		Name:      md.Name.Name,
+		Title:     strings.TrimSuffix(f.Doc.Text(), "\n"),
+		Variables: []jsonVariable{},
+		Tables:    []jsonTable{},
+	}
+	for _, mac := range f.Macros {
+		var buf bytes.Buffer
+		if err := writeMacro(&buf, DefaultWidth, mac); err != nil {
+			return nil, err
+		}
+		jm.Macros = append(jm.Macros, buf.String())
+	}
+	ranges, err := tableRanges(md)
+	if err != nil {
+		return nil, err
+	}
+
+	levels := map[string]bool{}
+	for _, s := range md.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && typeLetter(assign.Lhs) == "L" {
+			levels[strings.ToUpper(assign.Lhs.Name.Name)] = true
+		}
+	}
+	initials := map[string]string{} // the N cards of levels
+	for _, s := range md.Body.List {
+		switch s.(type) {
+		case *OutputStmt:
+			// which variables are printed isn't part of
+			// the model
+			continue
+		case *SpecStmt:
+			// the timespec has the values it gave
+			continue
+		}
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			return nil, fmt.Errorf("can't write %T as JSON", s)
+		}
+		if assign.Lhs.Name.Name == "timespec" {
+			ts, err := md.Timespec()
+			if err != nil {
+				return nil, err
+			}
+			jm.Timespec = &jsonTimespec{ts.Start, ts.End, ts.DT, ts.SaveStep}
+			continue
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		doc := strings.TrimSuffix(assign.Lhs.Doc.Text(), "\n")
+		switch letter := typeLetter(assign.Lhs); {
+		case letter == "T":
+			t, err := jsonTableOf(name, assign.Rhs, ranges)
+			if err != nil {
+				return nil, err
+			}
+			t.Units, t.Doc = unitsText(assign.Lhs), doc
+			jm.Tables = append(jm.Tables, t)
+			continue
+		case letter == "N" && levels[name]:
+			initials[name] = exprString(assign.Rhs)
+			continue
+		}
+		v := jsonVariable{
+			Name:      name,
+			Subscript: assign.Lhs.Sub,
+			Type:      assign.Lhs.Type.Name,
+			Units:     unitsText(assign.Lhs),
+			Doc:       doc,
+		}
+		if cl, ok := assign.Rhs.(*CompositeLit); ok && v.Type == "stock" {
+			if v.Equation, v.Initial, err = stockEqns(name, cl); err != nil {
+				return nil, err
+			}
+			v.Subscript = "K"
+		} else {
+			v.Equation = exprString(assign.Rhs)
+		}
+		jm.Variables = append(jm.Variables, v)
+	}
+	for i := range jm.Variables {
+		v := &jm.Variables[i]
+		if v.Type != "stock" || v.Initial != "" {
+			continue
+		}
+		if v.Initial = initials[v.Name]; v.Initial == "" {
+			return nil, fmt.Errorf("stock %s has no initial value", v.Name)
+		}
+	}
+
+	out, err := json.MarshalIndent(jm, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// jsonTableOf returns the table name, defined by rhs, with the range
+// of xs it's looked up over in ranges.  A table built by a
+// ModelBuilder gives its own xs, and has a range only if they're
+// evenly spaced.
+func jsonTableOf(name string, rhs Expr, ranges map[string]tableRange) (jsonTable, error) {
+	t := jsonTable{Name: name}
+	switch x := rhs.(type) {
+	case *TableFwdExpr:
+		for _, y := range x.Ys {
+			v, err := y.Float64()
+			if err != nil {
+				return t, fmt.Errorf("table %s: bad number %s", name, y.Value)
+			}
+			t.YValues = append(t.YValues, v)
+		}
+		if r, ok := ranges[name]; ok {
+			t.XMin, t.XMax, t.XInc = &r.lo, &r.hi, &r.step
+		}
+	case *TableExpr:
+		var xs []float64
+		for _, p := range x.Pairs {
+			px, err := constEval(p.X)
+			if err != nil {
+				return t, fmt.Errorf("table %s: %s", name, err)
+			}
+			py, err := constEval(p.Y)
+			if err != nil {
+				return t, fmt.Errorf("table %s: %s", name, err)
+			}
+			xs = append(xs, px)
+			t.YValues = append(t.YValues, py)
+		}
+		if n := len(xs); n > 1 {
+			lo, hi, step := xs[0], xs[n-1], (xs[n-1]-xs[0])/float64(n-1)
+			even := true
+			for i, x := range xs {
+				even = even && math.Abs(x-(lo+float64(i)*step)) <= 1e-9*math.Max(1, math.Abs(x))
+			}
+			if even {
+				t.XMin, t.XMax, t.XInc = &lo, &hi, &step
+			}
+		}
+	default:
+		return t, fmt.Errorf("table %s is %T, not a table", name, rhs)
+	}
+	return t, nil
+}
+
+// ParseJSON returns the model represented by data, as written by
+// GenJSON.  The model is rebuilt as DYNAMO cards and parsed, so the
+// File is as if it were parsed from source.  The tables' xMin, xMax
+// and xInc are ignored, as the TABHL calls looking them up give
+// them.  Errors in an equation are reported against the variable
+// it's for, and data of a version other than JSONVersion is
+// rejected.
+func ParseJSON(data []byte) (*File, error) {
+	var jm jsonModel
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return nil, err
+	}
+	switch jm.Version {
+	case JSONVersion:
+	case "":
+		return nil, fmt.Errorf("JSON model has no version")
+	default:
+		return nil, fmt.Errorf("JSON model is version %s, not %s", jm.Version, JSONVersion)
+	}
+
+	// owners holds the variable each line of buf is for, so that
+	// errors can be reported against it
+	var buf bytes.Buffer
+	var owners []string
+	own := func(owner string) {
+		for len(owners) < bytes.Count(buf.Bytes(), []byte("\n")) {
+			owners = append(owners, owner)
+		}
+	}
+	if strings.ContainsAny(jm.Title, "\n\r") {
+		return nil, fmt.Errorf("title %q spans more than one card", jm.Title)
+	}
+	buf.WriteString(strings.TrimSpace("* "+jm.Title) + "\n")
+	own("")
+	for i, mac := range jm.Macros {
+		buf.WriteString(strings.TrimSuffix(mac, "\n") + "\n")
+		own(fmt.Sprintf("macro %d", i+1))
+	}
+
+	units := func(u string) string {
+		if u == "" {
+			return ""
+		}
+		return " {" + u + "}"
+	}
+	for _, v := range jm.Variables {
+		letter, ok := jsonTypes[v.Type]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown type %q", v.Name, v.Type)
+		}
+		if err := checkJSONText(v.Name, v.Subscript, v.Equation, v.Initial, v.Units); err != nil {
+			return nil, err
+		}
+		switch {
+		case letter == "L" && v.Initial == "":
+			return nil, fmt.Errorf("stock %s has no initial value", v.Name)
+		case letter != "L" && v.Initial != "":
+			return nil, fmt.Errorf("%s: a %s can't have an initial value", v.Name, v.Type)
+		}
+		writeNotes(&buf, v.Doc)
+		lhs := v.Name
+		if v.Subscript != "" {
+			lhs += "." + v.Subscript
+		}
+		writeCard(&buf, DefaultWidth, letter, lhs+"="+v.Equation+units(v.Units))
+		if letter == "L" {
+			writeCard(&buf, DefaultWidth, "N", v.Name+"="+v.Initial+units(v.Units))
+		}
+		own(v.Name)
+	}
+	for _, t := range jm.Tables {
+		if err := checkJSONText(t.Name, t.Units); err != nil {
+			return nil, err
+		}
+		if len(t.YValues) == 0 {
+			return nil, fmt.Errorf("table %s has no values", t.Name)
+		}
+		ys := make([]string, len(t.YValues))
+		for i, y := range t.YValues {
+			ys[i] = strconv.FormatFloat(y, 'g', -1, 64)
+		}
+		writeNotes(&buf, t.Doc)
+		writeCard(&buf, DefaultWidth, "T", t.Name+"="+strings.Join(ys, "/")+units(t.Units))
+		own(t.Name)
+	}
+	if ts := jm.Timespec; ts != nil {
+		for _, c := range []struct {
+			name string
+			v    float64
+		}{{"TIME", ts.Start}, {"LENGTH", ts.End}, {"DT", ts.DT}, {"SAVPER", ts.SaveStep}} {
+			writeCard(&buf, DefaultWidth, "C", c.name+"="+strconv.FormatFloat(c.v, 'g', -1, 64))
+		}
+		own("timespec")
+	}
+
+	src := buf.String()
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+	if list, ok := err.(ErrorList); ok {
+		for _, e := range list {
+			if l := e.Pos.Line - 1; 0 <= l && l < len(owners) && owners[l] != "" {
+				e.Msg = owners[l] + ": " + e.Msg
+			}
+			e.Pos = token.Position{}
+		}
+		return nil, list
+	} else if err != nil {
+		return nil, err
+	}
+	if jm.Name != "" {
+		f.Decls[0].(*ModelDecl).Name.Name = jm.Name
+	}
+	return f, nil
+}
+
+// checkJSONText returns an error if one of the fields of the JSON
+// variable name would end the card it's written on, or its units.
+func checkJSONText(name string, fields ...string) error {
+	if name == "" {
+		return fmt.Errorf("variable with no name")
+	}
+	for _, s := range append([]string{name}, fields...) {
+		if strings.ContainsAny(s, "\n\r;{}") {
+			return fmt.Errorf("%s: %q spans more than one card", name, s)
+		}
+	}
+	return nil
+}
+
+// writeNotes writes doc as NOTE cards, one for each line.
+func writeNotes(buf *bytes.Buffer, doc string) {
+	for _, line := range strings.Split(doc, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			buf.WriteString("NOTE\t" + line + "\n")
+		}
+	}
+}
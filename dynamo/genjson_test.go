@@ -0,0 +1,85 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"go/token"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = append(paths, "../models/logistic.dynamo")
+	for _, path := range paths {
+		f, err := ParseFile(path, token.NewFileSet())
+		if err != nil {
+			t.Errorf("ParseFile: %s", err)
+			continue
+		}
+		data, err := GenJSON(f)
+		if err != nil {
+			t.Errorf("%s: GenJSON: %s", path, err)
+			continue
+		}
+		g, err := ParseJSON(data)
+		if err != nil {
+			t.Errorf("%s: ParseJSON: %s\n%s", path, err, data)
+			continue
+		}
+		if got, want := g.Doc.Text(), f.Doc.Text(); got != want {
+			t.Errorf("%s: got title %q, want %q", path, got, want)
+		}
+		if got, want := equations(g), equations(f); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got equations\n%v\nwant\n%v", path, got, want)
+		}
+		if got, want := len(g.Macros), len(f.Macros); got != want {
+			t.Errorf("%s: got %d macros, want %d", path, got, want)
+		}
+		again, err := GenJSON(g)
+		if err != nil {
+			t.Errorf("%s: GenJSON of ParseJSON: %s", path, err)
+		} else if !bytes.Equal(again, data) {
+			t.Errorf("%s: got JSON\n%s\nthen\n%s", path, data, again)
+		}
+	}
+}
+
+func TestJSONTitle(t *testing.T) {
+	f, _ := parseSrc(t, "* functions\nA Y.K=ABS(-1)\n")
+	data, err := GenJSON(f)
+	if err != nil {
+		t.Fatalf("GenJSON: %s", err)
+	}
+	if !bytes.Contains(data, []byte(`"title": "functions"`)) {
+		t.Errorf("no title in\n%s", data)
+	}
+	g, err := ParseJSON(data)
+	if err != nil {
+		t.Fatalf("ParseJSON: %s", err)
+	}
+	src, err := Unparse(g)
+	if err != nil {
+		t.Fatalf("Unparse: %s", err)
+	}
+	if !strings.HasPrefix(src, "* functions\n") {
+		t.Errorf("got\n%s\nwant the title card first", src)
+	}
+
+	// a model without a title card has none
+	f, _ = parseSrc(t, "*\nA Y.K=1\n")
+	if data, err = GenJSON(f); err != nil || bytes.Contains(data, []byte(`"title"`)) {
+		t.Errorf("untitled: got\n%s\n(%v)", data, err)
+	}
+	if _, err := ParseJSON([]byte(`{"version": "1", "title": "a\nb"}`)); err == nil {
+		t.Errorf("two-line title: expected an error")
+	}
+}
@@ -0,0 +1,679 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const pyFileTmpl = `# generated by GenPython from a DYNAMO model
+"""Simulates a DYNAMO model, writing its output to standard output
+as CSV when run as a script."""
+
+import argparse
+import csv
+import math
+{{- if .Random}}
+import random{{end}}
+import sys
+from dataclasses import dataclass, replace
+
+# the simulation runs from START to END in steps of DT, saving the
+# model's state every SAVE_STEP.
+START = {{.Start}}
+END = {{.End}}
+DT = {{.DT}}
+SAVE_STEP = {{.SaveStep}}
+
+# the columns of the output, in order
+COLUMNS = {{.Columns}}
+
+
+@dataclass
+class Model:
+    """Model holds the value of each of the model's variables at TIME."""
+
+    TIME: float = 0.0
+{{- range .Fields}}
+    {{.}}{{end}}
+{{- range $i, $t := .Tables}}
+{{- if not $i}}
+{{end}}
+
+{{$t.Name}}_XS = {{$t.Xs}}
+{{$t.Name}}_YS = {{$t.Ys}}
+{{- end}}
+{{- if .Tables}}
+
+
+def lookup(xs, ys, x):
+    """lookup interpolates linearly between the points of a table,
+    holding the first and last y beyond them."""
+    if x <= xs[0]:
+        return ys[0]
+    if x >= xs[-1]:
+        return ys[-1]
+    i = 1
+    while x > xs[i]:
+        i += 1
+    return ys[i-1] + (x - xs[i-1]) / (xs[i] - xs[i-1]) * (ys[i] - ys[i-1])
+{{- end}}
+{{- if .Funcs.STEP}}
+
+
+def step_input(h, st, time):
+    """step_input is h from st on."""
+    return h if time >= st else 0.0
+{{- end}}
+{{- if .Funcs.RAMP}}
+
+
+def ramp_input(sl, st, time):
+    """ramp_input rises with slope sl from st on."""
+    return sl * (time - st) if time >= st else 0.0
+{{- end}}
+{{- if .Funcs.PULSE}}
+
+
+def pulse_input(h, st, pt, time, dt):
+    """pulse_input is h/dt for the duration pt from st, adding h to a
+    level it flows into."""
+    return h / dt if st <= time < st + pt else 0.0
+{{- end}}
+{{- if .Random}}
+
+
+# rng draws the numbers of NOISE and NORMRN.  run seeds it, so that
+# each run draws the same numbers.
+rng = random.Random()
+{{- end}}
+{{- if .Funcs.NOISE}}
+
+
+def noise():
+    """noise is uniformly distributed over [-0.5, 0.5)."""
+    return rng.random() - 0.5
+{{- end}}
+{{- if .Funcs.NORMRN}}
+
+
+def normrn(mu, sigma):
+    """normrn is normally distributed with mean mu and standard
+    deviation sigma."""
+    return rng.gauss(mu, sigma)
+{{- end}}
+
+
+def calc(m, dt):
+    """calc computes the auxiliaries, then the rates, of m from its
+    levels."""
+{{- range .Calc}}
+    {{.}}{{else}}
+    pass{{end}}
+{{- if .Save}}
+
+
+def save(m, dt):
+    """save computes the supplementaries of m, which are only needed
+    when it is output."""
+{{- range .Save}}
+    {{.}}{{end}}
+{{- end}}
+
+
+def init_model(start, dt):
+    """init_model returns the model's state at start."""
+    m = Model(TIME=start)
+{{- range .Initials}}
+    {{.}}{{end}}
+    calc(m, dt)
+{{- if .Hidden}}
+
+    # the hidden levels start from their inputs
+{{- range .Hidden}}
+    {{.}}{{end}}
+    calc(m, dt)
+{{- end}}
+    return m
+
+
+def step(m, dt):
+    """step advances m by dt: the levels at K are integrated from the
+    model at J, and the auxiliaries and rates at K then computed from
+    the new levels."""
+{{- if .Step}}
+    j = replace(m)
+{{- range .Step}}
+    {{.}}{{end}}{{end}}
+    m.TIME += dt
+    calc(m, dt)
+
+
+def run(dt, start, end):
+    """run yields the model at each save step from start to end.  It
+    is the same Model each time, updated in place."""
+{{- if .Random}}
+    rng.seed(1)
+{{- end}}
+    steps = max(0, math.floor((end - start) / dt + 0.5))
+    save_every = max(1, math.floor(SAVE_STEP / dt + 0.5))
+    m = init_model(start, dt)
+    for i in range(steps + 1):
+        if i > 0:
+            step(m, dt)
+        if i % save_every == 0:
+{{- if .Save}}
+            save(m, dt)
+{{- end}}
+            yield m
+
+
+def simulate(dt=DT, start=START, end=END):
+    """simulate returns the output of the model, a dict of the values
+    of COLUMNS by name for each save step."""
+    return [{name: getattr(m, name) for name in COLUMNS}
+            for m in run(dt, start, end)]
+
+
+def simulate_numpy(dt=DT, start=START, end=END):
+    """simulate_numpy is like simulate, but returns a dict of NumPy
+    arrays, one for each of COLUMNS by name, filled in place as the
+    model runs.  It needs NumPy."""
+    import numpy
+
+    steps = max(0, math.floor((end - start) / dt + 0.5))
+    save_every = max(1, math.floor(SAVE_STEP / dt + 0.5))
+    n = steps // save_every + 1
+    out = {name: numpy.empty(n) for name in COLUMNS}
+    for i, m in enumerate(run(dt, start, end)):
+        for name in COLUMNS:
+            out[name][i] = getattr(m, name)
+    return out
+
+
+def main():
+    parser = argparse.ArgumentParser(description=__doc__)
+    parser.add_argument('--dt', type=float, default=DT, help='the time step')
+    parser.add_argument('--start', type=float, default=START, help='the start time')
+    parser.add_argument('--end', type=float, default=END, help='the end time')
+    args = parser.parse_args()
+
+    w = csv.writer(sys.stdout, lineterminator='\n')
+    w.writerow(COLUMNS)
+    for m in run(args.dt, args.start, args.end):
+        w.writerow([getattr(m, name) for name in COLUMNS])
+
+
+if __name__ == '__main__':
+    main()
+`
+
+// A pyTable is a table in the generated Python, with its points as
+// tuples.
+type pyTable struct {
+	Name   string
+	Xs, Ys string
+}
+
+// A pygen generates Python for a model prepared by a simulator,
+// whose equations are already in the order they're computed in.
+type pygen struct {
+	s      *simulator
+	hidden map[*CallExpr]string // the hidden level of each SMOOTH, or base name of DELAY3's
+	used   map[string]bool      // the tables looked up, by upper-cased name
+
+	Start, End, DT, SaveStep string
+	Columns                  string   // a tuple of the column names
+	Fields                   []string // declarations of the Model's fields
+	Tables                   []pyTable
+	Funcs                    map[string]bool // the helpers used, by built-in
+	Random                   bool            // NOISE or NORMRN is used
+	Calc                     []string
+	Save                     []string // statements computing the supplementaries
+	Initials                 []string
+	Hidden                   []string // statements starting the hidden levels
+	Step                     []string
+}
+
+// pyNum returns a Python float literal for v.
+func pyNum(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "math.inf"
+	case math.IsInf(v, -1):
+		return "-math.inf"
+	case math.IsNaN(v):
+		return "math.nan"
+	}
+	return cNum(v)
+}
+
+// pyTuple returns a Python tuple of elts, with the trailing comma
+// one element needs.
+func pyTuple(elts []string) string {
+	if len(elts) == 1 {
+		return "(" + elts[0] + ",)"
+	}
+	return "(" + strings.Join(elts, ", ") + ")"
+}
+
+// pyComment returns the Go comment doc, as from goComment, as Python
+// comments.
+func pyComment(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSuffix(doc, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "#" + strings.TrimPrefix(line, "//")
+	}
+	return strings.Join(lines, "\n    ") + "\n    "
+}
+
+// pyExpr returns Python computing e from the variables of the Model
+// recv.
+func (p *pygen) pyExpr(e Expr, recv string) (string, error) {
+	switch x := e.(type) {
+	case *BasicLit:
+		v, err := x.Float64()
+		if err != nil {
+			return "", fmt.Errorf("bad number %s", x.Value)
+		}
+		return pyNum(v), nil
+	case *Ident:
+		return p.pyRef(x, recv)
+	case *RefExpr:
+		return p.pyRef(&x.Ident, recv)
+	case *SubscriptExpr:
+		return p.pyRef(x.Base, recv)
+	case *UnitExpr:
+		return p.pyExpr(x.X, recv)
+	case *ParenExpr:
+		inner, err := p.pyExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		return "(" + inner + ")", nil
+	case *UnaryExpr:
+		inner, err := p.pyExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(inner, "-") || strings.HasPrefix(inner, "+") {
+			inner = "(" + inner + ")"
+		}
+		return x.Op.String() + inner, nil
+	case *BinaryExpr:
+		if isComparison(x.Op) {
+			return "", fmt.Errorf("comparison %s outside of an IF", exprString(x))
+		}
+		l, err := p.pyExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		r, err := p.pyExpr(x.Y, recv)
+		if err != nil {
+			return "", err
+		}
+		if x.Op == token.XOR {
+			// math.pow rather than **, which binds tighter
+			// than a unary minus, and gives a complex for a
+			// negative number to a fractional power
+			return fmt.Sprintf("math.pow(%s, %s)", l, r), nil
+		}
+		return fmt.Sprintf("%s %s %s", l, x.Op, r), nil
+	case *CallExpr:
+		return p.pyCall(x, recv)
+	case *IfExpr:
+		cond, err := p.pyCond(x.Cond, recv)
+		if err != nil {
+			return "", err
+		}
+		then, err := p.pyExpr(x.Then, recv)
+		if err != nil {
+			return "", err
+		}
+		els, err := p.pyExpr(x.Else, recv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s if %s else %s)", then, cond, els), nil
+	}
+	return "", fmt.Errorf("can't generate Python for %T", e)
+}
+
+// pyCond returns Python for the condition of an IF.  Anything other
+// than a comparison holds when it is non-zero.
+func (p *pygen) pyCond(e Expr, recv string) (string, error) {
+	for {
+		paren, ok := stripUnits(e).(*ParenExpr)
+		if !ok {
+			break
+		}
+		e = paren.X
+	}
+	if x, ok := stripUnits(e).(*BinaryExpr); ok && isComparison(x.Op) {
+		l, err := p.pyExpr(x.X, recv)
+		if err != nil {
+			return "", err
+		}
+		r, err := p.pyExpr(x.Y, recv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", l, x.Op, r), nil
+	}
+	v, err := p.pyExpr(e, recv)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%s) != 0", v), nil
+}
+
+// pyRef returns Python for a reference to a variable.  DT is the
+// step of the simulation, dt.
+func (p *pygen) pyRef(id *Ident, recv string) (string, error) {
+	n := strings.ToUpper(id.Name)
+	switch ty, ok := p.s.g.types[n]; {
+	case n == "DT":
+		return "dt", nil
+	case n == "TIME":
+		return recv + ".TIME", nil
+	case !ok:
+		return "", fmt.Errorf("undefined: %s", id.Name)
+	case ty == "table":
+		return "", fmt.Errorf("table %s used outside of TABHL", id.Name)
+	}
+	return recv + "." + cName(n), nil
+}
+
+// pyMath maps the built-ins with an equivalent in Python's builtins
+// or math module to it.
+var pyMath = map[string]string{
+	"MAX":  "max",
+	"MIN":  "min",
+	"ABS":  "abs",
+	"SQRT": "math.sqrt",
+	"EXP":  "math.exp",
+	"LOG":  "math.log",
+	"SIN":  "math.sin",
+	"COS":  "math.cos",
+}
+
+// pyCall returns Python for a function call.  The helpers are those
+// of the generated C, in cHelpers.
+func (p *pygen) pyCall(call *CallExpr, recv string) (string, error) {
+	name := funcName(call)
+	if name == "" {
+		return "", fmt.Errorf("call of non-function %T", call.Fun)
+	}
+	if n, ok := builtins[name]; ok && len(call.Args) != n {
+		return "", fmt.Errorf("%s takes %d arguments, not %d", name, n, len(call.Args))
+	}
+
+	switch name {
+	case "TABHL":
+		table, ok := call.Args[0].(*Ident)
+		if !ok || p.s.g.types[strings.ToUpper(table.Name)] != "table" {
+			return "", fmt.Errorf("TABHL of %s, not a table", exprString(call.Args[0]))
+		}
+		x, err := p.pyExpr(call.Args[1], recv)
+		if err != nil {
+			return "", err
+		}
+		return p.lookup(strings.ToUpper(table.Name), x), nil
+	case "SMOOTH":
+		return recv + "." + p.hidden[call], nil
+	case "DELAY3":
+		del, err := p.pyExpr(call.Args[1], recv)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s.%s_3)/((%s)/3.0)", recv, p.hidden[call], del), nil
+	}
+
+	args := make([]string, len(call.Args))
+	for i, arg := range call.Args {
+		var err error
+		if args[i], err = p.pyExpr(arg, recv); err != nil {
+			return "", err
+		}
+	}
+	if fn, ok := pyMath[name]; ok {
+		return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", ")), nil
+	}
+	if name == "CLIP" {
+		// like IF, only the argument chosen is computed
+		return fmt.Sprintf("(%s if %s >= %s else %s)", args[0], args[2], args[3], args[1]), nil
+	}
+	fn, ok := cHelpers[name]
+	if !ok {
+		return "", fmt.Errorf("can't generate Python for function %s", exprString(call.Fun))
+	}
+	p.Funcs[name] = true
+	switch name {
+	case "STEP", "RAMP":
+		args = append(args, recv+".TIME")
+	case "PULSE":
+		args = append(args, recv+".TIME", "dt")
+	case "NOISE", "NORMRN":
+		p.Random = true
+	}
+	return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", ")), nil
+}
+
+// lookup returns Python looking up x in the table name.
+func (p *pygen) lookup(name, x string) string {
+	p.used[name] = true
+	return fmt.Sprintf("lookup(%s_XS, %s_YS, %s)", cName(name), cName(name), x)
+}
+
+// model generates the Python statements for the model prepared by
+// p.s.
+func (p *pygen) model() error {
+	s := p.s
+	p.Start, p.End = pyNum(s.g.Time.Start), pyNum(s.g.Time.End)
+	p.DT, p.SaveStep = pyNum(s.dt), pyNum(s.g.Time.SaveStep)
+
+	fields := map[string]string{}
+	for _, f := range s.g.Fields {
+		fields[cName(f.Name)] = pyComment(f.Doc) + cName(f.Name) + ": float = 0.0"
+	}
+	counts := map[string]int{}
+	for _, call := range s.calls {
+		name := funcName(call)
+		field := fmt.Sprintf("_%s_%d", strings.ToLower(name), counts[name])
+		counts[name]++
+		p.hidden[call] = field
+		if name == "SMOOTH" {
+			fields[field] = field + ": float = 0.0"
+			continue
+		}
+		for i := 1; i <= 3; i++ {
+			f := fmt.Sprintf("%s_%d", field, i)
+			fields[f] = f + ": float = 0.0"
+		}
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.Fields = append(p.Fields, fields[name])
+	}
+
+	for _, eqn := range s.initials {
+		rhs, err := p.pyExpr(eqn.rhs, "m")
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		p.Initials = append(p.Initials, fmt.Sprintf("m.%s = %s", cName(eqn.name), rhs))
+	}
+	for _, eqn := range s.calc {
+		rhs, err := p.pyExpr(eqn.rhs, "m")
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		if eqn.lookup {
+			rhs = p.lookup(eqn.name, rhs)
+		}
+		p.Calc = append(p.Calc, fmt.Sprintf("m.%s = %s", cName(eqn.name), rhs))
+	}
+	for _, eqn := range s.supps {
+		rhs, err := p.pyExpr(eqn.rhs, "m")
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		p.Save = append(p.Save, fmt.Sprintf("m.%s = %s", cName(eqn.name), rhs))
+	}
+	for _, l := range s.levels {
+		rhs, err := p.level(l)
+		if err != nil {
+			return err
+		}
+		p.Step = append(p.Step, fmt.Sprintf("m.%s = %s", cName(l.name), rhs))
+	}
+	if err := p.hiddenLevels(); err != nil {
+		return err
+	}
+
+	var tables []string
+	for name := range p.used {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	for _, name := range tables {
+		t := s.tables[name]
+		var xs, ys []string
+		for i := range t.Xs {
+			xs = append(xs, pyNum(t.Xs[i]))
+			ys = append(ys, pyNum(t.Ys[i]))
+		}
+		p.Tables = append(p.Tables, pyTable{cName(name), pyTuple(xs), pyTuple(ys)})
+	}
+
+	cols := []string{strconv.Quote("TIME")}
+	for _, f := range s.g.Output {
+		cols = append(cols, strconv.Quote(cName(f.Name)))
+	}
+	p.Columns = pyTuple(cols)
+	return nil
+}
+
+// level returns Python for the value of the level l at K, computed
+// from the model at J.  A level built by ModelBuilder gives its
+// flows, rather than the equation for its next value.
+func (p *pygen) level(l simEqn) (string, error) {
+	cl, ok := l.rhs.(*CompositeLit)
+	if !ok {
+		rhs, err := p.pyExpr(l.rhs, "j")
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", l.name, err)
+		}
+		return rhs, nil
+	}
+	var flows string
+	for _, e := range cl.Elts {
+		k, val, err := kvConvert(e)
+		if err != nil {
+			return "", fmt.Errorf("stock(%s): %s", l.name, err)
+		}
+		switch k {
+		case "initial":
+			// set by init_model
+		case "biflow", "inflow", "outflow":
+			flow, err := p.pyExpr(val, "j")
+			if err != nil {
+				return "", fmt.Errorf("stock(%s) %s: %s", l.name, k, err)
+			}
+			if k == "outflow" {
+				flows += "-(" + flow + ")"
+			} else {
+				flows += "+" + flow
+			}
+		default:
+			return "", fmt.Errorf("stock(%s): unknown key %s", l.name, k)
+		}
+	}
+	if flows == "" {
+		flows = "0.0"
+	}
+	return fmt.Sprintf("j.%s + (%s)*dt", cName(l.name), strings.TrimPrefix(flows, "+")), nil
+}
+
+// hiddenLevels adds the statements starting and integrating the
+// hidden levels of SMOOTH and DELAY3, as GenGo's do.
+func (p *pygen) hiddenLevels() error {
+	for _, call := range p.s.calls {
+		field := p.hidden[call]
+		var args [2][2]string // the arguments from m, then from j
+		for i, recv := range []string{"m", "j"} {
+			for k := range args[i] {
+				var err error
+				if args[i][k], err = p.pyExpr(call.Args[k], recv); err != nil {
+					return err
+				}
+			}
+		}
+		if funcName(call) == "SMOOTH" {
+			p.Hidden = append(p.Hidden, fmt.Sprintf("m.%s = %s", field, args[0][0]))
+			p.Step = append(p.Step, fmt.Sprintf("m.%s = j.%s + dt*(%s - j.%s)/(%s)",
+				field, field, args[1][0], field, args[1][1]))
+			continue
+		}
+		rate := args[1][0]
+		for i := 1; i <= 3; i++ {
+			f := fmt.Sprintf("%s_%d", field, i)
+			out := fmt.Sprintf("(j.%s)/((%s)/3.0)", f, args[1][1])
+			p.Hidden = append(p.Hidden, fmt.Sprintf("m.%s = (%s)*(%s)/3.0", f, args[0][0], args[0][1]))
+			p.Step = append(p.Step, fmt.Sprintf("m.%s = j.%s + dt*(%s - %s)", f, f, rate, out))
+			rate = out
+		}
+	}
+	return nil
+}
+
+// GenPython returns a Python 3 script simulating the model named main
+// in f, using only the standard library.  It defines a Model
+// dataclass holding the model's variables and simulate(dt, start,
+// end), which returns the time and the model's levels, rates and
+// auxiliaries at each save step as a list of dicts; simulate_numpy
+// returns them as NumPy arrays instead.  Run as a script, it writes
+// them to standard output as CSV.  The levels are integrated with
+// Euler's method.  Where Simulate gives an infinity or NaN, like
+// for the log of zero, the script raises an exception.
+func GenPython(f *File) ([]byte, error) {
+	s, err := newSimulator(f, Euler)
+	if err != nil {
+		return nil, err
+	}
+	p := &pygen{
+		s:      s,
+		hidden: map[*CallExpr]string{},
+		used:   map[string]bool{},
+		Funcs:  map[string]bool{},
+	}
+	if err := p.model(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tmpl, err := template.New("model.py").Parse(pyFileTmpl)
+	if err != nil {
+		panic(fmt.Sprintf("Parse(pyFileTmpl): %s", err))
+	}
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
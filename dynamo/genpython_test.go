@@ -0,0 +1,62 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenPythonGolden(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	src, err := GenPython(f)
+	if err != nil {
+		t.Fatalf("GenPython: %s", err)
+	}
+	checkGolden(t, "testdata/hello.py.golden", src)
+}
+
+func TestGenPythonCompiles(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("no python3 to compile the generated scripts")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths, err := filepath.Glob("testdata/*.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		f, err := ParseFile(path, token.NewFileSet())
+		if err != nil {
+			t.Errorf("ParseFile: %s", err)
+			continue
+		}
+		src, err := GenPython(f)
+		if err != nil {
+			t.Errorf("%s: GenPython: %s", path, err)
+			continue
+		}
+		py := filepath.Join(dir, filepath.Base(path)+".py")
+		if err := ioutil.WriteFile(py, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// without doraise, py_compile prints syntax errors but
+		// exits successfully.
+		cmd := exec.Command(python, "-c", "import py_compile; py_compile.compile('"+py+"', doraise=True)")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("%s: py_compile: %s\n%s", path, err, out)
+		}
+	}
+}
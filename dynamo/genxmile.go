@@ -0,0 +1,666 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// xmileNS is the namespace of XMILE 1.0 documents.
+const xmileNS = "http://docs.oasis-open.org/xmile/ns/XMILE/v1.0"
+
+// An xmileFile is an XMILE document, as written by GenXMILE.
+type xmileFile struct {
+	XMLName  xml.Name      `xml:"xmile"`
+	Version  string        `xml:"version,attr"`
+	NS       string        `xml:"xmlns,attr"`
+	Header   xmileHeader   `xml:"header"`
+	SimSpecs xmileSimSpecs `xml:"sim_specs"`
+	Models   []xmileModel  `xml:"model"`
+}
+
+type xmileHeader struct {
+	Name    string       `xml:"name,omitempty"`
+	Vendor  string       `xml:"vendor"`
+	Product xmileProduct `xml:"product"`
+}
+
+type xmileProduct struct {
+	Version string `xml:"version,attr"`
+	Name    string `xml:",chardata"`
+}
+
+type xmileSimSpecs struct {
+	Method    string  `xml:"method,attr,omitempty"`
+	TimeUnits string  `xml:"time_units,attr,omitempty"`
+	Start     float64 `xml:"start"`
+	Stop      float64 `xml:"stop"`
+	DT        xmileDT `xml:"dt"`
+}
+
+// An xmileDT is the time step, which may be given as its reciprocal.
+type xmileDT struct {
+	Reciprocal bool   `xml:"reciprocal,attr,omitempty"`
+	Value      string `xml:",chardata"`
+}
+
+type xmileModel struct {
+	Name      string         `xml:"name,attr,omitempty"`
+	Variables xmileVariables `xml:"variables"`
+}
+
+// xmileVariables holds a model's variables by kind, as the order of
+// a model's variables is insignificant.
+type xmileVariables struct {
+	Stocks []xmileStock `xml:"stock"`
+	Flows  []xmileVar   `xml:"flow"`
+	Auxes  []xmileVar   `xml:"aux"`
+	GFs    []xmileGF    `xml:"gf"`
+}
+
+type xmileStock struct {
+	Name     string           `xml:"name,attr"`
+	Dims     *xmileDimensions `xml:"dimensions"`
+	Eqn      string           `xml:"eqn"` // the initial value
+	Inflows  []string         `xml:"inflow"`
+	Outflows []string         `xml:"outflow"`
+	Units    string           `xml:"units,omitempty"`
+	Doc      string           `xml:"doc,omitempty"`
+}
+
+// An xmileVar is a flow or auxiliary.  One with a GF is looked up
+// in it, with its Eqn as the input.
+type xmileVar struct {
+	Name  string           `xml:"name,attr"`
+	Dims  *xmileDimensions `xml:"dimensions"`
+	Eqn   string           `xml:"eqn"`
+	GF    *xmileGF         `xml:"gf"`
+	Units string           `xml:"units,omitempty"`
+	Doc   string           `xml:"doc,omitempty"`
+}
+
+// xmileDimensions are the dimensions of an array, which DYNAMO
+// doesn't have.
+type xmileDimensions struct {
+	Dims []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"dim"`
+}
+
+// An xmileGF is a graphical function: a table.  Its x values are
+// either evenly spaced over XScale, or listed in XPts.
+type xmileGF struct {
+	Name   string      `xml:"name,attr,omitempty"`
+	Type   string      `xml:"type,attr,omitempty"`
+	XScale *xmileScale `xml:"xscale"`
+	XPts   string      `xml:"xpts,omitempty"`
+	YPts   string      `xml:"ypts"`
+	Units  string      `xml:"units,omitempty"`
+	Doc    string      `xml:"doc,omitempty"`
+}
+
+type xmileScale struct {
+	Min float64 `xml:"min,attr"`
+	Max float64 `xml:"max,attr"`
+}
+
+// xmileFuncs maps the built-ins with an XMILE equivalent taking the
+// same arguments to it.
+var xmileFuncs = map[string]string{
+	"MAX":    "MAX",
+	"MIN":    "MIN",
+	"ABS":    "ABS",
+	"SQRT":   "SQRT",
+	"EXP":    "EXP",
+	"LOG":    "LN",
+	"SIN":    "SIN",
+	"COS":    "COS",
+	"STEP":   "STEP",
+	"RAMP":   "RAMP",
+	"SMOOTH": "SMTH1",
+	"DELAY3": "DELAY3",
+	"NORMRN": "NORMAL",
+}
+
+// xmileName returns name as written in an XMILE equation, quoted if
+// it isn't an identifier, like the NAME$1 of an expanded macro.
+func xmileName(name string) string {
+	for i, r := range name {
+		if !(r == '_' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z' || i > 0 && '0' <= r && r <= '9') {
+			return strconv.Quote(name)
+		}
+	}
+	return name
+}
+
+// xmileFloats returns vs as a comma separated list, as in a gf's
+// points.
+func xmileFloats(vs []float64) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+// xmileExpr returns e as an XMILE equation.
+func xmileExpr(e Expr) (string, error) {
+	var buf bytes.Buffer
+	if err := writeXMILE(&buf, e); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// writeXMILE writes e as XMILE to buf.  Time subscripts are dropped,
+// and the built-ins without an XMILE equivalent are written as the
+// expressions computing them.
+func writeXMILE(buf *bytes.Buffer, e Expr) error {
+	switch x := e.(type) {
+	case *BasicLit:
+		writeNumber(buf, x.Value)
+	case *Ident:
+		buf.WriteString(xmileName(strings.ToUpper(x.Name)))
+	case *RefExpr:
+		buf.WriteString(xmileName(strings.ToUpper(x.Name)))
+	case *SubscriptExpr:
+		buf.WriteString(xmileName(strings.ToUpper(x.Base.Name)))
+	case *UnitExpr:
+		return writeXMILE(buf, x.X)
+	case *ParenExpr:
+		if _, ok := x.X.(*IfExpr); ok {
+			// IFs are written in parens of their own
+			return writeXMILE(buf, x.X)
+		}
+		buf.WriteByte('(')
+		if err := writeXMILE(buf, x.X); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+	case *UnaryExpr:
+		buf.WriteString(x.Op.String())
+		return writeXMILE(buf, x.X)
+	case *BinaryExpr:
+		if err := writeXMILE(buf, x.X); err != nil {
+			return err
+		}
+		buf.WriteString(" " + opString(x.Op) + " ")
+		return writeXMILE(buf, x.Y)
+	case *IfExpr:
+		buf.WriteString("(IF ")
+		if err := writeXMILECond(buf, x.Cond); err != nil {
+			return err
+		}
+		buf.WriteString(" THEN ")
+		if err := writeXMILE(buf, x.Then); err != nil {
+			return err
+		}
+		buf.WriteString(" ELSE ")
+		if err := writeXMILE(buf, x.Else); err != nil {
+			return err
+		}
+		buf.WriteByte(')')
+	case *CallExpr:
+		return writeXMILECall(buf, x)
+	default:
+		return fmt.Errorf("can't write %T as XMILE", e)
+	}
+	return nil
+}
+
+// writeXMILECond writes the condition of an IF.  Anything other than
+// a comparison holds when it is non-zero.
+func writeXMILECond(buf *bytes.Buffer, e Expr) error {
+	if x, ok := stripUnits(e).(*BinaryExpr); ok && isComparison(x.Op) {
+		return writeXMILE(buf, e)
+	}
+	if p, ok := stripUnits(e).(*ParenExpr); ok {
+		if x, ok := stripUnits(p.X).(*BinaryExpr); ok && isComparison(x.Op) {
+			return writeXMILE(buf, e)
+		}
+	}
+	buf.WriteByte('(')
+	if err := writeXMILE(buf, e); err != nil {
+		return err
+	}
+	buf.WriteString(") <> 0")
+	return nil
+}
+
+// writeXMILECall writes a call of a built-in function.
+func writeXMILECall(buf *bytes.Buffer, c *CallExpr) error {
+	name := funcName(c)
+	if name == "" {
+		return fmt.Errorf("call of non-function %T", c.Fun)
+	}
+	if n, ok := builtins[name]; ok && len(c.Args) != n {
+		return fmt.Errorf("%s takes %d arguments, not %d", name, n, len(c.Args))
+	}
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		var err error
+		if args[i], err = xmileExpr(arg); err != nil {
+			return err
+		}
+	}
+	if fn, ok := xmileFuncs[name]; ok {
+		fmt.Fprintf(buf, "%s(%s)", fn, strings.Join(args, ", "))
+		return nil
+	}
+	switch name {
+	case "TABHL":
+		if _, ok := c.Args[0].(*Ident); !ok {
+			return fmt.Errorf("TABHL of %s, not a table", exprString(c.Args[0]))
+		}
+		// the table is looked up over the range of its gf
+		fmt.Fprintf(buf, "LOOKUP(%s, %s)", args[0], args[1])
+	case "CLIP":
+		fmt.Fprintf(buf, "(IF (%s) >= (%s) THEN %s ELSE %s)", args[2], args[3], args[0], args[1])
+	case "PULSE":
+		// XMILE's PULSE repeats, and lasts for a single DT
+		fmt.Fprintf(buf, "(IF TIME >= (%s) AND TIME < (%s) + (%s) THEN (%s) / DT ELSE 0)",
+			args[1], args[1], args[2], args[0])
+	case "NOISE":
+		buf.WriteString("RANDOM(-0.5, 0.5)")
+	default:
+		return fmt.Errorf("can't write function %s as XMILE", exprString(c.Fun))
+	}
+	return nil
+}
+
+// A stockTerm is a term of a level's net rate of flow.
+type stockTerm struct {
+	neg bool
+	x   Expr
+}
+
+// isRefTo reports whether e, less parens and units, refers to name,
+// an upper-cased variable name.
+func isRefTo(e Expr, name string) bool {
+	switch x := stripParens(e).(type) {
+	case *Ident:
+		return strings.ToUpper(x.Name) == name
+	case *RefExpr:
+		return strings.ToUpper(x.Name) == name
+	case *SubscriptExpr:
+		return strings.ToUpper(x.Base.Name) == name
+	}
+	return false
+}
+
+// stripParens returns e without the parens and units around it.
+func stripParens(e Expr) Expr {
+	for {
+		switch x := e.(type) {
+		case *ParenExpr:
+			e = x.X
+		case *UnitExpr:
+			e = x.X
+		default:
+			return e
+		}
+	}
+}
+
+// withoutDT returns the product e with a factor of DT removed, or
+// false if DT isn't a factor of it.
+func withoutDT(e Expr) (Expr, bool) {
+	if isRefTo(e, "DT") {
+		return &BasicLit{Kind: token.FLOAT, Value: "1"}, true
+	}
+	switch x := stripParens(e).(type) {
+	case *BinaryExpr:
+		switch x.Op {
+		case token.MUL:
+			if isRefTo(x.X, "DT") {
+				return x.Y, true
+			}
+			if isRefTo(x.Y, "DT") {
+				return x.X, true
+			}
+			if l, ok := withoutDT(x.X); ok {
+				return &BinaryExpr{X: l, Op: token.MUL, Y: x.Y}, true
+			}
+			if r, ok := withoutDT(x.Y); ok {
+				return &BinaryExpr{X: x.X, Op: token.MUL, Y: r}, true
+			}
+		case token.QUO:
+			if l, ok := withoutDT(x.X); ok {
+				return &BinaryExpr{X: l, Op: token.QUO, Y: x.Y}, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// sumTerms appends the terms of the sum e to terms, negated if neg.
+func sumTerms(terms []stockTerm, e Expr, neg bool) []stockTerm {
+	switch x := stripParens(e).(type) {
+	case *BinaryExpr:
+		if x.Op == token.ADD || x.Op == token.SUB {
+			terms = sumTerms(terms, x.X, neg)
+			return sumTerms(terms, x.Y, neg != (x.Op == token.SUB))
+		}
+	case *UnaryExpr:
+		if x.Op == token.SUB {
+			return sumTerms(terms, x.X, !neg)
+		}
+	}
+	return append(terms, stockTerm{neg, e})
+}
+
+// levelTerms returns the terms of the net rate of flow of the level
+// name, whose equation is rhs: E in NAME.J+DT*E, as L cards are
+// written, with DT a factor of the product.  A level built by a
+// ModelBuilder gives its flows.  Any other equation is taken as a
+// single term, (rhs-NAME)/DT.
+func levelTerms(name string, rhs Expr) ([]stockTerm, error) {
+	if cl, ok := rhs.(*CompositeLit); ok {
+		var terms []stockTerm
+		for _, e := range cl.Elts {
+			k, v, err := kvConvert(e)
+			if err != nil {
+				return nil, fmt.Errorf("stock %s: %s", name, err)
+			}
+			switch k {
+			case "inflow", "biflow":
+				terms = sumTerms(terms, v, false)
+			case "outflow":
+				terms = sumTerms(terms, v, true)
+			}
+		}
+		return terms, nil
+	}
+	if x, ok := stripParens(rhs).(*BinaryExpr); ok && (x.Op == token.ADD || x.Op == token.SUB) && isRefTo(x.X, name) {
+		if rate, ok := withoutDT(x.Y); ok {
+			return sumTerms(nil, rate, x.Op == token.SUB), nil
+		}
+	}
+	rate := &BinaryExpr{
+		X:  &ParenExpr{X: &BinaryExpr{X: &ParenExpr{X: rhs}, Op: token.SUB, Y: id(name)}},
+		Op: token.QUO,
+		Y:  id("DT"),
+	}
+	return []stockTerm{{false, rate}}, nil
+}
+
+// GenXMILE returns the model in f as an XMILE 1.0 document, the
+// standard interchange format for system dynamics models.  Macros
+// are expanded, and each level becomes a stock whose inflows and
+// outflows are the rates its equation adds and subtracts.  A level
+// whose net rate has terms other than rates, like the S.K=S.J+
+// (DT)(X.K-S.J)/T of an exponential average, gets a flow of its
+// own, NAME_NET_FLOW, computing it.  Tables become graphical
+// functions, looked up over the range their TABHL calls give, and
+// the built-ins without an equivalent in XMILE, like CLIP and PULSE,
+// are written as the IF expressions computing them.  As XMILE
+// has no save step, SAVPER isn't written.
+func GenXMILE(f *File) ([]byte, error) {
+	if len(f.Decls) != 1 {
+		return nil, fmt.Errorf("can't write %d models as XMILE", len(f.Decls))
+	}
+	md, ok := f.Decls[0].(*ModelDecl)
+	if !ok {
+		return nil, fmt.Errorf("can't write %T as XMILE", f.Decls[0])
+	}
+	md, err := expandMacros(md, f.Macros)
+	if err != nil {
+		return nil, err
+	}
+	if timespecStmt(md) == nil {
+		return nil, fmt.Errorf("model %s has no timespec", md.Name.Name)
+	}
+	ts, err := md.Timespec()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := tableRanges(md)
+	if err != nil {
+		return nil, err
+	}
+
+	x := xmileFile{
+		Version: "1.0",
+		NS:      xmileNS,
+		Header: xmileHeader{
+			Name:    md.Name.Name,
+			Vendor:  "bpowers",
+			Product: xmileProduct{Version: "1.0", Name: "dynamo"},
+		},
+		SimSpecs: xmileSimSpecs{
+			Method: "Euler",
+			Start:  ts.Start,
+			Stop:   ts.End,
+			DT:     xmileDT{Value: strconv.FormatFloat(ts.DT, 'g', -1, 64)},
+		},
+		Models: []xmileModel{{}},
+	}
+	vars := &x.Models[0].Variables
+
+	types := map[string]string{}
+	for _, s := range md.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && assign.Lhs.Name.Name != "timespec" {
+			n := strings.ToUpper(assign.Lhs.Name.Name)
+			if typeLetter(assign.Lhs) != "N" || types[n] == "" {
+				types[n] = assign.Lhs.Type.Name
+			}
+		}
+	}
+	// the initial values of levels, from their N cards
+	initials := map[string]Expr{}
+	for _, s := range md.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		n := strings.ToUpper(assign.Lhs.Name.Name)
+		if typeLetter(assign.Lhs) == "N" && types[n] == "stock" {
+			initials[n] = assign.Rhs
+		}
+		if cl, ok := assign.Rhs.(*CompositeLit); ok && typeLetter(assign.Lhs) == "L" {
+			for _, e := range cl.Elts {
+				if k, v, err := kvConvert(e); err == nil && k == "initial" {
+					initials[n] = v
+				}
+			}
+		}
+	}
+
+	for _, s := range md.Body.List {
+		switch s.(type) {
+		case *OutputStmt:
+			// which variables are printed isn't part of
+			// the model
+			continue
+		case *SpecStmt:
+			// the timespec has the values it gave
+			continue
+		}
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			return nil, fmt.Errorf("can't write %T as XMILE", s)
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		if name == "TIMESPEC" {
+			continue
+		}
+		units := unitsText(assign.Lhs)
+		doc := strings.TrimSuffix(assign.Lhs.Doc.Text(), "\n")
+		switch letter := typeLetter(assign.Lhs); letter {
+		case "L":
+			stock, err := xmileStockOf(name, assign.Rhs, initials[name], types, vars)
+			if err != nil {
+				return nil, err
+			}
+			stock.Units, stock.Doc = units, doc
+			vars.Stocks = append(vars.Stocks, stock)
+		case "T":
+			gf, err := xmileGFOf(name, assign.Rhs, ranges)
+			if err != nil {
+				return nil, err
+			}
+			gf.Units, gf.Doc = units, doc
+			vars.GFs = append(vars.GFs, gf)
+		case "N":
+			if types[name] == "stock" {
+				continue
+			}
+			// an N card's value is fixed at the start
+			eqn, err := xmileExpr(assign.Rhs)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			vars.Auxes = append(vars.Auxes, xmileVar{Name: name, Eqn: "INIT(" + eqn + ")", Units: units, Doc: doc})
+		default:
+			eqn, err := xmileExpr(assign.Rhs)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			v := xmileVar{Name: name, Eqn: eqn, Units: units, Doc: doc}
+			if letter == "R" {
+				vars.Flows = append(vars.Flows, v)
+			} else {
+				vars.Auxes = append(vars.Auxes, v)
+			}
+		}
+	}
+
+	out, err := xml.MarshalIndent(x, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(xml.Header), out...), '\n'), nil
+}
+
+// xmileStockOf returns the stock for the level name, given its
+// equation, rhs, and initial value.  A flow computing its net rate
+// is added to vars if its rates can't be listed as its inflows and
+// outflows.
+func xmileStockOf(name string, rhs, initial Expr, types map[string]string, vars *xmileVariables) (xmileStock, error) {
+	stock := xmileStock{Name: name}
+	if initial == nil {
+		return stock, fmt.Errorf("stock %s has no initial value", name)
+	}
+	var err error
+	if stock.Eqn, err = xmileExpr(initial); err != nil {
+		return stock, fmt.Errorf("%s: %s", name, err)
+	}
+	terms, err := levelTerms(name, rhs)
+	if err != nil {
+		return stock, err
+	}
+
+	flows := true
+	seen := map[string]bool{}
+	for _, t := range terms {
+		ref := strings.ToUpper(exprString(stripParens(t.x)))
+		if i := strings.IndexByte(ref, '.'); i >= 0 {
+			ref = ref[:i]
+		}
+		if !isRefTo(t.x, ref) || types[ref] != "flow" || seen[ref] {
+			flows = false
+			break
+		}
+		seen[ref] = true
+	}
+	if flows {
+		for _, t := range terms {
+			ref := strings.ToUpper(exprString(stripParens(t.x)))
+			if i := strings.IndexByte(ref, '.'); i >= 0 {
+				ref = ref[:i]
+			}
+			if t.neg {
+				stock.Outflows = append(stock.Outflows, ref)
+			} else {
+				stock.Inflows = append(stock.Inflows, ref)
+			}
+		}
+		return stock, nil
+	}
+
+	var net Expr
+	for _, t := range terms {
+		term := t.x
+		switch {
+		case net == nil && t.neg:
+			net = &UnaryExpr{Op: token.SUB, X: &ParenExpr{X: term}}
+		case net == nil:
+			net = term
+		case t.neg:
+			net = &BinaryExpr{X: net, Op: token.SUB, Y: &ParenExpr{X: term}}
+		default:
+			net = &BinaryExpr{X: net, Op: token.ADD, Y: term}
+		}
+	}
+	eqn, err := xmileExpr(net)
+	if err != nil {
+		return stock, fmt.Errorf("%s: %s", name, err)
+	}
+	flow := name + "_NET_FLOW"
+	for i := 2; types[flow] != ""; i++ {
+		flow = fmt.Sprintf("%s_NET_FLOW_%d", name, i)
+	}
+	types[flow] = "flow"
+	vars.Flows = append(vars.Flows, xmileVar{Name: flow, Eqn: eqn, Doc: "the net flow of " + name})
+	stock.Inflows = []string{flow}
+	return stock, nil
+}
+
+// xmileGFOf returns the graphical function for the table name,
+// defined by rhs.  A table parsed from a T card has its xs from the
+// range its TABHL calls look it up over, in ranges; one built by a
+// ModelBuilder gives its own.
+func xmileGFOf(name string, rhs Expr, ranges map[string]tableRange) (xmileGF, error) {
+	gf := xmileGF{Name: name}
+	var ys []float64
+	switch x := rhs.(type) {
+	case *TableFwdExpr:
+		for _, y := range x.Ys {
+			v, err := y.Float64()
+			if err != nil {
+				return gf, fmt.Errorf("table %s: bad number %s", name, y.Value)
+			}
+			ys = append(ys, v)
+		}
+		r, ok := ranges[name]
+		if !ok {
+			return gf, fmt.Errorf("table %s isn't used by any TABHL", name)
+		}
+		if n := len(r.xs()); n != len(ys) {
+			return gf, fmt.Errorf("table %s has %d values for TABHL's %d", name, len(ys), n)
+		}
+		gf.XScale = &xmileScale{r.lo, r.hi}
+		if r.descending() {
+			// XMILE's ys are for ascending xs.
+			for i, j := 0, len(ys)-1; i < j; i, j = i+1, j-1 {
+				ys[i], ys[j] = ys[j], ys[i]
+			}
+			gf.XScale = &xmileScale{r.hi, r.lo}
+		}
+	case *TableExpr:
+		var xs []float64
+		for _, p := range x.Pairs {
+			px, err := constEval(p.X)
+			if err != nil {
+				return gf, fmt.Errorf("table %s: %s", name, err)
+			}
+			py, err := constEval(p.Y)
+			if err != nil {
+				return gf, fmt.Errorf("table %s: %s", name, err)
+			}
+			xs, ys = append(xs, px), append(ys, py)
+		}
+		gf.XPts = xmileFloats(xs)
+	default:
+		return gf, fmt.Errorf("table %s is %T, not a table", name, rhs)
+	}
+	gf.YPts = xmileFloats(ys)
+	return gf, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"encoding/xml"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// xmileSchema is the part of the XMILE 1.0 schema GenXMILE's output
+// and the models ImportXMILE reads are checked against.
+const xmileSchema = "testdata/xmile/xmile.xsd"
+
+// validateXMILE checks the XMILE document data against xmileSchema
+// with xmllint, or skips the test if there's no xmllint.
+func validateXMILE(t *testing.T, name string, data []byte) {
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Skip("no xmllint to validate XMILE with")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "model.xmile")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(xmllint, "--noout", "--schema", xmileSchema, path).CombinedOutput()
+	if err != nil {
+		t.Errorf("%s: invalid XMILE: %s\n%s\n%s", name, err, out, data)
+	}
+}
+
+// xmileNames returns the sorted names of the variables in the XMILE
+// document data, with their kinds.
+func xmileNames(t *testing.T, data []byte) []string {
+	var x xmileFile
+	if err := xml.Unmarshal(data, &x); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if len(x.Models) != 1 {
+		t.Fatalf("got %d models, want 1", len(x.Models))
+	}
+	var names []string
+	vars := x.Models[0].Variables
+	for _, s := range vars.Stocks {
+		names = append(names, "stock "+s.Name)
+	}
+	for _, v := range vars.Flows {
+		names = append(names, "flow "+v.Name)
+	}
+	for _, v := range vars.Auxes {
+		names = append(names, "aux "+v.Name)
+	}
+	for _, gf := range vars.GFs {
+		names = append(names, "gf "+gf.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestGenXMILESchema(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range append(paths, "../models/logistic.dynamo") {
+		f, err := ParseFile(path, token.NewFileSet())
+		if err != nil {
+			t.Errorf("ParseFile: %s", err)
+			continue
+		}
+		data, err := GenXMILE(f)
+		if err != nil {
+			t.Errorf("%s: GenXMILE: %s", path, err)
+			continue
+		}
+		validateXMILE(t, path, data)
+	}
+}
+
+func TestGenXMILE(t *testing.T) {
+	// every kind of card, and a level whose rate isn't a sum of
+	// rates
+	const src = `* every card
+L	POP.K=POP.J+(DT)(B.JK-D.JK)
+N	POP=POPN
+C	POPN=100
+R	B.KL=(NB)(POP.K)(BM.K)
+R	D.KL=POP.K/LIFE
+C	NB=.04
+C	LIFE=50
+A	BM.K=TABHL(BMT,TIME.K,0,10,5)
+T	BMT=1/1.5/.5
+L	AVG.K=AVG.J+(DT)(POP.J-AVG.J)/3
+N	AVG=POP
+S	NET.K=B.JK-D.JK
+N	HALF=POPN/2
+C	LENGTH=10
+C	DT=.25
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	data, err := GenXMILE(f)
+	if err != nil {
+		t.Fatalf("GenXMILE: %s", err)
+	}
+	validateXMILE(t, "every card", data)
+
+	var x xmileFile
+	if err := xml.Unmarshal(data, &x); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if ss := x.SimSpecs; ss.Start != 0 || ss.Stop != 10 || ss.DT.Value != "0.25" {
+		t.Errorf("got sim specs %+v, want 0 to 10 by .25", ss)
+	}
+	vars := x.Models[0].Variables
+	stocks := map[string]xmileStock{}
+	for _, s := range vars.Stocks {
+		stocks[s.Name] = s
+	}
+	if pop := stocks["POP"]; pop.Eqn != "POPN" || strings.Join(pop.Inflows, " ") != "B" || strings.Join(pop.Outflows, " ") != "D" {
+		t.Errorf("got POP %+v, want POPN in by B and out by D", pop)
+	}
+	if avg := stocks["AVG"]; avg.Eqn != "POP" || strings.Join(avg.Inflows, " ") != "AVG_NET_FLOW" || len(avg.Outflows) != 0 {
+		t.Errorf("got AVG %+v, want POP in by AVG_NET_FLOW", avg)
+	}
+	if len(vars.GFs) != 1 || vars.GFs[0].XScale == nil || vars.GFs[0].XScale.Max != 10 || vars.GFs[0].YPts != "1,1.5,0.5" {
+		t.Errorf("got gfs %+v, want BMT over 0 to 10", vars.GFs)
+	}
+	eqns := map[string]string{}
+	for _, v := range append(vars.Flows, vars.Auxes...) {
+		eqns[v.Name] = v.Eqn
+	}
+	for name, eqn := range map[string]string{
+		"B":    "(NB) * (POP) * (BM)",
+		"BM":   "LOOKUP(BMT, TIME)",
+		"NET":  "B - D",
+		"HALF": "INIT(POPN / 2)",
+		"NB":   "0.04",
+	} {
+		if eqns[name] != eqn {
+			t.Errorf("%s: got %q, want %q", name, eqns[name], eqn)
+		}
+	}
+
+	// each variable is written once, with its kind, and the
+	// timespec isn't written as variables
+	want := []string{
+		"aux BM", "aux HALF", "aux LIFE", "aux NB", "aux NET", "aux POPN",
+		"flow AVG_NET_FLOW", "flow B", "flow D",
+		"gf BMT",
+		"stock AVG", "stock POP",
+	}
+	if got := xmileNames(t, data); strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got variables\n%v\nwant\n%v", got, want)
+	}
+
+	if _, err := GenXMILE(&File{}); err == nil {
+		t.Errorf("no models: expected an error")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Hash returns a fingerprint of the model in f, suitable for use as
+// a cache key.  It is computed over each variable's canonical
+// equation as used by Diff: names are upper-cased, numbers are
+// printed in their shortest form, the timespec is expanded into its
+// TIME, LENGTH, SAVPER and DT constants, and equations are taken in
+// name order.  Comments, whitespace and the order of the cards in
+// the source therefore don't affect the result.  Macros are included
+// as their canonical source, in the order they're defined.
+func (f *File) Hash() string {
+	eqns := equations(f)
+	names := make([]string, 0, len(eqns))
+	for n := range eqns {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, n := range names {
+		fmt.Fprintf(h, "%s\n", eqns[n])
+	}
+	for _, mac := range f.Macros {
+		// a macro that can't be printed contributes the
+		// cards written before the one that couldn't be
+		var buf bytes.Buffer
+		writeMacro(&buf, DefaultWidth, mac)
+		h.Write(buf.Bytes())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
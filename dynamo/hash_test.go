@@ -0,0 +1,42 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	base, _ := parseSrc(t, helloWorld)
+	same := []string{
+		// comments and whitespace
+		strings.Replace(strings.Replace(helloWorld, "NOTE\tPopulation Sector\n", "", 1), "\t", " ", -1),
+		// card order and the case of names
+		strings.Replace(helloWorld, "C\tNB=.04\n", "", 1) + "c\tnb=.04\n",
+		// number formatting
+		strings.Replace(helloWorld, "NB=.04", "NB=0.040", 1),
+	}
+	for _, src := range same {
+		f, _ := parseSrc(t, src)
+		if f.Hash() != base.Hash() {
+			t.Errorf("hash of an equivalent model differs:\n%s", src)
+		}
+	}
+
+	different := []string{
+		strings.Replace(helloWorld, "NB=.04", "NB=.05", 1),
+		strings.Replace(helloWorld, "DT=5", "DT=2.5", 1),
+		strings.Replace(helloWorld, "(NB)(POP.K)", "(NB)(POP.K)(2)", 1),
+		strings.Replace(helloWorld, "(B.JK-D.JK)", "(B.JK)", 1),
+		helloWorld + "A\tGR.K=B.JK/POP.K\n",
+	}
+	for _, src := range different {
+		f, _ := parseSrc(t, src)
+		if f.Hash() == base.Hash() {
+			t.Errorf("hash of a changed model is the same:\n%s", src)
+		}
+	}
+}
@@ -0,0 +1,994 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"go/token"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// xmileReserved holds the names DYNAMO gives the timespec, which an
+// imported variable can't have.
+var xmileReserved = map[string]bool{
+	"TIME":      true,
+	"DT":        true,
+	"LENGTH":    true,
+	"SAVPER":    true,
+	"STARTTIME": true,
+	"STOPTIME":  true,
+}
+
+// xmileCanonical returns the DYNAMO name of the XMILE name s: upper
+// cased, with each run of spaces, underscores and escaped newlines
+// as a single underscore, as XMILE treats them all alike.
+func xmileCanonical(s string) string {
+	s = strings.Replace(s, `\n`, " ", -1)
+	f := strings.FieldsFunc(s, func(r rune) bool {
+		return r == '_' || unicode.IsSpace(r)
+	})
+	return strings.ToUpper(strings.Join(f, "_"))
+}
+
+// checkXMILEName returns an error if name can't be written as a
+// DYNAMO identifier.
+func checkXMILEName(name string) error {
+	if name == "" {
+		return fmt.Errorf("variable with no name")
+	}
+	if xmileReserved[name] {
+		return fmt.Errorf("%s is the name of a DYNAMO constant", name)
+	}
+	for i, r := range name {
+		if !isAlphaNumeric(r) || r == '.' || r == '"' || i == 0 && !isIdentifierStart(r) {
+			return fmt.Errorf("%q can't be a DYNAMO name", name)
+		}
+	}
+	return nil
+}
+
+// An xmileLexer splits an XMILE equation into tokens: numbers,
+// names, keywords and operators.  Names are canonical, and keywords
+// upper cased.  Comments, in braces, are skipped.
+type xmileLexer struct {
+	s   string
+	pos int
+}
+
+// xmileKeywords holds the keywords of XMILE equations.
+var xmileKeywords = map[string]bool{
+	"IF":   true,
+	"THEN": true,
+	"ELSE": true,
+	"AND":  true,
+	"OR":   true,
+	"NOT":  true,
+	"MOD":  true,
+}
+
+// xmileOps maps XMILE's binary operators to their tokens.  Those
+// other than DYNAMO's are lowered by xmileImporter.
+var xmileOps = map[string]token.Token{
+	"+":   token.ADD,
+	"-":   token.SUB,
+	"*":   token.MUL,
+	"/":   token.QUO,
+	"^":   token.XOR,
+	"MOD": token.REM,
+	"<":   token.LSS,
+	">":   token.GTR,
+	"<=":  token.LEQ,
+	">=":  token.GEQ,
+	"<>":  token.NEQ,
+	"=":   token.EQL,
+	"AND": token.LAND,
+	"OR":  token.LOR,
+}
+
+// An xmileToken is a token of an XMILE equation.  Kind is 'n' for a
+// number, 'i' for a name, 'k' for a keyword, 'o' for an operator or
+// punctuation and 0 at the end.
+type xmileToken struct {
+	kind byte
+	val  string
+}
+
+// next returns the next token, or an error for a character that
+// can't start one.
+func (l *xmileLexer) next() (xmileToken, error) {
+	for l.pos < len(l.s) {
+		switch c := l.s[l.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			l.pos++
+		case c == '{':
+			end := strings.IndexByte(l.s[l.pos:], '}')
+			if end < 0 {
+				return xmileToken{}, fmt.Errorf("unterminated comment")
+			}
+			l.pos += end + 1
+		default:
+			return l.token()
+		}
+	}
+	return xmileToken{}, nil
+}
+
+func (l *xmileLexer) token() (xmileToken, error) {
+	start := l.pos
+	digit := func() bool { return l.pos < len(l.s) && '0' <= l.s[l.pos] && l.s[l.pos] <= '9' }
+	switch c := l.s[l.pos]; {
+	case '0' <= c && c <= '9' || c == '.':
+		for digit() {
+			l.pos++
+		}
+		if l.pos < len(l.s) && l.s[l.pos] == '.' {
+			l.pos++
+			for digit() {
+				l.pos++
+			}
+		}
+		if l.pos < len(l.s) && (l.s[l.pos] == 'e' || l.s[l.pos] == 'E') {
+			l.pos++
+			if l.pos < len(l.s) && (l.s[l.pos] == '+' || l.s[l.pos] == '-') {
+				l.pos++
+			}
+			for digit() {
+				l.pos++
+			}
+		}
+		if _, err := strconv.ParseFloat(l.s[start:l.pos], 64); err != nil {
+			return xmileToken{}, fmt.Errorf("bad number %s", l.s[start:l.pos])
+		}
+		return xmileToken{'n', l.s[start:l.pos]}, nil
+	case c == '"':
+		end := strings.IndexByte(l.s[l.pos+1:], '"')
+		if end < 0 {
+			return xmileToken{}, fmt.Errorf("unterminated name %s", l.s[l.pos:])
+		}
+		l.pos += end + 2
+		return xmileToken{'i', xmileCanonical(l.s[start+1 : l.pos-1])}, nil
+	case strings.IndexByte("+-*/^(),=", c) >= 0:
+		l.pos++
+		return xmileToken{'o', l.s[start:l.pos]}, nil
+	case c == '<' || c == '>':
+		l.pos++
+		if l.pos < len(l.s) && (l.s[l.pos] == '=' || c == '<' && l.s[l.pos] == '>') {
+			l.pos++
+		}
+		return xmileToken{'o', l.s[start:l.pos]}, nil
+	}
+	for l.pos < len(l.s) {
+		r, n := rune(l.s[l.pos]), 1
+		if r >= 0x80 {
+			r, n = utf8.DecodeRuneInString(l.s[l.pos:])
+		}
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			break
+		}
+		l.pos += n
+	}
+	if l.pos == start {
+		return xmileToken{}, fmt.Errorf("unexpected %q", l.s[start])
+	}
+	name := xmileCanonical(l.s[start:l.pos])
+	if xmileKeywords[name] {
+		return xmileToken{'k', name}, nil
+	}
+	return xmileToken{'i', name}, nil
+}
+
+// An xmileParser parses an XMILE equation into an expression, using
+// the DYNAMO nodes with the operators XMILE adds: ^, MOD, =, AND, OR
+// and NOT.
+type xmileParser struct {
+	lex xmileLexer
+	tok xmileToken
+	err error
+}
+
+// parseXMILE parses the XMILE equation s.
+func parseXMILE(s string) (Expr, error) {
+	p := &xmileParser{lex: xmileLexer{s: s}}
+	p.advance()
+	x := p.expr()
+	if p.err == nil && p.tok.kind != 0 {
+		p.err = fmt.Errorf("unexpected %s", p.tok.val)
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("%s in %q", p.err, s)
+	}
+	return x, nil
+}
+
+func (p *xmileParser) advance() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+// is reports whether the current token is the operator or keyword
+// val.
+func (p *xmileParser) is(val string) bool {
+	return (p.tok.kind == 'o' || p.tok.kind == 'k') && p.tok.val == val
+}
+
+func (p *xmileParser) expect(val string) {
+	if p.err == nil && !p.is(val) {
+		if p.tok.kind == 0 {
+			p.err = fmt.Errorf("expected %s, not end of equation", val)
+		} else {
+			p.err = fmt.Errorf("expected %s, not %s", val, p.tok.val)
+		}
+	}
+	p.advance()
+}
+
+// binary parses a left-associative chain of the operators ops, with
+// operands parsed by next.
+func (p *xmileParser) binary(next func() Expr, ops ...string) Expr {
+	x := next()
+	for p.err == nil {
+		op := ""
+		for _, o := range ops {
+			if p.is(o) {
+				op = o
+			}
+		}
+		if op == "" {
+			break
+		}
+		p.advance()
+		x = &BinaryExpr{X: x, Op: xmileOps[op], Y: next()}
+	}
+	return x
+}
+
+func (p *xmileParser) expr() Expr {
+	if p.is("IF") {
+		return p.ifExpr()
+	}
+	return p.binary(p.and, "OR")
+}
+
+func (p *xmileParser) ifExpr() Expr {
+	x := new(IfExpr)
+	p.advance()
+	x.Cond = p.expr()
+	p.expect("THEN")
+	x.Then = p.expr()
+	p.expect("ELSE")
+	x.Else = p.expr()
+	return x
+}
+
+func (p *xmileParser) and() Expr {
+	return p.binary(p.not, "AND")
+}
+
+func (p *xmileParser) not() Expr {
+	if p.is("NOT") {
+		p.advance()
+		return &UnaryExpr{Op: token.NOT, X: p.not()}
+	}
+	return p.binary(p.sum, "<", ">", "<=", ">=", "<>", "=")
+}
+
+func (p *xmileParser) sum() Expr {
+	return p.binary(p.term, "+", "-")
+}
+
+func (p *xmileParser) term() Expr {
+	return p.binary(p.unary, "*", "/", "MOD")
+}
+
+func (p *xmileParser) unary() Expr {
+	if p.is("-") || p.is("+") {
+		op := xmileOps[p.tok.val]
+		p.advance()
+		return &UnaryExpr{Op: op, X: p.unary()}
+	}
+	return p.power()
+}
+
+// power parses an exponentiation, which is right-associative.
+func (p *xmileParser) power() Expr {
+	x := p.primary()
+	if p.err == nil && p.is("^") {
+		p.advance()
+		return &BinaryExpr{X: x, Op: token.XOR, Y: p.unary()}
+	}
+	return x
+}
+
+func (p *xmileParser) primary() Expr {
+	if p.err != nil {
+		return nil
+	}
+	switch tok := p.tok; {
+	case tok.kind == 'n':
+		p.advance()
+		return &BasicLit{Kind: token.FLOAT, Value: tok.val}
+	case tok.kind == 'i':
+		p.advance()
+		if !p.is("(") {
+			return id(tok.val)
+		}
+		p.advance()
+		c := &CallExpr{Fun: id(tok.val)}
+		for p.err == nil && !p.is(")") {
+			c.Args = append(c.Args, p.expr())
+			if !p.is(")") {
+				p.expect(",")
+			}
+		}
+		p.expect(")")
+		return c
+	case p.is("("):
+		p.advance()
+		x := p.expr()
+		p.expect(")")
+		return &ParenExpr{X: x}
+	case p.is("IF"):
+		return p.ifExpr()
+	case tok.kind == 0:
+		p.err = fmt.Errorf("expected expression, not end of equation")
+	default:
+		p.err = fmt.Errorf("expected expression, not %s", tok.val)
+	}
+	return nil
+}
+
+// An xmileImporter lowers parsed XMILE equations to DYNAMO.
+type xmileImporter struct {
+	types  map[string]string     // of each variable
+	ranges map[string]tableRange // of each table
+	specs  xmileSimSpecs
+	start  float64
+	stop   float64
+}
+
+func num(v float64) *BasicLit {
+	return &BasicLit{Kind: token.FLOAT, Value: strconv.FormatFloat(v, 'g', -1, 64)}
+}
+
+// paren returns e in parens, unless it's an operand already.
+func paren(e Expr) Expr {
+	switch e.(type) {
+	case *BasicLit, *Ident, *SubscriptExpr, *ParenExpr, *CallExpr:
+		return e
+	}
+	return &ParenExpr{X: e}
+}
+
+// ref returns the reference to name in an equation of type eqn,
+// with the time subscript it takes there.
+func (im *xmileImporter) ref(name, eqn string) (Expr, error) {
+	switch name {
+	case "TIME", "DT":
+		return id(name), nil
+	case "STARTTIME":
+		return num(im.start), nil
+	case "STOPTIME":
+		return num(im.stop), nil
+	}
+	ty, ok := im.types[name]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("unknown variable %s", name)
+	case ty == "table":
+		return nil, fmt.Errorf("graphical function %s used as a value", name)
+	}
+	if sub := refSubscript(eqn, ty); sub != "" {
+		return &SubscriptExpr{id(name), sub}, nil
+	}
+	return id(name), nil
+}
+
+// expr lowers e, in an equation of type eqn, to DYNAMO.
+func (im *xmileImporter) expr(e Expr, eqn string) (Expr, error) {
+	switch x := e.(type) {
+	case *BasicLit:
+		return x, nil
+	case *Ident:
+		return im.ref(x.Name, eqn)
+	case *ParenExpr:
+		inner, err := im.expr(x.X, eqn)
+		if err != nil {
+			return nil, err
+		}
+		return paren(inner), nil
+	case *UnaryExpr:
+		if x.Op == token.NOT {
+			return im.boolean(x, eqn)
+		}
+		inner, err := im.expr(x.X, eqn)
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: x.Op, X: inner}, nil
+	case *BinaryExpr:
+		switch x.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO:
+		case token.XOR:
+			return im.power(x, eqn)
+		case token.REM:
+			return nil, fmt.Errorf("MOD has no DYNAMO equivalent")
+		default:
+			return im.boolean(x, eqn)
+		}
+		l, err := im.expr(x.X, eqn)
+		if err != nil {
+			return nil, err
+		}
+		r, err := im.expr(x.Y, eqn)
+		if err != nil {
+			return nil, err
+		}
+		return &BinaryExpr{X: l, Op: x.Op, Y: r}, nil
+	case *IfExpr:
+		return im.ifExpr(x.Cond, x.Then, x.Else, eqn)
+	case *CallExpr:
+		return im.call(x, eqn)
+	}
+	return nil, fmt.Errorf("can't import %T", e)
+}
+
+// ifExpr returns IF cond THEN then ELSE els, in parens so that it
+// can be an operand.
+func (im *xmileImporter) ifExpr(cond, then, els Expr, eqn string) (Expr, error) {
+	c, err := im.cond(cond, eqn)
+	if err != nil {
+		return nil, err
+	}
+	t, err := im.expr(then, eqn)
+	if err != nil {
+		return nil, err
+	}
+	e, err := im.expr(els, eqn)
+	if err != nil {
+		return nil, err
+	}
+	return &ParenExpr{X: &IfExpr{Cond: c, Then: t, Else: e}}, nil
+}
+
+// cond lowers the condition of an IF.  DYNAMO's comparisons are
+// written as they are; anything else holds when its value is
+// non-zero, as in DYNAMO.
+func (im *xmileImporter) cond(e Expr, eqn string) (Expr, error) {
+	x, ok := e.(*BinaryExpr)
+	for p, isParen := e.(*ParenExpr); isParen; p, isParen = p.X.(*ParenExpr) {
+		x, ok = p.X.(*BinaryExpr)
+	}
+	if !ok || !isComparison(x.Op) {
+		return im.expr(e, eqn)
+	}
+	l, err := im.expr(x.X, eqn)
+	if err != nil {
+		return nil, err
+	}
+	r, err := im.expr(x.Y, eqn)
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryExpr{X: l, Op: x.Op, Y: r}, nil
+}
+
+// boolean lowers a comparison or logical expression to 1 where it
+// holds and 0 where it doesn't.
+func (im *xmileImporter) boolean(e Expr, eqn string) (Expr, error) {
+	for {
+		p, ok := e.(*ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.X
+	}
+	one, zero := num(1), num(0)
+	switch x := e.(type) {
+	case *UnaryExpr:
+		if x.Op == token.NOT {
+			v, err := im.boolean(x.X, eqn)
+			if err != nil {
+				return nil, err
+			}
+			return &ParenExpr{X: &BinaryExpr{X: one, Op: token.SUB, Y: v}}, nil
+		}
+	case *BinaryExpr:
+		switch {
+		case isComparison(x.Op):
+			c, err := im.cond(x, eqn)
+			if err != nil {
+				return nil, err
+			}
+			return &ParenExpr{X: &IfExpr{Cond: c, Then: one, Else: zero}}, nil
+		case x.Op == token.EQL:
+			c, err := im.cond(&BinaryExpr{X: x.X, Op: token.NEQ, Y: x.Y}, eqn)
+			if err != nil {
+				return nil, err
+			}
+			return &ParenExpr{X: &IfExpr{Cond: c, Then: zero, Else: one}}, nil
+		case x.Op == token.LAND || x.Op == token.LOR:
+			l, err := im.boolean(x.X, eqn)
+			if err != nil {
+				return nil, err
+			}
+			r, err := im.boolean(x.Y, eqn)
+			if err != nil {
+				return nil, err
+			}
+			if x.Op == token.LAND {
+				return &ParenExpr{X: &BinaryExpr{X: l, Op: token.MUL, Y: r}}, nil
+			}
+			return &CallExpr{Fun: id("MAX"), Args: []Expr{l, r}}, nil
+		}
+	}
+	v, err := im.expr(e, eqn)
+	if err != nil {
+		return nil, err
+	}
+	c := &BinaryExpr{X: paren(v), Op: token.NEQ, Y: zero}
+	return &ParenExpr{X: &IfExpr{Cond: c, Then: one, Else: zero}}, nil
+}
+
+// power imports x^y as DYNAMO's ^.  A negative literal base is
+// parenthesized, as -2^2 would be read as -(2^2).
+func (im *xmileImporter) power(e *BinaryExpr, eqn string) (Expr, error) {
+	x, err := im.expr(e.X, eqn)
+	if err != nil {
+		return nil, err
+	}
+	y, err := im.expr(e.Y, eqn)
+	if err != nil {
+		return nil, err
+	}
+	base := paren(x)
+	if lit, ok := base.(*BasicLit); ok && strings.HasPrefix(lit.Value, "-") {
+		base = &ParenExpr{X: lit}
+	}
+	return paren(&BinaryExpr{X: base, Op: token.XOR, Y: paren(y)}), nil
+}
+
+// xmileCalls maps the XMILE built-ins DYNAMO has to their DYNAMO
+// names.
+var xmileCalls = map[string]string{
+	"ABS":    "ABS",
+	"SQRT":   "SQRT",
+	"EXP":    "EXP",
+	"LN":     "LOG",
+	"SIN":    "SIN",
+	"COS":    "COS",
+	"STEP":   "STEP",
+	"SMTH1":  "SMOOTH",
+	"DELAY3": "DELAY3",
+	"NORMAL": "NORMRN",
+}
+
+// call lowers a call of an XMILE built-in, or a lookup in a
+// graphical function by its name.
+func (im *xmileImporter) call(c *CallExpr, eqn string) (Expr, error) {
+	name := c.Fun.(*Ident).Name
+	nargs := func(ns ...int) error {
+		for _, n := range ns {
+			if len(c.Args) == n {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s can't take %d arguments", name, len(c.Args))
+	}
+	if im.types[name] == "table" {
+		if err := nargs(1); err != nil {
+			return nil, err
+		}
+		return im.lookup(name, c.Args[0], eqn)
+	}
+	if name == "IF_THEN_ELSE" {
+		if err := nargs(3); err != nil {
+			return nil, err
+		}
+		return im.ifExpr(c.Args[0], c.Args[1], c.Args[2], eqn)
+	}
+	if name == "LOOKUP" {
+		if err := nargs(2); err != nil {
+			return nil, err
+		}
+		gf, ok := c.Args[0].(*Ident)
+		if !ok || im.types[gf.Name] != "table" {
+			return nil, fmt.Errorf("LOOKUP of %s, not a graphical function", exprString(c.Args[0]))
+		}
+		return im.lookup(gf.Name, c.Args[1], eqn)
+	}
+
+	args := make([]Expr, len(c.Args))
+	for i, arg := range c.Args {
+		var err error
+		if args[i], err = im.expr(arg, eqn); err != nil {
+			return nil, err
+		}
+	}
+	call := func(fn string, args ...Expr) Expr {
+		return &CallExpr{Fun: id(fn), Args: args}
+	}
+	if fn, ok := xmileCalls[name]; ok {
+		if err := nargs(builtins[fn]); err != nil {
+			return nil, err
+		}
+		return call(fn, args...), nil
+	}
+	switch name {
+	case "MAX", "MIN":
+		if len(args) < 2 {
+			return nil, nargs(2)
+		}
+		x := args[0]
+		for _, arg := range args[1:] {
+			x = call(name, x, arg)
+		}
+		return x, nil
+	case "LOG10":
+		if err := nargs(1); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{X: &BinaryExpr{X: call("LOG", args[0]), Op: token.QUO, Y: call("LOG", num(10))}}, nil
+	case "RAMP":
+		if err := nargs(2, 3); err != nil {
+			return nil, err
+		}
+		if len(args) == 2 {
+			return call("RAMP", args...), nil
+		}
+		// a ramp ending at args[2]
+		return &ParenExpr{X: &BinaryExpr{
+			X:  call("RAMP", args[0], args[1]),
+			Op: token.SUB,
+			Y:  call("RAMP", args[0], args[2]),
+		}}, nil
+	case "PULSE":
+		if err := nargs(2, 3); err != nil {
+			return nil, err
+		}
+		if len(args) == 3 {
+			if lit, ok := args[2].(*BasicLit); !ok || lit.Value != "0" {
+				return nil, fmt.Errorf("PULSE repeating every %s has no DYNAMO equivalent", exprString(args[2]))
+			}
+		}
+		// a pulse of volume args[0] over a single DT
+		return call("PULSE", args[0], args[1], id("DT")), nil
+	case "RANDOM":
+		if err := nargs(2); err != nil {
+			return nil, err
+		}
+		// NOISE is uniform over [-0.5, 0.5)
+		width := &BinaryExpr{X: args[1], Op: token.SUB, Y: paren(args[0])}
+		unit := &ParenExpr{X: &BinaryExpr{X: call("NOISE"), Op: token.ADD, Y: num(0.5)}}
+		return &ParenExpr{X: &BinaryExpr{
+			X:  paren(args[0]),
+			Op: token.ADD,
+			Y:  &BinaryExpr{X: &ParenExpr{X: width}, Op: token.MUL, Y: unit},
+		}}, nil
+	}
+	return nil, fmt.Errorf("%s has no DYNAMO equivalent", name)
+}
+
+// lookup returns the lookup of x in the table name, over the range
+// of its graphical function.
+func (im *xmileImporter) lookup(name string, x Expr, eqn string) (Expr, error) {
+	in, err := im.expr(x, eqn)
+	if err != nil {
+		return nil, err
+	}
+	r := im.ranges[name]
+	return &CallExpr{Fun: id("TABHL"), Args: []Expr{id(name), in, num(r.lo), num(r.hi), num(r.step)}}, nil
+}
+
+// xmilePoints parses the points of a graphical function, separated
+// by sep, or by commas if sep is empty.
+func xmilePoints(name, s, sep string) ([]float64, error) {
+	if sep == "" {
+		sep = ","
+	}
+	var vs []float64
+	for _, f := range strings.Split(strings.TrimSpace(s), sep) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("graphical function %s: bad point %q", name, f)
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// gfRange returns the ys of the graphical function gf, and the range
+// of evenly spaced xs DYNAMO looks them up over.
+func gfRange(name string, gf *xmileGF) ([]float64, tableRange, error) {
+	var r tableRange
+	switch gf.Type {
+	case "", "continuous":
+	default:
+		return nil, r, fmt.Errorf("graphical function %s is %s, not continuous", name, gf.Type)
+	}
+	ys, err := xmilePoints(name, gf.YPts, "")
+	if err != nil {
+		return nil, r, err
+	}
+	if len(ys) < 2 {
+		return nil, r, fmt.Errorf("graphical function %s has %d points", name, len(ys))
+	}
+	switch {
+	case gf.XPts != "":
+		xs, err := xmilePoints(name, gf.XPts, "")
+		if err != nil {
+			return nil, r, err
+		}
+		if len(xs) != len(ys) {
+			return nil, r, fmt.Errorf("graphical function %s has %d xs for %d ys", name, len(xs), len(ys))
+		}
+		r = tableRange{xs[0], xs[len(xs)-1], (xs[len(xs)-1] - xs[0]) / float64(len(xs)-1)}
+		for i, x := range xs {
+			if math.Abs(x-(r.lo+float64(i)*r.step)) > 1e-9*math.Abs(r.hi-r.lo) {
+				return nil, r, fmt.Errorf("graphical function %s has unevenly spaced xs", name)
+			}
+		}
+	case gf.XScale != nil:
+		r = tableRange{gf.XScale.Min, gf.XScale.Max, (gf.XScale.Max - gf.XScale.Min) / float64(len(ys)-1)}
+	default:
+		return nil, r, fmt.Errorf("graphical function %s has no xs", name)
+	}
+	if !(r.step > 0) {
+		return nil, r, fmt.Errorf("graphical function %s has decreasing xs", name)
+	}
+	return ys, r, nil
+}
+
+// ImportXMILE parses an XMILE document, as written by GenXMILE and
+// other system dynamics tools, into a DYNAMO model.  Stocks become
+// levels, given by an L card adding their inflows and subtracting
+// their outflows, and an N card with their initial value.  Flows
+// become rates, graphical functions tables, and auxiliaries A
+// cards, or C cards if they are numbers and N cards if they are the
+// INIT of an expression.  The sim specs become the timespec, saved
+// every DT.
+//
+// XMILE's operators and built-ins missing from DYNAMO are lowered to
+// the expressions computing them where that's possible: AND, OR, NOT
+// and = to IFs giving 1 or 0, and ^ to a product or EXP and LOG.
+// Arrays, modules and stocks that are conveyors or queues aren't
+// supported; non-negative stocks and flows are imported as ordinary
+// ones.
+func ImportXMILE(data []byte) (*File, error) {
+	var x xmileFile
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, err
+	}
+	if len(x.Models) != 1 {
+		return nil, fmt.Errorf("can't import %d models; modules aren't supported", len(x.Models))
+	}
+	vars := x.Models[0].Variables
+
+	im := &xmileImporter{
+		types:  map[string]string{},
+		ranges: map[string]tableRange{},
+		start:  x.SimSpecs.Start,
+		stop:   x.SimSpecs.Stop,
+	}
+	dt, err := strconv.ParseFloat(strings.TrimSpace(x.SimSpecs.DT.Value), 64)
+	switch {
+	case x.SimSpecs.DT.Value == "":
+		dt = 1
+	case err != nil:
+		return nil, fmt.Errorf("bad dt %q", x.SimSpecs.DT.Value)
+	case x.SimSpecs.DT.Reciprocal:
+		dt = 1 / dt
+	}
+	if !(dt > 0) || !(im.stop > im.start) {
+		return nil, fmt.Errorf("bad sim specs: start %g, stop %g, dt %g", im.start, im.stop, dt)
+	}
+
+	// declare each variable, and each graphical function embedded
+	// in a flow or auxiliary as a table of its own
+	declare := func(name, ty string, dims *xmileDimensions) (string, error) {
+		n := xmileCanonical(name)
+		if err := checkXMILEName(n); err != nil {
+			return "", err
+		}
+		if dims != nil {
+			return "", fmt.Errorf("%s: arrays aren't supported", n)
+		}
+		if _, ok := im.types[n]; ok {
+			return "", fmt.Errorf("%s is declared more than once", n)
+		}
+		im.types[n] = ty
+		return n, nil
+	}
+	eqns := map[string]Expr{}
+	parse := func(name, eqn string) error {
+		e, err := parseXMILE(eqn)
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		eqns[name] = e
+		return nil
+	}
+	embedded := map[string]string{}
+	ys := map[string][]float64{}
+	table := func(name string, gf *xmileGF) error {
+		var err error
+		ys[name], im.ranges[name], err = gfRange(name, gf)
+		return err
+	}
+	for _, s := range vars.Stocks {
+		name, err := declare(s.Name, "stock", s.Dims)
+		if err != nil {
+			return nil, err
+		}
+		if err = parse(name, s.Eqn); err != nil {
+			return nil, err
+		}
+	}
+	auxes := append(append([]xmileVar(nil), vars.Flows...), vars.Auxes...)
+	for i, v := range auxes {
+		ty := "flow"
+		if i >= len(vars.Flows) {
+			ty = "aux"
+		}
+		name, err := declare(v.Name, ty, v.Dims)
+		if err != nil {
+			return nil, err
+		}
+		if err = parse(name, v.Eqn); err != nil {
+			return nil, err
+		}
+		if ty == "aux" && v.GF == nil {
+			switch e := eqns[name].(type) {
+			case *BasicLit:
+				im.types[name] = "const"
+			case *UnaryExpr:
+				if _, ok := e.X.(*BasicLit); ok && e.Op == token.SUB {
+					im.types[name] = "const"
+				}
+			case *CallExpr:
+				if e.Fun.(*Ident).Name == "INIT" && len(e.Args) == 1 {
+					im.types[name] = "initial"
+					eqns[name] = e.Args[0]
+				}
+			}
+		}
+		if v.GF != nil {
+			t := name + "_LOOKUP"
+			for i := 2; im.types[t] != ""; i++ {
+				t = fmt.Sprintf("%s_LOOKUP_%d", name, i)
+			}
+			if t, err = declare(t, "table", nil); err != nil {
+				return nil, err
+			}
+			if err = table(t, v.GF); err != nil {
+				return nil, err
+			}
+			embedded[name] = t
+		}
+	}
+	for _, gf := range vars.GFs {
+		name, err := declare(gf.Name, "table", nil)
+		if err != nil {
+			return nil, err
+		}
+		gf := gf
+		if err = table(name, &gf); err != nil {
+			return nil, err
+		}
+	}
+
+	// write each variable as the cards it becomes
+	var buf bytes.Buffer
+	buf.WriteString("*\n")
+	card := func(name, letter, lhs string, rhs Expr, units, doc string) error {
+		if strings.ContainsAny(units, "\n\r;{}") {
+			return fmt.Errorf("%s: bad units %q", name, units)
+		}
+		eqn := lhs + "=" + exprString(rhs)
+		if units = strings.TrimSpace(units); units != "" {
+			eqn += " {" + units + "}"
+		}
+		writeNotes(&buf, doc)
+		writeCard(&buf, DefaultWidth, letter, eqn)
+		return nil
+	}
+	for _, s := range vars.Stocks {
+		name := xmileCanonical(s.Name)
+		var rate Expr
+		for i, flows := range [][]string{s.Inflows, s.Outflows} {
+			for _, f := range flows {
+				f = xmileCanonical(f)
+				if im.types[f] != "flow" {
+					return nil, fmt.Errorf("stock %s: %s isn't a flow", name, f)
+				}
+				var ref Expr = &SubscriptExpr{id(f), "JK"}
+				switch {
+				case rate == nil && i == 1:
+					rate = &UnaryExpr{Op: token.SUB, X: ref}
+				case rate == nil:
+					rate = ref
+				default:
+					rate = &BinaryExpr{X: rate, Op: []token.Token{token.ADD, token.SUB}[i], Y: ref}
+				}
+			}
+		}
+		var level Expr = &SubscriptExpr{id(name), "J"}
+		if rate != nil {
+			level = &BinaryExpr{X: level, Op: token.ADD, Y: &BinaryExpr{X: &ParenExpr{X: id("DT")}, Op: token.MUL, Y: &ParenExpr{X: rate}}}
+		}
+		initial, err := im.expr(eqns[name], "initial")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if err = card(name, "L", name+".K", level, s.Units, s.Doc); err != nil {
+			return nil, err
+		}
+		if err = card(name, "N", name, initial, s.Units, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range auxes {
+		name := xmileCanonical(v.Name)
+		ty := im.types[name]
+		rhs, err := im.expr(eqns[name], ty)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if t, ok := embedded[name]; ok {
+			r := im.ranges[t]
+			if err = card(t, "T", t, &TableFwdExpr{Ys: floatLits(ys[t])}, "", ""); err != nil {
+				return nil, err
+			}
+			rhs = &CallExpr{Fun: id("TABHL"), Args: []Expr{id(t), rhs, num(r.lo), num(r.hi), num(r.step)}}
+		}
+		lhs := name
+		if sub := declSubscripts[ty]; sub != "" {
+			lhs += "." + sub
+		}
+		letter := typeLetter(&VarDecl{Type: id(ty)})
+		if err = card(name, letter, lhs, rhs, v.Units, v.Doc); err != nil {
+			return nil, err
+		}
+	}
+	for _, gf := range vars.GFs {
+		name := xmileCanonical(gf.Name)
+		if err = card(name, "T", name, &TableFwdExpr{Ys: floatLits(ys[name])}, gf.Units, gf.Doc); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range []struct {
+		name string
+		v    float64
+	}{{"TIME", im.start}, {"LENGTH", im.stop}, {"DT", dt}, {"SAVPER", dt}} {
+		writeCard(&buf, DefaultWidth, "C", c.name+"="+strconv.FormatFloat(c.v, 'g', -1, 64))
+	}
+
+	src := buf.String()
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+	if err != nil {
+		return nil, err
+	}
+	if name := x.Models[0].Name; name != "" {
+		f.Decls[0].(*ModelDecl).Name.Name = name
+	}
+	return f, nil
+}
+
+// floatLits returns vs as number literals.
+func floatLits(vs []float64) []*BasicLit {
+	lits := make([]*BasicLit, len(vs))
+	for i, v := range vs {
+		lits[i] = num(v)
+	}
+	return lits
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// canonicalNames returns the sorted kinds and canonical names of the
+// variables in the XMILE document data, as ImportXMILE names them:
+// a graphical function embedded in a variable becomes a table named
+// for it.
+func canonicalNames(t *testing.T, data []byte) []string {
+	var x xmileFile
+	if err := xml.Unmarshal(data, &x); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	vars := x.Models[0].Variables
+	var names []string
+	for _, s := range vars.Stocks {
+		names = append(names, "stock "+xmileCanonical(s.Name))
+	}
+	for _, v := range vars.Flows {
+		names = append(names, "flow "+xmileCanonical(v.Name))
+	}
+	for _, v := range vars.Auxes {
+		names = append(names, "aux "+xmileCanonical(v.Name))
+		if v.GF != nil {
+			names = append(names, "gf "+xmileCanonical(v.Name)+"_LOOKUP")
+		}
+	}
+	for _, gf := range vars.GFs {
+		names = append(names, "gf "+xmileCanonical(gf.Name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestImportXMILE(t *testing.T) {
+	paths, err := filepath.Glob("testdata/xmile/*.xmile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 3 {
+		t.Fatalf("got %d XMILE models in testdata/xmile, want at least 3", len(paths))
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		validateXMILE(t, path, data)
+		f, err := ImportXMILE(data)
+		if err != nil {
+			t.Errorf("%s: ImportXMILE: %s", path, err)
+			continue
+		}
+		if _, err := Simulate(f, SimulateOptions{}); err != nil {
+			t.Errorf("%s: Simulate: %s", path, err)
+		}
+
+		// ImportXMILE, then GenXMILE, keeps the variables, their
+		// kinds, the stocks' flows and the sim specs
+		out, err := GenXMILE(f)
+		if err != nil {
+			t.Errorf("%s: GenXMILE: %s", path, err)
+			continue
+		}
+		validateXMILE(t, path+" exported", out)
+		if got, want := xmileNames(t, out), canonicalNames(t, data); strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("%s: got variables\n%v\nwant\n%v", path, got, want)
+		}
+		var in, back xmileFile
+		if err := xml.Unmarshal(data, &in); err != nil {
+			t.Fatal(err)
+		}
+		if err := xml.Unmarshal(out, &back); err != nil {
+			t.Fatal(err)
+		}
+		flows := func(x xmileFile) map[string]string {
+			m := map[string]string{}
+			for _, s := range x.Models[0].Variables.Stocks {
+				var fs []string
+				for _, f := range s.Inflows {
+					fs = append(fs, "+"+xmileCanonical(f))
+				}
+				for _, f := range s.Outflows {
+					fs = append(fs, "-"+xmileCanonical(f))
+				}
+				m[xmileCanonical(s.Name)] = strings.Join(fs, " ")
+			}
+			return m
+		}
+		gotFlows, wantFlows := flows(back), flows(in)
+		for s, want := range wantFlows {
+			if gotFlows[s] != want {
+				t.Errorf("%s: %s: got flows %q, want %q", path, s, gotFlows[s], want)
+			}
+		}
+		dt := func(x xmileFile) float64 {
+			v, err := strconv.ParseFloat(x.SimSpecs.DT.Value, 64)
+			if err != nil {
+				t.Fatalf("%s: bad dt %q", path, x.SimSpecs.DT.Value)
+			}
+			if x.SimSpecs.DT.Reciprocal {
+				v = 1 / v
+			}
+			return v
+		}
+		if back.SimSpecs.Start != in.SimSpecs.Start || back.SimSpecs.Stop != in.SimSpecs.Stop || dt(back) != dt(in) {
+			t.Errorf("%s: got sim specs %+v, want %+v", path, back.SimSpecs, in.SimSpecs)
+		}
+	}
+}
+
+func TestImportXMILETeacup(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/xmile/teacup.xmile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ImportXMILE(data)
+	if err != nil {
+		t.Fatalf("ImportXMILE: %s", err)
+	}
+	ts, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	// the tea cools exponentially towards the room's temperature,
+	// with a time constant of 10 minutes
+	temp := ts.Vars["TEACUP_TEMPERATURE"]
+	if len(temp) != len(ts.Time) || temp[0] != 180 {
+		t.Fatalf("got TEACUP_TEMPERATURE %v, want 180 at first", temp)
+	}
+	for _, i := range []int{80, 160, 240} {
+		exact := 70 + 110*math.Exp(-ts.Time[i]/10)
+		if math.Abs(temp[i]-exact) > .5 {
+			t.Errorf("at TIME %g: got %g, want about %g", ts.Time[i], temp[i], exact)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// numLit returns the expression for v: a literal, negated if v is
+// negative.
+func numLit(v float64) Expr {
+	if v < 0 {
+		return &UnaryExpr{Op: token.SUB, X: numLit(-v)}
+	}
+	return &BasicLit{Kind: token.FLOAT, Value: strconv.FormatFloat(v, 'g', -1, 64)}
+}
+
+// constLit is like numLit, but puts a negative value in parentheses
+// so that it prints as (-2) inside an expression.
+func constLit(v float64) Expr {
+	if v < 0 {
+		return &ParenExpr{X: numLit(v)}
+	}
+	return numLit(v)
+}
+
+// InlineConsts returns a copy of f in which each reference to a C
+// card constant in the main model's equations is replaced by its
+// value, and each part of an equation made up only of numbers then
+// folded to a single number, so that R B.KL=(NB)(POP.K) with C
+// NB=0.04 becomes R B.KL=0.04*POP.K.  The constants themselves are
+// kept, as they may be output.  f itself is unchanged.
+func InlineConsts(f *File) (*File, error) {
+	inlined := *f
+	inlined.Decls = make([]Decl, len(f.Decls))
+	copy(inlined.Decls, f.Decls)
+	m := f.GetModel("main")
+	if m == nil || m.Body == nil {
+		return &inlined, nil
+	}
+	consts := constants(m)
+	fn := func(e Expr) (Expr, error) {
+		if _, ok := e.(*BasicLit); ok {
+			return nil, nil
+		}
+		if v, ok := foldConst(e, consts); ok {
+			return constLit(v), nil
+		}
+		return nil, nil
+	}
+
+	im := *m
+	im.Body = &BlockStmt{Lbrace: m.Body.Lbrace, Rbrace: m.Body.Rbrace}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Type.Name == "const" {
+			im.Body.List = append(im.Body.List, s)
+			continue
+		}
+		rhs, err := mapExpr(assign.Rhs, fn)
+		if err != nil {
+			return nil, err
+		}
+		ia := *assign
+		ia.Rhs = rhs
+		im.Body.List = append(im.Body.List, &ia)
+	}
+	for i, d := range inlined.Decls {
+		if d == Decl(m) {
+			inlined.Decls[i] = &im
+		}
+	}
+	return &inlined, nil
+}
+
+// SubstituteParam returns a copy of f in which the C card constant
+// name of the main model has the given value, for running what-if
+// variants of a model.  References to the constant are left as
+// they are; InlineConsts replaces them with its value.  It is an
+// error if name isn't declared, or isn't a constant.  f itself is
+// unchanged.
+func SubstituteParam(f *File, name string, value float64) (*File, error) {
+	clone := Clone(f)
+	m := clone.GetModel("main")
+	if m == nil || m.Body == nil {
+		return nil, fmt.Errorf("%s isn't declared", name)
+	}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || !strings.EqualFold(assign.Lhs.Name.Name, name) {
+			continue
+		}
+		if assign.Lhs.Type.Name != "const" {
+			return nil, fmt.Errorf("%s is a %s, not a constant", name, assign.Lhs.Type.Name)
+		}
+		assign.Rhs = numLit(value)
+		return clone, nil
+	}
+	return nil, fmt.Errorf("%s isn't declared", name)
+}
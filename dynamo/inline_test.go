@@ -0,0 +1,105 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"reflect"
+	"testing"
+)
+
+// rhs returns the right-hand side of the equation for name in f's
+// main model, or nil if there's none.
+func rhs(f *File, name string) Expr {
+	for _, d := range f.Decls {
+		m, ok := d.(*ModelDecl)
+		if !ok || m.Name.Name != "main" || m.Body == nil {
+			continue
+		}
+		for _, s := range m.Body.List {
+			if a, ok := s.(*AssignStmt); ok && a.Lhs.Name.Name == name {
+				return a.Rhs
+			}
+		}
+	}
+	return nil
+}
+
+func TestInlineConsts(t *testing.T) {
+	const src = `* inline
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=100
+C	NB=0.04
+R	B.KL=NB*POP.K
+A	X.K=(NB*100+2)*POP.K
+C	LENGTH=3
+C	DT=1
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	before := equations(f)
+	inlined, err := InlineConsts(f)
+	if err != nil {
+		t.Fatalf("InlineConsts: %s", err)
+	}
+	if got := equations(f); !reflect.DeepEqual(got, before) {
+		t.Errorf("InlineConsts changed f:\n%v\nwas\n%v", got, before)
+	}
+
+	b, ok := rhs(inlined, "B").(*BinaryExpr)
+	if !ok {
+		t.Fatalf("B: got %s, want a product", exprString(rhs(inlined, "B")))
+	}
+	if lit, ok := b.X.(*BasicLit); !ok || lit.Value != "0.04" {
+		t.Errorf("B: got %s, want 0.04*POP.K", exprString(b))
+	}
+	// NB*100+2 is folded to a single number
+	if got := exprString(rhs(inlined, "X")); got != "6*POP.K" {
+		t.Errorf("X: got %s, want 6*POP.K", got)
+	}
+
+	// and the model runs as it did
+	want, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	got, err := Simulate(inlined, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate inlined: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("inlined model gave %v, want %v", got, want)
+	}
+}
+
+func TestSubstituteParam(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	before := equations(f)
+	sub, err := SubstituteParam(f, "POPN", 200000)
+	if err != nil {
+		t.Fatalf("SubstituteParam: %s", err)
+	}
+	if lit, ok := rhs(sub, "POPN").(*BasicLit); !ok || lit.Value != "200000" {
+		t.Errorf("POPN: got %s, want 200000", exprString(rhs(sub, "POPN")))
+	}
+	after := equations(sub)
+	for n, eqn := range before {
+		if n != "POPN" && after[n] != eqn {
+			t.Errorf("%s: got %q, want it unchanged: %q", n, after[n], eqn)
+		}
+	}
+	if len(after) != len(before) {
+		t.Errorf("got %d equations, want %d", len(after), len(before))
+	}
+	if got := equations(f); !reflect.DeepEqual(got, before) {
+		t.Errorf("SubstituteParam changed f:\n%v\nwas\n%v", got, before)
+	}
+
+	if _, err := SubstituteParam(f, "NOSUCH", 1); err == nil {
+		t.Errorf("undeclared constant: expected an error")
+	}
+	if _, err := SubstituteParam(f, "B", 1); err == nil {
+		t.Errorf("a rate: expected an error")
+	}
+}
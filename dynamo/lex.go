@@ -16,55 +16,68 @@ import (
 
 const eof = 0
 
-type itemType int
+// A TokenKind is the kind of a Token, like an identifier, number
+// or operator.
+type TokenKind int
 
+// The kinds of tokens.  KindKindDecl is a card's kind, like A or L,
+// and KindSubscript a time subscript, like the K of POP.K.
 const (
-	itemEOF        itemType = iota
-	itemIdentifier itemType = iota
-	itemNumber     itemType = iota
-	itemSemi       itemType = iota
-	itemOperator   itemType = iota
-	itemKindDecl   itemType = iota
-	itemKeyword    itemType = iota
-	itemLiteral    itemType = iota
-	itemLBracket   itemType = iota
-	itemRBracket   itemType = iota
-	itemLParen     itemType = iota
-	itemRParen     itemType = iota
-	itemLSquare    itemType = iota
-	itemRSquare    itemType = iota
+	KindEOF       TokenKind = iota
+	KindIdent     TokenKind = iota
+	KindNumber    TokenKind = iota
+	KindSemi      TokenKind = iota
+	KindOp        TokenKind = iota
+	KindKindDecl  TokenKind = iota
+	KindKeyword   TokenKind = iota
+	KindLiteral   TokenKind = iota
+	KindLBracket  TokenKind = iota
+	KindRBracket  TokenKind = iota
+	KindLParen    TokenKind = iota
+	KindRParen    TokenKind = iota
+	KindLSquare   TokenKind = iota
+	KindRSquare   TokenKind = iota
+	KindComment   TokenKind = iota
+	KindSubscript TokenKind = iota
+	KindUnits     TokenKind = iota
 )
 
-func (i itemType) String() string {
+func (i TokenKind) String() string {
 	switch i {
-	case itemEOF:
+	case KindEOF:
 		return "eof"
-	case itemIdentifier:
+	case KindIdent:
 		return "ident"
-	case itemNumber:
+	case KindNumber:
 		return "num"
-	case itemSemi:
+	case KindSemi:
 		return "semi"
-	case itemOperator:
+	case KindOp:
 		return "op"
-	case itemKindDecl:
+	case KindKindDecl:
 		return "kind"
-	case itemKeyword:
+	case KindKeyword:
 		return "keyword"
-	case itemLiteral:
+	case KindLiteral:
 		return "lit"
-	case itemLBracket:
+	case KindLBracket:
 		return "lbrac"
-	case itemRBracket:
+	case KindRBracket:
 		return "rbrac"
-	case itemLParen:
+	case KindLParen:
 		return "lparen"
-	case itemRParen:
+	case KindRParen:
 		return "rparen"
-	case itemLSquare:
+	case KindLSquare:
 		return "lsquare"
-	case itemRSquare:
+	case KindRSquare:
 		return "rsquare"
+	case KindComment:
+		return "comment"
+	case KindSubscript:
+		return "subscript"
+	case KindUnits:
+		return "units"
 	default:
 		return "unknown"
 	}
@@ -82,62 +95,180 @@ const (
 // A Token provides information about a particular run of consecutive
 // chars in a file.
 type Token struct {
-	pos  token.Pos
-	val  string
-	kind itemType
+	Pos  token.Pos // position just past the end of the token; see ParseTokens
+	Val  string    // text of the token
+	Kind TokenKind // what the token is
+
+	start token.Pos // position of the first character of the token
 }
 
 // gross
 func (t Token) Exists() bool {
-	return t.val != "" && t.kind != itemType(0) && t.pos != token.Pos(0)
+	return t.Val != "" && t.Kind != TokenKind(0) && t.Pos != token.Pos(0)
 }
 
 func (t Token) String() string {
-	val := t.val
-	if t.kind == itemSemi {
+	val := t.Val
+	if t.Kind == KindSemi {
 		val = ";"
 	}
-	return fmt.Sprintf("(%s %s)", t.kind, val)
+	return fmt.Sprintf("(%s %s)", t.Kind, val)
 }
 
 type stateFn func() stateFn
 
 type dynLex struct {
 	f      *token.File
-	s      string // the string being scanned
-	pos    int    // current position in the input
-	start  int    // start of this token
-	width  int    // width of the last rune
+	err    ErrorHandler // reports lexical errors; or nil
+	s      string       // the string being scanned
+	pos    int          // current position in the input
+	start  int          // start of this token
+	width  int          // width of the last rune
 	last   Token
 	items  chan Token // channel of scanned items
 	state  stateFn
 	semi   bool
-	peeked Token
+	peeked *Token // token read by Peek; or nil
+
+	// comments are collected by Token as they are read,
+	// rather than returned to the parser.
+	comments []*CommentGroup // all comment groups, in order
+	title    *CommentGroup   // the * card starting the file
+	lead     *CommentGroup   // group read since the last token
+	doc      *CommentGroup   // group preceding the last token
+	lastPos  token.Pos       // end of the last token
 }
 
+// Peek returns the next token without consuming it; the following
+// call to Token returns it.  Any token can be peeked, including the
+// valueless semi and EOF tokens at the end of the input.
 func (l *dynLex) Peek() Token {
-	if !l.peeked.Exists() {
-		l.peeked = l.Token()
+	if l.peeked == nil {
+		t := l.Token()
+		l.peeked = &t
 	}
-	return l.peeked
+	return *l.peeked
 }
 
 // n=1 lookahead
 func (l *dynLex) Token() Token {
-	if l.peeked.Exists() {
-		p := l.peeked
-		l.peeked = Token{}
-		return p
+	if l.peeked != nil {
+		t := *l.peeked
+		l.peeked = nil
+		return t
+	}
+	for {
+		item := l.raw()
+		switch item.Kind {
+		case KindComment:
+			l.addComment(item)
+			continue
+		case KindSemi, KindEOF:
+		default:
+			l.doc, l.lead = l.lead, nil
+			l.lastPos = item.Pos
+		}
+		return item
 	}
+}
+
+// raw returns the next token, including comments, running the lexer
+// until it has produced one.
+func (l *dynLex) raw() Token {
 	for {
 		select {
 		case item := <-l.items:
 			return item
 		default:
+			if l.state == nil {
+				// an error stopped the lexer; keep
+				// returning EOF
+				return Token{Pos: l.f.Pos(l.pos), Kind: KindEOF, start: l.f.Pos(l.pos)}
+			}
 			l.state = l.state()
 		}
 	}
-	panic("unreachable")
+}
+
+// ParseTokens returns the tokens in src, comments included, up to
+// but not including the end of the input, for tools like syntax
+// highlighters and editors.  file must be a file of len(src) bytes
+// for src.  Unlike the positions the parser sees, the position of a
+// returned token is that of its first character.  If src can't be
+// lexed, the tokens before the error are returned with an ErrorList.
+func ParseTokens(src string, file *token.File) ([]Token, error) {
+	var errs ErrorVector
+	l := newLex(src, file)
+	l.err = &errs
+	var toks []Token
+	for t := l.raw(); t.Kind != KindEOF; t = l.raw() {
+		t.Pos = t.start
+		toks = append(toks, t)
+	}
+	return toks, errs.GetError(Sorted)
+}
+
+// Tokenize is like ParseTokens, adding src to fset as a file with no
+// name.
+func Tokenize(src string, fset *token.FileSet) ([]Token, error) {
+	return ParseTokens(src, fset.AddFile("", fset.Base(), len(src)))
+}
+
+// addComment records the comment in t.  Comments on consecutive lines
+// with no tokens between them form a group.  A comment following a
+// token on the same line starts a group of its own, and the title
+// card and section headers, lines starting with a *, are always
+// groups by themselves, never documenting the card after them.
+func (l *dynLex) addComment(t Token) {
+	c := &Comment{Slash: t.start, Text: t.Val}
+	line := l.f.Line(c.Slash)
+
+	if strings.HasPrefix(t.Val, "*") {
+		g := &CommentGroup{List: []*Comment{c}}
+		if int(c.Slash) == l.f.Base() {
+			l.title = g
+		}
+		l.comments = append(l.comments, g)
+		l.lead = nil
+		return
+	}
+	if n := len(l.comments); n > 0 {
+		g := l.comments[n-1]
+		if g == l.lead && l.f.Line(g.End())+1 == line {
+			g.List = append(g.List, c)
+			return
+		}
+	}
+	g := &CommentGroup{List: []*Comment{c}}
+	l.comments = append(l.comments, g)
+	if l.lastPos.IsValid() && l.f.Line(l.lastPos) == line {
+		l.lead = nil
+	} else {
+		l.lead = g
+	}
+}
+
+// leadComment returns the comment group directly above tok, which
+// must be the last token read, or nil if there is a blank line or
+// another token between them.
+func (l *dynLex) leadComment(tok Token) *CommentGroup {
+	if l.doc == nil || l.f.Line(l.doc.End())+1 != l.f.Line(tok.Pos) {
+		return nil
+	}
+	return l.doc
+}
+
+// emitComment sends the comment between start and pos for Token to
+// collect.  Unlike emit, it leaves semicolon insertion and the last
+// token as they were before the comment.
+func (l *dynLex) emitComment() {
+	l.items <- Token{
+		Pos:   l.f.Pos(l.pos),
+		Val:   l.s[l.start:l.pos],
+		Kind:  KindComment,
+		start: l.f.Pos(l.start),
+	}
+	l.ignore()
 }
 
 func newLex(input string, file *token.File) *dynLex {
@@ -150,12 +281,13 @@ func newLex(input string, file *token.File) *dynLex {
 }
 
 func (l *dynLex) getLine(pos token.Position) string {
-	p := pos.Offset - pos.Column
-	if p < 0 || p >= len(l.s) {
+	// columns are 1-based
+	p := pos.Offset - (pos.Column - 1)
+	if p < 0 || p > len(l.s) {
 		return fmt.Sprintf("getLine: o%d c%d, len%d",
 			pos.Offset, pos.Column, len(l.s))
 	}
-	result := l.s[pos.Offset-pos.Column:]
+	result := l.s[p:]
 	if newline := strings.IndexRune(result, '\n'); newline != -1 {
 		result = result[:newline]
 	}
@@ -163,11 +295,17 @@ func (l *dynLex) getLine(pos token.Position) string {
 }
 
 func (l *dynLex) Error(s string) {
-	pos := l.f.Position(l.last.pos)
+	pos := l.f.Position(l.last.Pos)
 	line := l.getLine(pos)
 	// we want the number of spaces (taking into account tabs)
 	// before the problematic token
-	prefixLen := pos.Column + strings.Count(line[:pos.Column], "\t")*7 - 1
+	col := pos.Column - 1
+	if col < 0 {
+		col = 0
+	} else if col > len(line) {
+		col = len(line)
+	}
+	prefixLen := col + strings.Count(line[:col], "\t")*7
 	prefix := strings.Repeat(" ", prefixLen)
 
 	line = strings.Replace(line, "\t", "        ", -1)
@@ -180,14 +318,20 @@ func (l *dynLex) Error(s string) {
 
 func (l *dynLex) next() rune {
 	if l.pos >= len(l.s) {
-		return 0
+		// nothing was consumed, so there is nothing for
+		// backup to undo
+		l.width = 0
+		return eof
 	}
 	r, width := utf8.DecodeRuneInString(l.s[l.pos:])
 	l.pos += width
 	l.width = width
+	if a, ok := lookalikes[r]; ok {
+		r = a
+	}
 
 	if r == '\n' {
-		l.f.AddLine(l.pos + 1)
+		l.f.AddLine(l.pos)
 	}
 	return r
 }
@@ -214,30 +358,36 @@ func (l *dynLex) accept(valid string) bool {
 	return false
 }
 
-func (l *dynLex) acceptRun(valid string) {
+// acceptRun consumes a run of runes from valid, and reports whether
+// there were any.
+func (l *dynLex) acceptRun(valid string) bool {
+	start := l.pos
 	for strings.IndexRune(valid, l.next()) >= 0 {
 	}
 	l.backup()
+	return l.pos > start
 }
 
 // insertEmit adds a token of given type and value to the output
 // stream.  It does not call ignore(), it does not perform semicolon
 // insertion, it does not pass go.
-func (l *dynLex) insertEmit(ty itemType, val string) {
+func (l *dynLex) insertEmit(ty TokenKind, val string) {
 	t := Token{
-		pos:  l.f.Pos(l.pos),
-		val:  val,
-		kind: ty,
+		Pos:   l.f.Pos(l.pos),
+		Val:   val,
+		Kind:  ty,
+		start: l.f.Pos(l.pos),
 	}
 	l.last = t
 	l.items <- t
 }
 
-func (l *dynLex) emit(ty itemType) {
+func (l *dynLex) emit(ty TokenKind) {
 	t := Token{
-		pos:  l.f.Pos(l.pos),
-		val:  l.s[l.start:l.pos],
-		kind: ty,
+		Pos:   l.f.Pos(l.pos),
+		Val:   normalize(l.s[l.start:l.pos]),
+		Kind:  ty,
+		start: l.f.Pos(l.start),
 	}
 	//log.Printf("t: %#v\n", t)
 	l.last = t
@@ -245,18 +395,31 @@ func (l *dynLex) emit(ty itemType) {
 	l.ignore()
 
 	switch {
-	case ty == itemRBracket || ty == itemRParen || ty == itemRSquare:
+	case ty == KindRBracket || ty == KindRParen || ty == KindRSquare:
 		fallthrough
-	case ty == itemIdentifier || ty == itemNumber || ty == itemKindDecl || ty == itemLiteral:
+	case ty == KindIdent || ty == KindNumber || ty == KindKindDecl || ty == KindLiteral:
+		fallthrough
+	case ty == KindSubscript || ty == KindUnits:
 		l.semi = true
 	default:
 		l.semi = false
 	}
 }
 
+// report passes msg, positioned at the start of the current token,
+// to the error handler if there is one, and logs it otherwise.
+func (l *dynLex) report(msg string) {
+	pos := l.f.Position(l.f.Pos(l.start))
+	if l.err != nil {
+		l.err.Error(pos, msg)
+	} else {
+		log.Printf("%s: %s", pos, msg)
+	}
+}
+
 func (l *dynLex) errorf(format string, args ...interface{}) stateFn {
-	log.Printf(format, args...)
-	l.emit(itemEOF)
+	l.report(fmt.Sprintf(format, args...))
+	l.emit(KindEOF)
 	return nil
 }
 
@@ -265,7 +428,7 @@ func (l *dynLex) begin() stateFn {
 	case r == '*':
 		return l.comment
 	default:
-		return l.errorf("Dynamo programs must begin with a *, not %#U\n", r)
+		return l.errorf("Dynamo programs must begin with a *, not %#U", r)
 	}
 }
 
@@ -273,26 +436,38 @@ func (l *dynLex) statement() stateFn {
 	switch r := l.next(); {
 	case r == eof:
 		if l.semi {
-			l.emit(itemSemi)
+			l.emit(KindSemi)
 		}
-		l.emit(itemEOF)
+		l.emit(KindEOF)
 	case r == '/':
-		if l.peek() == '/' {
+		if l.peek() == '/' && !l.inTable() {
 			l.next()
 			return l.comment
 		}
-		l.emit(itemOperator)
+		l.emit(KindOp)
+	case r == '*' && l.atLineStart():
+		// a section header
+		return l.comment
 	case r == '`':
 		return l.lexType
 	case r == ';':
-		l.emit(itemSemi)
+		l.emit(KindSemi)
 	case unicode.IsSpace(r):
-		if r == '\n' && l.semi {
-			l.emit(itemSemi)
+		if r == '\n' {
+			if l.isContinuation() {
+				l.next() // skip the X
+			} else if l.semi || l.last.Kind == KindOp || l.isCardLine() {
+				// a trailing operator or table separator,
+				// or an unclosed paren, still ends the
+				// card, so the parser can report the
+				// missing operand without eating the next
+				// card
+				l.emit(KindSemi)
+			}
 		}
 		//		log.Print("1 ignoring:", l.s[l.start:l.pos])
 		l.ignore()
-	case r == 'n' || r == 'N' && l.isNoteStart(r):
+	case (r == 'n' || r == 'N') && l.isNoteStart(r):
 		l.backup()
 		return l.comment
 	case unicode.IsDigit(r) || r == '.':
@@ -304,47 +479,63 @@ func (l *dynLex) statement() stateFn {
 	case isIdentifierStart(r):
 		l.backup()
 		return l.identifier
+	case r == '{':
+		return l.units
 	case isOperator(r):
 		l.backup()
 		return l.operator
 	default:
-		return l.errorf("unrecognized char: %#U\n", r)
+		return l.errorf("unrecognized char: %#U", r)
 	}
 	return l.statement
 }
 
 func (l *dynLex) operator() stateFn {
-	ty := itemOperator
+	ty := KindOp
 	r := l.next()
 	switch {
 	case r == '{':
-		ty = itemLBracket
+		ty = KindLBracket
 	case r == '}':
-		ty = itemRBracket
+		ty = KindRBracket
 	case r == '(':
-		ty = itemLParen
+		ty = KindLParen
 	case r == ')':
-		ty = itemRParen
+		ty = KindRParen
 	case r == '[':
-		ty = itemLSquare
+		ty = KindLSquare
 	case r == ']':
-		ty = itemRSquare
+		ty = KindRSquare
+	case r == '<' && (l.peek() == '=' || l.peek() == '>'):
+		l.next()
+	case r == '>' && l.peek() == '=':
+		l.next()
 	}
 	l.emit(ty)
 	if r == ')' && l.peek() == '(' {
-		l.insertEmit(itemOperator, "*")
+		l.insertEmit(KindOp, "*")
 	}
 	return l.statement
 }
 
+// inTable reports whether the '/' at the current position directly
+// follows a table value or separator, as in 1//2, in which case it
+// is an empty table entry rather than the start of a comment.
+func (l *dynLex) inTable() bool {
+	if l.last.Kind != KindNumber && l.last.Val != "/" {
+		return false
+	}
+	// token positions are those of the end of the token
+	return l.last.Pos == l.f.Pos(l.start)
+}
+
 func (l *dynLex) comment() stateFn {
 	// skip everything until the end of the line, or the end of
 	// the file, whichever is first
 	for r := l.next(); r != '\n' && r != eof; r = l.next() {
 	}
 	l.backup()
-	//	log.Print("2 ignoring:", l.s[l.start:l.pos])
-	l.ignore()
+	l.emitComment()
 	return l.statement
 }
 
@@ -364,8 +555,7 @@ func (l *dynLex) multiComment() stateFn {
 			break
 		}
 	}
-	//	log.Print("2 ignoring:", l.s[l.start:l.pos])
-	l.ignore()
+	l.emitComment()
 	return l.statement
 }
 
@@ -378,21 +568,31 @@ func (l *dynLex) lexType() stateFn {
 	if l.peek() != '`' {
 		return l.errorf("unexpected EOF")
 	}
-	l.emit(itemKindDecl)
+	l.emit(KindKindDecl)
 	l.next()
 	l.ignore()
 	return l.statement
 }
 
 func (l *dynLex) number() stateFn {
-	l.acceptRun("0123456789")
-	l.accept(".")
-	l.acceptRun("0123456789")
+	valid := l.acceptRun("0123456789")
+	if l.accept(".") {
+		valid = l.acceptRun("0123456789") || valid
+	}
 	if l.accept("eE") {
 		l.accept("+-")
-		l.acceptRun("0123456789")
+		valid = l.acceptRun("0123456789") && valid
+	}
+	// anything running on from the number, as in 1.2.3 or 12AB,
+	// is part of the same malformed literal
+	for isAlphaNumeric(l.peek()) {
+		l.next()
+		valid = false
 	}
-	l.emit(itemNumber)
+	if !valid {
+		l.report(fmt.Sprintf("invalid number literal '%s'", l.s[l.start:l.pos]))
+	}
+	l.emit(KindNumber)
 	return l.statement
 }
 
@@ -406,45 +606,189 @@ func (l *dynLex) literal() stateFn {
 	if l.peek() != delim {
 		return l.errorf("unexpected EOF")
 	}
-	l.emit(itemLiteral)
+	l.emit(KindLiteral)
 	l.next()
 	l.ignore()
 	return l.statement
 }
 
+// units scans a unit annotation, from { to the matching } on the
+// same line, as a single token.
+func (l *dynLex) units() stateFn {
+	for r := l.next(); r != '}'; r = l.next() {
+		if r == '\n' || r == eof {
+			l.backup()
+			return l.errorf("unterminated units")
+		}
+	}
+	l.emit(KindUnits)
+	return l.statement
+}
+
 func (l *dynLex) identifier() stateFn {
 	for isAlphaNumeric(l.next()) {
 	}
 	l.backup()
 	switch id := l.s[l.start:l.pos]; {
 	case id == "kind":
-		l.emit(itemKeyword)
+		l.emit(KindKeyword)
 	case id == "import":
-		l.emit(itemKeyword)
+		l.emit(KindKeyword)
 	case id == "package":
-		l.emit(itemKeyword)
+		l.emit(KindKeyword)
 	case id == "model":
-		l.emit(itemKeyword)
+		l.emit(KindKeyword)
 	case id == "interface":
-		l.emit(itemKeyword)
+		l.emit(KindKeyword)
 	case id == "specializes":
-		l.emit(itemKeyword)
+		l.emit(KindKeyword)
+	case isCondKeyword(id):
+		l.emit(KindKeyword)
 	default:
-		l.emit(itemIdentifier)
+		dot := strings.IndexRune(id, '.')
+		if msg := checkIdent(id); msg != "" {
+			l.report(msg)
+			dot = -1
+		}
+		if dot < 0 {
+			l.emit(KindIdent)
+			break
+		}
+		// split POP.K into the identifier POP and the
+		// subscript K, dropping the dot.
+		end := l.pos
+		l.pos = l.start + dot
+		l.emit(KindIdent)
+		l.pos++
+		l.ignore()
+		l.pos = end
+		l.emit(KindSubscript)
 	}
 	return l.statement
 }
 
+// isCondKeyword returns true if id is one of the keywords of a
+// conditional expression, in any case.
+func isCondKeyword(id string) bool {
+	switch strings.ToUpper(id) {
+	case "IF", "THEN", "ELSE":
+		return true
+	}
+	return false
+}
+
+// checkIdent returns a description of what is wrong with the
+// identifier id, or the empty string if it is well formed.  A dot
+// may only appear once, to introduce a trailing time subscript.
+// Malformed identifiers are emitted whole, without splitting off
+// their subscript.
+func checkIdent(id string) string {
+	dot := strings.IndexRune(id, '.')
+	if dot < 0 {
+		return ""
+	}
+	sub := id[dot+1:]
+	if sub == "" || strings.ContainsRune(sub, '.') {
+		return fmt.Sprintf("malformed identifier '%s'", id)
+	}
+	switch strings.ToUpper(sub) {
+	case "J", "K", "L", "JK", "KL", "KJ":
+		return ""
+	}
+	return fmt.Sprintf("unknown time subscript '%s' in '%s'", sub, id)
+}
+
+// isContinuation returns true if the line starting at the current
+// position is an X card, continuing the previous line's statement.
+// X cards also declare external constants, as in X RATE=.1; those
+// have an '=' after their first word, which a continuation, being
+// part of an equation's right hand side, never does.
+func (l *dynLex) isContinuation() bool {
+	rest := l.s[l.pos:]
+	if len(rest) < 2 || (rest[0] != 'X' && rest[0] != 'x') ||
+		(rest[1] != ' ' && rest[1] != '\t') {
+		return false
+	}
+	rest = strings.TrimLeft(rest[2:], " \t")
+	n := strings.IndexFunc(rest, func(r rune) bool {
+		return !isAlphaNumeric(r)
+	})
+	if n <= 0 {
+		return true
+	}
+	rest = strings.TrimLeft(rest[n:], " \t")
+	return !strings.HasPrefix(rest, "=")
+}
+
+// lookalikes maps Unicode characters that turn up in decks pasted from
+// word processors to the ASCII operators and quotes they stand for.
+// next returns the ASCII rune in their place.
+var lookalikes = map[rune]rune{
+	'\u2212': '-', // minus sign
+	'\u2013': '-', // en dash
+	'\u00d7': '*', // multiplication sign
+	'\u2217': '*', // asterisk operator
+	'\u00f7': '/', // division sign
+	'\u2215': '/', // division slash
+	'\u201c': '"', // left double quotation mark
+	'\u201d': '"', // right double quotation mark
+}
+
+// normalize returns s with any lookalikes replaced by their ASCII
+// equivalents.
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if a, ok := lookalikes[r]; ok {
+			return a
+		}
+		return r
+	}, s)
+}
+
 func isLiteralStart(r rune) bool {
 	return r == '"'
 }
 
+// isNoteStart returns true if the current token starts a NOTE card:
+// the word NOTE at the start of a line.
 func (l *dynLex) isNoteStart(r rune) bool {
-	return len(l.s[l.start:]) >= 4 && strings.ToUpper(l.s[l.start:l.start+4]) == "NOTE"
+	rest := l.s[l.start:]
+	if !l.atLineStart() || len(rest) < 4 || strings.ToUpper(rest[:4]) != "NOTE" {
+		return false
+	}
+	next, _ := utf8.DecodeRuneInString(rest[4:])
+	return !isAlphaNumeric(next)
+}
+
+// isCardLine returns true if the line starting at the current
+// position starts a new card.
+func (l *dynLex) isCardLine() bool {
+	rest := l.s[l.pos:]
+	return len(rest) >= 2 && rest[0] >= 'A' && rest[0] <= 'Z' &&
+		(rest[1] == ' ' || rest[1] == '\t')
+}
+
+// isCardStart returns true if tok, which must have been read from
+// l, starts a card: it is a single upper case letter in the first
+// column of a line, followed by a space.
+func (l *dynLex) isCardStart(tok Token) bool {
+	if tok.Kind != KindIdent || len(tok.Val) != 1 || tok.Val[0] < 'A' || tok.Val[0] > 'Z' {
+		return false
+	}
+	// token positions are those of the end of the token
+	off := l.f.Offset(tok.Pos)
+	return (off == 1 || l.s[off-2] == '\n') && off < len(l.s) &&
+		(l.s[off] == ' ' || l.s[off] == '\t')
+}
+
+// atLineStart returns true if the current token starts in the first
+// column of its line.
+func (l *dynLex) atLineStart() bool {
+	return l.start == 0 || l.s[l.start-1] == '\n'
 }
 
 func isOperator(r rune) bool {
-	return bytes.IndexRune([]byte(",+-*/|&=(){}[]:"), r) > -1
+	return bytes.IndexRune([]byte(",+-*/^|&=(){}[]:<>"), r) > -1
 }
 
 func isIdentifierStart(r rune) bool {
@@ -453,5 +797,5 @@ func isIdentifierStart(r rune) bool {
 
 // isAlphaNumeric reports whether r is an alphabetic, digit, or underscore.
 func isAlphaNumeric(r rune) bool {
-	return !(unicode.IsSpace(r) || isOperator(r) || r == ';')
+	return !(r == eof || unicode.IsSpace(r) || isOperator(r) || r == ';')
 }
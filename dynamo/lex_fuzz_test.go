@@ -0,0 +1,83 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fuzzSeeds are the inputs the fuzz targets start from.
+var fuzzSeeds = []string{
+	helloWorld,
+	"",
+	"*",
+	"NOTE " + strings.Repeat("x", 100<<10) + "\n",
+	"A X.K=" + strings.Repeat("Y.K+", 25<<10) + "1\n",
+	"C X=1\x00\n\x00A Y.K=\x00X\n",
+	"A X.K=\xff\xfe\xc0\x80+\xe2\x88\n\xe2\n",
+}
+
+// FuzzLexer checks that the lexer gives a bounded number of tokens,
+// ending with EOF, on any input, rather than panicking or looping.
+// Errors are returned as tokens, and are fine.
+func FuzzLexer(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fset := token.NewFileSet()
+		l := newLex(string(data), fset.AddFile("fuzz.dyn", fset.Base(), len(data)))
+		// at most a token, an inserted multiplication and a
+		// semicolon per byte, and the EOF
+		for n := 0; l.Token().Kind != KindEOF; n++ {
+			if n > 3*len(data)+1 {
+				t.Fatalf("got more than %d tokens from %d bytes", n, len(data))
+			}
+		}
+	})
+}
+
+// FuzzParser checks that Parse returns, with a File or an error, in
+// a bounded time on any input, rather than panicking or looping.
+func FuzzParser(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			fset := token.NewFileSet()
+			file, err := Parse(fset.AddFile("fuzz.dyn", fset.Base(), len(data)), fset, string(data))
+			if err != nil {
+				return
+			}
+			if file == nil {
+				t.Errorf("Parse returned neither a File nor an error")
+				return
+			}
+			// each node the File holds is complete enough
+			// to walk and print
+			Inspect(file, func(n Node) bool {
+				if n != nil {
+					n.Pos()
+					n.End()
+				}
+				return true
+			})
+			var buf bytes.Buffer
+			Fprint(&buf, fset, file)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Parse didn't return within 10s")
+		}
+	})
+}
@@ -0,0 +1,255 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestMalformedIdents(t *testing.T) {
+	tests := []struct {
+		eqn, err string
+	}{
+		{"A X.K=POP..K", "malformed identifier 'POP..K'"},
+		{"A X.K=A.K.SUM", "malformed identifier 'A.K.SUM'"},
+		{"A X.K=POP.", "malformed identifier 'POP.'"},
+		{"A X.K=POP.X", "unknown time subscript 'X' in 'POP.X'"},
+		{"A X.Q=1", "unknown time subscript 'Q' in 'X.Q'"},
+	}
+	for _, test := range tests {
+		src := "* malformed\n" + test.eqn + "\n"
+		fset := token.NewFileSet()
+		_, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %s", test.eqn, err, test.err)
+		}
+	}
+
+	// well-formed subscripts lex as an identifier and a subscript
+	for _, sub := range []string{"J", "K", "L", "JK", "KL", "k", "kl"} {
+		src := "* ok\nA X.K=POP." + sub + "\n"
+		toks, err := ParseTokens(src, token.NewFileSet().AddFile("", 1, len(src)))
+		if err != nil {
+			t.Errorf("POP.%s: %s", sub, err)
+			continue
+		}
+		ok := false
+		for i, tok := range toks[:len(toks)-1] {
+			next := toks[i+1]
+			if tok.Kind == KindIdent && tok.Val == "POP" && next.Kind == KindSubscript && next.Val == sub {
+				ok = true
+			}
+		}
+		if !ok {
+			t.Errorf("POP.%s: got tokens %v, want POP then %s", sub, toks, sub)
+		}
+	}
+}
+
+func TestMalformedNumbers(t *testing.T) {
+	tests := []struct {
+		val, err string // err is empty if val is well-formed
+	}{
+		{".", "invalid number literal '.'"},
+		{"1e", "invalid number literal '1e'"},
+		{"1e+", "invalid number literal '1e+'"},
+		{"1.2.3", "invalid number literal '1.2.3'"},
+		{"1.5E", "invalid number literal '1.5E'"},
+		{".5", ""},
+		{"5.", ""},
+		{"1e3", ""},
+		{"2.5E-2", ""},
+	}
+	for _, test := range tests {
+		src := "* numbers\nC X=" + test.val + "\n"
+		fset := token.NewFileSet()
+		_, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %s", test.val, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %s", test.val, err, test.err)
+		}
+	}
+}
+
+func TestLookalikes(t *testing.T) {
+	tests := []struct {
+		src, ascii string
+	}{
+		{"A X.K=Y.K−Z.K–W.K", "A X.K=Y.K-Z.K-W.K"},
+		{"A X.K=Y.K×Z.K∗W.K", "A X.K=Y.K*Z.K*W.K"},
+		{"A X.K=Y.K÷Z.K∕W.K", "A X.K=Y.K/Z.K/W.K"},
+		{"“pop”", `"pop"`},
+	}
+	for _, test := range tests {
+		src, ascii := "* T\n"+test.src+"\n", "* T\n"+test.ascii+"\n"
+		got, err := ParseTokens(src, token.NewFileSet().AddFile("", 1, len(src)))
+		if err != nil {
+			t.Errorf("%s: %s", test.src, err)
+			continue
+		}
+		want, err := ParseTokens(ascii, token.NewFileSet().AddFile("", 1, len(ascii)))
+		if err != nil {
+			t.Fatalf("%s: %s", test.ascii, err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got tokens %v, want %v", test.src, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i].Kind != want[i].Kind || got[i].Val != want[i].Val {
+				t.Errorf("%s: token %d is %s %q, want %s %q", test.src, i,
+					got[i].Kind, got[i].Val, want[i].Kind, want[i].Val)
+			}
+		}
+	}
+}
+
+func TestParseTokens(t *testing.T) {
+	src := "* T\nA X.K=Y.K−Z.K\n"
+	fset := token.NewFileSet()
+	toks, err := ParseTokens(src, fset.AddFile("", fset.Base(), len(src)))
+	if err != nil {
+		t.Fatalf("ParseTokens: %s", err)
+	}
+	var got []string
+	for _, tok := range toks {
+		pos := fset.Position(tok.Pos)
+		got = append(got, fmt.Sprintf("%d:%d %s %q", pos.Line, pos.Column, tok.Kind, tok.Val))
+	}
+	// the Unicode minus sign is three bytes long, but lexes as '-'
+	want := []string{
+		`1:1 comment "* T"`,
+		`1:4 semi "\n"`,
+		`2:1 ident "A"`,
+		`2:3 ident "X"`,
+		`2:5 subscript "K"`,
+		`2:6 op "="`,
+		`2:7 ident "Y"`,
+		`2:9 subscript "K"`,
+		`2:10 op "-"`,
+		`2:13 ident "Z"`,
+		`2:15 subscript "K"`,
+		`2:16 semi "\n"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got tokens\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// each token of helloWorld is at its text, but for the
+	// multiplications inserted between parenthesized factors, and
+	// each card starts its line
+	fset = token.NewFileSet()
+	toks, err = ParseTokens(helloWorld, fset.AddFile("", fset.Base(), len(helloWorld)))
+	if err != nil {
+		t.Fatalf("ParseTokens: %s", err)
+	}
+	lines := strings.Split(helloWorld, "\n")
+	cards := 0
+	for _, tok := range toks {
+		pos := fset.Position(tok.Pos)
+		line := lines[pos.Line-1]
+		if !strings.HasPrefix(line[pos.Column-1:], tok.Val) && tok.Kind != KindSemi && tok.Val != "*" {
+			t.Errorf("%d:%d: token %q isn't at its position in %q", pos.Line, pos.Column, tok.Val, line)
+		}
+		if pos.Column == 1 && tok.Kind == KindIdent && len(tok.Val) == 1 {
+			cards++
+		}
+	}
+	if cards != 10 {
+		t.Errorf("got %d cards, want 10", cards)
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	const src = "* lines\n" +
+		"C A=1\n" +
+		"C B=2\n" +
+		"\n" +
+		"A CC.K=A+B\n"
+	tests := []struct {
+		val  string
+		line int
+	}{
+		{"* lines", 1},
+		{"C", 2},
+		{"A", 2},
+		{"B", 3},
+		{"2", 3},
+		{"CC", 5},
+		{"+", 5},
+	}
+	fset := token.NewFileSet()
+	toks, err := ParseTokens(src, fset.AddFile("", fset.Base(), len(src)))
+	if err != nil {
+		t.Fatalf("ParseTokens: %s", err)
+	}
+	for _, test := range tests {
+		found := false
+		for _, tok := range toks {
+			if tok.Val != test.val {
+				continue
+			}
+			found = true
+			if line := fset.Position(tok.Pos).Line; line != test.line {
+				t.Errorf("%q: got line %d, want %d", test.val, line, test.line)
+			}
+			break
+		}
+		if !found {
+			t.Errorf("%q: no such token", test.val)
+		}
+	}
+
+	// the first character of a line is on that line in errors
+	for _, test := range []struct {
+		src  string
+		line int
+	}{
+		{"* bad\nC A=1\n)\n", 3},
+		{"* bad\nC A=1\n\n\nC B=)\n", 5},
+	} {
+		fset := token.NewFileSet()
+		_, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(test.src)), fset, test.src)
+		list, ok := err.(ErrorList)
+		if !ok || len(list) == 0 {
+			t.Errorf("%q: got error %v, want an ErrorList", test.src, err)
+			continue
+		}
+		if list[0].Pos.Line != test.line {
+			t.Errorf("%q: got error on line %d, want %d: %s", test.src, list[0].Pos.Line, test.line, err)
+		}
+	}
+}
+
+func TestPeek(t *testing.T) {
+	lex := func() *dynLex {
+		fset := token.NewFileSet()
+		return newLex(helloWorld, fset.AddFile("", fset.Base(), len(helloWorld)))
+	}
+	// peeking, even twice, doesn't change the token stream
+	var want []Token
+	for l := lex(); ; {
+		tok := l.Token()
+		want = append(want, tok)
+		if tok.Kind == KindEOF {
+			break
+		}
+	}
+	l := lex()
+	for i, w := range want {
+		first, second := l.Peek(), l.Peek()
+		if first != w || second != w {
+			t.Fatalf("token %d: Peek returned %v, then %v; want %v", i, first, second, w)
+		}
+		if tok := l.Token(); tok != w {
+			t.Fatalf("token %d: Token after Peek returned %v, want %v", i, tok, w)
+		}
+	}
+}
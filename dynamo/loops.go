@@ -0,0 +1,251 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// maxLoops is the most feedback loops FeedbackLoopFinder reports
+// before giving up on a model.
+const maxLoops = 10000
+
+// A FeedbackLoop is a cycle of variables, each used in the equation
+// of the next and the last in that of the first.  Polarity is 1 if
+// the loop is reinforcing, with an even number of negative links, -1
+// if it is balancing, with an odd number, and 0 if one of its links
+// has no effect where its gain was measured.  Gain is the product of
+// the marginal gains of its links.
+type FeedbackLoop struct {
+	Vars     []string
+	Polarity int
+	Gain     float64
+}
+
+// String returns the loop as its variables joined by arrows, and
+// whether it reinforces or balances.
+func (l FeedbackLoop) String() string {
+	kind := "undetermined"
+	switch l.Polarity {
+	case 1:
+		kind = "reinforcing"
+	case -1:
+		kind = "balancing"
+	}
+	return fmt.Sprintf("%s -> %s (%s, gain %g)", strings.Join(l.Vars, " -> "), l.Vars[0], kind, l.Gain)
+}
+
+// A gainEnv evaluates equations at equilibrium: SMOOTH and DELAY3
+// give their inputs, which their outputs settle to, and NOISE and
+// NORMRN their means.
+type gainEnv struct {
+	simEnv
+}
+
+func (env gainEnv) call(c *CallExpr, name string) (float64, bool, error) {
+	switch name {
+	case "SMOOTH", "DELAY3":
+		v, err := eval(c.Args[0], env)
+		return v, true, err
+	case "NOISE":
+		return 0, true, nil
+	case "NORMRN":
+		v, err := eval(c.Args[0], env)
+		return v, true, err
+	case "TABHL":
+		x, err := eval(c.Args[1], env)
+		if err != nil {
+			return 0, true, err
+		}
+		table, ok := c.Args[0].(*Ident)
+		if !ok || env.s.tables[strings.ToUpper(table.Name)] == nil {
+			return 0, true, evalErr(c.Args[0], "TABHL of %s, not a table", exprString(c.Args[0]))
+		}
+		return env.s.tables[strings.ToUpper(table.Name)].lookup(x), true, nil
+	}
+	return env.simEnv.call(c, name)
+}
+
+// FeedbackLoopFinder returns the feedback loops of the model named
+// main in f, found by a depth-first search of the graph of its
+// equations, with each loop starting from the variable of it
+// declared first.  Initial values aren't part of the graph, and a
+// level's reference to its own previous value isn't a link.
+//
+// The gain of each link is the partial derivative of the equation
+// it leads to by the variable it leads from, taken by central
+// differences at the state the model reaches at the end of its
+// simulation: its equilibrium, if it has settled by then.  SMOOTH
+// and DELAY3 are taken to have settled to their inputs.  The gain
+// into a level is that into its rate of change.  Loops are sorted
+// by the magnitude of their gains, largest first.
+func FeedbackLoopFinder(f *File) ([]FeedbackLoop, error) {
+	s, err := newSimulator(f, Euler)
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.init()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < s.g.Steps; i++ {
+		if err := s.step(st); err != nil {
+			return nil, err
+		}
+	}
+
+	// the causal graph, of each equation other than initial
+	// values, in order
+	var names []string
+	eqns := map[string]simEqn{}
+	levels := map[string]bool{}
+	for _, l := range s.levels {
+		names = append(names, l.name)
+		eqns[l.name] = l
+		levels[l.name] = true
+	}
+	for _, c := range s.calc {
+		if !c.lookup {
+			names = append(names, c.name)
+			eqns[c.name] = c
+		}
+	}
+	index := map[string]int{}
+	for i, n := range names {
+		index[n] = i
+	}
+	uses := make([][]int, len(names))
+	for i, n := range names {
+		seen := map[int]bool{}
+		for _, ref := range refNames(eqns[n].rhs) {
+			j, ok := index[ref]
+			if ok && j != i && !seen[j] {
+				seen[j] = true
+				uses[j] = append(uses[j], i)
+			}
+		}
+	}
+	for _, u := range uses {
+		sort.Ints(u)
+	}
+
+	// the loops through each variable and only those after it
+	var cycles [][]int
+	var path []int
+	onPath := make([]bool, len(names))
+	var visit func(start, v int) error
+	visit = func(start, v int) error {
+		path = append(path, v)
+		onPath[v] = true
+		defer func() {
+			path = path[:len(path)-1]
+			onPath[v] = false
+		}()
+		for _, w := range uses[v] {
+			switch {
+			case w == start:
+				if len(cycles) == maxLoops {
+					return fmt.Errorf("more than %d feedback loops", maxLoops)
+				}
+				cycles = append(cycles, append([]int(nil), path...))
+			case w > start && !onPath[w]:
+				if err := visit(start, w); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for i := range names {
+		if err := visit(i, i); err != nil {
+			return nil, err
+		}
+	}
+
+	// gain returns the marginal gain of the link from from to to
+	gains := map[[2]string]float64{}
+	gain := func(from, to string) (float64, error) {
+		if g, ok := gains[[2]string{from, to}]; ok {
+			return g, nil
+		}
+		x := st.vals[from]
+		h := 1e-6 * math.Max(1, math.Abs(x))
+		at := func(v float64) (float64, error) {
+			st.vals[from] = v
+			defer func() { st.vals[from] = x }()
+			e := eqns[to]
+			env := gainEnv{simEnv{s, st}}
+			if !levels[to] {
+				return eval(e.rhs, env)
+			}
+			if cl, ok := e.rhs.(*CompositeLit); ok {
+				var net float64
+				for _, elt := range cl.Elts {
+					k, val, err := kvConvert(elt)
+					if err != nil || k == "initial" {
+						continue
+					}
+					flow, err := eval(val, env)
+					if err != nil {
+						return 0, err
+					}
+					if k == "outflow" {
+						flow = -flow
+					}
+					net += flow
+				}
+				return net, nil
+			}
+			v, err := eval(e.rhs, env)
+			return v / s.dt, err
+		}
+		hi, err := at(x + h)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", to, err)
+		}
+		lo, err := at(x - h)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %s", to, err)
+		}
+		g := (hi - lo) / (2 * h)
+		gains[[2]string{from, to}] = g
+		return g, nil
+	}
+
+	loops := make([]FeedbackLoop, 0, len(cycles))
+	for _, c := range cycles {
+		l := FeedbackLoop{Polarity: 1, Gain: 1}
+		for i, v := range c {
+			l.Vars = append(l.Vars, names[v])
+			g, err := gain(names[v], names[c[(i+1)%len(c)]])
+			if err != nil {
+				return nil, err
+			}
+			l.Gain *= g
+			switch {
+			case g < 0:
+				l.Polarity = -l.Polarity
+			case !(g > 0):
+				l.Polarity = 0
+			}
+		}
+		if l.Polarity == 0 {
+			l.Gain = 0
+		}
+		loops = append(loops, l)
+	}
+	sort.Stable(byGain(loops))
+	return loops, nil
+}
+
+// byGain sorts loops by the magnitude of their gains, largest first.
+type byGain []FeedbackLoop
+
+func (l byGain) Len() int           { return len(l) }
+func (l byGain) Less(i, j int) bool { return math.Abs(l[i].Gain) > math.Abs(l[j].Gain) }
+func (l byGain) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
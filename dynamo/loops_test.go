@@ -0,0 +1,78 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// predatorPrey is a Lotka-Volterra model, starting at its
+// equilibrium of 100 prey and 20 predators.
+const predatorPrey = `* predator and prey
+L	PREY.K=PREY.J+(DT)(PB.JK-PD.JK)
+N	PREY=100
+R	PB.KL=(BR)(PREY.K)
+R	PD.KL=(PR)(PREY.K)(PRED.K)
+L	PRED.K=PRED.J+(DT)(GR.JK-DR.JK)
+N	PRED=20
+R	GR.KL=(EF)(PREY.K)(PRED.K)
+R	DR.KL=(DRATE)(PRED.K)
+C	BR=.1
+C	PR=.005
+C	EF=.001
+C	DRATE=.1
+C	LENGTH=10
+C	DT=.25
+C	SAVPER=1
+`
+
+func TestFeedbackLoopFinder(t *testing.T) {
+	f, _ := parseSrc(t, predatorPrey)
+	loops, err := FeedbackLoopFinder(f)
+	if err != nil {
+		t.Fatalf("FeedbackLoopFinder: %s", err)
+	}
+	// the gains are the partial derivatives at the equilibrium:
+	// BR, PR*PRED, EF*PREY and DRATE around the loops of a single
+	// stock, and EF*PRED*PR*PREY around the loop through both.
+	want := map[string]struct {
+		polarity int
+		gain     float64
+	}{
+		"PREY PB":         {1, .1},
+		"PREY PD":         {-1, -.1},
+		"PRED GR":         {1, .1},
+		"PRED DR":         {-1, -.1},
+		"PREY GR PRED PD": {-1, -.01},
+	}
+	if len(loops) != len(want) {
+		t.Fatalf("got %d loops, want %d: %v", len(loops), len(want), loops)
+	}
+	for i, l := range loops {
+		vars := strings.Join(l.Vars, " ")
+		w, ok := want[vars]
+		if !ok {
+			t.Errorf("unexpected loop %s", l)
+			continue
+		}
+		if l.Polarity != w.polarity || math.Abs(l.Gain-w.gain) > 1e-6 {
+			t.Errorf("%s: got polarity %d and gain %g, want %d and %g", vars, l.Polarity, l.Gain, w.polarity, w.gain)
+		}
+		if i > 0 && math.Abs(l.Gain) > math.Abs(loops[i-1].Gain) {
+			t.Errorf("loop %d, %s, has a larger gain than the one before it", i, l)
+		}
+	}
+	if s := loops[len(loops)-1].String(); !strings.HasPrefix(s, "PREY -> GR -> PRED -> PD -> PREY (balancing, gain ") {
+		t.Errorf("got %s", s)
+	}
+
+	// a model without feedback has no loops
+	f, _ = parseSrc(t, "* open\nA X.K=TIME.K\nA Y.K=(2)(X.K)\nC LENGTH=1\nC DT=1\nC SAVPER=1\n")
+	if loops, err = FeedbackLoopFinder(f); err != nil || len(loops) != 0 {
+		t.Errorf("no feedback: got loops %v (%v)", loops, err)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CyclicMacro is the error returned when a macro calls itself,
+// directly or through other macros.  Names is the chain of calls,
+// starting and ending with the same macro.
+type CyclicMacro struct {
+	Names []string
+}
+
+func (e *CyclicMacro) Error() string {
+	return "macro cycle: " + strings.Join(e.Names, " -> ")
+}
+
+// mapExpr returns a copy of e in which each node fn returns an
+// expression for is replaced by it.  Nodes fn returns nil for are
+// copied, with their children mapped in turn.
+func mapExpr(e Expr, fn func(Expr) (Expr, error)) (Expr, error) {
+	if r, err := fn(e); r != nil || err != nil {
+		return r, err
+	}
+	var err error
+	m := func(e Expr) Expr {
+		if err != nil || e == nil {
+			return e
+		}
+		var r Expr
+		r, err = mapExpr(e, fn)
+		return r
+	}
+	switch x := e.(type) {
+	case *ParenExpr:
+		e = &ParenExpr{x.Lparen, m(x.X), x.Rparen}
+	case *UnaryExpr:
+		e = &UnaryExpr{x.OpPos, x.Op, m(x.X)}
+	case *BinaryExpr:
+		e = &BinaryExpr{m(x.X), x.OpPos, x.Op, m(x.Y)}
+	case *IfExpr:
+		e = &IfExpr{x.If, m(x.Cond), m(x.Then), m(x.Else)}
+	case *UnitExpr:
+		e = &UnitExpr{m(x.X), x.Unit}
+	case *IndexExpr:
+		e = &IndexExpr{m(x.X), x.Lbrack, m(x.Index), x.Rbrack}
+	case *KeyValueExpr:
+		e = &KeyValueExpr{x.Key, x.Colon, m(x.Value)}
+	case *CallExpr:
+		c := *x
+		c.Args = make([]Expr, len(x.Args))
+		for i, arg := range x.Args {
+			c.Args[i] = m(arg)
+		}
+		e = &c
+	case *CompositeLit:
+		c := *x
+		c.Elts = make([]Expr, len(x.Elts))
+		for i, elt := range x.Elts {
+			c.Elts[i] = m(elt)
+		}
+		e = &c
+	}
+	return e, err
+}
+
+// macroExpander inlines macro calls, giving each call its own copy
+// of the macro's variables so that macros with levels keep separate
+// state at each call site.
+type macroExpander struct {
+	macros map[string]*MacroDecl // by upper-cased name
+	calls  map[string]int        // calls expanded so far, by macro
+	stmts  []Stmt                // equations of the expanded calls
+}
+
+// expand returns a copy of e with the macro calls in it replaced by
+// references to the variables holding their results.  If sub isn't
+// nil, it gives the replacement for each identifier, or nil to keep
+// it.
+func (x *macroExpander) expand(e Expr, sub func(*Ident) Expr) (Expr, error) {
+	var fn func(Expr) (Expr, error)
+	fn = func(e Expr) (Expr, error) {
+		switch n := e.(type) {
+		case *Ident:
+			if sub != nil {
+				return sub(n), nil
+			}
+		case *RefExpr:
+			if sub != nil {
+				if id, ok := sub(&n.Ident).(*Ident); ok {
+					return &RefExpr{*id}, nil
+				}
+				return sub(&n.Ident), nil
+			}
+		case *SubscriptExpr:
+			if sub != nil {
+				if id, ok := sub(n.Base).(*Ident); ok {
+					return &SubscriptExpr{id, n.Sub}, nil
+				}
+				return sub(n.Base), nil
+			}
+		case *CallExpr:
+			mac, ok := x.macros[funcName(n)]
+			if !ok {
+				return nil, nil
+			}
+			args := make([]Expr, len(n.Args))
+			for i, arg := range n.Args {
+				var err error
+				if args[i], err = mapExpr(arg, fn); err != nil {
+					return nil, err
+				}
+			}
+			return x.call(mac, args)
+		}
+		return nil, nil
+	}
+	return mapExpr(e, fn)
+}
+
+// call expands a call of mac with the given arguments, adding the
+// equations of the macro's variables, renamed for this call, to
+// x.stmts.  Each argument replaces its parameter without time
+// subscripts, which are those of the caller's equation and may not
+// suit the macro's.
+func (x *macroExpander) call(mac *MacroDecl, args []Expr) (Expr, error) {
+	name := strings.ToUpper(mac.Name.Name)
+	if len(args) != len(mac.Params) {
+		return nil, fmt.Errorf("%s takes %d arguments, not %d", name, len(mac.Params), len(args))
+	}
+	x.calls[name]++
+	prefix := fmt.Sprintf("%s$%d", name, x.calls[name])
+
+	params := map[string]Expr{}
+	for i, p := range mac.Params {
+		arg, _ := mapExpr(args[i], func(e Expr) (Expr, error) {
+			if s, ok := e.(*SubscriptExpr); ok {
+				return s.Base, nil
+			}
+			return nil, nil
+		})
+		params[strings.ToUpper(p.Name)] = &ParenExpr{X: arg}
+	}
+	locals := map[string]string{}
+	for _, s := range mac.Body.List {
+		if assign, ok := s.(*AssignStmt); ok {
+			n := strings.ToUpper(assign.Lhs.Name.Name)
+			locals[n] = prefix + "$" + n
+		}
+	}
+	if _, ok := locals[name]; !ok {
+		return nil, fmt.Errorf("macro %s doesn't define %s", name, name)
+	}
+	locals[name] = prefix
+	sub := func(id *Ident) Expr {
+		n := strings.ToUpper(id.Name)
+		if arg, ok := params[n]; ok {
+			return arg
+		}
+		if local, ok := locals[n]; ok {
+			return &Ident{NamePos: id.NamePos, Name: local}
+		}
+		return nil
+	}
+
+	for _, s := range mac.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			continue
+		}
+		rhs, err := x.expand(assign.Rhs, sub)
+		if err != nil {
+			return nil, err
+		}
+		lhs := *assign.Lhs
+		lhs.Name = &Ident{NamePos: lhs.Name.NamePos, Name: locals[strings.ToUpper(lhs.Name.Name)]}
+		x.stmts = append(x.stmts, &AssignStmt{Lhs: &lhs, Rhs: rhs})
+	}
+
+	return &Ident{Name: prefix}, nil
+}
+
+// checkCycles returns a CyclicMacro error if one of macros calls
+// itself, whether or not the model calls it.
+func (x *macroExpander) checkCycles(macros []*MacroDecl) error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			for i, n := range stack {
+				if n == name {
+					return &CyclicMacro{append(append([]string(nil), stack[i:]...), name)}
+				}
+			}
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		var err error
+		for _, s := range x.macros[name].Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok {
+				continue
+			}
+			Inspect(assign.Rhs, func(n Node) bool {
+				if c, ok := n.(*CallExpr); ok && err == nil {
+					if _, ok := x.macros[funcName(c)]; ok {
+						err = visit(funcName(c))
+					}
+				}
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+		return nil
+	}
+	for _, mac := range macros {
+		if err := visit(strings.ToUpper(mac.Name.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandMacros returns a copy of m with each call of one of macros
+// inlined.  The variables of a call of macro NAME are named NAME$n,
+// for its result, and NAME$n$VAR for the rest, where n counts the
+// calls of NAME.  m is returned as is if there are no macros, and a
+// CyclicMacro error if a macro calls itself.
+func expandMacros(m *ModelDecl, macros []*MacroDecl) (*ModelDecl, error) {
+	if len(macros) == 0 {
+		return m, nil
+	}
+	x := &macroExpander{
+		macros: map[string]*MacroDecl{},
+		calls:  map[string]int{},
+	}
+	for _, mac := range macros {
+		x.macros[strings.ToUpper(mac.Name.Name)] = mac
+	}
+	if err := x.checkCycles(macros); err != nil {
+		return nil, err
+	}
+
+	expanded := *m
+	expanded.Body = new(BlockStmt)
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			expanded.Body.List = append(expanded.Body.List, s)
+			continue
+		}
+		rhs, err := x.expand(assign.Rhs, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", assign.Lhs.Name.Name, err)
+		}
+		expanded.Body.List = append(expanded.Body.List, &AssignStmt{Lhs: assign.Lhs, Rhs: rhs})
+	}
+	expanded.Body.List = append(expanded.Body.List, x.stmts...)
+	return &expanded, nil
+}
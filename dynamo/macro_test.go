@@ -0,0 +1,66 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestLogisticMacro(t *testing.T) {
+	src, err := ioutil.ReadFile("../models/logistic.dynamo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := parseSrc(t, string(src))
+	if len(f.Macros) != 1 {
+		t.Fatalf("got %d macros, want 1", len(f.Macros))
+	}
+	mac := f.Macros[0]
+	if mac.Name.Name != "LOGIS" || len(mac.Params) != 2 ||
+		mac.Params[0].Name != "X" || mac.Params[1].Name != "S" {
+		t.Errorf("got macro %s with %d params, want LOGIS(X,S)", mac.Name.Name, len(mac.Params))
+	}
+
+	// each call is expanded with its own arguments
+	logis := func(x, s float64) float64 { return 1 / (1 + math.Exp(s*(x-1))) }
+	sim, gen := simulateBoth(t, string(src))
+	checkSeries(t, "B", map[float64]float64{0: .1 * 100 * logis(.1, 8)}, sim, gen)
+	checkSeries(t, "D", map[float64]float64{0: .02 * 100 * (2 - logis(.1, 4))}, sim, gen)
+	for name := range gen.Vars {
+		if strings.Contains(name, "$") {
+			t.Errorf("macro variable %s in the output", name)
+		}
+	}
+}
+
+func TestCyclicMacro(t *testing.T) {
+	const src = `* cycle
+MACRO	PING(X)
+A	PING.K=PONG(X)
+MEND
+MACRO	PONG(X)
+A	PONG.K=PING(X)+1
+MEND
+A	Y.K=TIME.K
+C	LENGTH=1
+C	DT=1
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	_, err := expandMacros(f.Decls[0].(*ModelDecl), f.Macros)
+	cyc, ok := err.(*CyclicMacro)
+	if !ok {
+		t.Fatalf("got error %v, want a CyclicMacro", err)
+	}
+	if got := strings.Join(cyc.Names, " "); got != "PING PONG PING" {
+		t.Errorf("got cycle %s, want PING PONG PING", got)
+	}
+	if _, err := Simulate(f, SimulateOptions{}); err == nil || !strings.Contains(err.Error(), "macro cycle") {
+		t.Errorf("Simulate: got error %v, want a macro cycle", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// manifestKinds maps the kinds accepted in a manifest, either as
+// card letters or type names, to card letters.
+var manifestKinds = map[string]string{
+	"L": "L", "STOCK": "L",
+	"N": "N", "INITIAL": "N",
+	"R": "R", "FLOW": "R",
+	"A": "A", "AUX": "A",
+	"C": "C", "CONST": "C",
+	"T": "T", "TABLE": "T",
+	"S": "S", "SUPPLEMENTARY": "S",
+	"X": "X", "EXTERNAL": "X",
+}
+
+// A Manifest lists the variables a family of models is expected to
+// define, as a map of upper-cased name to card letter.
+type Manifest map[string]string
+
+// ParseManifest reads a manifest with one variable per line, given
+// as its name followed by its kind: a card letter (L, N, R, A, C, T,
+// S or X) or the corresponding type name (stock, initial, flow, aux,
+// const, table, supplementary or external).  Blank lines and lines
+// starting with a * are ignored.
+func ParseManifest(r io.Reader) (Manifest, error) {
+	m := Manifest{}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '*' {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected 'NAME KIND', not '%s'", line, text)
+		}
+		kind, ok := manifestKinds[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown kind '%s'", line, fields[1])
+		}
+		name := strings.ToUpper(fields[0])
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("line %d: %s listed twice", line, name)
+		}
+		m[name] = kind
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Check returns an error for each variable in m that f doesn't
+// define, or defines on a different kind of card, sorted by name.
+// The timespec counts as the C cards TIME, LENGTH, DT and SAVPER.
+// Variables f defines beyond those in m are allowed.
+func (m Manifest) Check(f *File) []error {
+	// a level's L and N cards both have its name, so a variable
+	// can have more than one kind.
+	kinds := map[string][]string{}
+	for n, eqn := range equations(f) {
+		kinds[n] = append(kinds[n], eqn[:1])
+	}
+	for _, d := range f.Decls {
+		md, ok := d.(*ModelDecl)
+		if !ok || md.Body == nil {
+			continue
+		}
+		for _, s := range md.Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok || assign.Lhs.Type == nil {
+				continue
+			}
+			n, k := strings.ToUpper(assign.Lhs.Name.Name), typeLetter(assign.Lhs)
+			if !hasString(kinds[n], k) {
+				kinds[n] = append(kinds[n], k)
+				sort.Strings(kinds[n])
+			}
+		}
+	}
+
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, n := range names {
+		ks, ok := kinds[n]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: not defined, want kind %s", n, m[n]))
+			continue
+		}
+		if !hasString(ks, m[n]) {
+			errs = append(errs, fmt.Errorf("%s: kind %s, want %s", n, strings.Join(ks, "/"), m[n]))
+		}
+	}
+	return errs
+}
+
+// hasString reports whether s is in ss.
+func hasString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	tests := []struct {
+		manifest string
+		errs     []string
+	}{
+		{"* population\npop L\nB flow\nNB C\n\nDT const\n", nil},
+		{"POP A\nBIRTHS R\nNB const\n", []string{
+			"BIRTHS: not defined, want kind R",
+			"POP: kind L/N, want A",
+		}},
+	}
+	f, _ := parseSrc(t, helloWorld)
+	for _, test := range tests {
+		m, err := ParseManifest(strings.NewReader(test.manifest))
+		if err != nil {
+			t.Fatalf("%q: ParseManifest: %s", test.manifest, err)
+		}
+		var errs []string
+		for _, err := range m.Check(f) {
+			errs = append(errs, err.Error())
+		}
+		if got, want := fmt.Sprint(errs), fmt.Sprint(test.errs); got != want {
+			t.Errorf("%q: got %s, want %s", test.manifest, got, want)
+		}
+	}
+
+	if _, err := ParseManifest(strings.NewReader("POP Q\n")); err == nil {
+		t.Errorf("unknown kind: expected an error")
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"github.com/bpowers/boosd/runtime"
+	"go/token"
+	"strings"
+)
+
+// mergeTimespec sets the fields of spec that ts sets, those that
+// differ from the defaults used when a model doesn't give them,
+// returning an error if spec already has a different value for one.
+// set records the fields of spec given so far.
+func mergeTimespec(spec *runtime.Timespec, set map[string]bool, ts runtime.Timespec) error {
+	def := runtime.Timespec{DT: 1, SaveStep: 1}
+	fields := []struct {
+		name     string
+		dst      *float64
+		val, def float64
+	}{
+		{"TIME", &spec.Start, ts.Start, def.Start},
+		{"LENGTH", &spec.End, ts.End, def.End},
+		{"DT", &spec.DT, ts.DT, def.DT},
+		{"SAVPER", &spec.SaveStep, ts.SaveStep, def.SaveStep},
+	}
+	for _, f := range fields {
+		if f.val == f.def {
+			continue
+		}
+		if set[f.name] && *f.dst != f.val {
+			return fmt.Errorf("conflicting %s: %g and %g", f.name, *f.dst, f.val)
+		}
+		*f.dst = f.val
+		set[f.name] = true
+	}
+	return nil
+}
+
+// Merge combines the main models of files, as returned by ParseDir,
+// into a single model, along with their macros and comments.  It is
+// an error for two files to declare the same variable or macro, or
+// to give different values for the same timespec constant.  As the
+// parser can't tell a constant set to its default value from one
+// that wasn't set, DT=1 in one file doesn't conflict with DT=5 in
+// another.
+func Merge(files []*File) (*File, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to merge")
+	}
+
+	m := &ModelDecl{Name: id("main"), Body: new(BlockStmt)}
+	merged := &File{Name: m.Name, Doc: files[0].Doc, Decls: []Decl{m}}
+	spec := runtime.Timespec{DT: 1, SaveStep: 1}
+	specSet := map[string]bool{}
+	types := map[string]string{} // upper-cased name -> type name
+	macros := map[string]bool{}
+
+	for _, f := range files {
+		for _, mac := range f.Macros {
+			name := strings.ToUpper(mac.Name.Name)
+			if macros[name] {
+				return nil, fmt.Errorf("macro %s redeclared", mac.Name.Name)
+			}
+			macros[name] = true
+			merged.Macros = append(merged.Macros, mac)
+		}
+		merged.Comments = append(merged.Comments, f.Comments...)
+
+		fm := f.GetModel("main")
+		if fm != nil && fm.Body == nil {
+			fm = nil
+		}
+		for _, d := range f.Decls {
+			if md, ok := d.(*ModelDecl); !ok || md != fm {
+				merged.Decls = append(merged.Decls, d)
+			}
+		}
+		if fm == nil {
+			continue
+		}
+		if timespecStmt(fm) != nil {
+			ts, err := fm.Timespec()
+			if err != nil {
+				return nil, err
+			}
+			if err = mergeTimespec(&spec, specSet, ts); err != nil {
+				return nil, err
+			}
+		}
+		for _, s := range fm.Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok || assign.Lhs.Type == nil {
+				m.Body.List = append(m.Body.List, s)
+				continue
+			}
+			if assign.Lhs.Name.Name == "timespec" {
+				continue
+			}
+			// a level and its N card may be in different files,
+			// but each only once
+			name := strings.ToUpper(assign.Lhs.Name.Name)
+			ty := assign.Lhs.Type.Name
+			switch prev, ok := types[name]; {
+			case !ok:
+				types[name] = ty
+			case prev == "initial" && ty == "stock", prev == "stock" && ty == "initial":
+				types[name] = "stock+initial"
+			default:
+				return nil, fmt.Errorf("%s redeclared", assign.Lhs.Name.Name)
+			}
+			m.Body.List = append(m.Body.List, s)
+		}
+	}
+	m.SetTimespec(spec)
+
+	// redeclarations were reported above, so there are no errors
+	// to position
+	var errs ErrorVector
+	merged.Unresolved = resolveModel(m, token.NewFileSet(), &errs)
+	return merged, nil
+}
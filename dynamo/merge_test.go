@@ -0,0 +1,76 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDirMerge(t *testing.T) {
+	fset := token.NewFileSet()
+	files, err := ParseDir("testdata/multifile", fset)
+	if err != nil {
+		t.Fatalf("ParseDir: %s", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("got %d files, want 3", len(files))
+	}
+	f, err := Merge(files)
+	if err != nil {
+		t.Fatalf("Merge: %s", err)
+	}
+	ts, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	// there's a house for every 4 people at first, so births are
+	// at their normal rate for the first step, and half after.
+	checkSeries(t, "POP", map[float64]float64{0: 1000, 1: 1030, 2: 1035.15}, ts)
+	checkSeries(t, "HOUS", map[float64]float64{0: 250, 1: 252.5}, ts)
+	if n := len(ts.Time); n != 11 {
+		t.Errorf("got %d times, want the 11 of the control file's timespec", n)
+	}
+
+	// a variable declared in two files
+	if _, err := Merge(append(files, files[2])); err == nil {
+		t.Errorf("duplicate population sector: expected an error")
+	}
+	// a conflicting timespec
+	other, _ := parseSrc(t, "* other control cards\nC LENGTH=20\n")
+	if _, err := Merge(append(files, other)); err == nil || !strings.Contains(err.Error(), "conflicting LENGTH") {
+		t.Errorf("two LENGTHs: got error %v, want a conflict", err)
+	}
+}
+
+func TestParseDirErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ParseDir(dir, token.NewFileSet()); err == nil {
+		t.Errorf("empty directory: expected an error")
+	}
+
+	files := map[string]string{
+		"good.dyn": "* good\nC X=1\n",
+		"bad.dyn":  "* bad\nA Y.K=)\n",
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = ParseDir(dir, token.NewFileSet())
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(dir, "bad.dyn")+":2:") {
+		t.Errorf("got error %v, want one in bad.dyn", err)
+	}
+}
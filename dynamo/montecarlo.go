@@ -0,0 +1,174 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Distribution is a probability distribution a constant's value
+// is drawn from.
+type Distribution interface {
+	Sample(r *rand.Rand) float64
+}
+
+// A UniformDist is uniform over [Min, Max).
+type UniformDist struct {
+	Min, Max float64
+}
+
+// Sample returns a value drawn from d using r.
+func (d UniformDist) Sample(r *rand.Rand) float64 {
+	return d.Min + (d.Max-d.Min)*r.Float64()
+}
+
+// A NormalDist is normal, with mean Mean and standard deviation
+// Std.
+type NormalDist struct {
+	Mean, Std float64
+}
+
+// Sample returns a value drawn from d using r.
+func (d NormalDist) Sample(r *rand.Rand) float64 {
+	return d.Mean + d.Std*r.NormFloat64()
+}
+
+// mcPercentiles are the percentiles of an MCResult.
+var mcPercentiles = []int{5, 50, 95}
+
+// An MCResult summarizes the runs of a Monte Carlo analysis: the
+// mean, standard deviation and percentiles of each variable at each
+// time, across the runs.
+type MCResult struct {
+	Mean        TimeSeries
+	Std         TimeSeries
+	Percentiles map[int]TimeSeries // the 5th, 50th and 95th
+	Runs        []SensResult       // each run, with the values drawn for it
+}
+
+// MonteCarlo simulates the model named main in f n times, each with
+// the constants named in dists set to values drawn from their
+// distributions, and summarizes the results.  The values are drawn
+// from a source seeded with seed, in order of the constants' names,
+// so that an analysis can be repeated; the simulations run in a pool
+// of a goroutine per CPU.  The standard deviation is that of the
+// sample, with n-1 degrees of freedom, and percentiles interpolate
+// linearly between runs.
+func MonteCarlo(f *File, dists map[string]Distribution, n int, seed int64) (MCResult, error) {
+	var res MCResult
+	if n <= 0 {
+		return res, fmt.Errorf("need at least one run, not %d", n)
+	}
+	names := make([]string, 0, len(dists))
+	for name := range dists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	r := rand.New(rand.NewSource(seed))
+	samples := make([]map[string]float64, n)
+	for i := range samples {
+		samples[i] = make(map[string]float64, len(names))
+		for _, name := range names {
+			samples[i][strings.ToUpper(name)] = dists[name].Sample(r)
+		}
+	}
+
+	runs := make([]TimeSeries, n)
+	errs := make([]error, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				g, err := withParams(f, samples[i])
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				runs[i], errs[i] = Simulate(g, SimulateOptions{})
+			}
+		}()
+	}
+	for i := range samples {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return res, fmt.Errorf("run %d: %s", i+1, err)
+		}
+	}
+
+	res.Runs = make([]SensResult, n)
+	for i, run := range runs {
+		res.Runs[i] = SensResult{samples[i], run}
+	}
+
+	series := func() TimeSeries {
+		return TimeSeries{
+			Time: append([]float64(nil), runs[0].Time...),
+			Vars: make(map[string][]float64, len(runs[0].Vars)),
+		}
+	}
+	res.Mean, res.Std = series(), series()
+	res.Percentiles = make(map[int]TimeSeries, len(mcPercentiles))
+	for _, p := range mcPercentiles {
+		res.Percentiles[p] = series()
+	}
+	vals := make([]float64, n)
+	for name := range runs[0].Vars {
+		steps := len(runs[0].Time)
+		mean, std := make([]float64, steps), make([]float64, steps)
+		pcts := make([][]float64, len(mcPercentiles))
+		for j := range pcts {
+			pcts[j] = make([]float64, steps)
+		}
+		for t := 0; t < steps; t++ {
+			sum := 0.0
+			for i, run := range runs {
+				vals[i] = run.Vars[name][t]
+				sum += vals[i]
+			}
+			mean[t] = sum / float64(n)
+			if n > 1 {
+				ss := 0.0
+				for _, v := range vals {
+					ss += (v - mean[t]) * (v - mean[t])
+				}
+				std[t] = math.Sqrt(ss / float64(n-1))
+			}
+			sort.Float64s(vals)
+			for j, p := range mcPercentiles {
+				pcts[j][t] = percentile(vals, float64(p))
+			}
+		}
+		res.Mean.Vars[name], res.Std.Vars[name] = mean, std
+		for j, p := range mcPercentiles {
+			res.Percentiles[p].Vars[name] = pcts[j]
+		}
+	}
+	return res, nil
+}
+
+// percentile returns the pth percentile of the sorted values vals,
+// interpolating linearly between the closest ranks.
+func percentile(vals []float64, p float64) float64 {
+	pos := p / 100 * float64(len(vals)-1)
+	i := int(pos)
+	if i >= len(vals)-1 {
+		return vals[len(vals)-1]
+	}
+	return vals[i] + (pos-float64(i))*(vals[i+1]-vals[i])
+}
@@ -0,0 +1,85 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMonteCarlo(t *testing.T) {
+	// Y is ten times GAIN, the single random parameter
+	const src = `* gain
+A	Y.K=(GAIN)(10)
+C	GAIN=1
+C	LENGTH=2
+C	DT=1
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	const n = 2000
+	run := func(paramStd float64) MCResult {
+		res, err := MonteCarlo(f, map[string]Distribution{"gain": NormalDist{1, paramStd}}, n, 1)
+		if err != nil {
+			t.Fatalf("MonteCarlo: %s", err)
+		}
+		return res
+	}
+	narrow, wide := run(.1), run(.2)
+	for i := range narrow.Mean.Time {
+		ns, ws := narrow.Std.Vars["Y"][i], wide.Std.Vars["Y"][i]
+		// the samples are the same draws, scaled
+		if math.Abs(ws/ns-2) > 1e-9 {
+			t.Errorf("TIME %g: got std %g then %g, want twice the first", narrow.Mean.Time[i], ns, ws)
+		}
+		if math.Abs(ns-1) > .05 {
+			t.Errorf("TIME %g: got std %g, want about 1", narrow.Mean.Time[i], ns)
+		}
+		mean, p := narrow.Mean.Vars["Y"][i], narrow.Percentiles
+		if math.Abs(mean-10) > .1 || math.Abs(p[50].Vars["Y"][i]-10) > .1 {
+			t.Errorf("TIME %g: got mean %g and median %g, want about 10", narrow.Mean.Time[i], mean, p[50].Vars["Y"][i])
+		}
+		// the 5th and 95th percentiles of a normal distribution
+		// are 1.645 standard deviations from its mean
+		if lo, hi := p[5].Vars["Y"][i], p[95].Vars["Y"][i]; math.Abs(lo-(10-1.645)) > .15 || math.Abs(hi-(10+1.645)) > .15 {
+			t.Errorf("TIME %g: got 5th and 95th percentiles %g and %g, want about %g and %g",
+				narrow.Mean.Time[i], lo, hi, 10-1.645, 10+1.645)
+		}
+	}
+
+	// the same seed gives the same results
+	if again := run(.1); !reflect.DeepEqual(again, narrow) {
+		t.Errorf("seed 1 gave different results")
+	}
+
+	res, err := MonteCarlo(f, map[string]Distribution{"GAIN": UniformDist{2, 3}}, 100, 1)
+	if err != nil {
+		t.Fatalf("MonteCarlo: %s", err)
+	}
+	if lo, hi := res.Percentiles[5].Vars["Y"][0], res.Percentiles[95].Vars["Y"][0]; lo < 20 || hi >= 30 || lo >= hi {
+		t.Errorf("uniform: got 5th and 95th percentiles %g and %g, want within [20, 30)", lo, hi)
+	}
+	// each run is kept, with the GAIN drawn for it
+	if len(res.Runs) != 100 {
+		t.Fatalf("got %d runs, want 100", len(res.Runs))
+	}
+	for i, r := range res.Runs {
+		if gain := r.Params["GAIN"]; r.TS.Vars["Y"][0] != gain*10 {
+			t.Errorf("run %d: got Y %g with GAIN %g", i+1, r.TS.Vars["Y"][0], gain)
+		}
+	}
+
+	// a single run has no deviation
+	if res, err = MonteCarlo(f, map[string]Distribution{"GAIN": NormalDist{1, 1}}, 1, 1); err != nil || res.Std.Vars["Y"][0] != 0 {
+		t.Errorf("one run: got std %v (%v), want 0", res.Std.Vars["Y"], err)
+	}
+	if _, err := MonteCarlo(f, nil, 0, 1); err == nil {
+		t.Errorf("no runs: expected an error")
+	}
+	if _, err := MonteCarlo(f, map[string]Distribution{"Y": NormalDist{1, 1}}, 10, 1); err == nil {
+		t.Errorf("random auxiliary: expected an error")
+	}
+}
@@ -5,39 +5,194 @@
 package dynamo
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/bpowers/boosd/runtime"
 	"go/token"
+	"io"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
 )
 
-func Parse(f *token.File, fset *token.FileSet, str string) (*File, error) {
-	parser := newParser(f, fset, newLex(str, f))
+// A ParseOption changes how Parse parses a model.
+type ParseOption func(*dynParser)
+
+// WithStrictMode makes Parse run Check on the parsed file, failing
+// if it reports an error.  Warnings are dropped; call Check to see
+// them.
+func WithStrictMode(strict bool) ParseOption {
+	return func(p *dynParser) {
+		p.strict = strict
+	}
+}
+
+// ParseFile reads and parses the model in the file at filename,
+// adding the file to fset.
+func ParseFile(filename string, fset *token.FileSet, opts ...ParseOption) (*File, error) {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(fset.AddFile(filename, fset.Base(), len(src)), fset, string(src), opts...)
+}
+
+// ParseReader reads and parses the model in r, adding it to fset as
+// a file called name.
+func ParseReader(r io.Reader, name string, fset *token.FileSet, opts ...ParseOption) (*File, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAll(%s): %s", name, err)
+	}
+	return Parse(fset.AddFile(name, fset.Base(), len(src)), fset, string(src), opts...)
+}
+
+// ParseDir parses the models in the files in dir whose names end in
+// .dyn, in order by name, adding each file to fset.  The errors in
+// all of the files are returned together as an ErrorList, each
+// positioned in the file it's in.  A model split across files can
+// reference variables declared in the others, so the files aren't
+// checked in strict mode; Merge them and Check the result instead.
+func ParseDir(dir string, fset *token.FileSet) ([]*File, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.dyn"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no .dyn files in %s", dir)
+	}
+	var files []*File
+	var errs ErrorList
+	for _, name := range names {
+		f, err := ParseFile(name, fset)
+		if list, ok := err.(ErrorList); ok {
+			errs = append(errs, list...)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	if len(errs) > 0 {
+		return files, errs
+	}
+	return files, nil
+}
+
+// exprPrefix is the start of the equation ParseExpr parses an
+// expression as the right-hand side of.
+const exprPrefix = "A\tEXPR.K="
+
+// ParseExpr parses a single DYNAMO expression, like (NB)(POP) or
+// TABHL(AHMT,HAR,.4,1.4,.2), for building models with a ModelBuilder.
+// As with the rest of a ModelBuilder's equations, names in it don't
+// take time subscripts.  Errors are positioned on line 1 of src.
+func ParseExpr(src string) (Expr, error) {
+	if strings.Contains(src, "\n") {
+		return nil, fmt.Errorf("expression spans more than one line")
+	}
+	text := "*\n" + exprPrefix + src + "\n"
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("", fset.Base(), len(text)), fset, text)
+	if list, ok := err.(ErrorList); ok {
+		for _, e := range list {
+			e.Pos.Line, e.Pos.Column = 1, e.Pos.Column-len(exprPrefix)
+		}
+		return nil, list
+	} else if err != nil {
+		return nil, err
+	}
+	for _, s := range f.Decls[0].(*ModelDecl).Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Name.Name != "EXPR" {
+			continue
+		}
+		Inspect(assign.Rhs, func(n Node) bool {
+			if x, ok := n.(*SubscriptExpr); ok && err == nil {
+				err = fmt.Errorf("%s.%s: time subscripts aren't allowed", x.Base.Name, x.Sub)
+			}
+			return err == nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return assign.Rhs, nil
+	}
+	return nil, fmt.Errorf("no expression")
+}
+
+// Parse parses the model in str, which f, a file of fset, positions.
+// If there are errors, they are returned as an ErrorList sorted by
+// position, along with as much of the File as could be parsed.  With
+// errors.As, the ErrorList can be had as ParseErrors.
+func Parse(f *token.File, fset *token.FileSet, str string, opts ...ParseOption) (*File, error) {
+	lex := newLex(str, f)
+	parser := newParser(f, fset, lex)
+	for _, opt := range opts {
+		opt(parser)
+	}
+	lex.err = lexErrors{parser}
 	result, nerr := parser.Parse()
+	if nerr == 0 && parser.strict {
+		for _, d := range Check(result, nil) {
+			if d.Severity == SeverityError {
+				parser.report(fset.Position(d.Pos), d.Code, d.Msg)
+			}
+		}
+		nerr = parser.ErrorCount()
+	}
 	if nerr != 0 {
-		return nil, fmt.Errorf("%d parse errors:\n%s", nerr,
-			parser.errBuf.String())
+		return result, parser.GetError(Sorted)
 	}
 
 	return result, nil
 }
 
 type dynParser struct {
-	tokf   *token.File
-	fset   *token.FileSet
-	lex    *dynLex
-	f      *File
-	errBuf bytes.Buffer
-	nerr   int
+	ErrorVector
+	tokf      *token.File
+	fset      *token.FileSet
+	lex       *dynLex
+	f         *File
+	maxErrors int    // errors reported before giving up
+	strict    bool   // run Check after parsing
+	rule      string // the rule errors are reported under
 }
 
 func newParser(f *token.File, fs *token.FileSet, l *dynLex) *dynParser {
-	return &dynParser{tokf: f, fset: fs, lex: l, f: new(File)}
+	return &dynParser{tokf: f, fset: fs, lex: l, f: new(File), maxErrors: 10, rule: "syntax"}
+}
+
+// Error records the error msg at pos under the rule of the phase of
+// parsing under way: syntax, or once a model has been read the check
+// of it under way, like div-zero or redeclared.
+func (p *dynParser) Error(pos token.Position, msg string) {
+	p.report(pos, p.rule, msg)
+}
+
+// report records the error msg at pos, found by rule, unless
+// maxErrors errors have already been recorded.  Errors past the
+// limit are dropped, and the first of them is replaced by a note
+// that parsing stopped.
+func (p *dynParser) report(pos token.Position, rule, msg string) {
+	switch n := p.ErrorCount(); {
+	case n < p.maxErrors:
+		p.RuleError(pos, rule, msg)
+	case n == p.maxErrors:
+		p.RuleError(pos, rule, "too many errors, stopping")
+	}
+}
+
+// lexErrors reports the lexer's errors to p under the rule lex.
+type lexErrors struct {
+	p *dynParser
+}
+
+func (h lexErrors) Error(pos token.Position, msg string) {
+	h.p.report(pos, "lex", msg)
 }
 
 func ident(tok Token) *Ident {
-	return &Ident{tok.pos, tok.val, nil}
+	return &Ident{tok.Pos, tok.Val, nil}
 }
 
 func id(n string) *Ident {
@@ -48,14 +203,18 @@ func (p *dynParser) Parse() (*File, int) {
 
 	p.f.Name = id("main")
 	p.declModel(p.f.Name)
+	p.f.Doc = p.lex.title
+	p.f.Comments = p.lex.comments
 
-	return p.f, p.nerr
+	return p.f, p.ErrorCount()
 }
 
 func (p *dynParser) errorf(tok Token, f string, args ...interface{}) {
-	p.errBuf.WriteString(fmt.Sprintf("%s: %s\n", p.fset.Position(tok.pos),
-		fmt.Sprintf(f, args...)))
-	p.nerr++
+	pos := tok.start
+	if !pos.IsValid() {
+		pos = tok.Pos
+	}
+	p.Error(p.fset.Position(pos), fmt.Sprintf(f, args...))
 }
 
 func (p *dynParser) declModel(n *Ident) {
@@ -63,35 +222,56 @@ func (p *dynParser) declModel(n *Ident) {
 	m.Name = n
 	m.Body = new(BlockStmt)
 outer:
-	for {
-		switch tok := p.lex.Peek(); tok.kind {
-		case itemEOF:
+	for p.ErrorCount() <= p.maxErrors {
+		switch tok := p.lex.Peek(); tok.Kind {
+		case KindEOF:
 			break outer
-		case itemSemi:
+		case KindSemi:
 			p.lex.Token() // discard
-		case itemIdentifier:
-			if len(tok.val) == 1 {
+		case KindIdent:
+			if len(tok.Val) == 1 {
 				p.stmtInto(m)
 				break
 			}
+			if strings.ToUpper(tok.Val) == "MACRO" {
+				p.macroDecl()
+				break
+			}
+			if strings.ToUpper(tok.Val) == "SPEC" {
+				p.specStmt(m)
+				break
+			}
+			if kind := strings.ToUpper(tok.Val); kind == "PRINT" || kind == "PLOT" {
+				p.outputStmt(m)
+				break
+			}
 			fallthrough
 		default:
-			p.errorf(tok, "expected 1 char ident, not '%s'", tok.val)
+			p.errorf(tok, "expected 1 char ident, not '%s'", tok.Val)
 			p.lex.Token() // discard
 		}
 	}
 
+	p.rule = "div-zero"
+	checkDivZero(m, p.fset, p)
+	p.rule = "subscript"
+	checkSubscripts(m, p.fset, p)
+
 	if n.Name == "main" {
+		p.rule = "timespec"
 		if err := extractTimespec(m); err != nil {
 			p.errorf(Token{}, "extractTimespec: %s", err)
 		}
 	}
+	p.rule = "redeclared"
+	p.f.Unresolved = append(p.f.Unresolved, resolveModel(m, p.fset, p)...)
+	p.rule = "syntax"
 
 	p.f.Decls = append(p.f.Decls, m)
 }
 
 func floatLitS(t Token) *BasicLit {
-	return &BasicLit{t.pos, token.FLOAT, t.val}
+	return &BasicLit{ValuePos: t.Pos, Kind: token.FLOAT, Value: t.Val}
 }
 
 func floatLit(f float64) *BasicLit {
@@ -99,78 +279,187 @@ func floatLit(f float64) *BasicLit {
 	return &BasicLit{Kind: token.FLOAT, Value: fmt.Sprintf("%f", f)}
 }
 
-func extractTimespec(m *ModelDecl) error {
-	ts := new(AssignStmt)
-	ts.Lhs = new(VarDecl)
-	ts.Lhs.Name = id("timespec")
+// timespecStmt returns the assignment holding m's timespec, or nil
+// if it doesn't have one.
+func timespecStmt(m *ModelDecl) *AssignStmt {
+	for _, stmt := range m.Body.List {
+		if assign, ok := stmt.(*AssignStmt); ok && assign.Lhs.Name.Name == "timespec" {
+			return assign
+		}
+	}
+	return nil
+}
+
+// Timespec returns the simulation start, end, DT and save step of
+// m, as extracted from its TIME, LENGTH, DT and SAVPER constants.
+func (m *ModelDecl) Timespec() (ts runtime.Timespec, err error) {
+	assign := timespecStmt(m)
+	if assign == nil {
+		return ts, fmt.Errorf("model %s has no timespec", m.Name.Name)
+	}
+	cl, ok := assign.Rhs.(*CompositeLit)
+	if !ok {
+		return ts, fmt.Errorf("timespec is %T, not CompositeLit", assign.Rhs)
+	}
+	for _, e := range cl.Elts {
+		k, val, err := kvConvert(e)
+		if err != nil {
+			return ts, err
+		}
+		v, err := constEval(val)
+		if err != nil {
+			return ts, fmt.Errorf("timespec %s: %s", k, err)
+		}
+		switch k {
+		case "start":
+			ts.Start = v
+		case "end":
+			ts.End = v
+		case "dt":
+			ts.DT = v
+		case "save_step":
+			ts.SaveStep = v
+		}
+	}
+	return ts, nil
+}
+
+// SetTimespec replaces m's timespec with ts.
+func (m *ModelDecl) SetTimespec(ts runtime.Timespec) {
 	rhs := new(CompositeLit)
-	ts.Rhs = rhs
+	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("start"), Value: floatLit(ts.Start)})
+	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("end"), Value: floatLit(ts.End)})
+	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("dt"), Value: floatLit(ts.DT)})
+	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("save_step"), Value: floatLit(ts.SaveStep)})
 
+	if assign := timespecStmt(m); assign != nil {
+		assign.Rhs = rhs
+		return
+	}
+
+	assign := new(AssignStmt)
+	assign.Lhs = new(VarDecl)
+	assign.Lhs.Name = id("timespec")
+	assign.Rhs = rhs
+	m.Body.List = append(m.Body.List, assign)
+}
+
+// setTimespecField sets the field of spec given by the constant or
+// SPEC parameter name to the value of e.  Other names are ignored.
+func setTimespecField(spec *runtime.Timespec, name string, e Expr) error {
+	var err error
+	switch strings.ToUpper(name) {
+	case "TIME":
+		spec.Start, err = constEval(e)
+	case "LENGTH":
+		spec.End, err = constEval(e)
+	case "SAVPER":
+		spec.SaveStep, err = constEval(e)
+	case "DT":
+		spec.DT, err = constEval(e)
+	}
+	if err != nil {
+		return fmt.Errorf("constEval(%s): %s", name, err)
+	}
+	return nil
+}
+
+// extractTimespec sets m's timespec from its TIME, LENGTH, SAVPER
+// and DT constants and SPEC cards, and removes the constants from m.
+// A SPEC card takes priority over a constant.  SPEC cards are left in
+// m, so that Unparse can write them back, but it's the timespec that
+// gives the values simulated.  Without a SAVPER, the model
+// is saved every PLTPER or PRTPER, whichever is shorter, so that its
+// supplementaries are computed when they are plotted or printed.
+func extractTimespec(m *ModelDecl) error {
 	spec := runtime.Timespec{
 		DT:       1,
 		SaveStep: 1,
 	}
 
+	savper := false
 	for _, stmt := range m.Body.List {
-		assign, ok := stmt.(*AssignStmt)
+		if assign, ok := stmt.(*AssignStmt); ok {
+			if err := setTimespecField(&spec, assign.Lhs.Name.Name, assign.Rhs); err != nil {
+				return err
+			}
+			if strings.ToUpper(assign.Lhs.Name.Name) == "SAVPER" {
+				savper = true
+			}
+		}
+	}
+	period := 0.0
+	for _, stmt := range m.Body.List {
+		s, ok := stmt.(*SpecStmt)
 		if !ok {
 			continue
 		}
-		var err error
-		switch strings.ToUpper(assign.Lhs.Name.Name) {
-		case "TIME":
-			spec.Start, err = constEval(assign.Rhs)
-		case "LENGTH":
-			spec.End, err = constEval(assign.Rhs)
-		case "SAVPER":
-			spec.SaveStep, err = constEval(assign.Rhs)
-		case "DT":
-			spec.DT, err = constEval(assign.Rhs)
-		}
-		if err != nil {
-			return fmt.Errorf("constEval(%s): %s", assign.Lhs.Name.Name, err)
+		for _, e := range s.Elts {
+			k, v, err := kvConvert(e)
+			if err != nil {
+				return err
+			}
+			if err = setTimespecField(&spec, k, v); err != nil {
+				return err
+			}
+			switch k {
+			case "SAVPER":
+				savper = true
+			case "PLTPER", "PRTPER":
+				if p, err := constEval(v); err == nil && p > 0 && (period == 0 || p < period) {
+					period = p
+				}
+			}
 		}
 	}
+	if !savper && period > 0 {
+		spec.SaveStep = period
+	}
 
 	// remove these const assignments from the simulation, they
 	// are purely to specify the timespec
 	for i := 0; i < len(m.Body.List); i++ {
-		assign, ok := m.Body.List[i].(*AssignStmt)
+		s, ok := m.Body.List[i].(*AssignStmt)
 		if !ok {
 			continue
 		}
-		switch strings.ToUpper(assign.Lhs.Name.Name) {
+		switch strings.ToUpper(s.Lhs.Name.Name) {
 		case "TIME", "LENGTH", "SAVPER", "DT":
-			m.Body.List = append(m.Body.List[:i], m.Body.List[i+1:]...)
-			i--
+		default:
+			continue
 		}
+		m.Body.List = append(m.Body.List[:i], m.Body.List[i+1:]...)
+		i--
 	}
 
-	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("start"), Value: floatLit(spec.Start)})
-	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("end"), Value: floatLit(spec.End)})
-	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("dt"), Value: floatLit(spec.DT)})
-	rhs.Elts = append(rhs.Elts, &KeyValueExpr{Key: id("save_step"), Value: floatLit(spec.SaveStep)})
-
-	m.Body.List = append(m.Body.List, ts)
+	m.SetTimespec(spec)
 
 	return nil
 }
 
 func (p *dynParser) stmtInto(m *ModelDecl) {
 	typeTok := p.lex.Token()
-	typeTok.val = strings.ToUpper(typeTok.val)
-	switch typeTok.val {
-	case "L", "N", "C", "R", "A":
+	doc := p.lex.leadComment(typeTok)
+	typeTok.Val = strings.ToUpper(typeTok.Val)
+	switch typeTok.Val {
+	case "L", "N", "C", "R", "A", "S", "X":
 		decl, ok := p.varDecl(typeTok)
 		if !ok || !p.consumeEqual() {
 			p.discardStmt()
 			return
 		}
+		decl.Doc = doc
 		expr, ok := p.expr()
 		if !ok {
 			p.discardStmt()
 			return
 		}
+		p.unitsInto(decl)
+		if tok := p.lex.Peek(); tok.Kind != KindSemi && tok.Kind != KindEOF {
+			p.errorf(tok, "expected end of equation, not %s", tokText(tok))
+			p.discardStmt()
+			return
+		}
 		m.Body.List = append(m.Body.List, &AssignStmt{Lhs: decl, Rhs: expr})
 	case "T":
 		decl, ok := p.varDecl(typeTok)
@@ -178,84 +467,577 @@ func (p *dynParser) stmtInto(m *ModelDecl) {
 			p.discardStmt()
 			return
 		}
+		decl.Doc = doc
 		expr, ok := p.tableDef()
 		if !ok {
 			p.discardStmt()
 			return
 		}
+		p.unitsInto(decl)
 		m.Body.List = append(m.Body.List, &AssignStmt{Lhs: decl, Rhs: expr})
 	default:
-		p.errorf(typeTok, "unknown type: %s", typeTok.val)
+		p.errorf(typeTok, "unknown type: %s", typeTok.Val)
 	}
 }
 
+// macroDecl parses a macro definition: a MACRO card naming the
+// macro and its parameters, the macro's equations and a MEND card.
+// The macro is added to the file's Macros unless its MACRO card is
+// malformed.
+func (p *dynParser) macroDecl() {
+	macroTok := p.lex.Token()
+	d := &MacroDecl{Macro: macroTok.Pos, Body: new(BlockStmt)}
+	d.Doc = p.lex.leadComment(macroTok)
+	ok := p.macroHeader(d)
+	if !ok {
+		p.discardStmt()
+	}
+
+	body := &ModelDecl{Body: d.Body}
+	for p.ErrorCount() <= p.maxErrors {
+		switch tok := p.lex.Peek(); {
+		case tok.Kind == KindEOF:
+			p.errorf(macroTok, "MACRO without MEND")
+			return
+		case tok.Kind == KindSemi:
+			p.lex.Token() // discard
+		case tok.Kind == KindIdent && strings.ToUpper(tok.Val) == "MEND":
+			p.lex.Token()
+			d.Mend = tok.Pos
+			if ok {
+				p.f.Macros = append(p.f.Macros, d)
+			}
+			return
+		case tok.Kind == KindIdent && len(tok.Val) == 1:
+			p.stmtInto(body)
+		default:
+			p.errorf(tok, "expected 1 char ident or MEND, not '%s'", tok.Val)
+			p.lex.Token() // discard
+		}
+	}
+}
+
+// macroHeader parses the name and parameters on a MACRO card into d,
+// returning false if they're malformed or clash with a built-in
+// function, an earlier macro or each other.
+func (p *dynParser) macroHeader(d *MacroDecl) bool {
+	nameTok := p.lex.Peek()
+	if nameTok.Kind != KindIdent {
+		p.errorf(nameTok, "expected macro name, not %s", tokText(nameTok))
+		return false
+	}
+	p.lex.Token()
+	d.Name = ident(nameTok)
+	name := strings.ToUpper(nameTok.Val)
+	if _, ok := builtins[name]; ok {
+		p.errorf(nameTok, "macro %s redeclares a built-in function", nameTok.Val)
+		return false
+	}
+	for _, m := range p.f.Macros {
+		if strings.ToUpper(m.Name.Name) == name {
+			p.errorf(nameTok, "macro %s redeclared", nameTok.Val)
+			return false
+		}
+	}
+
+	if tok := p.lex.Peek(); tok.Kind != KindLParen {
+		p.errorf(tok, "expected '(' after macro name, not %s", tokText(tok))
+		return false
+	}
+	p.lex.Token()
+	params := map[string]bool{}
+	for {
+		tok := p.lex.Peek()
+		if tok.Kind != KindIdent {
+			p.errorf(tok, "expected parameter name, not %s", tokText(tok))
+			return false
+		}
+		if params[strings.ToUpper(tok.Val)] {
+			p.errorf(tok, "duplicate parameter %s", tok.Val)
+			return false
+		}
+		p.lex.Token()
+		params[strings.ToUpper(tok.Val)] = true
+		d.Params = append(d.Params, ident(tok))
+
+		switch tok = p.lex.Peek(); {
+		case tok.Kind == KindRParen:
+			p.lex.Token()
+			if tok = p.lex.Peek(); tok.Kind != KindSemi && tok.Kind != KindEOF {
+				p.errorf(tok, "expected end of MACRO card, not %s", tokText(tok))
+				return false
+			}
+			return true
+		case tok.Val != ",":
+			p.errorf(tok, "expected ',' or ')' in parameters, not %s", tokText(tok))
+			return false
+		}
+		p.lex.Token()
+	}
+}
+
+// specParams are the parameters a SPEC card may give.  PRTPER and
+// PLTPER, the print and plot periods, stand in for SAVPER when it
+// isn't given.
+var specParams = map[string]bool{
+	"TIME":   true,
+	"DT":     true,
+	"LENGTH": true,
+	"SAVPER": true,
+	"PRTPER": true,
+	"PLTPER": true,
+}
+
+// specStmt parses a SPEC card, parameters like DT=.25/LENGTH=100
+// separated by '/', into m.
+func (p *dynParser) specStmt(m *ModelDecl) {
+	specTok := p.lex.Token()
+	spec := &SpecStmt{Spec: specTok.Pos}
+	seen := map[string]bool{}
+	for {
+		keyTok := p.lex.Peek()
+		if keyTok.Kind != KindIdent {
+			p.errorf(keyTok, "expected SPEC parameter, not %s", tokText(keyTok))
+			p.discardStmt()
+			return
+		}
+		p.lex.Token()
+		key := strings.ToUpper(keyTok.Val)
+		switch {
+		case !specParams[key]:
+			p.errorf(keyTok, "unknown SPEC parameter %s", keyTok.Val)
+			p.discardStmt()
+			return
+		case seen[key]:
+			p.errorf(keyTok, "SPEC parameter %s given twice", key)
+			p.discardStmt()
+			return
+		}
+		seen[key] = true
+		if !p.consumeEqual() {
+			p.discardStmt()
+			return
+		}
+
+		neg := false
+		if tok := p.lex.Peek(); tok.Val == "-" {
+			p.lex.Token()
+			neg = true
+		}
+		valTok := p.lex.Peek()
+		if valTok.Kind != KindNumber {
+			p.errorf(valTok, "expected number for SPEC parameter %s, not %s", key, tokText(valTok))
+			p.discardStmt()
+			return
+		}
+		p.lex.Token()
+		val := floatLitS(valTok)
+		if neg {
+			val.Value = "-" + val.Value
+		}
+		spec.Elts = append(spec.Elts, &KeyValueExpr{Key: &Ident{keyTok.Pos, key, nil}, Value: val})
+
+		switch tok := p.lex.Peek(); {
+		case tok.Val == "/":
+			p.lex.Token() // discard
+		case tok.Kind == KindSemi || tok.Kind == KindEOF:
+			m.Body.List = append(m.Body.List, spec)
+			return
+		default:
+			p.errorf(tok, "expected '/' in SPEC, not %s", tokText(tok))
+			p.discardStmt()
+			return
+		}
+	}
+}
+
+// outputStmt parses a PRINT or PLOT card, the names of the variables
+// to write out separated by ',' or '/', into m.  A PLOT card may give
+// each name a plotting symbol, any single token, and a scale, as in
+// POP=P(0,1000); they are checked for form but otherwise ignored.
+func (p *dynParser) outputStmt(m *ModelDecl) {
+	cardTok := p.lex.Token()
+	out := &OutputStmt{Card: cardTok.Pos, Kind: strings.ToUpper(cardTok.Val)}
+	for {
+		nameTok := p.lex.Peek()
+		if nameTok.Kind != KindIdent {
+			p.errorf(nameTok, "expected variable name in %s, not %s", out.Kind, tokText(nameTok))
+			p.discardStmt()
+			return
+		}
+		p.lex.Token()
+		out.Names = append(out.Names, &Ident{nameTok.Pos, nameTok.Val, nil})
+
+		if tok := p.lex.Peek(); tok.Val == "=" {
+			p.lex.Token()
+			switch sym := p.lex.Peek(); {
+			case sym.Kind != KindSemi && sym.Kind != KindEOF && sym.Val != "," && sym.Val != "/" && sym.Val != "(":
+				p.lex.Token()
+			default:
+				p.errorf(sym, "expected plotting symbol, not %s", tokText(sym))
+				p.discardStmt()
+				return
+			}
+		}
+		if tok := p.lex.Peek(); tok.Val == "(" {
+			if !p.outputScale() {
+				p.discardStmt()
+				return
+			}
+		}
+
+		switch tok := p.lex.Peek(); {
+		case tok.Val == "," || tok.Val == "/":
+			p.lex.Token() // discard
+		case tok.Kind == KindSemi || tok.Kind == KindEOF:
+			m.Body.List = append(m.Body.List, out)
+			return
+		default:
+			p.errorf(tok, "expected ',' or '/' in %s, not %s", out.Kind, tokText(tok))
+			p.discardStmt()
+			return
+		}
+	}
+}
+
+// outputScale parses the scale of a plotted variable, its lower and
+// upper bounds in parentheses.
+func (p *dynParser) outputScale() bool {
+	p.lex.Token() // (
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			if tok := p.lex.Peek(); tok.Val != "," {
+				p.errorf(tok, "expected ',' in scale, not %s", tokText(tok))
+				return false
+			}
+			p.lex.Token()
+		}
+		if tok := p.lex.Peek(); tok.Val == "-" {
+			p.lex.Token()
+		}
+		if tok := p.lex.Peek(); tok.Kind != KindNumber {
+			p.errorf(tok, "expected number in scale, not %s", tokText(tok))
+			return false
+		}
+		p.lex.Token()
+	}
+	if tok := p.lex.Peek(); tok.Val != ")" {
+		p.errorf(tok, "expected ')' after scale, not %s", tokText(tok))
+		return false
+	}
+	p.lex.Token()
+	return true
+}
+
+// binaryOps maps the arithmetic and comparison operators to their
+// tokens.  <> is DYNAMO's not-equal, and ^ raises to a power, which
+// the tree records as XOR, as go/token has no power operator.
+var binaryOps = map[string]token.Token{
+	"+":  token.ADD,
+	"-":  token.SUB,
+	"*":  token.MUL,
+	"/":  token.QUO,
+	"^":  token.XOR,
+	"<":  token.LSS,
+	">":  token.GTR,
+	"<=": token.LEQ,
+	">=": token.GEQ,
+	"<>": token.NEQ,
+}
+
+// isComparison returns true if op is one of the comparison
+// operators.
+func isComparison(op token.Token) bool {
+	switch op {
+	case token.LSS, token.GTR, token.LEQ, token.GEQ, token.NEQ:
+		return true
+	}
+	return false
+}
+
+// peekOp returns the operator at the head of the token stream if it
+// is one of ops.
+func (p *dynParser) peekOp(ops ...token.Token) (Token, token.Token, bool) {
+	tok := p.lex.Peek()
+	if tok.Kind != KindOp {
+		return tok, token.ILLEGAL, false
+	}
+	for _, op := range ops {
+		if binaryOps[tok.Val] == op {
+			return tok, op, true
+		}
+	}
+	return tok, token.ILLEGAL, false
+}
+
+// tokText describes tok for use in error messages.
+func tokText(tok Token) string {
+	switch tok.Kind {
+	case KindSemi, KindEOF:
+		return "end of equation"
+	}
+	return fmt.Sprintf("'%s'", tok.Val)
+}
+
+// expr parses a conditional, or a sum, or a comparison of two sums.
+// Comparisons don't chain.
 func (p *dynParser) expr() (Expr, bool) {
-	switch tok := p.lex.Token(); tok.kind {
-	case itemNumber:
-		return &BasicLit{tok.pos, token.FLOAT, tok.val}, true
-	default:
-		fmt.Printf("expr\n")
+	if isKeyword(p.lex.Peek(), "IF") {
+		return p.ifExpr()
+	}
+	x, ok := p.sum()
+	if !ok {
+		return nil, false
+	}
+	tok, op, ok := p.peekOp(token.LSS, token.GTR, token.LEQ, token.GEQ, token.NEQ)
+	if !ok {
+		return x, true
+	}
+	p.lex.Token()
+	y, ok := p.sum()
+	if !ok {
+		return nil, false
+	}
+	return &BinaryExpr{X: x, OpPos: tok.Pos, Op: op, Y: y}, true
+}
+
+// sum parses a sum or difference of terms.
+func (p *dynParser) sum() (Expr, bool) {
+	x, ok := p.term()
+	if !ok {
 		return nil, false
 	}
+	for {
+		tok, op, ok := p.peekOp(token.ADD, token.SUB)
+		if !ok {
+			return x, true
+		}
+		p.lex.Token()
+		y, ok := p.term()
+		if !ok {
+			return nil, false
+		}
+		x = &BinaryExpr{X: x, OpPos: tok.Pos, Op: op, Y: y}
+	}
+}
+
+// isKeyword returns true if tok is the keyword kw, in any case.
+func isKeyword(tok Token, kw string) bool {
+	return tok.Kind == KindKeyword && strings.ToUpper(tok.Val) == kw
+}
+
+// consumeKeyword reads the keyword kw, or reports an error and
+// leaves the offending token unread.
+func (p *dynParser) consumeKeyword(kw string) bool {
+	if tok := p.lex.Peek(); !isKeyword(tok, kw) {
+		p.errorf(tok, "expected %s, not %s", kw, tokText(tok))
+		return false
+	}
+	p.lex.Token()
+	return true
 }
 
+// ifExpr parses IF cond THEN expr ELSE expr.  Each part extends as
+// far as it can, so an IF in the THEN part takes the first ELSE.
+func (p *dynParser) ifExpr() (Expr, bool) {
+	x := &IfExpr{If: p.lex.Token().Pos}
+	var ok bool
+	if x.Cond, ok = p.expr(); !ok || !p.consumeKeyword("THEN") {
+		return nil, false
+	}
+	if x.Then, ok = p.expr(); !ok || !p.consumeKeyword("ELSE") {
+		return nil, false
+	}
+	if x.Else, ok = p.expr(); !ok {
+		return nil, false
+	}
+	return x, true
+}
+
+// term parses a product or quotient of unary expressions.
 func (p *dynParser) term() (Expr, bool) {
-	return nil, false
+	x, ok := p.unary()
+	if !ok {
+		return nil, false
+	}
+	for {
+		tok, op, ok := p.peekOp(token.MUL, token.QUO)
+		if !ok {
+			return x, true
+		}
+		p.lex.Token()
+		y, ok := p.unary()
+		if !ok {
+			return nil, false
+		}
+		x = &BinaryExpr{X: x, OpPos: tok.Pos, Op: op, Y: y}
+	}
 }
 
-func (p *dynParser) factor() (Expr, bool) {
-	return nil, false
+// unary parses a power with any number of leading signs, so that
+// -2^2 is -4.
+func (p *dynParser) unary() (Expr, bool) {
+	tok, op, ok := p.peekOp(token.ADD, token.SUB)
+	if !ok {
+		return p.power()
+	}
+	p.lex.Token()
+	x, ok := p.unary()
+	if !ok {
+		return nil, false
+	}
+	return &UnaryExpr{OpPos: tok.Pos, Op: op, X: x}, true
 }
 
-func (p *dynParser) ident() (Expr, bool) {
-	return nil, false
+// power parses a factor raised to a power.  ^ is right-associative,
+// and its exponent may have a sign, as in 2^-1.
+func (p *dynParser) power() (Expr, bool) {
+	x, ok := p.factor()
+	if !ok {
+		return nil, false
+	}
+	tok, op, ok := p.peekOp(token.XOR)
+	if !ok {
+		return x, true
+	}
+	p.lex.Token()
+	y, ok := p.unary()
+	if !ok {
+		return nil, false
+	}
+	return &BinaryExpr{X: x, OpPos: tok.Pos, Op: op, Y: y}, true
 }
 
-func (p *dynParser) num() (Expr, bool) {
-	switch tok := p.lex.Token(); tok.kind {
-	case itemNumber:
-		return &BasicLit{tok.pos, token.FLOAT, tok.val}, true
+// factor parses a number, a variable reference, a function call or
+// a parenthesized expression.  On error the offending token is left
+// unread, so that a missing operand at the end of a card doesn't
+// consume the card after it.
+func (p *dynParser) factor() (Expr, bool) {
+	switch tok := p.lex.Peek(); tok.Kind {
+	case KindNumber:
+		p.lex.Token()
+		return floatLitS(tok), true
+	case KindIdent:
+		p.lex.Token()
+		switch next := p.lex.Peek(); next.Kind {
+		case KindLParen:
+			return p.call(ident(tok))
+		case KindSubscript:
+			p.lex.Token()
+			return &SubscriptExpr{ident(tok), strings.ToUpper(next.Val)}, true
+		}
+		return ident(tok), true
+	case KindLParen:
+		p.lex.Token()
+		x, ok := p.expr()
+		if !ok {
+			return nil, false
+		}
+		rparen := p.lex.Peek()
+		if rparen.Kind != KindRParen {
+			p.errorf(rparen, "expected ')', not %s", tokText(rparen))
+			return nil, false
+		}
+		p.lex.Token()
+		return &ParenExpr{Lparen: tok.Pos, X: x, Rparen: rparen.Pos}, true
 	default:
-		fmt.Printf("expr\n")
+		p.errorf(tok, "expected expression, not %s", tokText(tok))
 		return nil, false
 	}
 }
 
+// call parses the parenthesized, comma-separated arguments of a
+// call to fun.
+func (p *dynParser) call(fun *Ident) (Expr, bool) {
+	c := &CallExpr{Fun: fun, Lparen: p.lex.Token().Pos}
+	if tok := p.lex.Peek(); tok.Kind == KindRParen {
+		c.Rparen = p.lex.Token().Pos
+		return c, true
+	}
+	for {
+		arg, ok := p.expr()
+		if !ok {
+			return nil, false
+		}
+		c.Args = append(c.Args, arg)
+
+		switch tok := p.lex.Peek(); {
+		case tok.Val == ",":
+			p.lex.Token()
+		case tok.Kind == KindRParen:
+			c.Rparen = p.lex.Token().Pos
+			return c, true
+		default:
+			p.errorf(tok, "expected ',' or ')' in call to %s, not %s",
+				fun.Name, tokText(tok))
+			return nil, false
+		}
+	}
+}
+
+// tableDef parses the '/'-separated values of a T card.  Every
+// separator must sit between two values; a leading, doubled or
+// trailing '/' is reported as a missing table value.  The token
+// ending the statement is left for the caller.
 func (p *dynParser) tableDef() (Expr, bool) {
 	table := new(TableFwdExpr)
-outer:
 	for {
-		tok := p.lex.Token()
-		if tok.kind != itemNumber {
-			p.errorf(tok, "expected float literal in table def, not '%s'", tok.val)
-			return nil, true
+		tok := p.lex.Peek()
+		var sign *Token
+		if tok.Val == "-" || tok.Val == "+" {
+			// a signed value, like -1
+			s := p.lex.Token()
+			sign, tok = &s, p.lex.Peek()
+		}
+		switch {
+		case tok.Kind == KindNumber:
+			p.lex.Token()
+			if sign != nil {
+				tok.Val, tok.start = sign.Val+tok.Val, sign.start
+			}
+		case tok.Val == "/" || tok.Kind == KindSemi || tok.Kind == KindEOF:
+			p.errorf(tok, "missing table value")
+			return nil, false
+		default:
+			p.errorf(tok, "expected float literal in table def, not '%s'", tok.Val)
+			return nil, false
 		}
 		table.Ys = append(table.Ys, floatLitS(tok))
 
-		switch tok = p.lex.Token(); {
-		case tok.val == "/":
-			break // discard
-		case tok.kind == itemSemi || tok.kind == itemEOF:
-			break outer
+		switch tok = p.lex.Peek(); {
+		case tok.Val == "/":
+			p.lex.Token() // discard
+		case tok.Kind == KindSemi || tok.Kind == KindEOF || tok.Kind == KindUnits:
+			return table, true
 		default:
-			p.errorf(tok, "expected '/' in table def, not '%s'", tok.val)
+			p.errorf(tok, "expected '/' in table def, not '%s'", tok.Val)
+			return nil, false
 		}
 	}
-	return table, false
 }
 
-// discard everything before the next EOF or semi
+// discardStmt skips the rest of a broken card: everything up to and
+// including the next semi, or up to the start of the next card,
+// whichever comes first.  Stopping at the next card keeps a card
+// that was never ended, say by an unclosed paren, from taking the
+// cards after it down with it.
 func (p *dynParser) discardStmt() {
-	tok := p.lex.Token()
-	for tok.kind != itemEOF && tok.kind != itemSemi {
-		fmt.Printf("discard: %s\n", tok)
-		tok = p.lex.Token()
+	for {
+		tok := p.lex.Peek()
+		switch {
+		case tok.Kind == KindEOF || p.lex.isCardStart(tok):
+			return
+		case tok.Kind == KindSemi:
+			p.lex.Token()
+			return
+		}
+		p.lex.Token()
 	}
 }
 
 func typeIdent(typeTok Token) *Ident {
 	var n string
-	switch typeTok.val {
+	switch typeTok.Val {
 	case "L":
 		n = "stock"
 	case "N":
@@ -266,26 +1048,49 @@ func typeIdent(typeTok Token) *Ident {
 		n = "flow"
 	case "A":
 		n = "aux"
+	case "S":
+		n = "supplementary"
+	case "X":
+		n = "external"
 	case "T":
 		n = "table"
 	default:
-		panic("unknown type " + typeTok.val)
+		panic("unknown type " + typeTok.Val)
 	}
-	return &Ident{typeTok.pos, n, nil}
+	return &Ident{typeTok.Pos, n, nil}
 }
 
 func (p *dynParser) varDecl(typeTok Token) (*VarDecl, bool) {
 	nameTok := p.lex.Token()
-	if nameTok.kind != itemIdentifier {
-		p.errorf(nameTok, "expected ident, not %s", typeTok.val)
+	if nameTok.Kind != KindIdent {
+		p.errorf(nameTok, "expected ident, not %s", typeTok.Val)
 		return nil, false
 	}
 	d := new(VarDecl)
 	d.Name = ident(nameTok)
 	d.Type = typeIdent(typeTok)
+	if tok := p.lex.Peek(); tok.Kind == KindSubscript {
+		p.lex.Token()
+		d.Sub = strings.ToUpper(tok.Val)
+	}
 	return d, true
 }
 
+// unitsInto records the unit annotation following an equation, if
+// there is one, as the units of d.
+func (p *dynParser) unitsInto(d *VarDecl) {
+	tok := p.lex.Peek()
+	if tok.Kind != KindUnits {
+		return
+	}
+	p.lex.Token()
+	d.Units = &BasicLit{
+		ValuePos: tok.Pos,
+		Kind:     token.STRING,
+		Value:    strings.TrimSpace(tok.Val[1 : len(tok.Val)-1]),
+	}
+}
+
 func (p *dynParser) tableInto(m *ModelDecl) {
 
 }
@@ -293,8 +1098,8 @@ func (p *dynParser) tableInto(m *ModelDecl) {
 // consumeEqual returns true on success
 func (p *dynParser) consumeEqual() bool {
 	tok := p.lex.Token()
-	if tok.val != "=" {
-		p.errorf(tok, "expected =, not %s", tok.val)
+	if tok.Val != "=" {
+		p.errorf(tok, "expected =, not %s", tok.Val)
 		return false
 	}
 	return true
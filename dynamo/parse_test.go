@@ -0,0 +1,319 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/bpowers/boosd/runtime"
+	"go/token"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTableSeparators(t *testing.T) {
+	tests := []struct {
+		card string
+		ys   string // the values, or the error if there should be one
+	}{
+		{"T FOO=1/2/3", "1 2 3"},
+		{"T FOO=-1/0/+1", "-1 0 +1"},
+		{"T FOO=/1/2", "test.dyn:2:7: missing table value"},
+		{"T FOO=1//2", "test.dyn:2:9: missing table value"},
+		{"T FOO=1/2/", "test.dyn:2:11: missing table value"},
+		{"T FOO=1/-/2", "test.dyn:2:10: missing table value"},
+	}
+	for _, test := range tests {
+		src := "* tables\n" + test.card + "\n"
+		fset := token.NewFileSet()
+		f, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src)
+		if err != nil {
+			if got := err.Error(); got != test.ys {
+				t.Errorf("%q: got error %s, want %s", test.card, got, test.ys)
+			}
+			continue
+		}
+		var ys []string
+		Inspect(f, func(n Node) bool {
+			if table, ok := n.(*TableFwdExpr); ok {
+				for _, y := range table.Ys {
+					ys = append(ys, y.Value)
+				}
+			}
+			return true
+		})
+		if got := strings.Join(ys, " "); got != test.ys {
+			t.Errorf("%q: got %s, want %s", test.card, got, test.ys)
+		}
+	}
+}
+
+func TestRatioConstants(t *testing.T) {
+	const src = `* ratios
+C	RATE=365/7
+C	LENGTH=100/4
+C	DT=1/8
+C	SAVPER=1
+`
+	f, _ := parseSrc(t, src)
+	var m *ModelDecl
+	for _, d := range f.Decls {
+		if md, ok := d.(*ModelDecl); ok && md.Name.Name == "main" {
+			m = md
+		}
+	}
+	if m == nil {
+		t.Fatalf("no model named main")
+	}
+	ts, err := m.Timespec()
+	if err != nil {
+		t.Fatalf("Timespec: %s", err)
+	}
+	if ts.DT != .125 || ts.End != 25 {
+		t.Errorf("got DT %g and LENGTH %g, want .125 and 25", ts.DT, ts.End)
+	}
+	var rate *AssignStmt
+	for _, s := range m.Body.List {
+		if a, ok := s.(*AssignStmt); ok && a.Lhs.Name.Name == "RATE" {
+			rate = a
+		}
+	}
+	if rate == nil {
+		t.Fatalf("no RATE")
+	}
+	if v, err := constEval(rate.Rhs); err != nil || v != 365.0/7 {
+		t.Errorf("RATE: got %g (%v), want %g", v, err, 365.0/7)
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	// a 50 line model: two timespec cards and 48 auxiliaries
+	model := func(broken func(line int) bool) string {
+		var buf bytes.Buffer
+		buf.WriteString("* recovery\nC DT=1\n")
+		for line := 3; line <= 50; line++ {
+			if broken(line) {
+				fmt.Fprintf(&buf, "A X%d.K=(1+\n", line)
+			} else {
+				fmt.Fprintf(&buf, "A X%d.K=%d\n", line, line)
+			}
+		}
+		return buf.String()
+	}
+	tests := []struct {
+		name   string
+		broken func(line int) bool
+		errs   int
+	}{
+		{"line 3", func(line int) bool { return line == 3 }, 1},
+		{"every line", func(line int) bool { return true }, 11},
+	}
+	for _, test := range tests {
+		src := model(test.broken)
+		fset := token.NewFileSet()
+		_, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src)
+		list, ok := err.(ErrorList)
+		if !ok {
+			t.Errorf("%s: got error %v, want an ErrorList", test.name, err)
+			continue
+		}
+		if len(list) != test.errs {
+			t.Errorf("%s: got %d errors, want %d:\n%s", test.name, len(list), test.errs, err)
+			continue
+		}
+		if list[0].Pos.Line != 3 {
+			t.Errorf("%s: first error is on line %d, want 3", test.name, list[0].Pos.Line)
+		}
+		if last := list[len(list)-1]; test.errs > 10 && last.Msg != "too many errors, stopping" {
+			t.Errorf("%s: last error is %s, want too many errors", test.name, last.Msg)
+		}
+	}
+}
+
+// TestParseErrors checks that Parse's errors can be had with
+// errors.As as ParseErrors, or the first as a ParseError, while the
+// partial File is still returned.
+func TestParseErrors(t *testing.T) {
+	const src = "* errors\nA X.K=(1\nA Y.K=2\nA Z.K=3+\n"
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src)
+	if f == nil {
+		t.Fatalf("no partial File with %v", err)
+	}
+	var errs ParseErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("errors.As(%T, *ParseErrors) failed", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("got %d errors, want 2:\n%s", len(errs), errs)
+	}
+	for i, line := range []int{2, 4} {
+		e := errs[i]
+		if e.Filename != "test.dyn" || e.Line != line || e.Column == 0 {
+			t.Errorf("error %d at %s, want test.dyn:%d", i, e.Position(), line)
+		}
+		if pos := e.Position(); pos.Filename != e.Filename || pos.Line != e.Line || pos.Column != e.Column {
+			t.Errorf("error %d: Position %s doesn't match", i, pos)
+		}
+	}
+	if lines := strings.Split(errs.Error(), "\n"); len(lines) != 2 || lines[1] != errs[1].Error() {
+		t.Errorf("Error: got %q, want one error per line", errs.Error())
+	}
+	if want := err.(ErrorList)[0].Error(); errs[0].Error() != want {
+		t.Errorf("ParseError: got %q, want %q", errs[0].Error(), want)
+	}
+
+	var first ParseError
+	if !errors.As(err, &first) || first != errs[0] {
+		t.Errorf("errors.As(*ParseError): got %v, want %v", first, errs[0])
+	}
+	wrapped := fmt.Errorf("loading: %w", err)
+	if !errors.As(wrapped, &errs) {
+		t.Errorf("errors.As didn't see through a wrapped error")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := ParseFile("../models/logistic.dynamo", fset)
+	if err != nil {
+		t.Fatalf("ParseFile: %s", err)
+	}
+	if len(f.Decls) == 0 {
+		t.Errorf("ParseFile: no declarations")
+	}
+	if _, err := ParseFile("testdata/nonexistent.dyn", fset); !os.IsNotExist(err) {
+		t.Errorf("nonexistent file: got error %v, want it not to exist", err)
+	}
+
+	if _, err := ParseReader(strings.NewReader(helloWorld), "hello.dyn", fset); err != nil {
+		t.Errorf("ParseReader: %s", err)
+	}
+	_, err = ParseReader(strings.NewReader("* bad\nA X.K=)\n"), "bad.dyn", fset)
+	if err == nil || !strings.HasPrefix(err.Error(), "bad.dyn:2:7: ") {
+		t.Errorf("ParseReader: got error %v, want one at bad.dyn:2:7", err)
+	}
+}
+
+func TestIfThenElse(t *testing.T) {
+	env := map[string]float64{"X": 3}
+	tests := []struct {
+		src string
+		v   float64
+	}{
+		{"IF X>2 THEN 1 ELSE 0", 1},
+		{"IF X>5 THEN 1 ELSE IF X>2 THEN 2 ELSE 3", 2},
+		{"IF X>2 THEN IF X<3 THEN 1 ELSE 4 ELSE 5", 4},
+		{"MAX(IF X>2 THEN 1 ELSE 7, 2)", 2},
+		{"MIN(10, IF X<=3 THEN X*3 ELSE 0)", 9},
+	}
+	for _, test := range tests {
+		if v, err := EvalExpr(test.src, env); err != nil || v != test.v {
+			t.Errorf("%s: got %g (%v), want %g", test.src, v, err, test.v)
+		}
+	}
+
+	for _, src := range []string{
+		"IF X>2 THEN 1",
+		"MAX(IF X>2 THEN 1, 2)",
+		"IF X>2 1 ELSE 0",
+	} {
+		if _, err := ParseExpr(src); err == nil {
+			t.Errorf("%s: expected a parse error", src)
+		}
+	}
+	src := "* if\nA Y.K=IF TIME.K>2 THEN 1\nC DT=1\n"
+	fset := token.NewFileSet()
+	_, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src)
+	if list, ok := err.(ErrorList); !ok || list[0].Pos.Line != 2 {
+		t.Errorf("missing ELSE: got error %v, want one on line 2", err)
+	}
+}
+
+func TestIfThenElseSimulated(t *testing.T) {
+	const src = `* if
+A	Y.K=MAX(IF TIME.K<2 THEN 0 ELSE IF TIME.K<4 THEN 1 ELSE 5, 1)
+C	LENGTH=5
+C	DT=1
+C	SAVPER=1
+`
+	sim, gen := simulateBoth(t, src)
+	checkSeries(t, "Y", map[float64]float64{0: 1, 2: 1, 3: 1, 4: 5, 5: 5}, sim, gen)
+}
+
+func TestSpec(t *testing.T) {
+	mainTimespec := func(src string) runtime.Timespec {
+		f, _ := parseSrc(t, src)
+		ts, err := f.Decls[0].(*ModelDecl).Timespec()
+		if err != nil {
+			t.Fatalf("Timespec: %s", err)
+		}
+		return ts
+	}
+
+	// a SPEC card alone gives the whole timespec
+	ts := mainTimespec(`* spec
+SPEC	TIME=-10/DT=.25/LENGTH=100/SAVPER=2
+L	X.K=X.J+(DT)(R.JK)
+N	X=0
+R	R.KL=1
+`)
+	want := runtime.Timespec{Start: -10, End: 100, DT: .25, SaveStep: 2}
+	if ts != want {
+		t.Errorf("got timespec %+v, want %+v", ts, want)
+	}
+
+	// and takes priority over C cards
+	ts = mainTimespec(`* spec
+C	DT=1
+C	LENGTH=10
+SPEC	DT=.5/PRTPER=1
+A	Y.K=TIME.K
+`)
+	if ts.DT != .5 || ts.End != 10 {
+		t.Errorf("got DT %g and LENGTH %g, want .5 and 10", ts.DT, ts.End)
+	}
+
+	for _, card := range []string{"SPEC DT=1/BOGUS=2", "SPEC DT=1/DT=2"} {
+		src := "* spec\n" + card + "\n"
+		fset := token.NewFileSet()
+		if _, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src); err == nil {
+			t.Errorf("%s: expected an error", card)
+		}
+	}
+}
+
+func TestOutputCards(t *testing.T) {
+	f, _ := parseSrc(t, `* output
+A	X.K=TIME.K
+A	Y.K=X.K*2
+PRINT	X,Y
+PLOT	X=X(0,10)/Y=*(-5,5)
+SPEC	DT=1/LENGTH=4/PRTPER=2
+`)
+	var cards []string
+	for _, s := range f.Decls[0].(*ModelDecl).Body.List {
+		if out, ok := s.(*OutputStmt); ok {
+			cards = append(cards, out.Kind+" "+outputNames(out))
+		}
+	}
+	if got := strings.Join(cards, "; "); got != "PRINT X,Y; PLOT X,Y" {
+		t.Errorf("got output cards %q, want PRINT X,Y; PLOT X,Y", got)
+	}
+	// PRTPER stands in for SAVPER
+	if ts, err := f.Decls[0].(*ModelDecl).Timespec(); err != nil || ts.SaveStep != 2 {
+		t.Errorf("got save step %g (%v), want 2", ts.SaveStep, err)
+	}
+
+	for _, card := range []string{"PRINT", "PRINT X,", "PLOT X=", "PLOT X(0)", "PLOT X(0,1", "PRINT X Y"} {
+		src := "* output\nA X.K=TIME.K\n" + card + "\n"
+		fset := token.NewFileSet()
+		if _, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src); err == nil {
+			t.Errorf("%s: expected an error", card)
+		}
+	}
+}
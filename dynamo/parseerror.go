@@ -0,0 +1,78 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"strings"
+)
+
+// A ParseError is an error found parsing a model, at a line and
+// column of the file Filename, for callers that want it without the
+// go/token machinery of an Error.
+type ParseError struct {
+	Filename     string
+	Line, Column int
+	Msg          string
+}
+
+func (e ParseError) Error() string {
+	if e.Filename != "" || e.Line > 0 {
+		return e.Position().String() + ": " + e.Msg
+	}
+	return e.Msg
+}
+
+// Position returns the position of e, without its offset.
+func (e ParseError) Position() token.Position {
+	return token.Position{Filename: e.Filename, Line: e.Line, Column: e.Column}
+}
+
+// ParseErrors are the errors found parsing a model, in order by
+// position.
+type ParseErrors []ParseError
+
+// Error returns the errors, one per line.
+func (p ParseErrors) Error() string {
+	if len(p) == 0 {
+		return "unspecified error"
+	}
+	lines := make([]string, len(p))
+	for i, e := range p {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ParseErrors returns p as ParseErrors.  A warning's message keeps
+// its "warning: " prefix.
+func (p ErrorList) ParseErrors() ParseErrors {
+	errs := make(ParseErrors, len(p))
+	for i, e := range p {
+		msg := e.Msg
+		if e.Severity == SeverityWarning {
+			msg = "warning: " + msg
+		}
+		errs[i] = ParseError{e.Pos.Filename, e.Pos.Line, e.Pos.Column, msg}
+	}
+	return errs
+}
+
+// As lets errors.As find the errors Parse returns as ParseErrors, or
+// the first of them as a ParseError.
+func (p ErrorList) As(target interface{}) bool {
+	switch t := target.(type) {
+	case *ParseErrors:
+		*t = p.ParseErrors()
+		return true
+	case *ParseError:
+		if len(p) == 0 {
+			return false
+		}
+		*t = p[:1].ParseErrors()[0]
+		return true
+	}
+	return false
+}
@@ -0,0 +1,663 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// DefaultWidth is the column past which Unparse continues a card on
+// X cards.
+const DefaultWidth = 72
+
+// cardIndent is the column a card's equation starts in, after the
+// card letter and a tab.
+const cardIndent = 8
+
+// An UnparseConfig controls the layout of Unparse's output.
+type UnparseConfig struct {
+	// Width is the column past which a card is continued on X
+	// cards.  Lines are only broken after an operator, so a line
+	// with nowhere to break may run past it.  If Width is 0,
+	// DefaultWidth is used.
+	Width int
+}
+
+// typeLetter is the inverse of typeIdent, returning the DYNAMO card
+// letter for a variable declaration's type.
+func typeLetter(d *VarDecl) string {
+	if d.Type == nil {
+		return "A"
+	}
+	switch d.Type.Name {
+	case "stock":
+		return "L"
+	case "initial":
+		return "N"
+	case "const":
+		return "C"
+	case "flow":
+		return "R"
+	case "table":
+		return "T"
+	case "supplementary":
+		return "S"
+	case "external":
+		return "X"
+	default:
+		return "A"
+	}
+}
+
+// exprString returns the canonical DYNAMO source representation of
+// e: identifiers are upper-cased and number literals are printed in
+// their shortest form.
+func exprString(e Expr) string {
+	var buf bytes.Buffer
+	writeExpr(&buf, e)
+	return buf.String()
+}
+
+func writeNumber(buf *bytes.Buffer, lit string) {
+	if v, err := strconv.ParseFloat(lit, 64); err == nil {
+		lit = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	buf.WriteString(lit)
+}
+
+// opString returns the DYNAMO spelling of the binary operator op.
+func opString(op token.Token) string {
+	for s, tok := range binaryOps {
+		if tok == op {
+			return s
+		}
+	}
+	return op.String()
+}
+
+func writeExpr(buf *bytes.Buffer, e Expr) {
+	switch x := e.(type) {
+	case nil:
+	case *BasicLit:
+		writeNumber(buf, x.Value)
+	case *Ident:
+		buf.WriteString(strings.ToUpper(x.Name))
+	case *RefExpr:
+		buf.WriteString(strings.ToUpper(x.Name))
+	case *SubscriptExpr:
+		buf.WriteString(strings.ToUpper(x.Base.Name))
+		buf.WriteByte('.')
+		buf.WriteString(x.Sub)
+	case *ParenExpr:
+		buf.WriteByte('(')
+		writeExpr(buf, x.X)
+		buf.WriteByte(')')
+	case *UnaryExpr:
+		buf.WriteString(x.Op.String())
+		writeExpr(buf, x.X)
+	case *BinaryExpr:
+		writeExpr(buf, x.X)
+		buf.WriteString(opString(x.Op))
+		writeExpr(buf, x.Y)
+	case *CallExpr:
+		writeExpr(buf, x.Fun)
+		buf.WriteByte('(')
+		for i, arg := range x.Args {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeExpr(buf, arg)
+		}
+		buf.WriteByte(')')
+	case *IndexExpr:
+		writeExpr(buf, x.X)
+		buf.WriteByte('[')
+		writeExpr(buf, x.Index)
+		buf.WriteByte(']')
+	case *UnitExpr:
+		writeExpr(buf, x.X)
+	case *IfExpr:
+		buf.WriteString("IF ")
+		writeExpr(buf, x.Cond)
+		buf.WriteString(" THEN ")
+		writeExpr(buf, x.Then)
+		buf.WriteString(" ELSE ")
+		writeExpr(buf, x.Else)
+	case *TableFwdExpr:
+		for i, y := range x.Ys {
+			if i > 0 {
+				buf.WriteByte('/')
+			}
+			writeExpr(buf, y)
+		}
+	case *KeyValueExpr:
+		writeExpr(buf, x.Key)
+		buf.WriteByte(':')
+		writeExpr(buf, x.Value)
+	case *CompositeLit:
+		buf.WriteByte('{')
+		for i, elt := range x.Elts {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeExpr(buf, elt)
+		}
+		buf.WriteByte('}')
+	default:
+		fmt.Fprintf(buf, "%v", e)
+	}
+}
+
+// isBreak returns true if a long card may be continued on the next
+// line after src[i].  Lines are only broken after operators, and
+// never inside the exponent of a number like 1e-07 or inside units.
+func isBreak(src string, i int) bool {
+	if strings.IndexByte("+-*/,(", src[i]) < 0 {
+		return false
+	}
+	if strings.LastIndex(src[:i], "{") > strings.LastIndex(src[:i], "}") {
+		return false
+	}
+	return i == 0 || (src[i-1] != 'e' && src[i-1] != 'E')
+}
+
+// writeCard writes a single card, continuing it on as many X cards as
+// necessary to keep lines within width columns.
+func writeCard(buf *bytes.Buffer, width int, letter, eqn string) {
+	prefix := letter + "\t"
+	for cardIndent+len(eqn) > width {
+		split := -1
+		for i := width - cardIndent - 1; i > 0; i-- {
+			if isBreak(eqn, i) {
+				split = i + 1
+				break
+			}
+		}
+		if split < 0 {
+			break
+		}
+		buf.WriteString(prefix)
+		buf.WriteString(eqn[:split])
+		buf.WriteByte('\n')
+		eqn = eqn[split:]
+		prefix = "X\t"
+	}
+	buf.WriteString(prefix)
+	buf.WriteString(eqn)
+	buf.WriteByte('\n')
+}
+
+// tableYs returns the y values of a table, whether it was parsed from
+// a T card or built from (x, y) pairs.
+func tableYs(e Expr) (string, bool) {
+	switch t := stripUnits(e).(type) {
+	case *TableFwdExpr:
+		return exprString(t), true
+	case *TableExpr:
+		ys := make([]string, 0, len(t.Pairs))
+		for _, p := range t.Pairs {
+			ys = append(ys, exprString(p.Y))
+		}
+		return strings.Join(ys, "/"), true
+	}
+	return "", false
+}
+
+// writeComment writes the comments in g, one per line, with NOTE
+// cards canonically spelt.
+func writeComment(buf *bytes.Buffer, g *CommentGroup) {
+	for _, c := range g.List {
+		text := strings.TrimRightFunc(c.Text, unicode.IsSpace)
+		if len(text) >= 4 && strings.ToUpper(text[:4]) == "NOTE" {
+			text = "NOTE"
+			if rest := strings.TrimSpace(c.Text[4:]); rest != "" {
+				text += "\t" + rest
+			}
+		}
+		buf.WriteString(text)
+		buf.WriteByte('\n')
+	}
+}
+
+// isHeader returns true if g is the title card or a section header.
+func isHeader(g *CommentGroup) bool {
+	return strings.HasPrefix(g.List[0].Text, "*")
+}
+
+// lastPos returns the position of the last token in e.  Token
+// positions, unlike those of the nodes built from them, are on the
+// line the token is on.
+func lastPos(e Expr) (pos token.Pos) {
+	Inspect(e, func(n Node) bool {
+		p := token.NoPos
+		switch x := n.(type) {
+		case *Ident:
+			p = x.NamePos
+		case *BasicLit:
+			p = x.ValuePos
+		case *ParenExpr:
+			p = x.Rparen
+		case *CallExpr:
+			p = x.Rparen
+		}
+		if p > pos {
+			pos = p
+		}
+		return true
+	})
+	return
+}
+
+// Unparse returns DYNAMO source for f, which may have been parsed or
+// built with a ModelBuilder.  The timespec is written on the model's
+// SPEC card if it had one, and otherwise as TIME, LENGTH, DT and
+// SAVPER constants.  Stocks built from an initial value and net flow
+// become an L and N card pair.  PRINT and PLOT cards keep their
+// names, but not their symbols or scales.  Comments
+// are written above the card they preceded, and those that didn't
+// document it are set off by a blank line.  Parsing the result
+// yields an equivalent File.
+func Unparse(f *File) (string, error) {
+	return new(UnparseConfig).Unparse(f)
+}
+
+// Unparse is like the Unparse function, but lays cards out as
+// specified by c.
+func (c *UnparseConfig) Unparse(f *File) (string, error) {
+	var buf bytes.Buffer
+	if err := c.Fprint(&buf, nil, f); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Fprint writes the DYNAMO source for f to w, as Unparse does.  If
+// fset, the file set f was parsed into, isn't nil, the blank lines
+// between cards and comments in the original source are kept, with
+// runs of them collapsed into one.  Nothing is written if f can't be
+// printed.
+func Fprint(w io.Writer, fset *token.FileSet, f *File) error {
+	return new(UnparseConfig).Fprint(w, fset, f)
+}
+
+// Fprint is like the Fprint function, but lays cards out as
+// specified by c.
+func (c *UnparseConfig) Fprint(w io.Writer, fset *token.FileSet, f *File) error {
+	width := c.Width
+	if width == 0 {
+		width = DefaultWidth
+	}
+
+	var buf bytes.Buffer
+	if f.Doc != nil {
+		writeComment(&buf, f.Doc)
+	} else {
+		buf.WriteString("*\n")
+	}
+
+	// space writes a blank line if there was one in the source
+	// between the last card or comment written, which ended on
+	// line last, and the one starting at pos.
+	last := 0
+	space := func(pos, end token.Pos) {
+		if fset == nil || !pos.IsValid() {
+			return
+		}
+		line := fset.Position(pos).Line
+		if last > 0 && line > last+1 && !bytes.HasSuffix(buf.Bytes(), []byte("\n\n")) {
+			buf.WriteByte('\n')
+		}
+		last = fset.Position(end).Line
+	}
+	if f.Doc != nil {
+		space(f.Doc.Pos(), f.Doc.End())
+	}
+
+	// flush writes the comments before pos, or all those left if
+	// pos is NoPos.  doc is the documentation of the card at pos.
+	comments := f.Comments
+	flush := func(pos token.Pos, doc *CommentGroup) {
+		for len(comments) > 0 && (pos == token.NoPos || comments[0].Pos() < pos) {
+			g := comments[0]
+			comments = comments[1:]
+			if g == f.Doc {
+				continue
+			}
+			space(g.Pos(), g.End())
+			writeComment(&buf, g)
+			if g != doc && !isHeader(g) {
+				buf.WriteByte('\n')
+			}
+		}
+	}
+
+	if len(f.Decls) > 1 {
+		return fmt.Errorf("can't unparse %d models into one deck", len(f.Decls))
+	}
+	for _, mac := range f.Macros {
+		if mac.Macro.IsValid() {
+			flush(mac.Macro, mac.Doc)
+			space(mac.Macro, mac.Mend)
+		}
+		if err := writeMacro(&buf, width, mac); err != nil {
+			return err
+		}
+	}
+	for _, d := range f.Decls {
+		md, ok := d.(*ModelDecl)
+		if !ok {
+			return fmt.Errorf("can't unparse %T", d)
+		}
+		// once reordered, as by SortEquations, cards are written
+		// with their documentation but without the comments and
+		// blank lines that were around them
+		reordered := !inSourceOrder(md)
+		var timespec *AssignStmt
+		hasSpec := false
+		for _, s := range md.Body.List {
+			if out, ok := s.(*OutputStmt); ok {
+				if !reordered && out.Card.IsValid() {
+					flush(out.Card, nil)
+					space(out.Card, out.End())
+				}
+				writeCard(&buf, width, out.Kind, outputNames(out))
+				continue
+			}
+			if spec, ok := s.(*SpecStmt); ok {
+				if hasSpec {
+					// the first gives the whole timespec
+					continue
+				}
+				hasSpec = true
+				params, err := specParamsOf(md, spec)
+				if err != nil {
+					return err
+				}
+				if !reordered && spec.Spec.IsValid() {
+					flush(spec.Spec, nil)
+					space(spec.Spec, spec.End())
+				}
+				writeCard(&buf, width, "SPEC", params)
+				continue
+			}
+			assign, ok := s.(*AssignStmt)
+			if !ok {
+				return fmt.Errorf("can't unparse %T", s)
+			}
+			if assign.Lhs.Name.Name == "timespec" {
+				timespec = assign
+				continue
+			}
+			if reordered {
+				if assign.Lhs.Doc != nil {
+					writeComment(&buf, assign.Lhs.Doc)
+				}
+			} else if ty := assign.Lhs.Type; ty != nil && ty.Pos().IsValid() {
+				flush(ty.Pos(), assign.Lhs.Doc)
+				space(ty.Pos(), lastPos(assign.Rhs))
+			}
+			if err := unparseAssign(&buf, width, assign); err != nil {
+				return err
+			}
+		}
+		if !reordered {
+			flush(token.NoPos, nil)
+		}
+		if timespec == nil || hasSpec {
+			continue
+		}
+		ts, err := md.Timespec()
+		if err != nil {
+			return err
+		}
+		if ts.Start != 0 {
+			writeCard(&buf, width, "C", "TIME="+exprString(floatLit(ts.Start)))
+		}
+		writeCard(&buf, width, "C", "LENGTH="+exprString(floatLit(ts.End)))
+		writeCard(&buf, width, "C", "DT="+exprString(floatLit(ts.DT)))
+		writeCard(&buf, width, "C", "SAVPER="+exprString(floatLit(ts.SaveStep)))
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// specParamsOf returns the parameters of the SPEC card spec in md,
+// as written on the card, with the values md's timespec has now.  The
+// timespec's TIME, if not 0, LENGTH, DT and SAVPER follow any the
+// card didn't have.
+func specParamsOf(md *ModelDecl, spec *SpecStmt) (string, error) {
+	ts, err := md.Timespec()
+	if err != nil {
+		return "", err
+	}
+	vals := map[string]float64{
+		"TIME":   ts.Start,
+		"LENGTH": ts.End,
+		"DT":     ts.DT,
+		"SAVPER": ts.SaveStep,
+	}
+	var params []string
+	seen := map[string]bool{}
+	for _, e := range spec.Elts {
+		k, v, err := kvConvert(e)
+		if err != nil {
+			return "", err
+		}
+		k = strings.ToUpper(k)
+		seen[k] = true
+		if val, ok := vals[k]; ok {
+			v = floatLit(val)
+		}
+		params = append(params, k+"="+exprString(v))
+	}
+	for _, k := range []string{"TIME", "LENGTH", "DT", "SAVPER"} {
+		if seen[k] || (k == "TIME" && ts.Start == 0) {
+			continue
+		}
+		params = append(params, k+"="+exprString(floatLit(vals[k])))
+	}
+	return strings.Join(params, "/"), nil
+}
+
+// A FormatOption changes how Format lays out a model.
+type FormatOption func(*formatConfig)
+
+type formatConfig struct {
+	sort  bool // sort the equations with SortEquations
+	width int  // the card width; DefaultWidth if 0
+}
+
+// WithSortedEquations makes Format put the equations in the order
+// given by SortEquations.  Only the comments documenting a card are
+// kept, as the others no longer sit by the cards they were about.
+func WithSortedEquations(sort bool) FormatOption {
+	return func(c *formatConfig) {
+		c.sort = sort
+	}
+}
+
+// WithWidth makes Format continue cards on X cards past width
+// columns, rather than DefaultWidth.
+func WithWidth(width int) FormatOption {
+	return func(c *formatConfig) {
+		c.width = width
+	}
+}
+
+// Format returns src, which must be a valid model, in canonical
+// form: one card per line with upper case type letters and names,
+// equations without spaces, tables as their y values separated by
+// '/', and the timespec constants last.  NOTE cards, other comments
+// and single blank lines are kept.  Formatting canonical source
+// doesn't change it.
+func Format(src []byte, opts ...FormatOption) ([]byte, error) {
+	var c formatConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, string(src))
+	if err != nil {
+		return nil, err
+	}
+	if c.sort {
+		for _, d := range f.Decls {
+			if m, ok := d.(*ModelDecl); ok {
+				if err := SortEquations(m); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	uc := &UnparseConfig{Width: c.width}
+	if err := uc.Fprint(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inSourceOrder reports whether the cards of m with positions are in
+// the order they were parsed in.
+func inSourceOrder(m *ModelDecl) bool {
+	last := token.NoPos
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || !assign.Lhs.Type.Pos().IsValid() {
+			continue
+		}
+		pos := assign.Lhs.Type.Pos()
+		if pos < last {
+			return false
+		}
+		last = pos
+	}
+	return true
+}
+
+func unparseAssign(buf *bytes.Buffer, width int, assign *AssignStmt) error {
+	letter := typeLetter(assign.Lhs)
+	name := strings.ToUpper(assign.Lhs.Name.Name)
+
+	switch letter {
+	case "T":
+		ys, ok := tableYs(assign.Rhs)
+		if !ok {
+			return fmt.Errorf("table %s is %T, not a table", name, assign.Rhs)
+		}
+		writeCard(buf, width, letter, name+"="+ys+unitsString(assign.Lhs))
+		return nil
+	case "L":
+		cl, ok := assign.Rhs.(*CompositeLit)
+		if !ok {
+			break
+		}
+		level, initial, err := stockEqns(name, cl)
+		if err != nil {
+			return err
+		}
+		writeCard(buf, width, "L", name+".K="+level+unitsString(assign.Lhs))
+		writeCard(buf, width, "N", name+"="+initial+unitsString(assign.Lhs))
+		return nil
+	}
+
+	writeCard(buf, width, letter, lhsString(assign.Lhs)+"="+exprString(assign.Rhs)+unitsString(assign.Lhs))
+	return nil
+}
+
+// outputNames returns the names on the PRINT or PLOT card out,
+// separated by commas.
+func outputNames(out *OutputStmt) string {
+	names := make([]string, len(out.Names))
+	for i, id := range out.Names {
+		names[i] = strings.ToUpper(id.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// stockEqns returns the equations of the L and N cards for the stock
+// name built by a ModelBuilder from its initial value and flows, cl.
+func stockEqns(name string, cl *CompositeLit) (level, initial string, err error) {
+	var initials, netflow []string
+	for _, e := range cl.Elts {
+		k, v, err := kvConvert(e)
+		if err != nil {
+			return "", "", fmt.Errorf("stock %s: %s", name, err)
+		}
+		switch k {
+		case "initial":
+			initials = append(initials, exprString(v))
+		case "inflow", "biflow":
+			netflow = append(netflow, "+"+exprString(v))
+		case "outflow":
+			netflow = append(netflow, "-("+exprString(v)+")")
+		}
+	}
+	if len(initials) != 1 || len(netflow) == 0 {
+		return "", "", fmt.Errorf("stock %s needs one initial value and a flow", name)
+	}
+	level = fmt.Sprintf("%s.J+(DT)*(%s)", name, strings.TrimPrefix(strings.Join(netflow, ""), "+"))
+	return level, initials[0], nil
+}
+
+// unitsText returns the units of d as written, or "" if d has none.
+func unitsText(d *VarDecl) string {
+	switch u := d.Units.(type) {
+	case nil:
+		return ""
+	case *BasicLit:
+		if u.Kind == token.STRING {
+			return u.Value
+		}
+	}
+	return exprString(d.Units)
+}
+
+// unitsString returns the unit annotation for d, with a leading
+// space, or "" if d has no units.
+func unitsString(d *VarDecl) string {
+	if d.Units == nil {
+		return ""
+	}
+	return " {" + unitsText(d) + "}"
+}
+
+// writeMacro writes the MACRO card declaring mac, its equations and
+// the MEND card ending it.
+func writeMacro(buf *bytes.Buffer, width int, mac *MacroDecl) error {
+	params := make([]string, len(mac.Params))
+	for i, p := range mac.Params {
+		params[i] = strings.ToUpper(p.Name)
+	}
+	fmt.Fprintf(buf, "MACRO\t%s(%s)\n", strings.ToUpper(mac.Name.Name), strings.Join(params, ","))
+	for _, s := range mac.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			return fmt.Errorf("can't unparse %T in macro %s", s, mac.Name.Name)
+		}
+		if err := unparseAssign(buf, width, assign); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("MEND\n")
+	return nil
+}
+
+// lhsString returns the upper-cased name declared by d, with its time
+// subscript if it has one.
+func lhsString(d *VarDecl) string {
+	name := strings.ToUpper(d.Name.Name)
+	if d.Sub != "" {
+		name += "." + d.Sub
+	}
+	return name
+}
@@ -0,0 +1,236 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"go/token"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// roundTripSrcs are models exercising each kind of card, for the
+// printer's round trip tests.
+var roundTripSrcs = map[string]string{
+	"helloWorld": helloWorld,
+	"tables": `*
+NOTE	tables, specs and long equations
+SPEC	DT=.25/LENGTH=20/SAVPER=1
+L	STOCK.K=STOCK.J+(DT)(INFLOW.JK-OUTFLOW.JK)
+N	STOCK=TABHL(INITT,START,0,2,1)
+T	INITT=10/20/-30
+C	START=1.5
+R	INFLOW.KL=CLIP(STEP(5,2)+RAMP(.5,4)+PULSE(10,3,5),0,TIME.K,10)*SMOOTH(STOCK.K,3)/STOCK.K
+R	OUTFLOW.KL=IF STOCK.K>100 THEN STOCK.K/DELAY3(INFLOW.JK,4) ELSE MAX(0,MIN(STOCK.K,1))
+A	AVERYLONGNAME.K=STOCK.K*1.0001+STOCK.K*1.0002+STOCK.K*1.0003+STOCK.K*1.0004+STOCK.K*1.0005+STOCK.K*1.0006
+S	RATIO.K=INFLOW.JK/OUTFLOW.JK
+X	EXT=2
+PLOT	STOCK=S(0,100),RATIO=R/INFLOW
+`,
+}
+
+func TestUnparseRoundTrip(t *testing.T) {
+	srcs := map[string]string{}
+	for name, src := range roundTripSrcs {
+		srcs[name] = src
+	}
+	logistic, err := ioutil.ReadFile("../models/logistic.dynamo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs["logistic"] = string(logistic)
+
+	for name, src := range srcs {
+		f, _ := parseSrc(t, src)
+		once, err := Unparse(f)
+		if err != nil {
+			t.Errorf("%s: Unparse: %s", name, err)
+			continue
+		}
+		g, _ := parseSrc(t, once)
+		if changes := Diff(f, g); len(changes) > 0 {
+			t.Errorf("%s: parse(unparse(f)) differs from f: %v", name, changes)
+		}
+		twice, err := Unparse(g)
+		if err != nil {
+			t.Errorf("%s: Unparse: %s", name, err)
+			continue
+		}
+		if twice != once {
+			t.Errorf("%s: unparse isn't idempotent:\n%s\nthen:\n%s", name, once, twice)
+		}
+	}
+}
+
+func TestUnparseSpec(t *testing.T) {
+	const src = `* spec
+L	S.K=S.J+(DT)(IN.JK)
+N	S=1
+R	IN.KL=S.K*.1
+SPEC	DT=.5/LENGTH=10/PLTPER=2
+PRINT	S
+`
+	f, _ := parseSrc(t, src)
+	once, err := Unparse(f)
+	if err != nil {
+		t.Fatalf("Unparse: %s", err)
+	}
+	if !strings.Contains(once, "SPEC\tDT=0.5/LENGTH=10/PLTPER=2/SAVPER=2\n") {
+		t.Errorf("SPEC card not kept:\n%s", once)
+	}
+	if strings.Contains(once, "\nC\t") {
+		t.Errorf("timespec written as constants too:\n%s", once)
+	}
+	g, _ := parseSrc(t, once)
+	if changes := Diff(f, g); len(changes) > 0 {
+		t.Errorf("parse(unparse(f)) differs from f: %v", changes)
+	}
+
+	md := f.GetModel("main")
+	ts, err := md.Timespec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.End = 20
+	md.SetTimespec(ts)
+	out, err := Unparse(f)
+	if err != nil {
+		t.Fatalf("Unparse: %s", err)
+	}
+	if !strings.Contains(out, "SPEC\tDT=0.5/LENGTH=20/PLTPER=2/SAVPER=2\n") {
+		t.Errorf("SPEC card doesn't have the new LENGTH:\n%s", out)
+	}
+}
+
+func TestUnparseBuilt(t *testing.T) {
+	b := NewModel("main")
+	for _, err := range []error{
+		b.AddStock("S", expr(t, "10"), expr(t, "IN")),
+		b.AddFlow("IN", expr(t, "S*K")),
+		b.AddConst("K", .1),
+		b.AddTable("T", []float64{0, 1}, []float64{2, 3}),
+		b.AddAux("A", expr(t, "TABHL(T,S/100,0,1,1)")),
+		b.AddConst("LENGTH", 5),
+		b.AddConst("DT", 1),
+		b.AddConst("SAVPER", 1),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	built, err := b.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := Unparse(built)
+	if err != nil {
+		t.Fatalf("Unparse: %s", err)
+	}
+	parsed, _ := parseSrc(t, src)
+	want, err := Simulate(built, SimulateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Simulate(parsed, SimulateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, vals := range want.Vars {
+		for i, v := range vals {
+			if got.Vars[name][i] != v {
+				t.Errorf("%s at %g: got %g, want %g from:\n%s", name, want.Time[i], got.Vars[name][i], v, src)
+				break
+			}
+		}
+	}
+}
+
+func TestFormatWidth(t *testing.T) {
+	const src = `* wrap
+A	X.K=A.K+B.K+C.K+D.K+E.K+F.K+G.K+H.K
+A	A.K=1
+A	B.K=1
+A	C.K=1
+A	D.K=1
+A	E.K=1
+A	F.K=1
+A	G.K=1
+A	H.K=1
+C	LENGTH=1
+C	DT=1
+C	SAVPER=1
+`
+	tests := []struct {
+		width int
+		cards string // X's equation, a line per card
+	}{
+		{72, "A\tX.K=A.K+B.K+C.K+D.K+E.K+F.K+G.K+H.K"},
+		{30, "A\tX.K=A.K+B.K+C.K+D.K+\nX\tE.K+F.K+G.K+H.K"},
+		{20, "A\tX.K=A.K+B.K+\nX\tC.K+D.K+E.K+\nX\tF.K+G.K+H.K"},
+	}
+	f, _ := parseSrc(t, src)
+	want := equations(f)
+	for _, test := range tests {
+		out, err := Format([]byte(src), WithWidth(test.width))
+		if err != nil {
+			t.Fatalf("%d: Format: %s", test.width, err)
+		}
+		if !strings.Contains(string(out), "\n"+test.cards+"\nA\tA.K=1\n") {
+			t.Errorf("%d: want cards\n%s\ngot\n%s", test.width, test.cards, out)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			// the card letter and tab take up 8 columns
+			if strings.Contains(line, "\t") && len(line)+6 > test.width {
+				t.Errorf("%d: %q is too wide", test.width, line)
+			}
+		}
+		fset := token.NewFileSet()
+		g, err := Parse(fset.AddFile("", fset.Base(), len(out)), fset, string(out))
+		if err != nil {
+			t.Fatalf("%d: Parse: %s", test.width, err)
+		}
+		if got := equations(g); !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: got equations %v, want %v", test.width, got, want)
+		}
+	}
+}
+
+func TestFormatIdempotent(t *testing.T) {
+	for name, src := range roundTripSrcs {
+		once, err := Format([]byte(src))
+		if err != nil {
+			t.Errorf("%s: Format: %s", name, err)
+			continue
+		}
+		twice, err := Format(once)
+		if err != nil {
+			t.Errorf("%s: Format of formatted source: %s", name, err)
+			continue
+		}
+		if string(twice) != string(once) {
+			t.Errorf("%s: Format isn't idempotent:\n%s\nthen:\n%s", name, once, twice)
+		}
+	}
+}
+
+func TestFprint(t *testing.T) {
+	f, fset := parseSrc(t, helloWorld)
+	var buf bytes.Buffer
+	if err := Fprint(&buf, fset, f); err != nil {
+		t.Fatalf("Fprint: %s", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"NOTE\tPopulation Sector\n", "L\tPOP.K=POP.J+(DT)*(B.JK-D.JK)\n", "N\tPOP=POPN\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+	g, _ := parseSrc(t, out)
+	if changes := Diff(f, g); len(changes) > 0 {
+		t.Errorf("parse(Fprint(f)) differs from f: %v", changes)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxPathLen is the most variables a path ReachabilityAnalysis
+// reports may pass through, so that the search of a densely
+// connected model ends.
+const maxPathLen = 16
+
+// ReachabilityAnalysis returns the paths by which the variable from
+// influences the variable to in the model named main in f: each a
+// chain of upper-cased variable names, from first and to last, each
+// used in the equation of the next.  The paths are those of the
+// graph BuildDepGraph returns, found by a depth-first search that
+// visits no variable twice and gives up on paths through more than
+// 16 variables, in the order the variables are declared.  If to
+// doesn't depend on from, there are none.
+func ReachabilityAnalysis(f *File, from, to string) ([][]string, error) {
+	main := f.GetModel("main")
+	if main == nil || main.Body == nil {
+		return nil, fmt.Errorf("no model named main")
+	}
+	g := BuildDepGraph(main)
+	declared := map[string]bool{}
+	for _, n := range g.Nodes {
+		declared[n.Name] = true
+	}
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	for _, n := range []string{from, to} {
+		if !declared[n] {
+			return nil, fmt.Errorf("no variable %s", n)
+		}
+	}
+	uses := map[string][]string{}
+	for _, e := range g.Edges {
+		uses[e[0]] = append(uses[e[0]], e[1])
+	}
+
+	paths := [][]string{}
+	var path []string
+	onPath := map[string]bool{}
+	var visit func(n string)
+	visit = func(n string) {
+		path = append(path, n)
+		onPath[n] = true
+		defer func() {
+			path = path[:len(path)-1]
+			onPath[n] = false
+		}()
+		if n == to {
+			paths = append(paths, append([]string(nil), path...))
+			return
+		}
+		if len(path) == maxPathLen {
+			return
+		}
+		for _, next := range uses[n] {
+			if !onPath[next] {
+				visit(next)
+			}
+		}
+	}
+	visit(from)
+	return paths, nil
+}
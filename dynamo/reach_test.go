@@ -0,0 +1,75 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReachabilityAnalysis(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	tests := []struct {
+		from, to string
+		paths    string // the paths, one per line
+	}{
+		{"NB", "POP", "NB B POP"},
+		{"nb", "pop", "NB B POP"},
+		{"POPN", "D", "POPN POP D"},
+		{"NB", "D", "NB B POP D"},
+		{"POP", "POP", "POP"},
+		{"NB", "ND", ""},
+		{"POP", "NB", ""},
+	}
+	for _, test := range tests {
+		paths, err := ReachabilityAnalysis(f, test.from, test.to)
+		if err != nil {
+			t.Errorf("%s to %s: %s", test.from, test.to, err)
+			continue
+		}
+		if paths == nil {
+			t.Errorf("%s to %s: got nil, want an empty slice", test.from, test.to)
+		}
+		var got []string
+		for _, p := range paths {
+			got = append(got, strings.Join(p, " "))
+		}
+		if strings.Join(got, "\n") != test.paths {
+			t.Errorf("%s to %s: got paths %q, want %q", test.from, test.to, got, test.paths)
+		}
+	}
+
+	for _, test := range []struct{ from, to, err string }{
+		{"BOGUS", "POP", "no variable BOGUS"},
+		{"POP", "bogus", "no variable BOGUS"},
+	} {
+		if _, err := ReachabilityAnalysis(f, test.from, test.to); err == nil || err.Error() != test.err {
+			t.Errorf("%s to %s: got error %v, want %s", test.from, test.to, err, test.err)
+		}
+	}
+	f, _ = parseSrc(t, "* macros\nMACRO M(X)\nA M.K=X\nMEND\n")
+	if _, err := ReachabilityAnalysis(f, "X", "M"); err == nil {
+		t.Errorf("no main model: expected an error")
+	}
+
+	// a chain of 20 auxiliaries is longer than any path reported
+	var buf bytes.Buffer
+	buf.WriteString("* chain\nA X1.K=1\n")
+	for i := 2; i <= 20; i++ {
+		fmt.Fprintf(&buf, "A X%d.K=X%d.K\n", i, i-1)
+	}
+	f, _ = parseSrc(t, buf.String())
+	for _, test := range []struct {
+		to    string
+		paths int
+	}{{"X16", 1}, {"X17", 0}} {
+		paths, err := ReachabilityAnalysis(f, "X1", test.to)
+		if err != nil || len(paths) != test.paths {
+			t.Errorf("X1 to %s: got %d paths (%v), want %d", test.to, len(paths), err, test.paths)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// declared reports whether m declares a variable called name, which
+// must be upper-cased.
+func declared(m *ModelDecl, name string) bool {
+	for _, s := range m.Body.List {
+		if assign, ok := s.(*AssignStmt); ok && assign.Lhs.Type != nil &&
+			strings.ToUpper(assign.Lhs.Name.Name) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Rename returns a copy of f in which the variable oldName of the
+// main model is called newName, both in its declarations and in
+// every reference to it.  Names are compared upper-cased.  It is an
+// error if oldName isn't declared or newName already is.  f itself
+// is unchanged.  Macro bodies, whose names are their own, are left
+// alone.
+func Rename(f *File, oldName, newName string) (*File, error) {
+	oldName, newName = strings.ToUpper(oldName), strings.ToUpper(newName)
+	if newName == "" {
+		return nil, fmt.Errorf("empty variable name")
+	}
+
+	renamed := *f
+	renamed.Decls = make([]Decl, len(f.Decls))
+	copy(renamed.Decls, f.Decls)
+	m := f.GetModel("main")
+	if m == nil || m.Body == nil {
+		return &renamed, nil
+	}
+	if !declared(m, oldName) {
+		return nil, fmt.Errorf("%s isn't declared", oldName)
+	}
+	if declared(m, newName) {
+		return nil, fmt.Errorf("%s is already declared", newName)
+	}
+
+	// every identifier is copied, not just those renamed,
+	// so that resolving the copy leaves f's alone
+	rename := func(id *Ident) *Ident {
+		c := *id
+		if strings.ToUpper(id.Name) == oldName {
+			c.Name = newName
+		}
+		return &c
+	}
+	fn := func(e Expr) (Expr, error) {
+		switch x := e.(type) {
+		case *Ident:
+			return rename(x), nil
+		case *RefExpr:
+			return &RefExpr{*rename(&x.Ident)}, nil
+		case *SubscriptExpr:
+			return &SubscriptExpr{rename(x.Base), x.Sub}, nil
+		}
+		return nil, nil
+	}
+
+	rm := *m
+	rm.Body = &BlockStmt{Lbrace: m.Body.Lbrace, Rbrace: m.Body.Rbrace}
+	for _, s := range m.Body.List {
+		if out, ok := s.(*OutputStmt); ok {
+			ro := *out
+			ro.Names = make([]*Ident, len(out.Names))
+			for j, id := range out.Names {
+				ro.Names[j] = rename(id)
+			}
+			rm.Body.List = append(rm.Body.List, &ro)
+			continue
+		}
+		assign, ok := s.(*AssignStmt)
+		if !ok {
+			rm.Body.List = append(rm.Body.List, s)
+			continue
+		}
+		rhs, err := mapExpr(assign.Rhs, fn)
+		if err != nil {
+			return nil, err
+		}
+		lhs := *assign.Lhs
+		lhs.Name = rename(assign.Lhs.Name)
+		ra := *assign
+		ra.Lhs, ra.Rhs = &lhs, rhs
+		rm.Body.List = append(rm.Body.List, &ra)
+	}
+
+	// the copy's names were checked for redeclarations
+	// above, so there are no errors to position
+	var errs ErrorVector
+	renamed.Unresolved = resolveModel(&rm, token.NewFileSet(), &errs)
+	for i, d := range renamed.Decls {
+		if d == Decl(m) {
+			renamed.Decls[i] = &rm
+		}
+	}
+	return &renamed, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"reflect"
+	"testing"
+)
+
+// renameModel references POP in its own equations, in those of other
+// variables and as a function argument, and has a constant whose
+// name starts with POP.
+const renameModel = `* rename
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=POPN
+C	POPN=100
+R	B.KL=(NB)(MAX(POP.K,0))
+C	NB=.04
+A	PC.K=POP.K/1000
+C	LENGTH=2
+C	DT=1
+C	SAVPER=1
+`
+
+func TestRename(t *testing.T) {
+	f, _ := parseSrc(t, renameModel)
+	before := equations(f)
+	renamed, err := Rename(f, "pop", "People")
+	if err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	if got := equations(f); !reflect.DeepEqual(got, before) {
+		t.Errorf("Rename changed f:\n%v\nwas\n%v", got, before)
+	}
+
+	eqns := equations(renamed)
+	want := map[string]string{
+		"PEOPLE": "L PEOPLE.K=PEOPLE.J+(DT)*(B.JK)\nN PEOPLE=POPN",
+		"POPN":   "C POPN=100",
+		"B":      "R B.KL=(NB)*(MAX(PEOPLE.K,0))",
+		"PC":     "A PC.K=PEOPLE.K/1000",
+	}
+	for n, w := range want {
+		if eqns[n] != w {
+			t.Errorf("%s: got %q, want %q", n, eqns[n], w)
+		}
+	}
+	if _, ok := eqns["POP"]; ok {
+		t.Errorf("POP is still declared")
+	}
+
+	// the renamed model runs as the original did
+	ts, err := Simulate(renamed, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	checkSeries(t, "PEOPLE", map[float64]float64{0: 100, 1: 104, 2: 108.16}, ts)
+
+	if _, err := Rename(f, "NOSUCH", "X"); err == nil {
+		t.Errorf("renaming an undeclared variable: expected an error")
+	}
+	if _, err := Rename(f, "POP", "NB"); err == nil {
+		t.Errorf("renaming to a declared variable: expected an error")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"go/token"
 	"strconv"
+	"strings"
 )
 
 type pkgBuilder struct {
@@ -168,3 +169,112 @@ func NewPackage(fset *token.FileSet, files map[string]*File, importer Importer,
 
 	return &Package{pkgName, pkgScope, imports, files}, p.GetError(Sorted)
 }
+
+// resolveModel collects the variables declared in m into a scope
+// keyed by upper-cased name, records it in m.Objects, and points the
+// identifiers in m's equations at the objects they refer to.  A
+// variable declared twice is reported to h, except that an N card
+// may give the initial value of the level of the same name; the
+// level's declaration is the object's Decl.  Function names aren't
+// resolved, and the identifiers that don't name a variable of m, like
+// TIME, are returned.
+func resolveModel(m *ModelDecl, fset *token.FileSet, h ErrorHandler) (unresolved []*Ident) {
+	m.Objects = NewScope(nil)
+	initials := map[string]bool{}
+	for _, s := range m.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Name.Name == "timespec" {
+			continue
+		}
+		d := assign.Lhs
+		name := strings.ToUpper(d.Name.Name)
+		obj := m.Objects.Lookup(name)
+		switch ty := d.Type.Name; {
+		case obj == nil:
+			obj = NewObj(Var, name)
+			if ty == "const" || ty == "external" {
+				obj.Kind = Con
+			}
+			obj.Decl = d
+			m.Objects.Insert(obj)
+		case ty == "initial" && !initials[name] && declType(obj) == "stock":
+		case ty == "stock" && declType(obj) == "initial":
+			obj.Decl = d
+		default:
+			prevDecl := ""
+			if pos := obj.Pos(); pos.IsValid() {
+				prevDecl = fmt.Sprintf("\n\tprevious declaration at %s", fset.Position(pos))
+			}
+			h.Error(fset.Position(d.Name.Pos()),
+				fmt.Sprintf("%s redeclared in this model%s", d.Name.Name, prevDecl))
+			continue
+		}
+		if d.Type.Name == "initial" {
+			initials[name] = true
+		}
+		d.Name.Obj = obj
+	}
+
+	var refs func(e Expr)
+	refs = func(e Expr) {
+		Inspect(e, func(n Node) bool {
+			switch x := n.(type) {
+			case *CallExpr:
+				for _, arg := range x.Args {
+					refs(arg)
+				}
+				return false
+			case *UnitExpr:
+				refs(x.X)
+				return false
+			case *KeyValueExpr:
+				// the parts of a stock built by a
+				// ModelBuilder
+				refs(x.Value)
+				return false
+			case *RefExpr:
+				n = &x.Ident
+			}
+			if id, ok := n.(*Ident); ok {
+				if id.Obj = m.Objects.Lookup(strings.ToUpper(id.Name)); id.Obj == nil {
+					unresolved = append(unresolved, id)
+				}
+			}
+			return true
+		})
+	}
+	for _, s := range m.Body.List {
+		switch x := s.(type) {
+		case *AssignStmt:
+			if x.Lhs.Name.Name != "timespec" {
+				refs(x.Rhs)
+			}
+		case *OutputStmt:
+			for _, id := range x.Names {
+				refs(id)
+			}
+		}
+	}
+	return
+}
+
+// declType returns the type of the variable obj was declared as.
+func declType(obj *Object) string {
+	if d, ok := obj.Decl.(*VarDecl); ok && d.Type != nil {
+		return d.Type.Name
+	}
+	return ""
+}
+
+// ResolveModel resolves the identifiers in m as Parse does, for
+// models built with a ModelBuilder or edited after parsing.  It
+// returns m's scope, and an ErrorList if a variable was declared
+// twice.  fset, the file set m was parsed into, may be nil.
+func ResolveModel(fset *token.FileSet, m *ModelDecl) (*Scope, error) {
+	if fset == nil {
+		fset = token.NewFileSet()
+	}
+	var errs ErrorVector
+	resolveModel(m, fset, &errs)
+	return m.Objects, errs.GetError(Sorted)
+}
@@ -0,0 +1,73 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"strings"
+	"testing"
+)
+
+func TestScope(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	m := f.Decls[0].(*ModelDecl)
+	if m.Objects == nil {
+		t.Fatalf("Parse didn't resolve main's scope")
+	}
+	tests := []struct {
+		name, decl string // decl is the declaring card's type
+		kind       ObjKind
+	}{
+		{"POP", "stock", Var},
+		{"B", "flow", Var},
+		{"NB", "const", Con},
+	}
+	for _, test := range tests {
+		obj := m.Objects.Lookup(test.name)
+		if obj == nil {
+			t.Errorf("%s: not in scope", test.name)
+			continue
+		}
+		if obj.Kind != test.kind || declType(obj) != test.decl {
+			t.Errorf("%s: got %s declared by %s, want %s declared by %s",
+				test.name, obj.Kind, declType(obj), test.kind, test.decl)
+		}
+	}
+	if obj := m.Objects.Lookup("BOGUS"); obj != nil {
+		t.Errorf("BOGUS: got %v, want it not in scope", obj)
+	}
+
+	// references point at their declarations
+	Inspect(m, func(n Node) bool {
+		if id, ok := n.(*Ident); ok && strings.ToUpper(id.Name) == "POP" && id.Obj != m.Objects.Lookup("POP") {
+			t.Errorf("%s at %d doesn't refer to POP's declaration", id.Name, id.Pos())
+		}
+		return true
+	})
+}
+
+func TestScopeDuplicates(t *testing.T) {
+	tests := []struct {
+		eqns string
+		err  string // or empty if there should be none
+	}{
+		{"L S.K=S.J+(DT)(R.JK)\nN S=1\nR R.KL=1", ""},
+		{"N S=1\nL S.K=S.J+(DT)(R.JK)\nR R.KL=1", ""},
+		{"C X=1\nC X=2", "X redeclared in this model\n\tprevious declaration at test.dyn:3:"},
+		{"A X.K=1\nC x=2", "x redeclared in this model"},
+		{"L S.K=S.J+(DT)(R.JK)\nN S=1\nN S=2\nR R.KL=1", "S redeclared in this model"},
+	}
+	for _, test := range tests {
+		src := "* dups\n" + "C DT=1\n" + test.eqns + "\n"
+		fset := token.NewFileSet()
+		_, err := Parse(fset.AddFile("test.dyn", fset.Base(), len(src)), fset, src)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error %s", test.eqns, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: got error %v, want %s", test.eqns, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// placeholders returns the names in braces in the path template
+// tmpl, upper-cased, in the order they appear.
+func placeholders(tmpl string) ([]string, error) {
+	var names []string
+	for {
+		i := strings.Index(tmpl, "{")
+		if i < 0 {
+			return names, nil
+		}
+		j := strings.Index(tmpl[i:], "}")
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed { in %q", tmpl)
+		}
+		names = append(names, strings.ToUpper(tmpl[i+1:i+j]))
+		tmpl = tmpl[i+j+1:]
+	}
+}
+
+// RunPath returns the path the template tmpl gives a run: each
+// {NAME} in it is replaced by the value vals has for NAME, which is
+// upper-cased to look it up.
+func RunPath(tmpl string, vals map[string]float64) (string, error) {
+	names, err := placeholders(tmpl)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		v, ok := vals[name]
+		if !ok {
+			return "", fmt.Errorf("no value for {%s} in %q", name, tmpl)
+		}
+		i := strings.Index(tmpl, "{")
+		j := i + strings.Index(tmpl[i:], "}")
+		tmpl = tmpl[:i] + strconv.FormatFloat(v, 'g', -1, 64) + tmpl[j+1:]
+	}
+	return tmpl, nil
+}
+
+// runVals returns the values the placeholders of the i'th of runs
+// are replaced by: its constants, and its number from 1 as RUN.
+func runVals(runs []SensResult, i int) map[string]float64 {
+	vals := map[string]float64{"RUN": float64(i + 1)}
+	for name, v := range runs[i].Params {
+		vals[strings.ToUpper(name)] = v
+	}
+	return vals
+}
+
+// WriteRuns writes each of runs, the result of a Sweep or of a
+// MonteCarlo analysis, as CSV to its own file, named by the template
+// tmpl as RunPath does.  {RUN} is the run's number, from 1, and the
+// other placeholders are the constants the runs set.  With more than
+// one run, one of tmpl's placeholders must vary between them, so that
+// no run overwrites another's file.
+func WriteRuns(tmpl string, runs []SensResult) error {
+	names, err := placeholders(tmpl)
+	if err != nil {
+		return err
+	}
+	if len(runs) > 1 {
+		varies := false
+		for _, name := range names {
+			first := runVals(runs, 0)[name]
+			for i := range runs[1:] {
+				varies = varies || runVals(runs, i+1)[name] != first
+			}
+		}
+		if !varies {
+			return fmt.Errorf("%d runs, but %q has no placeholder that varies between them", len(runs), tmpl)
+		}
+	}
+	for i, run := range runs {
+		path, err := RunPath(tmpl, runVals(runs, i))
+		if err != nil {
+			return fmt.Errorf("run %d: %s", i+1, err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = run.TS.WriteCSV(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
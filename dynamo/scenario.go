@@ -0,0 +1,264 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A ScenarioManager runs a model under a number of scenarios, each
+// setting some of its constants, and compares their results.
+type ScenarioManager struct {
+	f         *File
+	scenarios []scenario // in the order added
+	results   map[string]TimeSeries
+}
+
+// A scenario is a named set of values for a model's constants.
+type scenario struct {
+	name   string
+	params map[string]float64 // by upper-cased name
+}
+
+// NewScenarioManager returns a ScenarioManager for the model named
+// main in f, which has no scenarios yet.
+func NewScenarioManager(f *File) *ScenarioManager {
+	return &ScenarioManager{f: f, results: map[string]TimeSeries{}}
+}
+
+// Add adds the scenario name, which gives the constants named by
+// params their values, and returns m so calls can be chained.  A
+// scenario with no params runs the model as it is, as a baseline.
+// Adding a scenario with the name of an earlier one replaces it.
+func (m *ScenarioManager) Add(name string, params map[string]float64) *ScenarioManager {
+	s := scenario{name, make(map[string]float64, len(params))}
+	for n, v := range params {
+		s.params[strings.ToUpper(n)] = v
+	}
+	for i := range m.scenarios {
+		if m.scenarios[i].name == name {
+			m.scenarios[i] = s
+			return m
+		}
+	}
+	m.scenarios = append(m.scenarios, s)
+	return m
+}
+
+// withParams returns a copy of f with the constants of its model
+// named main, from its C and X cards, set to params.
+func withParams(f *File, params map[string]float64) (*File, error) {
+	f = Clone(f)
+	main := f.GetModel("main")
+	if main == nil {
+		return nil, fmt.Errorf("no model named main")
+	}
+	set := map[string]bool{}
+	for _, s := range main.Body.List {
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil {
+			continue
+		}
+		if ty := assign.Lhs.Type.Name; ty != "const" && ty != "external" {
+			continue
+		}
+		n := strings.ToUpper(assign.Lhs.Name.Name)
+		if v, ok := params[n]; ok {
+			assign.Rhs = num(v)
+			set[n] = true
+		}
+	}
+	var missing []string
+	for n := range params {
+		if !set[n] {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		if len(missing) == 1 {
+			return nil, fmt.Errorf("%s isn't a constant", missing[0])
+		}
+		return nil, fmt.Errorf("%s aren't constants", strings.Join(missing, ", "))
+	}
+	return f, nil
+}
+
+// RunAll simulates each scenario, replacing the results of any
+// earlier run.  Scenarios run concurrently, at most one per CPU at
+// a time, and stop early if ctx is done.  The error returned is that
+// of the first scenario, in the order they were added, to fail; the
+// results of the others are kept.
+func (m *ScenarioManager) RunAll(ctx context.Context) error {
+	results := make([]TimeSeries, len(m.scenarios))
+	errs := make([]error, len(m.scenarios))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, s := range m.scenarios {
+		f, err := withParams(m.f, s.params)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, f *File) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if errs[i] = ctx.Err(); errs[i] != nil {
+				return
+			}
+			results[i], errs[i] = Simulate(f, SimulateOptions{TimeoutCtx: ctx})
+		}(i, f)
+	}
+	wg.Wait()
+
+	m.results = map[string]TimeSeries{}
+	var first error
+	for i, s := range m.scenarios {
+		if errs[i] != nil {
+			if first == nil {
+				first = fmt.Errorf("scenario %s: %s", s.name, errs[i])
+			}
+			continue
+		}
+		m.results[s.name] = results[i]
+	}
+	return first
+}
+
+// Results returns the results of the scenarios from the last call
+// of RunAll, by scenario name.
+func (m *ScenarioManager) Results() map[string]TimeSeries {
+	results := make(map[string]TimeSeries, len(m.results))
+	for name, ts := range m.results {
+		results[name] = ts
+	}
+	return results
+}
+
+// result returns the results of the scenario name, or an error if it
+// hasn't been run.
+func (m *ScenarioManager) result(name string) (TimeSeries, error) {
+	ts, ok := m.results[name]
+	if !ok {
+		return ts, fmt.Errorf("no results for scenario %s", name)
+	}
+	return ts, nil
+}
+
+// sameTimes reports whether a and b are at the same times.
+func sameTimes(a, b TimeSeries) bool {
+	if len(a.Time) != len(b.Time) {
+		return false
+	}
+	for i, t := range a.Time {
+		if math.Abs(t-b.Time[i]) > 1e-9*math.Max(1, math.Abs(t)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare returns the difference between the results of scenario
+// and those of baseline: for each variable in both, its value in
+// scenario less its value in baseline, at each time.
+func (m *ScenarioManager) Compare(baseline, scenario string) (TimeSeries, error) {
+	var diff TimeSeries
+	base, err := m.result(baseline)
+	if err != nil {
+		return diff, err
+	}
+	ts, err := m.result(scenario)
+	if err != nil {
+		return diff, err
+	}
+	if !sameTimes(base, ts) {
+		return diff, fmt.Errorf("scenarios %s and %s aren't at the same times", baseline, scenario)
+	}
+	diff.Time = append([]float64(nil), ts.Time...)
+	diff.Vars = map[string][]float64{}
+	for name, vals := range ts.Vars {
+		bvals, ok := base.Vars[name]
+		if !ok {
+			continue
+		}
+		d := make([]float64, len(vals))
+		for i, v := range vals {
+			d[i] = v - bvals[i]
+		}
+		diff.Vars[name] = d
+	}
+	return diff, nil
+}
+
+// WriteComparisonCSV writes the results of every scenario to w as
+// CSV, side by side: a header row of time followed by a column for
+// each of vars in each scenario, named SCENARIO:VAR, then a row for
+// each time.  Scenarios are in the order they were added.  If vars
+// is empty, it is every variable, in sorted order.
+func (m *ScenarioManager) WriteComparisonCSV(w io.Writer, vars []string) error {
+	if len(m.scenarios) == 0 {
+		return fmt.Errorf("no scenarios")
+	}
+	var all []TimeSeries
+	for _, s := range m.scenarios {
+		ts, err := m.result(s.name)
+		if err != nil {
+			return err
+		}
+		if len(all) > 0 && !sameTimes(all[0], ts) {
+			return fmt.Errorf("scenarios %s and %s aren't at the same times", m.scenarios[0].name, s.name)
+		}
+		all = append(all, ts)
+	}
+	if len(vars) == 0 {
+		names, err := all[0].names()
+		if err != nil {
+			return err
+		}
+		vars = names
+	}
+
+	header := []string{"time"}
+	var cols [][]float64
+	for _, name := range vars {
+		for i, ts := range all {
+			vals, ok := ts.Vars[name]
+			if !ok {
+				vals, ok = ts.Vars[strings.ToUpper(name)]
+			}
+			if !ok {
+				return fmt.Errorf("scenario %s has no variable %s", m.scenarios[i].name, name)
+			}
+			header = append(header, m.scenarios[i].name+":"+name)
+			cols = append(cols, vals)
+		}
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	row := make([]string, len(cols)+1)
+	for i, t := range all[0].Time {
+		row[0] = formatValue(t)
+		for j, vals := range cols {
+			row[j+1] = formatValue(vals[i])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
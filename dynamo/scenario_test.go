@@ -0,0 +1,128 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// growth is a population with births and deaths, in proportion to
+// its size.
+const growth = `* growth
+L	POP.K=POP.J+(DT)(B.JK-D.JK)
+N	POP=100
+R	B.KL=(NB)(POP.K)
+R	D.KL=(ND)(POP.K)
+C	NB=.04
+C	ND=.01
+C	LENGTH=20
+C	DT=1
+C	SAVPER=1
+`
+
+func TestScenarioManager(t *testing.T) {
+	f, _ := parseSrc(t, growth)
+	m := NewScenarioManager(f).
+		Add("baseline", nil).
+		Add("boom", map[string]float64{"NB": .06}).
+		Add("bust", map[string]float64{"nb": .02, "ND": .03})
+	if err := m.RunAll(context.Background()); err != nil {
+		t.Fatalf("RunAll: %s", err)
+	}
+	results := m.Results()
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	end := func(name string) float64 {
+		pop := results[name].Vars["POP"]
+		return pop[len(pop)-1]
+	}
+	if !(end("boom") > end("baseline") && end("baseline") > end("bust")) {
+		t.Errorf("got POP %g, %g and %g at the end, want boom > baseline > bust",
+			end("boom"), end("baseline"), end("bust"))
+	}
+	// the population declines in the bust, as deaths outpace births
+	if end("bust") >= 100 {
+		t.Errorf("bust: got POP %g at the end, want less than 100", end("bust"))
+	}
+
+	for _, test := range []struct {
+		scenario string
+		sign     float64
+	}{
+		{"boom", 1},
+		{"bust", -1},
+	} {
+		diff, err := m.Compare("baseline", test.scenario)
+		if err != nil {
+			t.Fatalf("Compare: %s", err)
+		}
+		pop := diff.Vars["POP"]
+		if len(pop) != 21 || pop[0] != 0 {
+			t.Errorf("%s: got POP differences %v, want 21 starting at 0", test.scenario, pop)
+			continue
+		}
+		for i, d := range pop[1:] {
+			if d*test.sign <= 0 {
+				t.Errorf("%s: POP differs by %g at TIME %g, want the sign of %g", test.scenario, d, diff.Time[i+1], test.sign)
+				break
+			}
+		}
+		// the differences are the scenario less the baseline
+		if want := end(test.scenario) - end("baseline"); pop[20] != want {
+			t.Errorf("%s: got POP difference %g at the end, want %g", test.scenario, pop[20], want)
+		}
+	}
+	if _, err := m.Compare("baseline", "nonexistent"); err == nil {
+		t.Errorf("Compare of an unknown scenario: expected an error")
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteComparisonCSV(&buf, []string{"POP"}); err != nil {
+		t.Fatalf("WriteComparisonCSV: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 22 || lines[0] != "time,baseline:POP,boom:POP,bust:POP" || lines[1] != "0,100,100,100" {
+		t.Errorf("got CSV\n%s", buf.String())
+	}
+	if err := m.WriteComparisonCSV(&buf, []string{"BOGUS"}); err == nil {
+		t.Errorf("WriteComparisonCSV of an unknown variable: expected an error")
+	}
+}
+
+func TestScenarioManagerErrors(t *testing.T) {
+	f, _ := parseSrc(t, growth)
+
+	// a scenario setting something other than a constant fails,
+	// but the others are run
+	m := NewScenarioManager(f).
+		Add("baseline", nil).
+		Add("bad", map[string]float64{"POP": 1})
+	err := m.RunAll(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "scenario bad: POP isn't a constant") {
+		t.Errorf("got error %v, want one for bad", err)
+	}
+	if _, ok := m.Results()["baseline"]; !ok {
+		t.Errorf("no results for baseline")
+	}
+
+	// adding a scenario again replaces it
+	m.Add("bad", map[string]float64{"NB": .05})
+	if err := m.RunAll(context.Background()); err != nil {
+		t.Errorf("RunAll: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.RunAll(ctx); err == nil {
+		t.Errorf("canceled: expected an error")
+	}
+	if err := NewScenarioManager(f).WriteComparisonCSV(&bytes.Buffer{}, nil); err == nil {
+		t.Errorf("no scenarios: expected an error")
+	}
+}
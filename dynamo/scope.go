@@ -121,6 +121,8 @@ func (obj *Object) Pos() token.Pos {
 		if d.Name.Name == name {
 			return d.Name.Pos()
 		}
+	case *VarDecl:
+		return d.Name.Pos()
 	}
 	return token.NoPos
 }
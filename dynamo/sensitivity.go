@@ -0,0 +1,348 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/token"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SweepOptions control a parameter sweep.
+type SweepOptions struct {
+	// MaxRuns is the most simulations that are run; 10000 if
+	// zero.  Combinations past it are skipped.
+	MaxRuns int
+
+	// TimeoutCtx, if non-nil, stops the sweep with its error once
+	// it is done.
+	TimeoutCtx context.Context
+}
+
+// A SensResult is the result of one run of a parameter sweep.
+type SensResult struct {
+	Params map[string]float64 // the constants set, by upper-cased name
+	TS     TimeSeries
+}
+
+// FinalValues returns the value of each variable of r at the end of
+// its simulation.
+func (r SensResult) FinalValues() map[string]float64 {
+	vals := make(map[string]float64, len(r.TS.Vars))
+	for name, vs := range r.TS.Vars {
+		if len(vs) > 0 {
+			vals[name] = vs[len(vs)-1]
+		}
+	}
+	return vals
+}
+
+// SensitivityAnalysis parses the DYNAMO model src and simulates it
+// with every combination of the values given for its constants by
+// params, as Sweep does with the default options.
+func SensitivityAnalysis(src string, params map[string][]float64) ([]SensResult, error) {
+	fset := token.NewFileSet()
+	f, err := Parse(fset.AddFile("", fset.Base(), len(src)), fset, src)
+	if err != nil {
+		return nil, err
+	}
+	return Sweep(f, params, SweepOptions{})
+}
+
+// A combinations generates the combinations of a set of values one
+// at a time, like an odometer: the last name's values vary fastest.
+type combinations struct {
+	names []string
+	vals  [][]float64
+	index []int
+	done  bool
+}
+
+// next returns the next combination, or false once there are no
+// more.
+func (c *combinations) next() (map[string]float64, bool) {
+	if c.done {
+		return nil, false
+	}
+	m := make(map[string]float64, len(c.names))
+	for i, n := range c.names {
+		m[n] = c.vals[i][c.index[i]]
+	}
+	c.done = true
+	for i := len(c.index) - 1; i >= 0; i-- {
+		if c.index[i]++; c.index[i] < len(c.vals[i]) {
+			c.done = false
+			break
+		}
+		c.index[i] = 0
+	}
+	return m, true
+}
+
+// Sweep simulates the model named main in f once for each
+// combination of the values given for its constants by params, up to
+// the most runs allowed.  Combinations are taken in order of the
+// constants' upper-cased names, the last varying fastest, and
+// generated as they are run rather than all at once; the simulations
+// run in a pool of a goroutine per CPU.  The results are in the same
+// order.
+func Sweep(f *File, params map[string][]float64, opts SweepOptions) ([]SensResult, error) {
+	if len(params) == 0 {
+		return nil, fmt.Errorf("no parameters to vary")
+	}
+	if opts.MaxRuns <= 0 {
+		opts.MaxRuns = 10000
+	}
+	ctx := opts.TimeoutCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// the constants by upper-cased name, so that they're ordered
+	// whatever case they're given in
+	byName := make(map[string][]float64, len(params))
+	c := &combinations{}
+	for name, vals := range params {
+		n := strings.ToUpper(name)
+		if _, ok := byName[n]; ok {
+			return nil, fmt.Errorf("%s given more than once", n)
+		}
+		byName[n] = vals
+		c.names = append(c.names, n)
+	}
+	sort.Strings(c.names)
+	runs := 1
+	for _, name := range c.names {
+		vals := byName[name]
+		if len(vals) == 0 {
+			return nil, fmt.Errorf("no values for %s", name)
+		}
+		c.vals = append(c.vals, vals)
+		if runs < opts.MaxRuns {
+			runs *= len(vals)
+		}
+	}
+	c.index = make([]int, len(c.names))
+	if runs > opts.MaxRuns {
+		runs = opts.MaxRuns
+	}
+
+	type job struct {
+		i      int
+		params map[string]float64
+	}
+	results := make([]SensResult, runs)
+	errs := make([]error, runs)
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results[j.i].Params = j.params
+				g, err := withParams(f, j.params)
+				if err != nil {
+					errs[j.i] = err
+					continue
+				}
+				results[j.i].TS, errs[j.i] = Simulate(g, SimulateOptions{TimeoutCtx: ctx})
+			}
+		}()
+	}
+	var err error
+	for i := 0; i < runs; i++ {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		p, _ := c.next()
+		jobs <- job{i, p}
+	}
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("run %d: %s", i+1, err)
+		}
+	}
+	return results, nil
+}
+
+// A SensitivityTable holds the sensitivities of a model's outputs
+// to its constants: how much each output changes at the end of the
+// simulation per unit change in each constant.  A table from
+// SensitivitySeries also has them at each save step.
+type SensitivityTable struct {
+	Params  []string    // the constants, sorted by name
+	Outputs []string    // the outputs, in the order asked for
+	Grad    [][]float64 // Grad[i][j] is d Outputs[j] / d Params[i]
+
+	Time  []float64     // the save steps, from SensitivitySeries
+	Steps [][][]float64 // Steps[k] is Grad at Time[k]
+}
+
+// String returns t as a tab-separated table, a row for each constant
+// and a column for each output.  If t has sensitivities at each save
+// step, there are rows for each constant at each of them, and a
+// column for the time.
+func (t *SensitivityTable) String() string {
+	var buf bytes.Buffer
+	if t.Steps != nil {
+		buf.WriteString("TIME\t")
+	}
+	buf.WriteString("PARAM")
+	for _, out := range t.Outputs {
+		fmt.Fprintf(&buf, "\t%s", out)
+	}
+	buf.WriteByte('\n')
+	rows := func(time string, grad [][]float64) {
+		for i, p := range t.Params {
+			buf.WriteString(time)
+			buf.WriteString(p)
+			for _, g := range grad[i] {
+				fmt.Fprintf(&buf, "\t%s", formatValue(g))
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	if t.Steps == nil {
+		rows("", t.Grad)
+	}
+	for k, grad := range t.Steps {
+		rows(formatValue(t.Time[k])+"\t", grad)
+	}
+	return buf.String()
+}
+
+// Sensitivities estimates the sensitivity of the outputs of the
+// model named main in f to each of its constants, from its C and X
+// cards, by finite differences.  The model is simulated once as it
+// is, and once for each constant with it perturbed by delta times
+// its value, or by delta if it is zero.  Outputs are upper-cased
+// variable names, taken at the end of the simulation; if there are
+// none, every variable the model saves is used.
+func Sensitivities(f *File, delta float64, outputs []string) (*SensitivityTable, error) {
+	return sensitivities(f, delta, outputs, false)
+}
+
+// SensitivitySeries is like Sensitivities, but also estimates the
+// sensitivities at each save step of the simulation, in the table's
+// Time and Steps.
+func SensitivitySeries(f *File, delta float64, outputs []string) (*SensitivityTable, error) {
+	return sensitivities(f, delta, outputs, true)
+}
+
+// sensitivities estimates the sensitivities of f's outputs as
+// Sensitivities does, and at each save step too if eachStep is true.
+func sensitivities(f *File, delta float64, outputs []string, eachStep bool) (*SensitivityTable, error) {
+	if delta == 0 {
+		return nil, fmt.Errorf("delta is 0")
+	}
+	base, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	t := &SensitivityTable{}
+	for _, out := range outputs {
+		t.Outputs = append(t.Outputs, strings.ToUpper(out))
+	}
+	if len(t.Outputs) == 0 {
+		for name := range base.Vars {
+			t.Outputs = append(t.Outputs, name)
+		}
+		sort.Strings(t.Outputs)
+	}
+	// values returns the outputs of ts at each save step, the last
+	// of them at the end of the simulation
+	values := func(ts TimeSeries) ([][]float64, error) {
+		vals := make([][]float64, len(ts.Time))
+		for k := range vals {
+			vals[k] = make([]float64, len(t.Outputs))
+		}
+		for i, out := range t.Outputs {
+			vs, ok := ts.Vars[out]
+			if !ok || len(vs) == 0 {
+				return nil, fmt.Errorf("no output %s", out)
+			}
+			if len(vs) != len(vals) {
+				return nil, fmt.Errorf("output %s has %d values for %d save steps", out, len(vs), len(vals))
+			}
+			for k, v := range vs {
+				vals[k][i] = v
+			}
+		}
+		return vals, nil
+	}
+	y0, err := values(base)
+	if err != nil {
+		return nil, err
+	}
+	if eachStep {
+		t.Time = base.Time
+		t.Steps = make([][][]float64, len(base.Time))
+	}
+
+	consts := map[string]float64{}
+	if md := f.GetModel("main"); md != nil && md.Body != nil {
+		for _, s := range md.Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok || assign.Lhs.Type == nil {
+				continue
+			}
+			if ty := assign.Lhs.Type.Name; ty == "const" || ty == "external" {
+				if v, err := constEval(assign.Rhs); err == nil {
+					consts[strings.ToUpper(assign.Lhs.Name.Name)] = v
+				}
+			}
+		}
+	}
+	for name := range consts {
+		t.Params = append(t.Params, name)
+	}
+	sort.Strings(t.Params)
+	for _, name := range t.Params {
+		v := consts[name]
+		h := delta * math.Abs(v)
+		if v == 0 {
+			h = delta
+		}
+		g, err := withParams(f, map[string]float64{name: v + h})
+		if err != nil {
+			return nil, err
+		}
+		ts, err := Simulate(g, SimulateOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("%s perturbed: %s", name, err)
+		}
+		y, err := values(ts)
+		if err != nil {
+			return nil, err
+		}
+		if len(y) != len(y0) {
+			return nil, fmt.Errorf("%s perturbed: %d save steps, not %d", name, len(y), len(y0))
+		}
+		var grad []float64
+		for k := range y {
+			grad = make([]float64, len(y[k]))
+			for j := range y[k] {
+				grad[j] = (y[k][j] - y0[k][j]) / h
+			}
+			if eachStep {
+				t.Steps[k] = append(t.Steps[k], grad)
+			}
+		}
+		t.Grad = append(t.Grad, grad)
+	}
+	return t, nil
+}
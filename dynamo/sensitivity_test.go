@@ -0,0 +1,197 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSensitivities(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	st, err := Sensitivities(f, 1e-6, []string{"pop"})
+	if err != nil {
+		t.Fatalf("Sensitivities: %s", err)
+	}
+	if got, want := strings.Join(st.Params, " "), "NB ND POPN"; got != want {
+		t.Fatalf("params: got %s, want %s", got, want)
+	}
+	// with Euler's method, POP grows by 1+(NB-ND)*DT each of its 50
+	// steps, to POPN*1.15^50.
+	grad := map[string]float64{
+		"NB":   133000 * 50 * 5 * math.Pow(1.15, 49),
+		"ND":   -133000 * 50 * 5 * math.Pow(1.15, 49),
+		"POPN": math.Pow(1.15, 50),
+	}
+	for i, p := range st.Params {
+		got, want := st.Grad[i][0], grad[p]
+		if math.Abs(got-want) > 1e-4*math.Abs(want) {
+			t.Errorf("d POP / d %s: got %g, want %g", p, got, want)
+		}
+	}
+	if s := st.String(); !strings.HasPrefix(s, "PARAM\tPOP\nNB\t") {
+		t.Errorf("String: got %q", s)
+	}
+
+	if _, err := Sensitivities(f, 1e-6, []string{"BOGUS"}); err == nil {
+		t.Errorf("unknown output: expected an error")
+	}
+	if _, err := Sensitivities(f, 0, nil); err == nil {
+		t.Errorf("zero delta: expected an error")
+	}
+}
+
+// TestSensitivitySeries checks the sensitivities at each save step,
+// and that the last of them are those at the end.
+func TestSensitivitySeries(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	st, err := SensitivitySeries(f, 1e-6, []string{"POP"})
+	if err != nil {
+		t.Fatalf("SensitivitySeries: %s", err)
+	}
+	if len(st.Time) != 51 || len(st.Steps) != 51 {
+		t.Fatalf("got %d times and %d steps, want 51", len(st.Time), len(st.Steps))
+	}
+	popn := -1
+	for i, p := range st.Params {
+		if p == "POPN" {
+			popn = i
+		}
+	}
+	if popn < 0 {
+		t.Fatalf("no POPN in %v", st.Params)
+	}
+	// POP is POPN*1.15^n after its n'th step of 5
+	for k, time := range st.Time {
+		got, want := st.Steps[k][popn][0], math.Pow(1.15, time/5)
+		if math.Abs(got-want) > 1e-4*want {
+			t.Errorf("d POP / d POPN at %g: got %g, want %g", time, got, want)
+		}
+	}
+	for i := range st.Params {
+		if got, want := st.Steps[50][i][0], st.Grad[i][0]; got != want {
+			t.Errorf("%s: last step %g, but at the end %g", st.Params[i], got, want)
+		}
+	}
+	if s := st.String(); !strings.HasPrefix(s, "TIME\tPARAM\tPOP\n0\tNB\t0\n") {
+		t.Errorf("String: got %q", s[:40])
+	}
+
+	final, err := Sensitivities(f, 1e-6, []string{"POP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.Steps != nil {
+		t.Errorf("Sensitivities computed %d steps, want only the end", len(final.Steps))
+	}
+}
+
+func TestSweep(t *testing.T) {
+	params := map[string][]float64{
+		"nb": {.03, .04, .05},
+		"ND": {.002, .011, .017},
+	}
+	results, err := SensitivityAnalysis(helloWorld, params)
+	if err != nil {
+		t.Fatalf("SensitivityAnalysis: %s", err)
+	}
+	if len(results) != 9 {
+		t.Fatalf("got %d results, want 9", len(results))
+	}
+	// the combinations are in order of the upper-cased names, ND
+	// varying fastest, and each run is different
+	seen := map[string]int{}
+	for i, r := range results {
+		nb, nd := params["nb"][i/3], params["ND"][i%3]
+		if len(r.Params) != 2 || r.Params["NB"] != nb || r.Params["ND"] != nd {
+			t.Errorf("run %d: got params %v, want NB %g and ND %g", i+1, r.Params, nb, nd)
+		}
+		final := r.FinalValues()
+		pop := r.TS.Vars["POP"]
+		if final["POP"] != pop[len(pop)-1] || len(final) != len(r.TS.Vars) {
+			t.Errorf("run %d: got final values %v, want the last of %v", i+1, final, r.TS.Vars)
+		}
+		// POP grows by (1+(NB-ND)*DT) each of its 50 steps
+		if want := 133000 * math.Pow(1+(nb-nd)*5, 50); math.Abs(final["POP"]-want) > 1e-9*want {
+			t.Errorf("run %d: got POP %g at the end, want %g", i+1, final["POP"], want)
+		}
+		key := fmt.Sprint(final["B"], final["D"], final["POP"])
+		if j, ok := seen[key]; ok {
+			t.Errorf("runs %d and %d have the same outcome, %s", j+1, i+1, key)
+		}
+		seen[key] = i
+	}
+
+	f, _ := parseSrc(t, helloWorld)
+	if results, err = Sweep(f, params, SweepOptions{MaxRuns: 4}); err != nil || len(results) != 4 {
+		t.Errorf("MaxRuns 4: got %d results (%v)", len(results), err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = Sweep(f, params, SweepOptions{TimeoutCtx: ctx}); err != context.Canceled {
+		t.Errorf("canceled: got error %v", err)
+	}
+	for _, bad := range []map[string][]float64{
+		nil,
+		{"NB": nil},
+		{"POP": {1}},
+		{"NB": {1}, "nb": {2}},
+	} {
+		if _, err := Sweep(f, bad, SweepOptions{}); err == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
+
+func TestWriteRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, _ := parseSrc(t, helloWorld)
+	results, err := Sweep(f, map[string][]float64{"NB": {.03, .04}}, SweepOptions{})
+	if err != nil {
+		t.Fatalf("Sweep: %s", err)
+	}
+	tmpl := filepath.Join(dir, "run_{nb}_{run}.csv")
+	if err = WriteRuns(tmpl, results); err != nil {
+		t.Fatalf("WriteRuns: %s", err)
+	}
+	for i, name := range []string{"run_0.03_1.csv", "run_0.04_2.csv"} {
+		r, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("run %d: %s", i+1, err)
+			continue
+		}
+		ts, err := ParseCSV(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		pop, want := ts.Vars["POP"], results[i].TS.Vars["POP"]
+		if len(pop) != len(want) || pop[len(pop)-1] != want[len(want)-1] {
+			t.Errorf("%s: got POP %v, want %v", name, pop, want)
+		}
+	}
+
+	// every run would write the same file
+	for _, tmpl := range []string{"run.csv", "run_{nd}.csv", "run_{nb"} {
+		if err := WriteRuns(filepath.Join(dir, tmpl), results); err == nil {
+			t.Errorf("%s: expected an error", tmpl)
+		}
+	}
+	if err := WriteRuns(filepath.Join(dir, "run.csv"), results[:1]); err != nil {
+		t.Errorf("one run: %s", err)
+	}
+}
@@ -0,0 +1,565 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// SimulateOptions control a run of Simulate.
+type SimulateOptions struct {
+	// OutputVars names the variables whose values are returned.
+	// If it is empty, they're the levels, rates, auxiliaries and
+	// supplementaries, as written by a program from GenGo.
+	OutputVars []string
+
+	// TimeoutCtx, if non-nil, stops the simulation with its error
+	// once it is done.
+	TimeoutCtx context.Context
+
+	IntegrationMethod IntegrationMethod
+}
+
+// A simEqn is an equation computing the variable name.  For a
+// lookup, rhs is the index into the table of the same name.
+type simEqn struct {
+	name   string
+	rhs    Expr
+	lookup bool
+}
+
+// A simState is the state of a simulation at one time.
+type simState struct {
+	vals   map[string]float64 // by upper-cased name, with TIME
+	hidden []float64          // the hidden levels of SMOOTH and DELAY3
+}
+
+func (st *simState) copy() *simState {
+	c := &simState{vals: make(map[string]float64, len(st.vals))}
+	for n, v := range st.vals {
+		c.vals[n] = v
+	}
+	c.hidden = append([]float64(nil), st.hidden...)
+	return c
+}
+
+// A simulator runs a model by evaluating its equations directly,
+// rather than generating a program to.  It does what the program
+// generated for the model would, in the same order, so that the two
+// give the same results.
+type simulator struct {
+	g       *generator           // the types, fields and tables of the model
+	tables  map[string]*genTable // by upper-cased name
+	dt      float64
+	rng     *rand.Rand        // source of NOISE and NORMRN
+	sites   map[*CallExpr]int // index of each SMOOTH or DELAY3's first hidden level
+	calls   []*CallExpr       // the calls of SMOOTH and DELAY3, in the order of sites
+	nhidden int               // the number of hidden levels
+
+	initials []simEqn // constants and initial values, in dependency order
+	calc     []simEqn // lookups and auxiliaries, then rates
+	supps    []simEqn // supplementaries, computed only at save steps
+	levels   []simEqn
+}
+
+// Simulate runs the model named main in f, as the program generated
+// for it by GenGo would, but without building that program: the
+// equations are evaluated as the simulation goes.  The result holds
+// the time and the values of the output variables at each save step.
+// NOISE and NORMRN draw the same numbers as a generated program run
+// without -seed.
+func Simulate(f *File, opts SimulateOptions) (TimeSeries, error) {
+	var ts TimeSeries
+	s, err := newSimulator(f, opts.IntegrationMethod)
+	if err != nil {
+		return ts, err
+	}
+
+	names := make([]string, 0, len(opts.OutputVars))
+	for _, n := range opts.OutputVars {
+		n = strings.ToUpper(n)
+		if _, ok := s.g.fields[n]; !ok {
+			return ts, fmt.Errorf("no variable %s to output", n)
+		}
+		names = append(names, n)
+	}
+	if len(names) == 0 {
+		for _, f := range s.g.Output {
+			names = append(names, f.Name)
+		}
+	}
+	ts.Vars = make(map[string][]float64, len(names))
+	for _, n := range names {
+		ts.Vars[n] = []float64{}
+	}
+	ts.Time = []float64{}
+
+	ctx := opts.TimeoutCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	st, err := s.init()
+	if err != nil {
+		return ts, err
+	}
+	for i := 0; i <= s.g.Steps; i++ {
+		if err := ctx.Err(); err != nil {
+			return ts, err
+		}
+		if i > 0 {
+			if err := s.step(st); err != nil {
+				return ts, err
+			}
+		}
+		if i%s.g.SaveEvery == 0 {
+			if err := s.save(st); err != nil {
+				return ts, err
+			}
+			ts.Time = append(ts.Time, st.vals["TIME"])
+			for _, n := range names {
+				ts.Vars[n] = append(ts.Vars[n], st.vals[n])
+			}
+		}
+	}
+	return ts, nil
+}
+
+// newSimulator returns a simulator of the model named main in f,
+// with its macros expanded, integrating its levels with method.
+func newSimulator(f *File, method IntegrationMethod) (*simulator, error) {
+	main := f.GetModel("main")
+	if main == nil {
+		return nil, fmt.Errorf("no model named main")
+	}
+	main, err := expandMacros(main, f.Macros)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &simulator{
+		g: &generator{
+			method: method,
+			Funcs:  map[string]bool{},
+			sites:  map[string]int{},
+			types:  map[string]string{},
+			fields: map[string]*genField{},
+		},
+		tables: map[string]*genTable{},
+		sites:  map[*CallExpr]int{},
+		rng:    rand.New(rand.NewSource(1)),
+	}
+	if err := s.model(main); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// model prepares s to simulate m, with the same checks as GenGo.
+func (s *simulator) model(m *ModelDecl) error {
+	g := s.g
+	var errs ErrorVector
+	checkDivZero(m, token.NewFileSet(), &errs)
+	checkSubscripts(m, token.NewFileSet(), &errs)
+	if err := errs.GetError(Sorted); err != nil {
+		return err
+	}
+
+	ts, err := m.Timespec()
+	if err != nil {
+		return err
+	}
+	if ts.DT <= 0 {
+		return fmt.Errorf("DT must be positive, not %g", ts.DT)
+	}
+	s.dt = ts.DT
+	g.Time = ts
+	g.Steps = int(math.Max(0, math.Floor((ts.End-ts.Start)/ts.DT+0.5)))
+	g.SaveEvery = int(math.Max(1, math.Floor(ts.SaveStep/ts.DT+0.5)))
+	if g.method == RK4 {
+		if err = checkPure(m); err != nil {
+			return err
+		}
+	}
+	if err = checkSupplementaries(m); err != nil {
+		return err
+	}
+	if g.xs, err = tableXs(m); err != nil {
+		return err
+	}
+	if err = g.vars(m.Body.List...); err != nil {
+		return err
+	}
+
+	names, eqns, err := initialEqns(m)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if g.types[n] == "external" {
+			if _, ok := foldConst(eqns[n], nil); !ok {
+				return fmt.Errorf("external %s: value isn't a number", n)
+			}
+		}
+		s.initials = append(s.initials, simEqn{name: n, rhs: eqns[n]})
+	}
+
+	var rates []simEqn
+	for _, st := range m.Body.List {
+		assign, ok := st.(*AssignStmt)
+		if !ok || assign.Lhs.Name.Name == "timespec" {
+			continue
+		}
+		name := strings.ToUpper(assign.Lhs.Name.Name)
+		switch assign.Lhs.Type.Name {
+		case "stock":
+			s.levels = append(s.levels, simEqn{name: name, rhs: assign.Rhs})
+		case "flow":
+			rates = append(rates, simEqn{name: name, rhs: assign.Rhs})
+		case "table":
+			if err := g.table(name, "", assign.Rhs); err != nil {
+				return err
+			}
+			t := g.Tables[len(g.Tables)-1]
+			s.tables[name] = &t
+			if x, ok := stripUnits(assign.Rhs).(*IndexExpr); ok {
+				s.calc = append(s.calc, simEqn{name: name, rhs: x.Index, lookup: true})
+			}
+		}
+	}
+
+	// auxiliaries are computed in dependency order, before the
+	// rates using them; supplementaries only when saving
+	auxes, err := TopoSort(m)
+	if err != nil {
+		return err
+	}
+	for _, a := range auxes {
+		eqn := simEqn{name: strings.ToUpper(a.Lhs.Name.Name), rhs: a.Rhs}
+		if a.Lhs.Type.Name == "supplementary" {
+			s.supps = append(s.supps, eqn)
+		} else {
+			s.calc = append(s.calc, eqn)
+		}
+	}
+	s.calc = append(s.calc, rates...)
+
+	for _, eqns := range [][]simEqn{s.initials, s.calc, s.supps, s.levels} {
+		for _, eqn := range eqns {
+			s.findSites(eqn.rhs)
+		}
+	}
+	return nil
+}
+
+// findSites gives each call of SMOOTH or DELAY3 in e its hidden
+// levels, those of calls in its arguments first.
+func (s *simulator) findSites(e Expr) {
+	Inspect(e, func(n Node) bool {
+		c, ok := n.(*CallExpr)
+		if !ok {
+			return true
+		}
+		for _, arg := range c.Args {
+			s.findSites(arg)
+		}
+		switch funcName(c) {
+		case "SMOOTH":
+			s.sites[c] = s.nhidden
+			s.calls = append(s.calls, c)
+			s.nhidden++
+		case "DELAY3":
+			s.sites[c] = s.nhidden
+			s.calls = append(s.calls, c)
+			s.nhidden += 3
+		}
+		return false
+	})
+}
+
+// init returns the state at the start of the simulation.  The hidden
+// levels start from their inputs, once the rest of the model has
+// been computed.
+func (s *simulator) init() (*simState, error) {
+	st := &simState{
+		vals:   make(map[string]float64, len(s.g.fields)+1),
+		hidden: make([]float64, s.nhidden),
+	}
+	for n := range s.g.fields {
+		st.vals[n] = 0
+	}
+	st.vals["TIME"] = s.g.Time.Start
+	for _, eqn := range s.initials {
+		v, err := s.eval(eqn.rhs, st)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		st.vals[eqn.name] = v
+	}
+	if err := s.calcAll(st); err != nil {
+		return nil, err
+	}
+	if len(s.calls) == 0 {
+		return st, nil
+	}
+	for _, c := range s.calls {
+		off := s.sites[c]
+		in, err := s.eval(c.Args[0], st)
+		if err != nil {
+			return nil, err
+		}
+		if funcName(c) == "SMOOTH" {
+			st.hidden[off] = in
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			if i > 0 {
+				if in, err = s.eval(c.Args[0], st); err != nil {
+					return nil, err
+				}
+			}
+			del, err := s.eval(c.Args[1], st)
+			if err != nil {
+				return nil, err
+			}
+			st.hidden[off+i] = in * del / 3
+		}
+	}
+	return st, s.calcAll(st)
+}
+
+// calcAll computes the auxiliaries and rates of st from its levels.
+func (s *simulator) calcAll(st *simState) error {
+	return s.calcEqns(st, s.calc)
+}
+
+// save computes the supplementaries of st, before it is saved.
+func (s *simulator) save(st *simState) error {
+	return s.calcEqns(st, s.supps)
+}
+
+func (s *simulator) calcEqns(st *simState, eqns []simEqn) error {
+	for _, eqn := range eqns {
+		v, err := s.eval(eqn.rhs, st)
+		if err != nil {
+			return fmt.Errorf("%s: %s", eqn.name, err)
+		}
+		if eqn.lookup {
+			v = s.tables[eqn.name].lookup(v)
+		}
+		st.vals[eqn.name] = v
+	}
+	return nil
+}
+
+// level returns the value of the i'th level of st: one of the
+// model's, or after them one of the hidden levels.
+func (s *simulator) level(st *simState, i int) float64 {
+	if i < len(s.levels) {
+		return st.vals[s.levels[i].name]
+	}
+	return st.hidden[i-len(s.levels)]
+}
+
+func (s *simulator) setLevel(st *simState, i int, v float64) {
+	if i < len(s.levels) {
+		st.vals[s.levels[i].name] = v
+	} else {
+		st.hidden[i-len(s.levels)] = v
+	}
+}
+
+// next returns the value of each level after a step of dt from st,
+// the model's levels followed by the hidden ones.
+func (s *simulator) next(st *simState) ([]float64, error) {
+	var vals []float64
+	for _, l := range s.levels {
+		v, err := s.levelEqn(l, st)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", l.name, err)
+		}
+		vals = append(vals, v)
+	}
+	for _, c := range s.calls {
+		off := s.sites[c]
+		if funcName(c) == "SMOOTH" {
+			x, err := s.eval(c.Args[0], st)
+			if err != nil {
+				return nil, err
+			}
+			avt, err := s.eval(c.Args[1], st)
+			if err != nil {
+				return nil, err
+			}
+			h := st.hidden[off]
+			vals = append(vals, h+s.dt*(x-h)/avt)
+			continue
+		}
+		rate, err := s.eval(c.Args[0], st)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < 3; i++ {
+			del, err := s.eval(c.Args[1], st)
+			if err != nil {
+				return nil, err
+			}
+			h := st.hidden[off+i]
+			out := h / (del / 3)
+			vals = append(vals, h+s.dt*(rate-out))
+			rate = out
+		}
+	}
+	return vals, nil
+}
+
+// levelEqn returns the value at K of the level l from st, the model
+// at J.  A level built by ModelBuilder gives its flows, rather than
+// the equation for its next value.
+func (s *simulator) levelEqn(l simEqn, st *simState) (float64, error) {
+	cl, ok := l.rhs.(*CompositeLit)
+	if !ok {
+		return s.eval(l.rhs, st)
+	}
+	var net float64
+	for _, e := range cl.Elts {
+		k, val, err := kvConvert(e)
+		if err != nil {
+			return 0, fmt.Errorf("stock(%s): %s", l.name, err)
+		}
+		switch k {
+		case "initial":
+			// set by init
+		case "biflow", "inflow", "outflow":
+			flow, err := s.eval(val, st)
+			if err != nil {
+				return 0, fmt.Errorf("stock(%s) %s: %s", l.name, k, err)
+			}
+			if k == "outflow" {
+				flow = -flow
+			}
+			net += flow
+		default:
+			return 0, fmt.Errorf("stock(%s): unknown key %s", l.name, k)
+		}
+	}
+	return st.vals[l.name] + net*s.dt, nil
+}
+
+// step advances st by dt, integrating its levels with the
+// simulation's method, as the step method of a generated Model does.
+func (s *simulator) step(st *simState) error {
+	n := len(s.levels) + len(st.hidden)
+	if s.g.method != RK4 {
+		vals, err := s.next(st)
+		if err != nil {
+			return err
+		}
+		for i, v := range vals {
+			s.setLevel(st, i, v)
+		}
+	} else if n > 0 {
+		j := st.copy()
+		var k [4][]float64
+		for stage := range k {
+			cur := j
+			if stage > 0 {
+				h := s.dt / 2
+				if stage == 3 {
+					h = s.dt
+				}
+				cur = j.copy()
+				for i := 0; i < n; i++ {
+					s.setLevel(cur, i, s.level(j, i)+h*k[stage-1][i])
+				}
+				cur.vals["TIME"] = j.vals["TIME"] + h
+				if err := s.calcAll(cur); err != nil {
+					return err
+				}
+			}
+			vals, err := s.next(cur)
+			if err != nil {
+				return err
+			}
+			k[stage] = make([]float64, n)
+			for i, v := range vals {
+				k[stage][i] = (v - s.level(cur, i)) / s.dt
+			}
+		}
+		for i := 0; i < n; i++ {
+			s.setLevel(st, i, s.level(j, i)+s.dt*(k[0][i]+2*k[1][i]+2*k[2][i]+k[3][i])/6)
+		}
+	}
+	st.vals["TIME"] += s.dt
+	return s.calcAll(st)
+}
+
+// eval returns the value of e in st.
+func (s *simulator) eval(e Expr, st *simState) (float64, error) {
+	return eval(e, simEnv{s, st})
+}
+
+// A simEnv is the evalEnv of a simulation in the state st.
+type simEnv struct {
+	s  *simulator
+	st *simState
+}
+
+// ref returns the value of the variable id.  DT is that of the
+// simulation.
+func (env simEnv) ref(id *Ident) (float64, error) {
+	n := strings.ToUpper(id.Name)
+	if n == "DT" {
+		return env.s.dt, nil
+	}
+	if env.s.g.types[n] == "table" {
+		return 0, evalErr(id, "table %s used outside of TABHL", id.Name)
+	}
+	v, ok := env.st.vals[n]
+	if !ok {
+		return 0, evalErr(id, "undefined: %s", id.Name)
+	}
+	return v, nil
+}
+
+// call computes the built-ins with state: TABHL looks up its table,
+// SMOOTH and DELAY3 read their hidden levels, and NOISE and NORMRN
+// draw from the simulation's random source.
+func (env simEnv) call(c *CallExpr, name string) (float64, bool, error) {
+	s, st := env.s, env.st
+	switch name {
+	case "TABHL":
+		table, ok := c.Args[0].(*Ident)
+		if !ok || s.g.types[strings.ToUpper(table.Name)] != "table" {
+			return 0, true, evalErr(c.Args[0], "TABHL of %s, not a table", exprString(c.Args[0]))
+		}
+		x, err := eval(c.Args[1], env)
+		if err != nil {
+			return 0, true, err
+		}
+		return s.tables[strings.ToUpper(table.Name)].lookup(x), true, nil
+	case "SMOOTH":
+		return st.hidden[s.sites[c]], true, nil
+	case "DELAY3":
+		del, err := eval(c.Args[1], env)
+		if err != nil {
+			return 0, true, err
+		}
+		return st.hidden[s.sites[c]+2] / (del / 3), true, nil
+	case "NOISE":
+		return s.rng.Float64() - 0.5, true, nil
+	case "NORMRN":
+		args, err := evalArgs(c.Args, env)
+		if err != nil {
+			return 0, true, err
+		}
+		return args[0] + args[1]*s.rng.NormFloat64(), true, nil
+	}
+	return 0, false, nil
+}
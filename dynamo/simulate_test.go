@@ -0,0 +1,154 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runC compiles the C program src with gcc -Wall, failing the test
+// on any warning, and returns its output.  The test is skipped if
+// there's no gcc.
+func runC(t *testing.T, src []byte) string {
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("no gcc to compile the generated program")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, bin := filepath.Join(dir, "model.c"), filepath.Join(dir, "model")
+	if err := ioutil.WriteFile(path, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(gcc, "-Wall", "-o", bin, path, "-lm").CombinedOutput()
+	if err != nil || len(out) != 0 {
+		t.Fatalf("gcc: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("model: %s\n%s", err, out)
+	}
+	return string(out)
+}
+
+// runPython runs the Python script src and returns its output.  The
+// test is skipped if there's no python3.
+func runPython(t *testing.T, src []byte) string {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("no python3 to run the generated script")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "model.py")
+	if err := ioutil.WriteFile(path, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(python, path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("python3: %s\n%s", err, out)
+	}
+	return string(out)
+}
+
+// sameSeries reports the first difference between a and b, which
+// are the same if they have the same times and variables and their
+// values differ by no more than the 15 digits C prints.
+func sameSeries(t *testing.T, name string, a, b TimeSeries) {
+	close := func(x, y float64) bool {
+		return math.Abs(x-y) <= 1e-13*math.Max(1, math.Max(math.Abs(x), math.Abs(y)))
+	}
+	if len(a.Time) != len(b.Time) || len(a.Vars) != len(b.Vars) {
+		t.Errorf("%s: got %d times of %d variables, want %d of %d",
+			name, len(b.Time), len(b.Vars), len(a.Time), len(a.Vars))
+		return
+	}
+	for i, time := range a.Time {
+		if !close(time, b.Time[i]) {
+			t.Errorf("%s: row %d: got TIME %g, want %g", name, i, b.Time[i], time)
+			return
+		}
+	}
+	for v, vals := range a.Vars {
+		other, ok := b.Vars[v]
+		if !ok {
+			t.Errorf("%s: no %s", name, v)
+			continue
+		}
+		for i := range vals {
+			if !close(vals[i], other[i]) {
+				t.Errorf("%s: %s at TIME %g: got %g, want %g", name, v, a.Time[i], other[i], vals[i])
+				break
+			}
+		}
+	}
+}
+
+func TestSimulateCompiled(t *testing.T) {
+	const src = `* inputs into a level
+L	STOCK.K=STOCK.J+(DT)(IN.JK-OUT.JK)
+N	STOCK=10
+R	IN.KL=CLIP(S.K+R.K+P.K,0,TIME.K,12)
+R	OUT.KL=IF STOCK.K>20 THEN STOCK.K/4 ELSE STOCK.K/8
+A	S.K=STEP(3,2)
+A	R.K=RAMP(.5,4)
+A	P.K=PULSE(6,8,1)
+A	SM.K=SMOOTH(STOCK.K,3)
+A	DL.K=DELAY3(IN.JK,5)
+C	LENGTH=20
+C	DT=.25
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, src)
+	sim, err := Simulate(f, SimulateOptions{})
+	if err != nil {
+		t.Fatalf("Simulate: %s", err)
+	}
+	if len(sim.Time) != 21 {
+		t.Fatalf("got %d times, want 21", len(sim.Time))
+	}
+
+	goOut := runGo(t, genGo(t, f, fset))
+	cSrc, err := GenC(f)
+	if err != nil {
+		t.Fatalf("GenC: %s", err)
+	}
+	pySrc, err := GenPython(f)
+	if err != nil {
+		t.Fatalf("GenPython: %s", err)
+	}
+	for _, out := range []struct {
+		name, csv string
+	}{
+		{"GenGo", goOut},
+		{"GenC", runC(t, cSrc)},
+		{"GenPython", runPython(t, pySrc)},
+	} {
+		ts, err := ParseCSV(strings.NewReader(out.csv))
+		if err != nil {
+			t.Errorf("%s: ParseCSV: %s", out.name, err)
+			continue
+		}
+		sameSeries(t, out.name, sim, ts)
+	}
+
+	// the model isn't at equilibrium, so that the comparison
+	// means something
+	if stock := sim.Vars["STOCK"]; stock[0] == stock[20] || sim.Vars["DL"][20] == 0 {
+		t.Errorf("STOCK %g to %g, DL %g: model didn't move", stock[0], stock[20], sim.Vars["DL"][20])
+	}
+}
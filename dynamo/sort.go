@@ -0,0 +1,62 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// eqnGroups orders the types of equations as SortEquations sorts
+// them.  Statements other than equations, and the timespec, go last.
+var eqnGroups = map[string]int{
+	"const":         0,
+	"external":      0,
+	"initial":       1,
+	"stock":         2,
+	"flow":          3,
+	"aux":           4,
+	"supplementary": 5,
+	"table":         6,
+}
+
+// eqnKey returns the group and upper-cased name s sorts by.
+func eqnKey(s Stmt) (int, string) {
+	assign, ok := s.(*AssignStmt)
+	if !ok || assign.Lhs.Type == nil || assign.Lhs.Name.Name == "timespec" {
+		return len(eqnGroups), ""
+	}
+	g, ok := eqnGroups[assign.Lhs.Type.Name]
+	if !ok {
+		g = eqnGroups["aux"]
+	}
+	return g, strings.ToUpper(assign.Lhs.Name.Name)
+}
+
+type byEqn []Stmt
+
+func (s byEqn) Len() int      { return len(s) }
+func (s byEqn) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byEqn) Less(i, j int) bool {
+	gi, ni := eqnKey(s[i])
+	gj, nj := eqnKey(s[j])
+	if gi != gj {
+		return gi < gj
+	}
+	return ni < nj
+}
+
+// SortEquations reorders m's equations in place into the order
+// DYNAMO modelers expect: constants, initial values, levels, rates,
+// auxiliaries, supplementaries and then tables, each group sorted
+// by name.  Anything else keeps its order after the tables.
+func SortEquations(m *ModelDecl) error {
+	if m.Body == nil {
+		return fmt.Errorf("model %s has no equations", m.Name.Name)
+	}
+	sort.Stable(byEqn(m.Body.List))
+	return nil
+}
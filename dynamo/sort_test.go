@@ -0,0 +1,84 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"strings"
+	"testing"
+)
+
+// scrambled is helloWorld's population sector, with a table and an
+// auxiliary, in no particular order.
+const scrambled = `* scrambled
+T	MT=1/2
+R	D.KL=(ND)(POP.K)
+A	M.K=TABHL(MT,POP.K/POPN,0,1,1)
+C	ND=.01
+L	POP.K=POP.J+(DT)(B.JK-D.JK)
+R	B.KL=(NB)(POP.K)(M.K)
+C	POPN=133000
+N	POP=POPN
+C	NB=.04
+`
+
+// cardNames returns the type letters and names of m's equations, in
+// order.
+func cardNames(m *ModelDecl) string {
+	var names []string
+	for _, s := range m.Body.List {
+		if a, ok := s.(*AssignStmt); ok && a.Lhs.Type != nil {
+			names = append(names, typeLetter(a.Lhs)+" "+a.Lhs.Name.Name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func TestSortEquations(t *testing.T) {
+	f, _ := parseSrc(t, scrambled)
+	m := f.Decls[0].(*ModelDecl)
+	if err := SortEquations(m); err != nil {
+		t.Fatalf("SortEquations: %s", err)
+	}
+	const want = "C NB, C ND, C POPN, N POP, L POP, R B, R D, A M, T MT"
+	if got := cardNames(m); got != want {
+		t.Errorf("got order %s, want %s", got, want)
+	}
+	if err := SortEquations(m); err != nil {
+		t.Fatalf("SortEquations: %s", err)
+	}
+	if got := cardNames(m); got != want {
+		t.Errorf("sorting again: got order %s, want %s", got, want)
+	}
+
+	if err := SortEquations(&ModelDecl{Name: id("empty")}); err == nil {
+		t.Errorf("model without a body: expected an error")
+	}
+}
+
+func TestFormatSorted(t *testing.T) {
+	out, err := Format([]byte(scrambled), WithSortedEquations(true))
+	if err != nil {
+		t.Fatalf("Format: %s", err)
+	}
+	var cards []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.SplitN(line, "=", 2); len(fields) == 2 && !strings.HasPrefix(line, "*") {
+			cards = append(cards, fields[0])
+		}
+	}
+	// the timespec constants are written last, as always
+	const want = "C\tNB, C\tND, C\tPOPN, N\tPOP, L\tPOP.K, R\tB.KL, R\tD.KL, A\tM.K, T\tMT, " +
+		"C\tLENGTH, C\tDT, C\tSAVPER"
+	if got := strings.Join(cards, ", "); got != want {
+		t.Errorf("got cards %q, want %q:\n%s", got, want, out)
+	}
+	again, err := Format(out, WithSortedEquations(true))
+	if err != nil {
+		t.Fatalf("Format: %s", err)
+	}
+	if string(again) != string(out) {
+		t.Errorf("formatting sorted output changed it:\n%s\nwas\n%s", again, out)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"math"
+)
+
+// Interpolate returns the value of the table t at x as TABHL gives
+// it: t's Ys are taken to be evenly spaced from xMin to xMax, x is
+// clamped to that range, and the value is interpolated linearly
+// between the two Ys around it.  xMin may be above xMax, when the Ys
+// are given for descending xs.  A table with a single value, or with
+// xMax equal to xMin, is that first value throughout.  The result is
+// NaN if t has no values, or one of those used isn't a number.
+func (t *TableFwdExpr) Interpolate(x, xMin, xMax float64) float64 {
+	lo, hi := xMin, xMax
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	if x < lo {
+		x = lo
+	} else if x > hi {
+		x = hi
+	}
+	return t.interpolate(x, xMin, xMax)
+}
+
+// InterpolateLinear is like Interpolate, but rather than holding the
+// first and last values beyond xMin and xMax it extrapolates them,
+// along the line through the two values nearest x.
+func (t *TableFwdExpr) InterpolateLinear(x, xMin, xMax float64) float64 {
+	return t.interpolate(x, xMin, xMax)
+}
+
+// interpolate returns the value at x of the line through the two of
+// t's Ys around x, or nearest it if x is outside [xMin, xMax].
+func (t *TableFwdExpr) interpolate(x, xMin, xMax float64) float64 {
+	n := len(t.Ys)
+	if n == 0 {
+		return math.NaN()
+	}
+	if n == 1 || xMax == xMin {
+		return t.y(0)
+	}
+	pos := (x - xMin) / (xMax - xMin) * float64(n-1)
+	i := int(math.Floor(pos))
+	if i < 0 {
+		i = 0
+	} else if i > n-2 {
+		i = n - 2
+	}
+	y0, y1 := t.y(i), t.y(i+1)
+	return y0 + (pos-float64(i))*(y1-y0)
+}
+
+// y returns the value of t's i'th Y, or NaN if it isn't a number.
+func (t *TableFwdExpr) y(i int) float64 {
+	v, err := t.Ys[i].Float64()
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
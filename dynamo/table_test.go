@@ -0,0 +1,96 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"go/token"
+	"math"
+	"testing"
+)
+
+// table returns a TableFwdExpr with the given values.
+func table(ys ...string) *TableFwdExpr {
+	t := &TableFwdExpr{}
+	for _, y := range ys {
+		t.Ys = append(t.Ys, &BasicLit{Kind: token.FLOAT, Value: y})
+	}
+	return t
+}
+
+func TestInterpolate(t *testing.T) {
+	// values 0, 10, 40 at x of 0, 5 and 10
+	tab := table("0", "10", "40")
+	tests := []struct {
+		x, clamped, linear float64
+	}{
+		{0, 0, 0}, // endpoints
+		{10, 40, 40},
+		{5, 10, 10}, // midpoint
+		{2.5, 5, 5}, // between values
+		{7.5, 25, 25},
+		{-5, 0, -10}, // below xMin
+		{15, 40, 70}, // above xMax
+		{-10, 0, -20},
+		{12.5, 40, 55},
+		{9.999, 39.994, 39.994},
+	}
+	for _, test := range tests {
+		if v := tab.Interpolate(test.x, 0, 10); math.Abs(v-test.clamped) > 1e-9 {
+			t.Errorf("Interpolate(%g): got %g, want %g", test.x, v, test.clamped)
+		}
+		if v := tab.InterpolateLinear(test.x, 0, 10); math.Abs(v-test.linear) > 1e-9 {
+			t.Errorf("InterpolateLinear(%g): got %g, want %g", test.x, v, test.linear)
+		}
+	}
+
+	// a single value, or an empty range, is the first value throughout
+	for _, x := range []float64{-1, 0, .5, 1, 2} {
+		if v := table("3").Interpolate(x, 0, 1); v != 3 {
+			t.Errorf("single value: Interpolate(%g) is %g, want 3", x, v)
+		}
+		if v := table("3").InterpolateLinear(x, 0, 1); v != 3 {
+			t.Errorf("single value: InterpolateLinear(%g) is %g, want 3", x, v)
+		}
+		if v := tab.Interpolate(x, 1, 1); v != 0 {
+			t.Errorf("empty range: Interpolate(%g) is %g, want 0", x, v)
+		}
+	}
+
+	// no values, or a value that isn't a number, give NaN
+	if v := table().Interpolate(1, 0, 1); !math.IsNaN(v) {
+		t.Errorf("no values: got %g, want NaN", v)
+	}
+	if v := table().InterpolateLinear(1, 0, 1); !math.IsNaN(v) {
+		t.Errorf("no values: got %g, want NaN", v)
+	}
+	if v := table("1", "x", "3").Interpolate(.25, 0, 1); !math.IsNaN(v) {
+		t.Errorf("bad value: got %g, want NaN", v)
+	}
+	if v := table("1", "2", "x").Interpolate(-1, 0, 2); v != 1 {
+		t.Errorf("bad value unused: got %g, want 1", v)
+	}
+}
+
+func TestInterpolateDescending(t *testing.T) {
+	// the values of TestInterpolate, given from x of 10 down to 0
+	tab := table("40", "10", "0")
+	for _, test := range []struct {
+		x, clamped, linear float64
+	}{
+		{0, 0, 0},
+		{10, 40, 40},
+		{2.5, 5, 5},
+		{7.5, 25, 25},
+		{-5, 0, -10},
+		{15, 40, 70},
+	} {
+		if v := tab.Interpolate(test.x, 10, 0); math.Abs(v-test.clamped) > 1e-9 {
+			t.Errorf("Interpolate(%g): got %g, want %g", test.x, v, test.clamped)
+		}
+		if v := tab.InterpolateLinear(test.x, 10, 0); math.Abs(v-test.linear) > 1e-9 {
+			t.Errorf("InterpolateLinear(%g): got %g, want %g", test.x, v, test.linear)
+		}
+	}
+}
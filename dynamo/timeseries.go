@@ -0,0 +1,147 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A TimeSeries is the output of a simulation: the value of each
+// variable in Vars, by name, at each of the times in Time.
+type TimeSeries struct {
+	Time []float64
+	Vars map[string][]float64
+}
+
+// names returns the names of ts's variables in sorted order, or an
+// error if one doesn't have a value for each time.
+func (ts TimeSeries) names() ([]string, error) {
+	names := make([]string, 0, len(ts.Vars))
+	for name, vals := range ts.Vars {
+		if len(vals) != len(ts.Time) {
+			return nil, fmt.Errorf("%s has %d values for %d times",
+				name, len(vals), len(ts.Time))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// WriteCSV writes ts to w as CSV: a header row of time followed by
+// the variable names in sorted order, then a row for each time.
+func (ts TimeSeries) WriteCSV(w io.Writer) error {
+	names, err := ts.names()
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append([]string{"time"}, names...)); err != nil {
+		return err
+	}
+	row := make([]string, len(names)+1)
+	for i, t := range ts.Time {
+		row[0] = formatValue(t)
+		for j, name := range names {
+			row[j+1] = formatValue(ts.Vars[name][i])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes ts to w as a JSON object with the times under
+// "time" followed by the values of each variable, in sorted order,
+// under its name.
+func (ts TimeSeries) WriteJSON(w io.Writer) error {
+	names, err := ts.names()
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	write := func(key string, vals []float64) error {
+		k, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		if vals == nil {
+			vals = []float64{}
+		}
+		v, err := json.Marshal(vals)
+		if err != nil {
+			return fmt.Errorf("%s: %s", key, err)
+		}
+		bw.Write(k)
+		bw.WriteByte(':')
+		bw.Write(v)
+		return nil
+	}
+	bw.WriteByte('{')
+	if err := write("time", ts.Time); err != nil {
+		return err
+	}
+	for _, name := range names {
+		bw.WriteByte(',')
+		if err := write(name, ts.Vars[name]); err != nil {
+			return err
+		}
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// ParseCSV reads a TimeSeries written by WriteCSV.  The first column
+// is the time, and may be headed TIME, as in the output of generated
+// models.
+func ParseCSV(r io.Reader) (TimeSeries, error) {
+	var ts TimeSeries
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return ts, err
+	}
+	if len(rows) == 0 {
+		return ts, fmt.Errorf("no header row")
+	}
+	header := rows[0]
+	if !strings.EqualFold(header[0], "time") {
+		return ts, fmt.Errorf("first column is %s, not time", header[0])
+	}
+	ts.Vars = map[string][]float64{}
+	for _, name := range header[1:] {
+		if _, ok := ts.Vars[name]; ok {
+			return ts, fmt.Errorf("%s listed twice", name)
+		}
+		ts.Vars[name] = []float64{}
+	}
+	ts.Time = []float64{}
+	for i, row := range rows[1:] {
+		for j, field := range row {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return ts, fmt.Errorf("line %d: %s", i+2, err)
+			}
+			if j == 0 {
+				ts.Time = append(ts.Time, v)
+			} else {
+				ts.Vars[header[j]] = append(ts.Vars[header[j]], v)
+			}
+		}
+	}
+	return ts, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTimeSeriesCSV(t *testing.T) {
+	ts := TimeSeries{
+		Time: []float64{0, .125, 1e9},
+		Vars: map[string][]float64{
+			"POP":   {1.0 / 3, -2.5, 1e-300},
+			"B":     {0, 12345678.875, math.MaxFloat64},
+			"A,B C": {1, 2, 3}, // quoted in CSV
+		},
+	}
+	var buf bytes.Buffer
+	if err := ts.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV: %s", err)
+	}
+	if header := strings.SplitN(buf.String(), "\n", 2)[0]; header != `time,"A,B C",B,POP` {
+		t.Errorf("got header %s, want time then the sorted names", header)
+	}
+	got, err := ParseCSV(&buf)
+	if err != nil {
+		t.Fatalf("ParseCSV: %s", err)
+	}
+	if !reflect.DeepEqual(got, ts) {
+		t.Errorf("round trip: got %v, want %v", got, ts)
+	}
+
+	// no variables, and no times
+	for _, ts := range []TimeSeries{
+		{Time: []float64{0, 1}, Vars: map[string][]float64{}},
+		{Time: []float64{}, Vars: map[string][]float64{"X": {}}},
+	} {
+		buf.Reset()
+		if err := ts.WriteCSV(&buf); err != nil {
+			t.Fatalf("WriteCSV: %s", err)
+		}
+		if got, err := ParseCSV(&buf); err != nil || !reflect.DeepEqual(got, ts) {
+			t.Errorf("round trip: got %v (%v), want %v", got, err, ts)
+		}
+	}
+
+	// generated models head the time column TIME
+	got, err = ParseCSV(strings.NewReader("TIME,POP\n0,1\n1,2\n"))
+	if err != nil {
+		t.Fatalf("ParseCSV: %s", err)
+	}
+	if want := (TimeSeries{Time: []float64{0, 1}, Vars: map[string][]float64{"POP": {1, 2}}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("TIME header: got %v, want %v", got, want)
+	}
+
+	for _, src := range []string{
+		"",
+		"POP,time\n1,0\n",
+		"time,POP,POP\n0,1,1\n",
+		"time,POP\n0,x\n",
+		"time,POP\n0,1,2\n",
+	} {
+		if _, err := ParseCSV(strings.NewReader(src)); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestTimeSeriesJSON(t *testing.T) {
+	ts := TimeSeries{
+		Time: []float64{0, .5, 1},
+		Vars: map[string][]float64{
+			"POP":  {1.0 / 3, -2.5, 1e-300},
+			"TIME": {0, .5, 1},
+		},
+	}
+	var buf bytes.Buffer
+	if err := ts.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %s", err)
+	}
+	want := `{"time":[0,0.5,1],"POP":[0.3333333333333333,-2.5,1e-300],"TIME":[0,0.5,1]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+	var got map[string][]float64
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if !reflect.DeepEqual(got["time"], ts.Time) || !reflect.DeepEqual(got["POP"], ts.Vars["POP"]) {
+		t.Errorf("round trip: got %v, want %v", got, ts)
+	}
+
+	buf.Reset()
+	if err := (TimeSeries{}).WriteJSON(&buf); err != nil || buf.String() != "{\"time\":[]}\n" {
+		t.Errorf("empty: got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestTimeSeriesErrors(t *testing.T) {
+	short := TimeSeries{Time: []float64{0, 1}, Vars: map[string][]float64{"POP": {1}}}
+	if err := short.WriteCSV(&bytes.Buffer{}); err == nil {
+		t.Errorf("WriteCSV: expected an error for a missing value")
+	}
+	if err := short.WriteJSON(&bytes.Buffer{}); err == nil {
+		t.Errorf("WriteJSON: expected an error for a missing value")
+	}
+	nan := TimeSeries{Time: []float64{0}, Vars: map[string][]float64{"POP": {math.NaN()}}}
+	if err := nan.WriteJSON(&bytes.Buffer{}); err == nil || !strings.HasPrefix(err.Error(), "POP: ") {
+		t.Errorf("WriteJSON: got error %v, want one for POP's NaN", err)
+	}
+}
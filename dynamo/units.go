@@ -0,0 +1,252 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"sort"
+	"strings"
+)
+
+// A UnitError is a dimensional inconsistency found by
+// CheckDimensionalConsistency.
+type UnitError struct {
+	Pos token.Pos
+	Msg string
+}
+
+// dims are units as the exponent of each base unit, like
+// {PERSONS: 1, YEAR: -1} for PERSONS/YEAR.
+type dims map[string]int
+
+// parseDims parses units written as base units separated by * and /,
+// like PERSONS/YEAR or 1/YEAR; DIMENSIONLESS and DMNL are 1.  Base
+// units are compared by upper-cased name, so YEAR and YEARS are
+// different units.
+func parseDims(s string) dims {
+	d := dims{}
+	exp := 1
+	for {
+		i := strings.IndexAny(s, "*/")
+		if i < 0 {
+			i = len(s)
+		}
+		if u := strings.ToUpper(strings.TrimSpace(s[:i])); u != "" && u != "1" && u != "DIMENSIONLESS" && u != "DMNL" {
+			d[u] += exp
+		}
+		if i == len(s) {
+			break
+		}
+		if s[i] == '/' {
+			exp = -1
+		} else {
+			exp = 1
+		}
+		s = s[i+1:]
+	}
+	return d
+}
+
+// mul returns the units of a value in d multiplied by one in o, or
+// divided by one if exp is -1.
+func (d dims) mul(o dims, exp int) dims {
+	r := dims{}
+	for u, e := range d {
+		r[u] += e
+	}
+	for u, e := range o {
+		if r[u] += exp * e; r[u] == 0 {
+			delete(r, u)
+		}
+	}
+	return r
+}
+
+func (d dims) equal(o dims) bool {
+	if len(d) != len(o) {
+		return false
+	}
+	for u, e := range d {
+		if o[u] != e {
+			return false
+		}
+	}
+	return true
+}
+
+func (d dims) String() string {
+	var num, den []string
+	for u := range d {
+		if d[u] > 0 {
+			num = append(num, u)
+		} else {
+			den = append(den, u)
+		}
+	}
+	sort.Strings(num)
+	sort.Strings(den)
+	write := func(us []string) string {
+		var parts []string
+		for _, u := range us {
+			e := d[u]
+			if e < 0 {
+				e = -e
+			}
+			for i := 0; i < e; i++ {
+				parts = append(parts, u)
+			}
+		}
+		return strings.Join(parts, "*")
+	}
+	s := write(num)
+	if s == "" {
+		s = "1"
+	}
+	if len(den) > 0 {
+		s += "/" + write(den)
+	}
+	return s
+}
+
+// unitVal is the inferred units of an expression.  The units of a
+// number are free: it takes on the units of whatever it's added to
+// or compared with.
+type unitVal struct {
+	dims  dims
+	known bool
+	free  bool
+}
+
+// unitChecker infers the units of expressions from the units of the
+// variables they reference.
+type unitChecker struct {
+	units map[string]dims // by upper-cased name
+	errs  []UnitError
+}
+
+func (c *unitChecker) errorf(pos token.Pos, format string, args ...interface{}) {
+	c.errs = append(c.errs, UnitError{pos, fmt.Sprintf(format, args...)})
+}
+
+// sum returns the units of the sum of values in l and r, reporting
+// an error at pos if both are known and differ.
+func (c *unitChecker) sum(pos token.Pos, l, r unitVal) unitVal {
+	switch {
+	case l.free:
+		return r
+	case r.free:
+		return l
+	case !l.known || !r.known:
+		return unitVal{}
+	case !l.dims.equal(r.dims):
+		c.errorf(pos, "mismatched units %s and %s", l.dims, r.dims)
+	}
+	return l
+}
+
+// unitsOf returns the units of e.
+func (c *unitChecker) unitsOf(e Expr) unitVal {
+	switch x := e.(type) {
+	case *BasicLit:
+		return unitVal{known: true, free: true}
+	case *Ident:
+		return c.ident(x)
+	case *RefExpr:
+		return c.ident(&x.Ident)
+	case *SubscriptExpr:
+		return c.ident(x.Base)
+	case *ParenExpr:
+		return c.unitsOf(x.X)
+	case *UnitExpr:
+		return c.unitsOf(x.X)
+	case *UnaryExpr:
+		return c.unitsOf(x.X)
+	case *BinaryExpr:
+		l, r := c.unitsOf(x.X), c.unitsOf(x.Y)
+		switch {
+		case x.Op == token.ADD || x.Op == token.SUB:
+			return c.sum(x.OpPos, l, r)
+		case isComparison(x.Op):
+			c.sum(x.OpPos, l, r)
+			return unitVal{known: true, free: true}
+		case !l.known || !r.known || x.Op == token.XOR:
+			// a power's units depend on the exponent's value
+			return unitVal{}
+		case x.Op == token.QUO:
+			return unitVal{dims: l.dims.mul(r.dims, -1), known: true, free: l.free && r.free}
+		}
+		return unitVal{dims: l.dims.mul(r.dims, 1), known: true, free: l.free && r.free}
+	case *IfExpr:
+		c.unitsOf(x.Cond)
+		return c.sum(x.If, c.unitsOf(x.Then), c.unitsOf(x.Else))
+	case *CallExpr:
+		var args []unitVal
+		for _, arg := range x.Args {
+			args = append(args, c.unitsOf(arg))
+		}
+		switch funcName(x) {
+		case "ABS", "SMOOTH", "DELAY3":
+			if len(args) > 0 {
+				return args[0]
+			}
+		case "MAX", "MIN", "CLIP":
+			if len(args) > 1 {
+				return c.sum(x.Pos(), args[0], args[1])
+			}
+		}
+	}
+	return unitVal{}
+}
+
+func (c *unitChecker) ident(id *Ident) unitVal {
+	d, ok := c.units[strings.ToUpper(id.Name)]
+	return unitVal{dims: d, known: ok}
+}
+
+// CheckDimensionalConsistency infers the units of each equation in f
+// from the units of the variables it references, and reports sums,
+// differences and comparisons of values in different units, and
+// equations whose units differ from their variable's.  units gives
+// the units of names f doesn't annotate, like DT and TIME, keyed by
+// upper-cased name; it may be nil.  A variable without units, and so
+// any expression using one, is left unchecked.
+func CheckDimensionalConsistency(f *File, units map[string]string) []UnitError {
+	var errs []UnitError
+	for _, d := range f.Decls {
+		m, ok := d.(*ModelDecl)
+		if !ok || m.Body == nil {
+			continue
+		}
+		c := &unitChecker{units: map[string]dims{}}
+		for n, u := range units {
+			c.units[strings.ToUpper(n)] = parseDims(u)
+		}
+		for _, s := range m.Body.List {
+			if assign, ok := s.(*AssignStmt); ok {
+				if u := unitsText(assign.Lhs); u != "" {
+					c.units[strings.ToUpper(assign.Lhs.Name.Name)] = parseDims(u)
+				}
+			}
+		}
+		for _, s := range m.Body.List {
+			assign, ok := s.(*AssignStmt)
+			if !ok || assign.Lhs.Type == nil || assign.Lhs.Type.Name == "table" {
+				continue
+			}
+			if _, ok := assign.Rhs.(*CompositeLit); ok {
+				continue
+			}
+			rhs := c.unitsOf(assign.Rhs)
+			want, ok := c.units[strings.ToUpper(assign.Lhs.Name.Name)]
+			if ok && rhs.known && !rhs.free && !rhs.dims.equal(want) {
+				c.errorf(assign.Lhs.Name.Pos(), "%s has units %s, but its equation gives %s",
+					assign.Lhs.Name.Name, want, rhs.dims)
+			}
+		}
+		errs = append(errs, c.errs...)
+	}
+	return errs
+}
@@ -0,0 +1,157 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+)
+
+// A ValidationError is a problem found by Validate with the
+// equation of the variable VarName, declared at Pos.  Code names the
+// check that found it, as with a Diagnostic.
+type ValidationError struct {
+	Pos      token.Pos
+	Severity DiagSeverity
+	Code     string
+	VarName  string
+	Msg      string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Severity, e.VarName, e.Msg)
+}
+
+// Validate checks that the variables of f's models fit together as
+// DYNAMO expects, beyond the checks of Check:
+//
+//	no-initial    a level without an N card giving its initial
+//	              value (a warning)
+//	dead-rate     a rate used in no level equation, nor named on a
+//	              PRINT or PLOT card (a warning)
+//	shared-rate   a rate used in more than one level equation (a
+//	              warning)
+//	unused-table  a table never looked up with TABHL (a warning)
+//	div-zero      a division by a constant that is 0: an error if
+//	              the whole denominator is 0, a warning if it only
+//	              uses the constant
+//
+// Levels built by a ModelBuilder carry their initial value and
+// flows, and are checked accordingly.  The problems with levels and
+// divisions come first, in the order of their equations, followed by
+// those with rates and tables.
+func Validate(f *File) []ValidationError {
+	var errs []ValidationError
+	for _, d := range f.Decls {
+		m, ok := d.(*ModelDecl)
+		if !ok || m.Body == nil {
+			continue
+		}
+		errs = append(errs, validateModel(m)...)
+	}
+	return errs
+}
+
+// validateModel returns the problems Validate finds in m.
+func validateModel(m *ModelDecl) []ValidationError {
+	var errs []ValidationError
+	report := func(d *VarDecl, sev DiagSeverity, code, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{d.Name.Pos(), sev, code, d.Name.Name, fmt.Sprintf(format, args...)})
+	}
+
+	var assigns []*AssignStmt
+	initials := map[string]bool{}
+	output := map[string]bool{} // the variables printed or plotted
+	for _, s := range m.Body.List {
+		if out, ok := s.(*OutputStmt); ok {
+			for _, id := range out.Names {
+				output[strings.ToUpper(id.Name)] = true
+			}
+			continue
+		}
+		assign, ok := s.(*AssignStmt)
+		if !ok || assign.Lhs.Type == nil || assign.Lhs.Name.Name == "timespec" {
+			continue
+		}
+		assigns = append(assigns, assign)
+		if assign.Lhs.Type.Name == "initial" {
+			initials[strings.ToUpper(assign.Lhs.Name.Name)] = true
+		}
+	}
+
+	// the level equations each rate is used in, and the tables
+	// looked up
+	flowsInto := map[string][]string{}
+	lookedUp := map[string]bool{}
+	consts := constants(m)
+	for _, assign := range assigns {
+		name := assign.Lhs.Name.Name
+		if assign.Lhs.Type.Name == "stock" {
+			_, built := assign.Rhs.(*CompositeLit)
+			if !built && !initials[strings.ToUpper(name)] {
+				report(assign.Lhs, SeverityWarning, "no-initial", "level %s has no N card giving its initial value", name)
+			}
+			seen := map[string]bool{}
+			for _, ref := range refNames(assign.Rhs) {
+				if !seen[ref] {
+					seen[ref] = true
+					flowsInto[ref] = append(flowsInto[ref], name)
+				}
+			}
+		}
+
+		Inspect(assign.Rhs, func(n Node) bool {
+			switch x := n.(type) {
+			case *CallExpr:
+				if len(x.Args) > 0 && lookupFuncs[funcName(x)] {
+					if id, ok := stripUnits(x.Args[0]).(*Ident); ok {
+						lookedUp[strings.ToUpper(id.Name)] = true
+					}
+				}
+			case *BinaryExpr:
+				if x.Op != token.QUO {
+					break
+				}
+				if v, ok := foldConst(x.Y, consts); ok && v == 0 {
+					report(assign.Lhs, SeverityError, "div-zero", "division by zero (%s is 0)", exprString(x.Y))
+					break
+				}
+				seen := map[string]bool{}
+				for _, ref := range refNames(x.Y) {
+					if v, ok := consts[ref]; ok && v == 0 && !seen[ref] {
+						seen[ref] = true
+						report(assign.Lhs, SeverityWarning, "div-zero", "denominator %s uses %s, which is 0", exprString(x.Y), ref)
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	for _, assign := range assigns {
+		name := assign.Lhs.Name.Name
+		switch assign.Lhs.Type.Name {
+		case "flow":
+			switch levels := flowsInto[strings.ToUpper(name)]; len(levels) {
+			case 0:
+				if output[strings.ToUpper(name)] {
+					// kept for its output
+					break
+				}
+				report(assign.Lhs, SeverityWarning, "dead-rate", "rate %s doesn't flow into or out of any level", name)
+			case 1:
+			default:
+				report(assign.Lhs, SeverityWarning, "shared-rate", "rate %s is used by %d levels: %s",
+					name, len(levels), strings.Join(levels, ", "))
+			}
+		case "table":
+			if !lookedUp[strings.ToUpper(name)] {
+				report(assign.Lhs, SeverityWarning, "unused-table", "table %s is never looked up with TABHL", name)
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,89 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	if errs := Validate(f); len(errs) != 0 {
+		t.Errorf("helloWorld: got problems %v", errs)
+	}
+
+	const src = `* problems
+L	S.K=S.J+(DT)(IN.JK)
+L	U.K=U.J+(DT)(IN.JK)
+N	U=0
+R	IN.KL=1
+R	IDLE.KL=S.K
+C	Z=0
+A	W.K=1/(Z+S.K)
+T	UNUSED=1/2/3
+C	LENGTH=1
+`
+	f, _ = parseSrc(t, src)
+	want := []string{
+		"warning: S: level S has no N card giving its initial value",
+		"warning: W: denominator (Z+S.K) uses Z, which is 0",
+		"warning: IN: rate IN is used by 2 levels: S, U",
+		"warning: IDLE: rate IDLE doesn't flow into or out of any level",
+		"warning: UNUSED: table UNUSED is never looked up with TABHL",
+	}
+	var got []string
+	for _, e := range Validate(f) {
+		got = append(got, e.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// a built level carries its initial value and flows, and a
+	// built model can divide by zero, which the parser reports
+	built, err := NewBuilder().
+		AddStock("S", "0", "IN").
+		AddRate("IN", "1/Z").
+		AddConst("Z", 0).
+		Build()
+	if err != nil {
+		t.Fatalf("Build: %s", err)
+	}
+	got = nil
+	for _, e := range Validate(built) {
+		got = append(got, e.Error())
+	}
+	if want := "error: IN: division by zero (Z is 0)"; strings.Join(got, "\n") != want {
+		t.Errorf("built model: got problems %v, want %s", got, want)
+	}
+}
+
+// TestOutputRate checks that a rate feeding only a PLOT card is
+// neither flagged as dead nor dropped: it's computed with the other
+// rates and plotted.
+func TestOutputRate(t *testing.T) {
+	const src = `* plotted rate
+L	POP.K=POP.J+(DT)(B.JK)
+N	POP=100
+R	B.KL=POP.K*.1
+R	SHOWN.KL=POP.K*.05
+PLOT	POP=P,SHOWN=S
+C	LENGTH=2
+C	DT=1
+C	SAVPER=1
+`
+	f, fset := parseSrc(t, src)
+	if errs := Validate(f); len(errs) != 0 {
+		t.Errorf("got problems %v", errs)
+	}
+	out := genGo(t, f, fset)
+	if !bytes.Contains(out, []byte("m.B = m.POP * .1\n\tm.SHOWN = m.POP * .05\n")) {
+		t.Errorf("SHOWN isn't computed with the rates:\n%s", out)
+	}
+	sim, gen := simulateBoth(t, src)
+	checkSeries(t, "SHOWN", map[float64]float64{0: 5, 1: 5.5, 2: 6.05}, sim, gen)
+}
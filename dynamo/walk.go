@@ -88,6 +88,9 @@ func Walk(v Visitor, node Node) {
 		}
 		walkExprList(v, n.Elts)
 
+	case *SubscriptExpr:
+		Walk(v, n.Base)
+
 	case *UnitExpr:
 		Walk(v, n.X)
 		if n.Unit != nil {
@@ -97,6 +100,11 @@ func Walk(v Visitor, node Node) {
 	case *TableExpr:
 		walkPairExprList(v, n.Pairs)
 
+	case *TableFwdExpr:
+		for _, y := range n.Ys {
+			Walk(v, y)
+		}
+
 	case *PairExpr:
 		Walk(v, n.X)
 		Walk(v, n.Y)
@@ -123,6 +131,11 @@ func Walk(v Visitor, node Node) {
 		Walk(v, n.X)
 		Walk(v, n.Y)
 
+	case *IfExpr:
+		Walk(v, n.Cond)
+		Walk(v, n.Then)
+		Walk(v, n.Else)
+
 	case *KeyValueExpr:
 		Walk(v, n.Key)
 		Walk(v, n.Value)
@@ -147,6 +160,12 @@ func Walk(v Visitor, node Node) {
 		Walk(v, n.Lhs)
 		Walk(v, n.Rhs)
 
+	case *SpecStmt:
+		walkExprList(v, n.Elts)
+
+	case *OutputStmt:
+		walkIdentList(v, n.Names)
+
 	case *BlockStmt:
 		walkStmtList(v, n.List)
 
@@ -188,12 +207,20 @@ func Walk(v Visitor, node Node) {
 			Walk(v, n.Body)
 		}
 
+	case *MacroDecl:
+		Walk(v, n.Name)
+		walkIdentList(v, n.Params)
+		Walk(v, n.Body)
+
 	// Files and packages
 	case *File:
 		if n == nil {
 			break
 		}
 		walkDeclList(v, n.Decls)
+		for _, m := range n.Macros {
+			Walk(v, m)
+		}
 		// don't walk n.Comments - they have been
 		// visited already through the individual
 		// nodes
@@ -227,3 +254,34 @@ func (f inspector) Visit(node Node) Visitor {
 func Inspect(node Node, f func(Node) bool) {
 	Walk(inspector(f), node)
 }
+
+// CollectIdents returns the identifiers in the AST rooted at node,
+// in depth-first order, including those of variable references.
+//
+func CollectIdents(node Node) []*Ident {
+	var ids []*Ident
+	Inspect(node, func(n Node) bool {
+		switch x := n.(type) {
+		case *Ident:
+			ids = append(ids, x)
+		case *RefExpr:
+			ids = append(ids, &x.Ident)
+		}
+		return true
+	})
+	return ids
+}
+
+// CountNodes returns the number of nodes in the AST rooted at node.
+//
+func CountNodes(node Node) int {
+	n := 0
+	Inspect(node, func(x Node) bool {
+		// Inspect calls f(nil) after each node's children
+		if x != nil {
+			n++
+		}
+		return true
+	})
+	return n
+}
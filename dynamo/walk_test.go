@@ -0,0 +1,57 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dynamo
+
+import (
+	"testing"
+)
+
+func TestCountNodes(t *testing.T) {
+	// (NB)(POP)+1 is a sum of a product and a literal, and the
+	// product of two parenthesized identifiers
+	e, err := ParseExpr("(NB)(POP)+1")
+	if err != nil {
+		t.Fatalf("ParseExpr: %s", err)
+	}
+	if n := CountNodes(e); n != 7 {
+		t.Errorf("(NB)(POP)+1: got %d nodes, want 7", n)
+	}
+
+	f, _ := parseSrc(t, helloWorld)
+	if n := CountNodes(f); n != 75 {
+		t.Errorf("helloWorld: got %d nodes, want 75", n)
+	}
+
+	// stopping at the model leaves only it and the File
+	n := 0
+	Inspect(f, func(node Node) bool {
+		if node != nil {
+			n++
+		}
+		_, isModel := node.(*ModelDecl)
+		return !isModel
+	})
+	if n != 2 {
+		t.Errorf("helloWorld without the model's children: got %d nodes, want 2", n)
+	}
+}
+
+func TestCollectIdents(t *testing.T) {
+	f, _ := parseSrc(t, helloWorld)
+	ids := CollectIdents(f)
+	if len(ids) != 28 {
+		t.Errorf("got %d identifiers, want 28", len(ids))
+	}
+	// POP's L and N cards, POP.J and the two rates
+	pops := 0
+	for _, id := range ids {
+		if id.Name == "POP" {
+			pops++
+		}
+	}
+	if pops != 5 {
+		t.Errorf("got %d POPs, want 5", pops)
+	}
+}
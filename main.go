@@ -7,6 +7,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/bpowers/dynamo/dynamo"
@@ -18,9 +19,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strings"
 )
 
 const usage = `Usage: %s [OPTION...]
@@ -35,7 +39,20 @@ const (
 )
 
 var (
-	outPath string
+	outPath     string
+	diffMode    bool
+	diagnostics string
+	manifest    string
+	strict      bool
+	integration string
+	debugState  bool
+	standalone  bool
+	sensitivity float64
+	outputs     string
+	eachStep    bool
+
+	// timespec overrides, applied only if given on the command line
+	dt, length, savper float64
 )
 
 func init() {
@@ -45,8 +62,29 @@ func init() {
 	}
 	flag.StringVar(&outPath, "o", "model.out",
 		"file name to use as output")
-
-	flag.Parse()
+	flag.BoolVar(&diffMode, "diff", false,
+		"report the changes between two models: -diff old new")
+	flag.StringVar(&manifest, "manifest", "",
+		"check a model defines the variables listed in a manifest: -manifest vars model")
+	flag.BoolVar(&strict, "strict", false,
+		"reject calls to functions that aren't DYNAMO built-ins, and circular auxiliaries")
+	flag.StringVar(&diagnostics, "diagnostics", "text",
+		"format for parse diagnostics: text or json")
+	flag.StringVar(&integration, "integration", "euler",
+		"method used to integrate levels: euler or rk4")
+	flag.BoolVar(&debugState, "debug-state", false,
+		"also output the hidden levels of SMOOTH and DELAY3, named for their call sites")
+	flag.BoolVar(&standalone, "standalone", false,
+		"write the model as a single Go program, needing only the standard library, rather than compiling it")
+	flag.Float64Var(&sensitivity, "sensitivity", 0,
+		"report the sensitivity of a model's outputs to each constant, perturbed by this fraction")
+	flag.StringVar(&outputs, "outputs", "",
+		"comma-separated outputs for -sensitivity; all of them if empty")
+	flag.BoolVar(&eachStep, "each-step", false,
+		"report -sensitivity at each save step, rather than only at the end")
+	flag.Float64Var(&dt, "dt", 0, "override the model's DT")
+	flag.Float64Var(&length, "length", 0, "override the model's LENGTH")
+	flag.Float64Var(&savper, "savper", 0, "override the model's SAVPER")
 }
 
 func main() {
@@ -54,6 +92,48 @@ func main() {
 	var in *bufio.Reader
 	var err error
 
+	flag.Parse()
+	if diagnostics != "text" && diagnostics != "json" {
+		log.Fatalf("unknown -diagnostics format '%s', want text or json", diagnostics)
+	}
+
+	if diffMode {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err = diff(flag.Arg(0), flag.Arg(1)); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if manifest != "" {
+		if flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		ok, err := checkManifest(manifest, flag.Arg(0))
+		if err != nil {
+			fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if sensitivity != 0 {
+		if flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err = sensitivities(flag.Arg(0)); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
 	// use the file if there is an argument, otherwise use stdin
 	if flag.NArg() == 0 {
 		filename = "stdin"
@@ -75,13 +155,76 @@ func main() {
 
 	goSource, err := transliterate(filename, in)
 	if err != nil {
-		log.Fatalf("%s", err)
+		fatal(err)
+	}
+
+	if standalone {
+		if err = ioutil.WriteFile(outPath, goSource, 0644); err != nil {
+			log.Fatalf("WriteFile: %s", err)
+		}
+		return
 	}
 
 	err = compileAndLink(goSource, outPath)
 	if err != nil {
-		log.Fatalf("compileAndLink('%s')", goSource, err)
+		log.Fatalf("compileAndLink('%s'): %s", outPath, err)
+	}
+}
+
+// A diagnostic is the machine-readable form of a single error or
+// warning, suitable for annotating the source in editors and CI.
+type diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Column   int    `json:"column"`
+	Severity string `json:"severity"`
+	Rule     string `json:"rule"`
+	Message  string `json:"message"`
+}
+
+// fatal reports err in the format selected by the -diagnostics flag
+// and exits.
+func fatal(err error) {
+	list, ok := err.(dynamo.ErrorList)
+	if !ok {
+		log.Fatalf("%s", err)
+	}
+
+	switch diagnostics {
+	case "json":
+		if err := writeDiagnostics(os.Stdout, list); err != nil {
+			log.Fatalf("json.Marshal: %s", err)
+		}
+	default:
+		dynamo.PrintError(os.Stderr, err)
 	}
+	os.Exit(1)
+}
+
+// writeDiagnostics writes list to w as a JSON array of diagnostics,
+// each with its severity and the rule that found it.
+func writeDiagnostics(w io.Writer, list dynamo.ErrorList) error {
+	diags := make([]diagnostic, 0, len(list))
+	for _, e := range list {
+		rule := e.Rule
+		if rule == "" {
+			rule = "unknown"
+		}
+		diags = append(diags, diagnostic{
+			File:     e.Pos.Filename,
+			Line:     e.Pos.Line,
+			Column:   e.Pos.Column,
+			Severity: e.Severity.String(),
+			Rule:     rule,
+			Message:  e.Msg,
+		})
+	}
+	buf, err := json.MarshalIndent(diags, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", buf)
+	return err
 }
 
 // copyFile copies the file at path 'from' to path 'to', overwriting
@@ -112,10 +255,10 @@ func mustGetwd() string {
 	return cwd
 }
 
-// gofmt takes the given, valid, Go AST and returns a
-// canonically-formatted go program in a byte-array, or an error.
-func gofmt(f *ast.File) ([]byte, error) {
-	fset := token.NewFileSet()
+// gofmt takes the given, valid, Go AST, positioned in fset, and
+// returns a canonically-formatted go program in a byte-array, or an
+// error.
+func gofmt(fset *token.FileSet, f *ast.File) ([]byte, error) {
 	var buf bytes.Buffer
 	if err := format.Node(&buf, fset, f); err != nil {
 		return nil, err
@@ -123,37 +266,230 @@ func gofmt(f *ast.File) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// transliterate takes an input stream and a name and returns a byte
-// buffer containing valid & gofmt'ed source code, or an error.  The
-// name is used purely for diagnostic purposes
-func transliterate(name string, in io.Reader) ([]byte, error) {
+// parse reads a model from the given input stream and returns its
+// AST, or an error.  The name is used purely for diagnostic purposes.
+// The warnings of Check and Validate are reported with the errors if
+// the model doesn't parse, and on their own, in the format selected
+// by -diagnostics, if it does.
+func parse(name string, in io.Reader) (*dynamo.File, error) {
 	fset := token.NewFileSet()
+	pkg, err := dynamo.ParseReader(in, name, fset)
+	if list, ok := err.(dynamo.ErrorList); ok && pkg != nil {
+		list = append(list, warnings(fset, pkg)...)
+		sort.Sort(list)
+		return nil, list
+	} else if err != nil {
+		return nil, err
+	}
+	if pkg.NErrors > 0 {
+		return nil, fmt.Errorf("There were errors parsing the file")
+	}
+	if strict {
+		if err = dynamo.CheckCalls(fset, pkg); err != nil {
+			return nil, err
+		}
+		if cycles := dynamo.CheckCycles(pkg); len(cycles) > 0 {
+			var errs dynamo.ErrorVector
+			for _, c := range cycles {
+				errs.RuleError(fset.Position(c.Pos), "cycle", c.Error())
+			}
+			return nil, errs.GetError(dynamo.Sorted)
+		}
+	}
+	if list := warnings(fset, pkg); len(list) > 0 {
+		sort.Sort(list)
+		if diagnostics == "json" {
+			if err := writeDiagnostics(os.Stdout, list); err != nil {
+				return nil, err
+			}
+		} else {
+			dynamo.PrintError(os.Stderr, list)
+		}
+	}
+	return pkg, nil
+}
+
+// warnings returns the warnings Check and Validate find in f, which
+// fset positions, each under the code of the check that found it.
+func warnings(fset *token.FileSet, f *dynamo.File) dynamo.ErrorList {
+	var errs dynamo.ErrorVector
+	for _, d := range dynamo.Check(f, nil) {
+		if d.Severity == dynamo.SeverityWarning {
+			errs.RuleWarning(fset.Position(d.Pos), d.Code, d.Msg)
+		}
+	}
+	for _, e := range dynamo.Validate(f) {
+		if e.Severity == dynamo.SeverityWarning {
+			errs.RuleWarning(fset.Position(e.Pos), e.Code, e.Msg)
+		}
+	}
+	return errs.GetErrorList(dynamo.Raw)
+}
+
+// parseFile opens and parses the model at path.
+func parseFile(path string) (*dynamo.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %s", err)
+	}
+	defer f.Close()
+
+	return parse(path, bufio.NewReader(f))
+}
 
-	// dump in the file
-	mdlSrc, err := ioutil.ReadAll(in)
+// diff prints the semantic differences between the models at the
+// paths 'from' and 'to' to stdout.
+func diff(from, to string) error {
+	a, err := parseFile(from)
 	if err != nil {
-		return nil, fmt.Errorf("ReadAll(%v): %s", in, err)
+		return err
+	}
+	b, err := parseFile(to)
+	if err != nil {
+		return err
 	}
+	for _, c := range dynamo.Diff(a, b) {
+		fmt.Println(c)
+	}
+	return nil
+}
 
-	fsetFile := fset.AddFile(name, fset.Base(), len(mdlSrc))
+// checkManifest prints each variable listed in the manifest at
+// manifestPath that the model at modelPath doesn't define with the
+// listed kind, and returns false if there were any.
+func checkManifest(manifestPath, modelPath string) (bool, error) {
+	mf, err := os.Open(manifestPath)
+	if err != nil {
+		return false, fmt.Errorf("Open: %s", err)
+	}
+	defer mf.Close()
 
-	// and parse
-	pkg, err := dynamo.Parse(fsetFile, fset, string(mdlSrc))
+	m, err := dynamo.ParseManifest(mf)
 	if err != nil {
-		return nil, fmt.Errorf("Parse(%v): %s", name, err)
+		return false, fmt.Errorf("%s: %s", manifestPath, err)
 	}
-	if pkg.NErrors > 0 {
-		return nil, fmt.Errorf("There were errors parsing the file")
+	f, err := parseFile(modelPath)
+	if err != nil {
+		return false, err
+	}
+
+	errs := m.Check(f)
+	for _, err := range errs {
+		fmt.Printf("%s: %s\n", modelPath, err)
+	}
+	return len(errs) == 0, nil
+}
+
+// sensitivities prints the table of the sensitivities of the outputs
+// of the model at path to its constants, given by the -sensitivity
+// and -outputs flags, at each save step if -each-step is given.
+func sensitivities(path string) error {
+	f, err := parseFile(path)
+	if err != nil {
+		return err
+	}
+	var outs []string
+	if outputs != "" {
+		outs = strings.Split(outputs, ",")
+	}
+	sens := dynamo.Sensitivities
+	if eachStep {
+		sens = dynamo.SensitivitySeries
+	}
+	t, err := sens(f, sensitivity, outs)
+	if err != nil {
+		return err
+	}
+	fmt.Print(t)
+	return nil
+}
+
+// isMultiple returns true if x is a whole multiple of y, allowing
+// for floating point error.
+func isMultiple(x, y float64) bool {
+	n := math.Floor(x/y + .5)
+	return n >= 1 && math.Abs(x-n*y) <= 1e-9*x
+}
+
+// overrideTimespec applies the -dt, -length and -savper flags, if
+// given, to the main model's timespec, checking that the values they
+// change are consistent with the rest of the model's timespec.
+func overrideTimespec(f *dynamo.File) error {
+	set := map[string]bool{}
+	flag.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	if !set["dt"] && !set["length"] && !set["savper"] {
+		return nil
+	}
+
+	m := f.GetModel("main")
+	if m == nil {
+		return fmt.Errorf("no main model to override the timespec of")
+	}
+	ts, err := m.Timespec()
+	if err != nil {
+		return err
+	}
+
+	if set["dt"] {
+		if dt <= 0 {
+			return fmt.Errorf("-dt must be positive, not %g", dt)
+		}
+		ts.DT = dt
+	}
+	if set["length"] {
+		if length <= ts.Start {
+			return fmt.Errorf("-length %g is not after the start time %g", length, ts.Start)
+		}
+		ts.End = length
+	}
+	if set["savper"] {
+		if savper <= 0 {
+			return fmt.Errorf("-savper must be positive, not %g", savper)
+		}
+		ts.SaveStep = savper
+	}
+	if (set["dt"] || set["savper"]) && !isMultiple(ts.SaveStep, ts.DT) {
+		return fmt.Errorf("SAVPER %g is not a multiple of DT %g", ts.SaveStep, ts.DT)
+	}
+
+	m.SetTimespec(ts)
+	return nil
+}
+
+// transliterate takes an input stream and a name and returns a byte
+// buffer containing valid & gofmt'ed source code, or an error.  The
+// name is used purely for diagnostic purposes
+func transliterate(name string, in io.Reader) ([]byte, error) {
+	pkg, err := parse(name, in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = overrideTimespec(pkg); err != nil {
+		return nil, err
+	}
+
+	opts := dynamo.Options{DebugState: debugState, Standalone: standalone}
+	switch integration {
+	case "euler":
+		opts.IntegrationMethod = dynamo.Euler
+	case "rk4":
+		opts.IntegrationMethod = dynamo.RK4
+	default:
+		return nil, fmt.Errorf("unknown integration method '%s'", integration)
 	}
 
-	goSource, err := dynamo.GenGo(pkg)
+	goFset := token.NewFileSet()
+	goSource, err := opts.GenGo(goFset, pkg)
 	if err != nil {
-		log.Fatalf("GenGo(%v): %s", pkg, err)
+		return nil, fmt.Errorf("GenGo: %s", err)
 	}
 
-	src, err := gofmt(goSource)
+	src, err := gofmt(goFset, goSource)
 	if err != nil {
-		log.Fatalf("gofmtFile(%v): %s", goSource, err)
+		return nil, fmt.Errorf("gofmt: %s", err)
 	}
 	return src, nil
 }
@@ -0,0 +1,152 @@
+// Copyright 2013 Bobby Powers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bpowers/dynamo/dynamo"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files")
+
+func TestDiagnosticsJSON(t *testing.T) {
+	f, err := os.Open("testdata/diagnostics.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = parse("testdata/diagnostics.dyn", bufio.NewReader(f))
+	list, ok := err.(dynamo.ErrorList)
+	if !ok {
+		t.Fatalf("parse: got %v, want an ErrorList", err)
+	}
+	var buf bytes.Buffer
+	if err = writeDiagnostics(&buf, list); err != nil {
+		t.Fatalf("writeDiagnostics: %s", err)
+	}
+
+	const golden = "testdata/diagnostics.json.golden"
+	if *updateGolden {
+		if err = ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("diagnostics differ from %s:\n%s", golden, buf.Bytes())
+	}
+}
+
+// TestStandalone checks the program -standalone writes against its
+// golden file, and that it builds with nothing but the standard
+// library: with an empty GOPATH, and outside of any module.
+func TestStandalone(t *testing.T) {
+	standalone = true
+	defer func() { standalone = false }()
+
+	f, err := os.Open("dynamo/testdata/hello.dyn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src, err := transliterate("hello.dyn", bufio.NewReader(f))
+	if err != nil {
+		t.Fatalf("transliterate: %s", err)
+	}
+
+	const golden = "testdata/hello.standalone.go.golden"
+	if *updateGolden {
+		if err = ioutil.WriteFile(golden, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Errorf("program differs from %s:\n%s", golden, src)
+	}
+
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the program")
+	}
+	dir, err := ioutil.TempDir("", "dynamo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "model.go")
+	if err = ioutil.WriteFile(path, src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(gobin, "build", "-o", filepath.Join(dir, "model"), path)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOPATH="+dir, "GO111MODULE=off", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("standalone program doesn't build: %s\n%s", err, out)
+	}
+}
+
+func TestOverrideTimespec(t *testing.T) {
+	const src = `*
+NOTE	decay
+L	S.K=S.J+(DT)(-OUT.JK)
+N	S=100
+R	OUT.KL=S.K/10
+C	LENGTH=10
+C	DT=1
+C	SAVPER=1
+`
+	steps := func() int {
+		f, err := parse("decay", strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = overrideTimespec(f); err != nil {
+			t.Fatalf("overrideTimespec: %s", err)
+		}
+		ts, err := dynamo.Simulate(f, dynamo.SimulateOptions{})
+		if err != nil {
+			t.Fatalf("Simulate: %s", err)
+		}
+		return len(ts.Time)
+	}
+
+	if n := steps(); n != 11 {
+		t.Fatalf("without overrides: got %d saved steps, want 11", n)
+	}
+	// flags stay set once they're set, so this must be the last
+	// test to use them
+	defer func() { dt, savper = 0, 0 }()
+	flag.Set("dt", ".5")
+	flag.Set("savper", ".5")
+	if n := steps(); n != 21 {
+		t.Errorf("with -dt .5 -savper .5: got %d saved steps, want 21", n)
+	}
+
+	flag.Set("dt", ".3")
+	f, err := parse("decay", strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = overrideTimespec(f); err == nil {
+		t.Errorf("SAVPER .5 with -dt .3: got no error")
+	}
+}